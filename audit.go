@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ============================================================
+// HTTP AUDIT (raw FHIR request/response log + replay)
+// ============================================================
+
+const createAuditTableSQL = `CREATE TABLE IF NOT EXISTS satu_sehat_http_audit (
+	id            BIGINT AUTO_INCREMENT PRIMARY KEY,
+	method        VARCHAR(10)  NOT NULL,
+	path          VARCHAR(500) NOT NULL,
+	request_body  MEDIUMTEXT,
+	status_code   INT          DEFAULT 0,
+	response_body MEDIUMTEXT,
+	duration_ms   INT          DEFAULT 0,
+	replay_of     BIGINT       NULL,
+	created_at    TIMESTAMP    DEFAULT CURRENT_TIMESTAMP,
+	INDEX idx_created (created_at),
+	INDEX idx_replay_of (replay_of)
+)`
+
+type httpAuditEntry struct {
+	Method       string
+	Path         string
+	RequestBody  []byte
+	StatusCode   int
+	ResponseBody []byte
+	Duration     time.Duration
+	ReplayOf     int64 // audit id this request replays, 0 for originals
+}
+
+func initAuditTable(db *sql.DB) {
+	if _, err := db.Exec(createAuditTableSQL); err != nil {
+		logErrorf("❌ create satu_sehat_http_audit table: %v", err)
+	} else {
+		logInfof("✅ satu_sehat_http_audit table ready")
+	}
+}
+
+// saveHTTPAudit stores one raw FHIR exchange and returns its audit id
+func saveHTTPAudit(db *sql.DB, e httpAuditEntry) int64 {
+	var replayOf interface{}
+	if e.ReplayOf > 0 {
+		replayOf = e.ReplayOf
+	}
+	res, err := db.Exec(`INSERT INTO satu_sehat_http_audit
+		(method, path, request_body, status_code, response_body, duration_ms, replay_of)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		e.Method, e.Path, string(e.RequestBody), e.StatusCode, string(e.ResponseBody), e.Duration.Milliseconds(), replayOf)
+	if err != nil {
+		logErrorf("❌ save http audit: %v", err)
+		return 0
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
+// requireAdmin gates debugging endpoints: open in sandbox, otherwise the
+// X-API-Key header must match ADMIN_API_KEY
+func (a *App) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.cfg.isSandbox() {
+			next(w, r)
+			return
+		}
+		if a.cfg.AdminAPIKey == "" {
+			jsonError(w, "only available in sandbox or with ADMIN_API_KEY configured", 403)
+			return
+		}
+		if r.Header.Get("X-API-Key") != a.cfg.AdminAPIKey {
+			jsonError(w, "invalid or missing X-API-Key", 401)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleReplayAudit re-sends the exact stored request body of an audit row.
+// The replay is recorded as a new audit row with replay_of set.
+func (a *App) handleReplayAudit(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		jsonError(w, "invalid audit id", 400)
+		return
+	}
+
+	var method, path string
+	var reqBody sql.NullString
+	var origStatus int
+	err = a.db.QueryRow(`SELECT method, path, request_body, status_code FROM satu_sehat_http_audit WHERE id=?`, id).
+		Scan(&method, &path, &reqBody, &origStatus)
+	if err == sql.ErrNoRows {
+		jsonError(w, "audit entry not found", 404)
+		return
+	}
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+
+	var body []byte
+	if reqBody.Valid && reqBody.String != "" {
+		body = []byte(reqBody.String)
+	}
+
+	logInfof("🔁 REPLAY of audit #%d: %s %s", id, method, path)
+	start := time.Now()
+	status, respBody, err := a.ss.sendRaw(r.Context(), method, path, body)
+	if err != nil {
+		jsonError(w, "replay failed: "+err.Error(), 502)
+		return
+	}
+	replayID := saveHTTPAudit(a.db, httpAuditEntry{Method: method, Path: path, RequestBody: body,
+		StatusCode: status, ResponseBody: respBody, Duration: time.Since(start), ReplayOf: id})
+	logInfof("🔁 REPLAY of audit #%d done: %d (audit #%d)", id, status, replayID)
+
+	jsonResponse(w, map[string]interface{}{
+		"replay_of": id, "audit_id": replayID, "method": method, "path": path,
+		"original_status": origStatus, "status_code": status,
+		"response": string(respBody),
+	})
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"unicode/utf8"
+)
+
+// ============================================================
+// BATCH RESULT (shared sent/failed/skipped accumulator)
+// ============================================================
+
+// batchResult collects per-record outcomes of a send batch. It is safe for
+// concurrent use so send loops can be parallelized without corrupting counts.
+type batchResult struct {
+	mu      sync.Mutex
+	sent    int
+	failed  int
+	skipped int
+	details []map[string]interface{}
+	batchID string // correlates the batch with its send_log and job rows
+	verbose bool   // ?verbose=true: failed details carry SatuSehat's response
+	limit   *rowLimit
+
+	// Queue mode: rows queued by the request, counted from queueBase on
+	queue     *enqueued
+	queueBase int64
+}
+
+// add records one outcome, classified by its "status" field:
+// "success" → sent, "skipped" → skipped, anything else → failed
+func (b *batchResult) add(detail map[string]interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch detail["status"] {
+	case "success":
+		b.sent++
+	case "skipped":
+		b.skipped++
+	default:
+		b.failed++
+	}
+	b.details = append(b.details, detail)
+}
+
+// verboseResponseMax caps the response attached to a verbose failure detail
+const verboseResponseMax = 4000
+
+// withResponse adds to detail, in a verbose batch, the body SatuSehat answered
+// the failed write with (OperationOutcome), truncated to verboseResponseMax
+func (b *batchResult) withResponse(detail map[string]interface{}, err error) map[string]interface{} {
+	var re *responseError
+	if !b.verbose || !errors.As(err, &re) {
+		return detail
+	}
+	body, _ := json.Marshal(re.result)
+	if len(body) > verboseResponseMax {
+		cut := verboseResponseMax
+		for cut > 0 && !utf8.RuneStart(body[cut]) {
+			cut-- // don't split a multi-byte character
+		}
+		detail["response"] = string(body[:cut]) + "…"
+	} else {
+		detail["response"] = json.RawMessage(body)
+	}
+	return detail
+}
+
+// verboseKey marks a send request made with ?verbose=true
+type verboseKey struct{}
+
+// withVerbose carries ?verbose=true into the request context, where
+// newBatchResult picks it up (also for queued sends)
+func withVerbose(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("verbose") == "true" {
+			r = r.WithContext(context.WithValue(r.Context(), verboseKey{}, true))
+		}
+		next(w, r)
+	}
+}
+
+// toJSON returns the batch summary with the details under listKey
+func (b *batchResult) toJSON(listKey string) map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := map[string]interface{}{
+		"sent":    b.sent,
+		"failed":  b.failed,
+		"skipped": b.skipped,
+		listKey:   b.details,
+	}
+	if b.batchID != "" {
+		out["batch_id"] = b.batchID
+	}
+	if b.limit.active() {
+		out["remaining"] = b.limit.left()
+	}
+	if b.queue != nil {
+		out["queued"] = b.queue.n.Load() - b.queueBase
+		out["progress"] = "/api/jobs?batch_id=" + b.batchID
+	}
+	return out
+}
+
+// ============================================================
+// ROW LIMIT (SS_MAX_BATCH / max_rows)
+// ============================================================
+
+// rowLimit caps how many rows one send request sends. Only rows that get a new
+// job count, so rows skipped or already sent never use it up and the next
+// request over the same range gets further. Rows left unchecked once the cap
+// is reached are counted as remaining.
+type rowLimit struct {
+	mu        sync.Mutex
+	max       int // 0 = no cap
+	used      int
+	remaining int
+}
+
+// rowLimitKey carries the request's *rowLimit in its context
+type rowLimitKey struct{}
+
+func rowLimitFrom(ctx context.Context) *rowLimit {
+	l, _ := ctx.Value(rowLimitKey{}).(*rowLimit)
+	return l
+}
+
+// withRowLimit gives a send request the SS_MAX_BATCH cap; decodeSendRequest
+// applies a max_rows from the body
+func (a *App) withRowLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l := &rowLimit{max: live.get().MaxBatch}
+		next(w, r.WithContext(context.WithValue(r.Context(), rowLimitKey{}, l)))
+	}
+}
+
+func (l *rowLimit) active() bool {
+	return l != nil && l.max > 0
+}
+
+// take counts one row sent (a new job)
+func (l *rowLimit) take() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.used++
+	l.mu.Unlock()
+}
+
+// reached reports whether no further row may be sent
+func (l *rowLimit) reached() bool {
+	if !l.active() {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.used >= l.max
+}
+
+// skip counts n rows left unchecked because the cap was reached
+func (l *rowLimit) skip(n int) {
+	l.mu.Lock()
+	l.remaining += n
+	l.mu.Unlock()
+}
+
+func (l *rowLimit) left() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.remaining
+}
+
+// rowCount is how many rows one eachChunk item holds: the length of a group
+// (e.g. a window's encounters), else 1
+func rowCount(item interface{}) int {
+	if v := reflect.ValueOf(item); v.Kind() == reflect.Slice {
+		return v.Len()
+	}
+	return 1
+}
+
+// batch returns a copy of a bound to ctx (normally the HTTP request's) and
+// stamped with a fresh batch id. Every send_log row, job and FHIR request made
+// through the copy carries that id, its DB queries and FHIR calls stop when
+// ctx is cancelled, and its patient/practitioner lookups share one cache.
+// The copy sends as the org withOrg put in ctx, if any.
+func (a *App) batch(ctx context.Context) *App {
+	b := *a
+	b.ctx = ctx
+	b.batchID = newUUID()
+	if id, ok := ctx.Value(batchIDKey{}).(string); ok {
+		b.batchID = id // the batch a queued row was selected in
+	}
+	if a.cfg.RequestLookupCache {
+		b.lookups = newLookupCache()
+	}
+	ss := *a.ss
+	ss.batchID = b.batchID
+	ss.ctx = ctx
+	b.ss = &ss
+	if org, ok := b.useOrg(orgFromContext(ctx)); ok {
+		return org
+	}
+	return &b
+}
+
+// newBatchResult starts a result that reports a's batch id
+func (a *App) newBatchResult() *batchResult {
+	verbose, _ := a.ctx.Value(verboseKey{}).(bool)
+	res := &batchResult{batchID: a.batchID, verbose: verbose, limit: rowLimitFrom(a.ctx)}
+	if q := enqueuedFrom(a.ctx); q != nil {
+		res.queue, res.queueBase = q, q.n.Load()
+	}
+	return res
+}
+
+// countBy tallies the outcomes per value of a detail field, e.g. "location"
+func (b *batchResult) countBy(field string) map[string]map[string]int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := map[string]map[string]int{}
+	for _, d := range b.details {
+		k := fmt.Sprint(d[field])
+		if out[k] == nil {
+			out[k] = map[string]int{"sent": 0, "failed": 0, "skipped": 0}
+		}
+		switch d["status"] {
+		case "success":
+			out[k]["sent"]++
+		case "skipped":
+			out[k]["skipped"]++
+		default:
+			out[k]["failed"]++
+		}
+	}
+	return out
+}
+
+// forEachPartition calls fn for every row. With workers > 1 the rows are
+// grouped by key and up to workers groups run concurrently; rows within a
+// group keep their order. workers <= 1 is a plain sequential loop.
+// Rows not started before ctx is cancelled are dropped; rows not started
+// once the request's rowLimit is reached are counted as remaining.
+func forEachPartition[T any](ctx context.Context, rows []T, key func(T) string, workers int, fn func(T)) {
+	limit := rowLimitFrom(ctx)
+	if workers <= 1 {
+		for _, r := range rows {
+			if ctx.Err() != nil {
+				return
+			}
+			if limit.reached() {
+				limit.skip(1)
+				continue
+			}
+			fn(r)
+		}
+		return
+	}
+	index := map[string]int{}
+	var groups [][]T
+	for _, r := range rows {
+		k := key(r)
+		i, ok := index[k]
+		if !ok {
+			i = len(groups)
+			index[k] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], r)
+	}
+
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for _, g := range groups {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(g []T) {
+			defer func() { <-sem; wg.Done() }()
+			for _, r := range g {
+				if ctx.Err() != nil {
+					return
+				}
+				if limit.reached() {
+					limit.skip(1)
+					continue
+				}
+				fn(r)
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+// writeBatch writes a send batch response. A failure before the first window
+// completed is a 500; a later failure is reported alongside the partial result.
+func writeBatch(w http.ResponseWriter, res *batchResult, done int, err error, listKey string, extra map[string]interface{}) {
+	if err != nil && done == 0 {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	resp := res.toJSON(listKey)
+	for k, v := range extra {
+		resp[k] = v
+	}
+	if err != nil {
+		resp["error"] = err.Error()
+	}
+	jsonResponse(w, resp)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// TestWithResponseTruncatesOnRune: a long OperationOutcome is cut before a
+// multi-byte character instead of through it.
+func TestWithResponseTruncatesOnRune(t *testing.T) {
+	b := &batchResult{verbose: true}
+	// `{"d":"` is 6 bytes, so a 3-byte "─" straddles the cap
+	err := &responseError{op: "POST", result: map[string]interface{}{"d": strings.Repeat("─", verboseResponseMax)}}
+	got, _ := b.withResponse(map[string]interface{}{}, err)["response"].(string)
+	if got == "" || !utf8.ValidString(got) {
+		t.Fatalf("response is empty or not valid UTF-8")
+	}
+	if len(got) > verboseResponseMax+len("…") {
+		t.Fatalf("response is %d bytes, want at most %d", len(got), verboseResponseMax+len("…"))
+	}
+}
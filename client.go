@@ -2,15 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 // ============================================================
@@ -20,14 +26,43 @@ import (
 type TokenManager struct {
 	cfg       Config
 	token     string
+	scope     string
 	expiresAt time.Time
 	mu        sync.RWMutex
+	inflight  *tokenFetch // the refresh in progress, nil when idle
+
+	// consecutive fetch failures, reset by the next successful fetch
+	failures  int
+	lastErr   string
+	lastErrAt time.Time
+	onAlert   func(event string, failures int, lastErr string) // set when SS_WEBHOOK_URL is configured
+}
+
+// tokenFetch is one token request shared by every caller that needed a token
+// while it ran
+type tokenFetch struct {
+	done chan struct{}
+	err  error
 }
 
+const (
+	// tokenFetchTimeout bounds one token request, so a hanging auth endpoint
+	// cannot hold every waiting send
+	tokenFetchTimeout = 30 * time.Second
+	// tokenFailCooldown is how long a failed fetch is answered from its error
+	// instead of hitting the auth endpoint again
+	tokenFailCooldown = 5 * time.Second
+)
+
+var tokenHTTP = &http.Client{Timeout: tokenFetchTimeout}
+
 func NewTokenManager(cfg Config) *TokenManager {
 	return &TokenManager{cfg: cfg}
 }
 
+// GetToken returns a valid token. Only one refresh runs at a time and every
+// other caller waits for its result; for tokenFailCooldown after a failure
+// callers get that failure back without a new request.
 func (tm *TokenManager) GetToken() (string, error) {
 	tm.mu.RLock()
 	if tm.token != "" && time.Now().Before(tm.expiresAt) {
@@ -36,43 +71,124 @@ func (tm *TokenManager) GetToken() (string, error) {
 	}
 	tm.mu.RUnlock()
 
-	// Need to refresh
 	tm.mu.Lock()
-	defer tm.mu.Unlock()
-
 	// Double-check after acquiring write lock
 	if tm.token != "" && time.Now().Before(tm.expiresAt) {
+		defer tm.mu.Unlock()
 		return tm.token, nil
 	}
+	if f := tm.inflight; f != nil {
+		tm.mu.Unlock()
+		<-f.done
+		return tm.result(f)
+	}
+	if tm.failures > 0 && time.Since(tm.lastErrAt) < tokenFailCooldown {
+		defer tm.mu.Unlock()
+		return "", fmt.Errorf("%w: %s (cooling down after failure)", ErrTokenFailed, tm.lastErr)
+	}
+	f := &tokenFetch{done: make(chan struct{})}
+	tm.inflight = f
+	tm.mu.Unlock()
+
+	tok, err := tm.fetch()
+
+	tm.mu.Lock()
+	if err != nil {
+		tm.recordFailure(err)
+		f.err = fmt.Errorf("%w: %w", ErrTokenFailed, err)
+	} else {
+		tm.token, tm.scope, tm.expiresAt = tok.token, tok.scope, tok.expiresAt
+		if tm.failures >= tm.cfg.TokenAlertThreshold && tm.cfg.TokenAlertThreshold > 0 && tm.onAlert != nil {
+			go tm.onAlert("token.recovered", tm.failures, tm.lastErr)
+		}
+		tm.failures = 0
+	}
+	tm.inflight = nil
+	close(f.done)
+	tm.mu.Unlock()
+	return tm.result(f)
+}
+
+// result is the outcome of the finished fetch f
+func (tm *TokenManager) result(f *tokenFetch) (string, error) {
+	if f.err != nil {
+		return "", f.err
+	}
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.token, nil
+}
+
+// recordFailure counts a failed fetch and alerts once when the streak reaches
+// SS_TOKEN_ALERT_THRESHOLD. Callers hold tm.mu.
+func (tm *TokenManager) recordFailure(err error) {
+	tm.failures++
+	tm.lastErr = err.Error()
+	tm.lastErrAt = time.Now()
+	logWarnf("⚠️ token fetch failed (%d in a row): %v", tm.failures, err)
+	if tm.failures == tm.cfg.TokenAlertThreshold {
+		logErrorf("❌ token failed %d times in a row, check SS_CLIENT_ID / SS_CLIENT_SECRET", tm.failures)
+		if tm.onAlert != nil {
+			go tm.onAlert("token.failing", tm.failures, tm.lastErr)
+		}
+	}
+}
+
+// Failures returns the current streak of failed fetches with the last error
+func (tm *TokenManager) Failures() (int, string, time.Time) {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.failures, tm.lastErr, tm.lastErrAt
+}
+
+// fetchedToken is a token response, applied to the manager under tm.mu
+type fetchedToken struct {
+	token     string
+	scope     string
+	expiresAt time.Time
+}
 
+// fetch requests a new token. It runs without tm.mu, so a slow auth endpoint
+// does not block readers of a still-valid token.
+func (tm *TokenManager) fetch() (fetchedToken, error) {
 	data := url.Values{}
 	data.Set("client_id", tm.cfg.SSClientID)
 	data.Set("client_secret", tm.cfg.SSSecret)
 
-	resp, err := http.PostForm(tm.cfg.SSAuthURL+"/accesstoken?grant_type=client_credentials", data)
+	resp, err := tokenHTTP.PostForm(tm.cfg.SSAuthURL+"/accesstoken?grant_type=client_credentials", data)
 	if err != nil {
-		return "", fmt.Errorf("token request failed: %w", err)
+		return fetchedToken{}, fmt.Errorf("token request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, _ := io.ReadAll(resp.Body)
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("token error %d: %s", resp.StatusCode, string(body))
+		return fetchedToken{}, fmt.Errorf("token error %d: %s", resp.StatusCode, string(body))
 	}
 
 	var result struct {
 		AccessToken string `json:"access_token"`
 		ExpiresIn   string `json:"expires_in"`
+		Scope       string `json:"scope"`
 	}
 	if err := json.Unmarshal(body, &result); err != nil {
-		return "", fmt.Errorf("parse token response: %w", err)
+		return fetchedToken{}, fmt.Errorf("parse token response: %w", err)
 	}
 
-	tm.token = result.AccessToken
 	expiresIn, _ := strconv.Atoi(result.ExpiresIn)
-	tm.expiresAt = time.Now().Add(time.Duration(expiresIn-60) * time.Second)
-	log.Printf("✅ Token refreshed, expires in %ss", result.ExpiresIn)
-	return tm.token, nil
+	logInfof("✅ Token refreshed, expires in %ss", result.ExpiresIn)
+	return fetchedToken{
+		token:     result.AccessToken,
+		scope:     result.Scope,
+		expiresAt: time.Now().Add(time.Duration(expiresIn-60) * time.Second),
+	}, nil
+}
+
+// Scope returns the scope granted with the current token
+func (tm *TokenManager) Scope() string {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.scope
 }
 
 // ============================================================
@@ -83,62 +199,183 @@ type SSClient struct {
 	cfg      Config
 	tokenMgr *TokenManager
 	http     *http.Client
+	hooks    []func(*http.Request)
+	audit    func(httpAuditEntry) // set when SS_HTTP_AUDIT is on
+	limiter  *rate.Limiter        // shared by every caller; unlimited when SS_RATE_LIMIT=0
+	batchID  string               // sent as X-Request-Id; set on the copy made by App.batch
+	ctx      context.Context      // bounds doRequest; the request context on App.batch copies
 }
 
 func NewSSClient(cfg Config, tm *TokenManager) *SSClient {
-	return &SSClient{
+	c := &SSClient{
 		cfg:      cfg,
 		tokenMgr: tm,
 		http:     &http.Client{Timeout: 30 * time.Second},
+		ctx:      context.Background(),
 	}
+	c.limiter = rate.NewLimiter(rate.Inf, 1)
+	c.setRateLimit(cfg.RateLimit)
+	return c
+}
+
+// OnRequest registers a hook that can add dynamic headers (e.g. a request id)
+// to every FHIR request. Hooks run after the static EXTRA_HEADERS are set.
+func (c *SSClient) OnRequest(fn func(*http.Request)) {
+	c.hooks = append(c.hooks, fn)
+}
+
+// newRequestID returns a random 16-byte hex id
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newUUID returns a random RFC 4122 version 4 UUID
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
 
 // doRequest makes an authenticated FHIR request
 func (c *SSClient) doRequest(method, path string, body interface{}) (map[string]interface{}, error) {
+	return c.doRequestCtx(c.ctx, method, path, body)
+}
+
+// doRequestCtx is doRequest bound to ctx (deadline/cancellation)
+func (c *SSClient) doRequestCtx(ctx context.Context, method, path string, body interface{}) (map[string]interface{}, error) {
+	_, result, err := c.doRequestStatus(ctx, method, path, body)
+	return result, err
+}
+
+// doRequestStatus is doRequestCtx that also returns the HTTP status code
+func (c *SSClient) doRequestStatus(ctx context.Context, method, path string, body interface{}) (int, map[string]interface{}, error) {
+	return c.doRequestType(ctx, method, path, "application/json", body)
+}
+
+// doRequestType is doRequestStatus with the request Content-Type
+func (c *SSClient) doRequestType(ctx context.Context, method, path, contentType string, body interface{}) (int, map[string]interface{}, error) {
+	var jsonBytes []byte
+	if body != nil {
+		jsonBytes, _ = json.Marshal(body)
+	}
+
+	start := time.Now()
+	status, respBody, err := c.sendRawType(ctx, method, path, contentType, jsonBytes)
+	if err != nil {
+		return 0, nil, err
+	}
+	if c.audit != nil {
+		c.audit(httpAuditEntry{Method: method, Path: path, RequestBody: jsonBytes,
+			StatusCode: status, ResponseBody: respBody, Duration: time.Since(start)})
+	}
+
+	var result map[string]interface{}
+	json.Unmarshal(respBody, &result)
+	return status, result, nil
+}
+
+// sendRaw performs one authenticated FHIR request with an already-encoded body
+func (c *SSClient) sendRaw(ctx context.Context, method, path string, jsonBytes []byte) (int, []byte, error) {
+	return c.sendRawType(ctx, method, path, "application/json", jsonBytes)
+}
+
+// sendRawType is sendRaw with the request Content-Type
+func (c *SSClient) sendRawType(ctx context.Context, method, path, contentType string, jsonBytes []byte) (int, []byte, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return 0, nil, fmt.Errorf("rate limit: %w", err)
+	}
 	token, err := c.tokenMgr.GetToken()
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 
 	var reqBody io.Reader
-	if body != nil {
-		jsonBytes, _ := json.Marshal(body)
+	if jsonBytes != nil {
 		reqBody = bytes.NewReader(jsonBytes)
-		log.Printf("📤 %s %s\n%s", method, path, string(jsonBytes))
+		logDebugf("📤 %s %s\n%s", method, redactPath(path), redactPayload(jsonBytes))
 	}
 
-	req, err := http.NewRequest(method, c.cfg.SSFHIRURL+path, reqBody)
+	req, err := http.NewRequestWithContext(ctx, method, c.cfg.SSFHIRURL+path, reqBody)
 	if err != nil {
-		return nil, err
+		return 0, nil, err
+	}
+	for k, v := range c.cfg.ExtraHeaders {
+		req.Header.Set(k, v)
 	}
 	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
+	for _, hook := range c.hooks {
+		hook(req)
+	}
+	if c.batchID != "" {
+		req.Header.Set("X-Request-Id", c.batchID)
+	}
 
 	resp, err := c.http.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
+		return 0, nil, fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	respBody, _ := io.ReadAll(resp.Body)
-	log.Printf("📥 Response %d:\n%s", resp.StatusCode, string(respBody))
+	logDebugf("📥 Response %d:\n%s", resp.StatusCode, redactPayload(respBody))
+	return resp.StatusCode, respBody, nil
+}
 
-	var result map[string]interface{}
-	json.Unmarshal(respBody, &result)
-	return result, nil
+// responseError is a FHIR write SatuSehat answered without the expected
+// resource; result is its parsed body, usually an OperationOutcome
+type responseError struct {
+	op     string
+	result map[string]interface{}
+}
+
+func (e *responseError) Error() string {
+	return fmt.Sprintf("%s failed: %v", e.op, e.result)
+}
+
+// Sentinel errors, wrapped so callers can tell them apart with errors.Is.
+// The not-found ones mean the lookup returned an empty bundle (total:0): the
+// record is genuinely not in SatuSehat, retrying will not help.
+var (
+	ErrPatientNotFound      = errors.New("patient not found")
+	ErrPractitionerNotFound = errors.New("practitioner not found")
+	ErrTokenFailed          = errors.New("token fetch failed")
+	// ErrTransient is a 429 or 5xx answer: SatuSehat is busy, the same
+	// request may succeed moments later
+	ErrTransient = errors.New("SatuSehat temporarily unavailable")
+)
+
+// searchStatusErr is the error of a search SatuSehat answered with an error
+// status instead of a Bundle, nil for a 2xx. Without it a 429 reads as an
+// empty bundle, i.e. not found.
+func searchStatusErr(what string, status int, result map[string]interface{}) error {
+	switch {
+	case status < 400:
+		return nil
+	case status == http.StatusTooManyRequests || status >= 500:
+		return fmt.Errorf("%s: HTTP %d: %w", what, status, ErrTransient)
+	}
+	return fmt.Errorf("%s: HTTP %d: %v", what, status, result)
 }
 
 // LookupPatient looks up a FHIR Patient ID by NIK
-func (c *SSClient) LookupPatient(nik string) (string, error) {
-	result, err := c.doRequest("GET", "/Patient?identifier=https://fhir.kemkes.go.id/id/nik|"+nik, nil)
+func (c *SSClient) LookupPatient(ctx context.Context, nik string) (string, error) {
+	status, result, err := c.doRequestStatus(ctx, "GET", "/Patient?identifier="+url.QueryEscape(nikSystem+"|"+nik), nil)
 	if err != nil {
 		return "", err
 	}
+	if err := searchStatusErr("patient NIK "+nik, status, result); err != nil {
+		return "", err
+	}
 
 	// Parse FHIR Bundle response
 	total, _ := result["total"].(float64)
 	if total == 0 {
-		return "", fmt.Errorf("patient NIK %s not found", nik)
+		return "", fmt.Errorf("NIK %s: %w", nik, ErrPatientNotFound)
 	}
 
 	entries, ok := result["entry"].([]interface{})
@@ -153,15 +390,18 @@ func (c *SSClient) LookupPatient(nik string) (string, error) {
 }
 
 // LookupPractitioner looks up a FHIR Practitioner ID by NIK
-func (c *SSClient) LookupPractitioner(nik string) (string, error) {
-	result, err := c.doRequest("GET", "/Practitioner?identifier=https://fhir.kemkes.go.id/id/nik|"+nik, nil)
+func (c *SSClient) LookupPractitioner(ctx context.Context, nik string) (string, error) {
+	status, result, err := c.doRequestStatus(ctx, "GET", "/Practitioner?identifier="+url.QueryEscape(nikSystem+"|"+nik), nil)
 	if err != nil {
 		return "", err
 	}
+	if err := searchStatusErr("practitioner NIK "+nik, status, result); err != nil {
+		return "", err
+	}
 
 	total, _ := result["total"].(float64)
 	if total == 0 {
-		return "", fmt.Errorf("practitioner NIK %s not found", nik)
+		return "", fmt.Errorf("NIK %s: %w", nik, ErrPractitionerNotFound)
 	}
 
 	entries, ok := result["entry"].([]interface{})
@@ -175,6 +415,62 @@ func (c *SSClient) LookupPractitioner(nik string) (string, error) {
 	return id, nil
 }
 
+// VerifyOrganization reads Organization/{id} and checks that it exists
+func (c *SSClient) VerifyOrganization(id string) error {
+	result, err := c.doRequest("GET", "/Organization/"+id, nil)
+	if err != nil {
+		return err
+	}
+	if rt, _ := result["resourceType"].(string); rt != "Organization" {
+		return fmt.Errorf("organization %s not found: %v", id, result)
+	}
+	return nil
+}
+
+// LookupPractitionerByName looks up a FHIR Practitioner ID by name. Only an
+// unambiguous match (exactly one result) is accepted.
+func (c *SSClient) LookupPractitionerByName(ctx context.Context, name string) (string, error) {
+	status, result, err := c.doRequestStatus(ctx, "GET", "/Practitioner?name="+url.QueryEscape(name), nil)
+	if err != nil {
+		return "", err
+	}
+	if err := searchStatusErr("practitioner name "+name, status, result); err != nil {
+		return "", err
+	}
+
+	entries, _ := result["entry"].([]interface{})
+	switch {
+	case len(entries) == 0:
+		return "", fmt.Errorf("name %q: %w", name, ErrPractitionerNotFound)
+	case len(entries) > 1:
+		return "", fmt.Errorf("practitioner name %q is ambiguous (%d matches)", name, len(entries))
+	}
+
+	entry := entries[0].(map[string]interface{})
+	resource := entry["resource"].(map[string]interface{})
+	id := resource["id"].(string)
+	return id, nil
+}
+
+// FindByIdentifier searches resourceType by identifier system|value and
+// returns the ids of every match
+func (c *SSClient) FindByIdentifier(resourceType, system, value string) ([]string, error) {
+	result, err := c.doRequest("GET", "/"+resourceType+"?identifier="+url.QueryEscape(system+"|"+value), nil)
+	if err != nil {
+		return nil, err
+	}
+	entries, _ := result["entry"].([]interface{})
+	var ids []string
+	for _, e := range entries {
+		entry, _ := e.(map[string]interface{})
+		resource, _ := entry["resource"].(map[string]interface{})
+		if id, _ := resource["id"].(string); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
 // ============================================================
 // FHIR RESOURCE SEND METHODS
 // ============================================================
@@ -188,11 +484,61 @@ func (c *SSClient) SendEncounter(enc map[string]interface{}) (string, error) {
 
 	id, ok := result["id"].(string)
 	if !ok || id == "" {
-		return "", fmt.Errorf("encounter send failed: %v", result)
+		return "", &responseError{op: "encounter send", result: result}
 	}
 	return id, nil
 }
 
+// GetEncounter reads Encounter/{id} as sent
+func (c *SSClient) GetEncounter(id string) (map[string]interface{}, error) {
+	result, err := c.doRequest("GET", "/Encounter/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rt, _ := result["resourceType"].(string); rt != "Encounter" {
+		return nil, fmt.Errorf("encounter %s not found: %v", id, result)
+	}
+	return result, nil
+}
+
+// UpdateEncounter replaces Encounter/{id} with enc (PUT)
+func (c *SSClient) UpdateEncounter(id string, enc map[string]interface{}) error {
+	enc["id"] = id
+	result, err := c.doRequest("PUT", "/Encounter/"+id, enc)
+	if err != nil {
+		return err
+	}
+	if rt, _ := result["resourceType"].(string); rt != "Encounter" {
+		return &responseError{op: "encounter update", result: result}
+	}
+	return nil
+}
+
+// UpdateObservation replaces Observation/{id} with obs (PUT)
+func (c *SSClient) UpdateObservation(id string, obs map[string]interface{}) error {
+	obs["id"] = id
+	result, err := c.doRequest("PUT", "/Observation/"+id, obs)
+	if err != nil {
+		return err
+	}
+	if rt, _ := result["resourceType"].(string); rt != "Observation" {
+		return &responseError{op: "observation update", result: result}
+	}
+	return nil
+}
+
+// SendPatch applies a JSON Patch (RFC 6902) document to resourceType/{id}
+func (c *SSClient) SendPatch(resourceType, id string, jsonPatch []interface{}) error {
+	status, result, err := c.doRequestType(c.ctx, "PATCH", "/"+resourceType+"/"+id, "application/json-patch+json", jsonPatch)
+	if err != nil {
+		return err
+	}
+	if rt, _ := result["resourceType"].(string); status >= 300 || rt != resourceType {
+		return &responseError{op: strings.ToLower(resourceType) + " patch", result: result}
+	}
+	return nil
+}
+
 // SendCondition sends condition FHIR resource
 func (c *SSClient) SendCondition(cond map[string]interface{}) (string, error) {
 	result, err := c.doRequest("POST", "/Condition", cond)
@@ -202,7 +548,7 @@ func (c *SSClient) SendCondition(cond map[string]interface{}) (string, error) {
 
 	id, ok := result["id"].(string)
 	if !ok || id == "" {
-		return "", fmt.Errorf("condition send failed: %v", result)
+		return "", &responseError{op: "condition send", result: result}
 	}
 	return id, nil
 }
@@ -215,7 +561,33 @@ func (c *SSClient) SendObservation(obs map[string]interface{}) (string, error) {
 	}
 	id, ok := result["id"].(string)
 	if !ok || id == "" {
-		return "", fmt.Errorf("observation send failed: %v", result)
+		return "", &responseError{op: "observation send", result: result}
+	}
+	return id, nil
+}
+
+// SendSpecimen sends a Specimen FHIR resource
+func (c *SSClient) SendSpecimen(spec map[string]interface{}) (string, error) {
+	result, err := c.doRequest("POST", "/Specimen", spec)
+	if err != nil {
+		return "", err
+	}
+	id, ok := result["id"].(string)
+	if !ok || id == "" {
+		return "", &responseError{op: "specimen send", result: result}
+	}
+	return id, nil
+}
+
+// SendServiceRequest sends a ServiceRequest (referral) FHIR resource
+func (c *SSClient) SendServiceRequest(sr map[string]interface{}) (string, error) {
+	result, err := c.doRequest("POST", "/ServiceRequest", sr)
+	if err != nil {
+		return "", err
+	}
+	id, ok := result["id"].(string)
+	if !ok || id == "" {
+		return "", &responseError{op: "service request send", result: result}
 	}
 	return id, nil
 }
@@ -227,7 +599,7 @@ func (c *SSClient) SendProcedure(proc map[string]interface{}) (string, error) {
 	}
 	id, ok := result["id"].(string)
 	if !ok || id == "" {
-		return "", fmt.Errorf("procedure send failed: %v", result)
+		return "", &responseError{op: "procedure send", result: result}
 	}
 	return id, nil
 }
@@ -239,7 +611,7 @@ func (c *SSClient) SendMedicationRequest(mr map[string]interface{}) (string, err
 	}
 	id, ok := result["id"].(string)
 	if !ok || id == "" {
-		return "", fmt.Errorf("medication request send failed: %v", result)
+		return "", &responseError{op: "medication request send", result: result}
 	}
 	return id, nil
 }
@@ -251,7 +623,57 @@ func (c *SSClient) SendMedicationDispense(md map[string]interface{}) (string, er
 	}
 	id, ok := result["id"].(string)
 	if !ok || id == "" {
-		return "", fmt.Errorf("medication dispense send failed: %v", result)
+		return "", &responseError{op: "medication dispense send", result: result}
+	}
+	return id, nil
+}
+
+func (c *SSClient) SendDevice(dev map[string]interface{}) (string, error) {
+	result, err := c.doRequest("POST", "/Device", dev)
+	if err != nil {
+		return "", err
+	}
+	id, ok := result["id"].(string)
+	if !ok || id == "" {
+		return "", &responseError{op: "device send", result: result}
+	}
+	return id, nil
+}
+
+// CreatePatient registers a new Patient
+func (c *SSClient) CreatePatient(patient map[string]interface{}) (string, error) {
+	result, err := c.doRequest("POST", "/Patient", patient)
+	if err != nil {
+		return "", err
+	}
+	id, ok := result["id"].(string)
+	if !ok || id == "" {
+		return "", &responseError{op: "patient create", result: result}
+	}
+	return id, nil
+}
+
+// SendComposition sends the resume medis Composition
+func (c *SSClient) SendComposition(comp map[string]interface{}) (string, error) {
+	result, err := c.doRequest("POST", "/Composition", comp)
+	if err != nil {
+		return "", err
+	}
+	id, ok := result["id"].(string)
+	if !ok || id == "" {
+		return "", &responseError{op: "composition send", result: result}
+	}
+	return id, nil
+}
+
+func (c *SSClient) SendQuestionnaireResponse(qr map[string]interface{}) (string, error) {
+	result, err := c.doRequest("POST", "/QuestionnaireResponse", qr)
+	if err != nil {
+		return "", err
+	}
+	id, ok := result["id"].(string)
+	if !ok || id == "" {
+		return "", &responseError{op: "questionnaire response send", result: result}
 	}
 	return id, nil
 }
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+)
+
+// ============================================================
+// COMPOSITION (resume medis rawat inap)
+// ============================================================
+
+const createCompositionTableSQL = `CREATE TABLE IF NOT EXISTS satu_sehat_composition (
+	no_rawat       VARCHAR(17)  NOT NULL PRIMARY KEY,
+	id_composition VARCHAR(100) NOT NULL
+)`
+
+// compositionResumeTable is the Khanza resume table the section texts are
+// read from (SS_COMPOSITION_RESUME_TABLE, validated at startup)
+var compositionResumeTable = "resume_pasien_ranap"
+
+type CompositionRow struct {
+	NoRawat       string
+	NmPasien      string
+	NoKTPPasien   string
+	IDEncounter   string
+	TglPulang     string // last kamar_inap discharge, "YYYY-MM-DDTHH:MM:SS+07:00"
+	KdDokter      string
+	NamaDokter    string
+	NoKTPDokter   string
+	KeluhanUtama  string
+	Jalannya      string // jalannya_penyakit
+	Penunjang     string // pemeriksaan_penunjang
+	HasilLab      string // hasil_laborat
+	KondisiPulang string
+	ObatPulang    string
+	IDComposition string
+}
+
+// jobKey is the idempotency key of this row's send job
+func (r CompositionRow) jobKey() string {
+	return idempKey(r.NoRawat)
+}
+
+// compositionEntry is a resource already sent for the visit that a section lists
+type compositionEntry struct {
+	Reference string
+	Display   string
+}
+
+func initCompositionTable(db *sql.DB) {
+	if _, err := db.Exec(createCompositionTableSQL); err != nil {
+		logErrorf("❌ create satu_sehat_composition table: %v", err)
+	}
+}
+
+// queryPendingCompositions lists discharged Ranap visits (no kamar_inap still
+// open) whose Encounter was sent and that have a resume
+func queryPendingCompositions(ctx context.Context, db *sql.DB, f PendingFilter) ([]CompositionRow, error) {
+	resume := compositionResumeTable
+	query := `
+		SELECT reg_periksa.no_rawat, pasien.nm_pasien, pasien.no_ktp,
+			satu_sehat_encounter.id_encounter,
+			(SELECT CONCAT(keluar.tgl_keluar,'T',keluar.jam_keluar,'+07:00') FROM kamar_inap keluar
+				WHERE keluar.no_rawat = reg_periksa.no_rawat
+				ORDER BY keluar.tgl_keluar DESC, keluar.jam_keluar DESC LIMIT 1) as pulang,
+			` + resume + `.kd_dokter, pegawai.nama, pegawai.no_ktp,
+			IFNULL(` + resume + `.keluhan_utama,''), IFNULL(` + resume + `.jalannya_penyakit,''),
+			IFNULL(` + resume + `.pemeriksaan_penunjang,''), IFNULL(` + resume + `.hasil_laborat,''),
+			IFNULL(` + resume + `.kondisi_pulang,''), IFNULL(` + resume + `.obat_pulang,''),
+			IFNULL(satu_sehat_composition.id_composition,'') as id_composition
+		FROM reg_periksa
+		INNER JOIN pasien ON reg_periksa.no_rkm_medis = pasien.no_rkm_medis
+		INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
+		INNER JOIN ` + resume + ` ON ` + resume + `.no_rawat = reg_periksa.no_rawat
+		INNER JOIN pegawai ON pegawai.nik = ` + resume + `.kd_dokter
+		LEFT JOIN satu_sehat_composition ON satu_sehat_composition.no_rawat = reg_periksa.no_rawat
+		WHERE reg_periksa.status_lanjut = 'Ranap'
+			AND ` + f.rangeSQL(registrationDate) + `
+			AND satu_sehat_encounter.id_encounter != ''
+			AND EXISTS (SELECT 1 FROM kamar_inap WHERE kamar_inap.no_rawat = reg_periksa.no_rawat)
+			AND NOT EXISTS (SELECT 1 FROM kamar_inap dirawat
+				WHERE dirawat.no_rawat = reg_periksa.no_rawat AND dirawat.tgl_keluar = '0000-00-00')
+		ORDER BY reg_periksa.tgl_registrasi ` + f.orderSQL() + `, reg_periksa.jam_reg ` + f.orderSQL()
+
+	rows, err := db.QueryContext(ctx, query, f.rangeArgs(1)...)
+	if err != nil {
+		return nil, fmt.Errorf("query compositions: %w", err)
+	}
+	defer rows.Close()
+
+	var results []CompositionRow
+	for rows.Next() {
+		var r CompositionRow
+		if err := rows.Scan(&r.NoRawat, &r.NmPasien, &r.NoKTPPasien, &r.IDEncounter, &r.TglPulang,
+			&r.KdDokter, &r.NamaDokter, &r.NoKTPDokter,
+			&r.KeluhanUtama, &r.Jalannya, &r.Penunjang, &r.HasilLab, &r.KondisiPulang, &r.ObatPulang,
+			&r.IDComposition); err != nil {
+			logWarnf("⚠️ scan composition: %v", err)
+			continue
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// queryCompositionEntries returns the Conditions (primary first) and
+// Procedures of the visit that were already sent
+func queryCompositionEntries(ctx context.Context, db *sql.DB, noRawat string) ([]compositionEntry, []compositionEntry, error) {
+	collect := func(query string) ([]compositionEntry, error) {
+		rows, err := db.QueryContext(ctx, query, noRawat)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var out []compositionEntry
+		for rows.Next() {
+			var e compositionEntry
+			if err := rows.Scan(&e.Reference, &e.Display); err != nil {
+				return nil, err
+			}
+			out = append(out, e)
+		}
+		return out, rows.Err()
+	}
+	conditions, err := collect(`
+		SELECT DISTINCT CONCAT('Condition/', satu_sehat_condition.id_condition), penyakit.nm_penyakit
+		FROM satu_sehat_condition
+		INNER JOIN penyakit ON penyakit.kd_penyakit = satu_sehat_condition.kd_penyakit
+		LEFT JOIN diagnosa_pasien ON diagnosa_pasien.no_rawat = satu_sehat_condition.no_rawat
+			AND diagnosa_pasien.kd_penyakit = satu_sehat_condition.kd_penyakit
+		WHERE satu_sehat_condition.no_rawat = ? AND satu_sehat_condition.id_condition != ''
+		ORDER BY IFNULL(diagnosa_pasien.prioritas, 99)`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query composition conditions: %w", err)
+	}
+	procedures, err := collect(`
+		SELECT DISTINCT CONCAT('Procedure/', satu_sehat_procedure.id_procedure), icd9.deskripsi_panjang
+		FROM satu_sehat_procedure
+		INNER JOIN icd9 ON icd9.kode = satu_sehat_procedure.kode
+		WHERE satu_sehat_procedure.no_rawat = ? AND satu_sehat_procedure.id_procedure != ''`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query composition procedures: %w", err)
+	}
+	return conditions, procedures, nil
+}
+
+// compositionSection is one resume section: LOINC-coded, narrative text
+// and/or references to resources already sent. nil when it has neither.
+func compositionSection(code, display, text string, entries []compositionEntry) map[string]interface{} {
+	text = strings.TrimSpace(text)
+	if text == "" && len(entries) == 0 {
+		return nil
+	}
+	section := map[string]interface{}{
+		"title": display,
+		"code": map[string]interface{}{
+			"coding": []interface{}{
+				map[string]interface{}{"system": "http://loinc.org", "code": code, "display": display},
+			},
+		},
+	}
+	if text == "" {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Display)
+		}
+		text = strings.Join(names, "; ")
+	}
+	section["text"] = map[string]interface{}{
+		"status": "generated",
+		"div": `<div xmlns="http://www.w3.org/1999/xhtml">` +
+			strings.ReplaceAll(html.EscapeString(text), "\n", "<br/>") + `</div>`,
+	}
+	if len(entries) > 0 {
+		var refs []interface{}
+		for _, e := range entries {
+			refs = append(refs, map[string]interface{}{"reference": e.Reference, "display": e.Display})
+		}
+		section["entry"] = refs
+	}
+	return section
+}
+
+func buildCompositionJSON(row CompositionRow, patientID, practitionerID, orgID string, conditions, procedures []compositionEntry) map[string]interface{} {
+	var sections []interface{}
+	for _, s := range []map[string]interface{}{
+		compositionSection("10154-3", "Chief complaint Narrative - Reported", row.KeluhanUtama, nil),
+		compositionSection("8648-8", "Hospital course Narrative", row.Jalannya, nil),
+		compositionSection("30954-2", "Relevant diagnostic tests/laboratory data Narrative",
+			strings.TrimSpace(row.Penunjang+"\n"+row.HasilLab), nil),
+		compositionSection("11535-2", "Hospital discharge Dx Narrative", "", conditions),
+		compositionSection("47519-4", "History of Procedures Document", "", procedures),
+		compositionSection("10184-0", "Hospital discharge physical findings Narrative", row.KondisiPulang, nil),
+		compositionSection("10183-2", "Hospital discharge medications Narrative", row.ObatPulang, nil),
+	} {
+		if s != nil {
+			sections = append(sections, s)
+		}
+	}
+	return withMetaProfile(map[string]interface{}{
+		"resourceType": "Composition",
+		"identifier":   map[string]interface{}{"system": sysID("composition", orgID), "value": row.NoRawat},
+		"status":       "final",
+		"type": map[string]interface{}{
+			"coding": []interface{}{
+				map[string]interface{}{"system": "http://loinc.org", "code": "18842-5", "display": "Discharge summary"},
+			},
+		},
+		"category": []interface{}{
+			map[string]interface{}{
+				"coding": []interface{}{
+					map[string]interface{}{"system": "http://loinc.org", "code": "LP173421-1", "display": "Report"},
+				},
+			},
+		},
+		"subject": map[string]interface{}{"reference": "Patient/" + patientID, "display": row.NmPasien},
+		"encounter": map[string]interface{}{
+			"reference": "Encounter/" + row.IDEncounter,
+			"display":   displayWords("Kunjungan rawat inap", row.NmPasien, labeled("pulang", row.TglPulang)),
+		},
+		"date":      row.TglPulang,
+		"author":    []interface{}{map[string]interface{}{"reference": "Practitioner/" + practitionerID, "display": row.NamaDokter}},
+		"title":     "Resume Medis Rawat Inap",
+		"custodian": map[string]interface{}{"reference": "Organization/" + orgID},
+		"section":   sections,
+	})
+}
+
+// ============================================================
+// COMPOSITION HANDLERS
+// ============================================================
+
+func (a *App) handlePendingCompositions(w http.ResponseWriter, r *http.Request) {
+	f := a.pendingFilterFromQuery(r)
+	rows, err := queryPendingCompositions(r.Context(), a.db, f)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	var pending []CompositionRow
+	for _, row := range rows {
+		if row.IDComposition == "" {
+			pending = append(pending, row)
+		}
+	}
+	writePending(w, r, map[string]interface{}{
+		"tgl1": f.Tgl1, "tgl2": f.Tgl2,
+		"total": len(rows), "pending_count": len(pending), "sent_count": len(rows) - len(pending),
+		"pending": pending,
+	})
+}
+
+func (a *App) handleSendCompositions(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.decodeSendRequest(w, r)
+	if !ok {
+		return
+	}
+	res, done, err := a.batch(r.Context()).sendCompositions(f)
+	writeBatch(w, res, done, err, "details", nil)
+}
+
+func (a *App) handlePreviewComposition(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.previewFilter(r)
+	if !ok {
+		jsonError(w, "no_rawat required", 400)
+		return
+	}
+	a = a.batch(r.Context())
+	rows, err := queryPendingCompositions(a.ctx, a.db, f)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	row, ok := pickPreviewRow(w, rows, func(CompositionRow) bool { return true }, "no_rawat")
+	if !ok {
+		return
+	}
+	conditions, procedures, err := queryCompositionEntries(a.ctx, a.db, row.NoRawat)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	patientID, practID, ok := a.previewLookups(w, row.NoKTPPasien, row.NoKTPDokter, row.NamaDokter)
+	if !ok {
+		return
+	}
+	writePreview(w, "Composition", row.NoRawat, buildCompositionJSON(row, patientID, practID, a.cfg.SSOrgID, conditions, procedures))
+}
+
+// sendCompositions sends the resume of every discharged Ranap visit in f.
+// A visit waits until at least one of its Conditions was sent, since the
+// Composition is sent once and would otherwise miss its diagnoses.
+func (a *App) sendCompositions(f PendingFilter) (*batchResult, int, error) {
+	res := a.newBatchResult()
+	done, err := eachChunk(a.ctx, f, a.cfg.ChunkDays, func(cf PendingFilter) ([]CompositionRow, error) {
+		return queryPendingCompositions(a.ctx, a.db, cf)
+	}, func(row CompositionRow) {
+		if row.IDComposition != "" {
+			return
+		}
+		if row.NoKTPPasien == "" || !a.canLookupPractitioner(row.NoKTPDokter, row.NamaDokter) {
+			a.saveSendLog(row.NoRawat, "Composition", "", "skipped", "missing NIK")
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "status": "skipped", "reason": "missing NIK"})
+			return
+		}
+		conditions, procedures, err := queryCompositionEntries(a.ctx, a.db, row.NoRawat)
+		if err != nil {
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "status": "failed", "error": err.Error()})
+			return
+		}
+		if len(conditions) == 0 {
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "status": "skipped", "reason": "no Condition sent yet"})
+			return
+		}
+		if a.enqueueRow("Composition", row.jobKey(), row.NoRawat) {
+			return
+		}
+		patientID, err := a.lookupPatient(row.NoKTPPasien)
+		if err != nil {
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, "Composition", "", st, "patient lookup: "+err.Error())
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "status": st, "error": "patient lookup: " + err.Error()})
+			return
+		}
+		practitionerID, err := a.lookupPractitioner(row.NoKTPDokter, row.NamaDokter)
+		if err != nil {
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, "Composition", "", st, "practitioner lookup: "+err.Error())
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "status": st, "error": "practitioner lookup: " + err.Error()})
+			return
+		}
+		comp := buildCompositionJSON(row, patientID, practitionerID, a.cfg.SSOrgID, conditions, procedures)
+		fhirID, err := a.sendViaJob("Composition", row.jobKey(), comp, a.ss.SendComposition)
+		if err != nil {
+			a.saveSendLog(row.NoRawat, "Composition", "", "failed", err.Error())
+			res.add(res.withResponse(map[string]interface{}{"no_rawat": row.NoRawat, "status": "failed", "error": err.Error()}, err))
+			return
+		}
+		if fhirID == "" {
+			return
+		}
+		_, dbErr := a.db.Exec("INSERT INTO satu_sehat_composition (no_rawat, id_composition) VALUES (?,?)", row.NoRawat, fhirID)
+		if dbErr != nil {
+			logErrorf("❌ save composition %s: %v", fhirID, dbErr)
+		}
+		a.saveSendLog(row.NoRawat, "Composition", fhirID, "success", "")
+		res.add(map[string]interface{}{
+			"no_rawat": row.NoRawat, "status": "success", "fhir_id": fhirID,
+			"conditions": len(conditions), "procedures": len(procedures),
+		})
+	})
+	return res, done, err
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
-	"time"
+	"sort"
+	"strings"
 )
 
 // ============================================================
@@ -25,16 +25,110 @@ type ConditionRow struct {
 	StatusLanjut string
 	IDEncounter  string
 	IDCondition  string
+	Prioritas    int    // diagnosa_pasien.prioritas, 1 = primary as entered in Khanza
+	Rank         int    // 1-based rank within the visit after primary selection
+	Primary      bool   // exactly one per visit
+	Verified     bool   // only meaningful when Condition requires verification
+	StatusSrc    string // raw SS_CONDITION_STATUS_COLUMN value, see conditionClinicalStatus
+	DiagStatus   string // diagnosa_pasien.status: Ralan, or Ranap for a diagnosis of the inpatient stay
+	Onset        string // registration (Ralan) or first kamar_inap admission (Ranap), "YYYY-MM-DD HH:MM:SS"
+	Discharge    string // last kamar_inap discharge of a Ranap diagnosis, "" while still admitted
+	OriginRawat  string // prior no_rawat from SS_CONDITION_ORIGIN_COLUMN, "" = this visit
+	OriginEnc    string // id_encounter of OriginRawat, "" when that visit's Encounter is not sent
 }
 
-func queryPendingConditions(db *sql.DB, tgl1, tgl2 string) ([]ConditionRow, error) {
+// jobKey is the idempotency key of this row's send job
+func (r ConditionRow) jobKey() string {
+	return idempKey(r.NoRawat, r.KdPenyakit)
+}
+
+// encounterID is the Encounter the Condition references: the origin visit's
+// when the diagnosis points at one that was sent, else the row's own
+func (r ConditionRow) encounterID() string {
+	if r.OriginEnc != "" {
+		return r.OriginEnc
+	}
+	return r.IDEncounter
+}
+
+// conditionStatusColumn is the diagnosa_pasien column read as clinical status
+// (SS_CONDITION_STATUS_COLUMN, validated at startup; "" = always active)
+var conditionStatusColumn = "status_penyakit"
+
+// conditionOriginColumn is the diagnosa_pasien column holding the no_rawat of
+// the visit a follow-up diagnosis belongs to (SS_CONDITION_ORIGIN_COLUMN,
+// validated at startup; "" = always the diagnosis row's own visit)
+var conditionOriginColumn = ""
+
+// conditionClinicalStatus maps a Khanza status value to a condition-clinical
+// code and display, defaulting to active when unknown
+func conditionClinicalStatus(v string) (string, string) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "lama", "recurrence", "kambuh":
+		return "recurrence", "Recurrence"
+	case "relapse":
+		return "relapse", "Relapse"
+	case "inactive", "tidak aktif", "nonaktif":
+		return "inactive", "Inactive"
+	case "remission", "remisi":
+		return "remission", "Remission"
+	case "resolved", "sembuh":
+		return "resolved", "Resolved"
+	default:
+		return "active", "Active"
+	}
+}
+
+// conditionRangeSQL is the WHERE condition of queryPendingConditions: the
+// registration window, widened to Ranap diagnoses whose stay overlaps it so a
+// diagnosis entered during a long admission is not missed
+func conditionRangeSQL(f PendingFilter) (string, []interface{}) {
+	if f.Tgl1 == "" || f.Tgl2 == "" {
+		return f.rangeSQL(registrationDate), f.rangeArgs(1)
+	}
+	cond := `(` + registrationDate + ` BETWEEN ? AND ?
+			OR (diagnosa_pasien.status = 'Ranap' AND EXISTS (SELECT 1 FROM kamar_inap
+				WHERE kamar_inap.no_rawat = reg_periksa.no_rawat AND kamar_inap.tgl_masuk <= ?
+					AND (kamar_inap.tgl_keluar >= ? OR kamar_inap.tgl_keluar = '0000-00-00'))))`
+	args := []interface{}{f.Tgl1, f.Tgl2, f.Tgl2, f.Tgl1}
+	if f.NoRawat != "" {
+		cond += " AND reg_periksa.no_rawat = ?"
+		args = append(args, f.NoRawat)
+	}
+	return cond, args
+}
+
+func queryPendingConditions(ctx context.Context, db *sql.DB, f PendingFilter) ([]ConditionRow, error) {
+	statusExpr := "''"
+	if conditionStatusColumn != "" {
+		statusExpr = "IFNULL(diagnosa_pasien." + conditionStatusColumn + ",'')"
+	}
+	originExpr, originJoin := "'', ''", ""
+	if conditionOriginColumn != "" {
+		originCol := "diagnosa_pasien." + conditionOriginColumn
+		originExpr = "IFNULL(" + originCol + ",''), IFNULL(origin_encounter.id_encounter,'')"
+		originJoin = `
+		LEFT JOIN satu_sehat_encounter origin_encounter ON origin_encounter.no_rawat = ` + originCol + `
+			AND ` + originCol + ` <> reg_periksa.no_rawat`
+	}
+	where, args := conditionRangeSQL(f)
 	query := `
 		SELECT reg_periksa.no_rawat, pasien.nm_pasien, pasien.no_ktp,
 			reg_periksa.kd_dokter, pegawai.nama, pegawai.no_ktp as ktpdokter,
 			diagnosa_pasien.kd_penyakit, penyakit.nm_penyakit,
 			reg_periksa.status_lanjut,
 			IFNULL(satu_sehat_encounter.id_encounter,'') as id_encounter,
-			IFNULL(satu_sehat_condition.id_condition,'') as id_condition
+			IFNULL(satu_sehat_condition.id_condition,'') as id_condition,
+			diagnosa_pasien.prioritas, ` + statusExpr + `, diagnosa_pasien.status,
+			IF(diagnosa_pasien.status = 'Ranap',
+				IFNULL((SELECT MIN(CONCAT(kamar_inap.tgl_masuk,' ',kamar_inap.jam_masuk)) FROM kamar_inap
+					WHERE kamar_inap.no_rawat = reg_periksa.no_rawat), CONCAT(reg_periksa.tgl_registrasi,' ',reg_periksa.jam_reg)),
+				CONCAT(reg_periksa.tgl_registrasi,' ',reg_periksa.jam_reg)) as onset,
+			IF(diagnosa_pasien.status = 'Ranap',
+				IFNULL((SELECT MAX(CONCAT(kamar_inap.tgl_keluar,' ',kamar_inap.jam_keluar)) FROM kamar_inap
+					WHERE kamar_inap.no_rawat = reg_periksa.no_rawat AND kamar_inap.tgl_keluar <> '0000-00-00'), ''),
+				'') as discharge,
+			` + originExpr + `
 		FROM reg_periksa
 		INNER JOIN pasien ON reg_periksa.no_rkm_medis = pasien.no_rkm_medis
 		INNER JOIN pegawai ON pegawai.nik = reg_periksa.kd_dokter
@@ -42,11 +136,13 @@ func queryPendingConditions(db *sql.DB, tgl1, tgl2 string) ([]ConditionRow, erro
 		INNER JOIN penyakit ON penyakit.kd_penyakit = diagnosa_pasien.kd_penyakit
 		INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
 		LEFT JOIN satu_sehat_condition ON satu_sehat_condition.no_rawat = reg_periksa.no_rawat
-			AND satu_sehat_condition.kd_penyakit = diagnosa_pasien.kd_penyakit
-		WHERE reg_periksa.tgl_registrasi BETWEEN ? AND ?
-			AND satu_sehat_encounter.id_encounter != ''`
+			AND satu_sehat_condition.kd_penyakit = diagnosa_pasien.kd_penyakit` + originJoin + `
+		WHERE ` + where + `
+			AND satu_sehat_encounter.id_encounter != ''
+		ORDER BY reg_periksa.tgl_registrasi ` + f.orderSQL() + `, reg_periksa.jam_reg ` + f.orderSQL() + `,
+			reg_periksa.no_rawat, diagnosa_pasien.prioritas`
 
-	rows, err := db.Query(query, tgl1, tgl2)
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("query conditions: %w", err)
 	}
@@ -58,24 +154,160 @@ func queryPendingConditions(db *sql.DB, tgl1, tgl2 string) ([]ConditionRow, erro
 		err := rows.Scan(&r.NoRawat, &r.NmPasien, &r.NoKTPPasien,
 			&r.KdDokter, &r.NamaDokter, &r.NoKTPDokter,
 			&r.KdPenyakit, &r.NmPenyakit, &r.StatusLanjut,
-			&r.IDEncounter, &r.IDCondition)
+			&r.IDEncounter, &r.IDCondition, &r.Prioritas, &r.StatusSrc,
+			&r.DiagStatus, &r.Onset, &r.Discharge, &r.OriginRawat, &r.OriginEnc)
 		if err != nil {
-			log.Printf("⚠️ scan condition row: %v", err)
+			logWarnf("⚠️ scan condition row: %v", err)
 			continue
 		}
 		results = append(results, r)
 	}
+	results = dedupeConditions(results)
+	rankDiagnoses(results)
 	return results, nil
 }
 
-func buildConditionJSON(row ConditionRow, patientID, encounterID string) map[string]interface{} {
+// blockedCondition is a diagnosis that cannot be sent yet because its visit's
+// Encounter has not been sent
+type blockedCondition struct {
+	NoRawat    string `json:"no_rawat"`
+	NmPasien   string `json:"nm_pasien"`
+	KdPenyakit string `json:"kd_penyakit"`
+	NmPenyakit string `json:"nm_penyakit"`
+}
+
+// queryBlockedConditions lists the diagnoses in f that queryPendingConditions
+// leaves out because satu_sehat_encounter has no id for their visit
+func queryBlockedConditions(ctx context.Context, db *sql.DB, f PendingFilter) ([]blockedCondition, error) {
+	where, args := conditionRangeSQL(f)
+	query := `
+		SELECT DISTINCT reg_periksa.no_rawat, pasien.nm_pasien, diagnosa_pasien.kd_penyakit, penyakit.nm_penyakit
+		FROM reg_periksa
+		INNER JOIN pasien ON reg_periksa.no_rkm_medis = pasien.no_rkm_medis
+		INNER JOIN diagnosa_pasien ON diagnosa_pasien.no_rawat = reg_periksa.no_rawat
+		INNER JOIN penyakit ON penyakit.kd_penyakit = diagnosa_pasien.kd_penyakit
+		LEFT JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
+		WHERE ` + where + `
+			AND IFNULL(satu_sehat_encounter.id_encounter,'') = ''
+		ORDER BY reg_periksa.no_rawat, diagnosa_pasien.kd_penyakit`
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query blocked conditions: %w", err)
+	}
+	defer rows.Close()
+
+	results := []blockedCondition{}
+	for rows.Next() {
+		var r blockedCondition
+		if err := rows.Scan(&r.NoRawat, &r.NmPasien, &r.KdPenyakit, &r.NmPenyakit); err != nil {
+			logWarnf("⚠️ scan blocked condition row: %v", err)
+			continue
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// dedupeConditions keeps one row per (no_rawat, kd_penyakit). diagnosa_pasien
+// can hold the same code twice (e.g. once as Ralan and once as Ranap); if any
+// copy was already sent, that copy wins so the pair is reported as sent,
+// otherwise the Ranap copy wins so an inpatient visit keeps its stay context.
+func dedupeConditions(rows []ConditionRow) []ConditionRow {
+	index := make(map[string]int, len(rows))
+	var out []ConditionRow
+	for _, r := range rows {
+		key := idempKey(r.NoRawat, r.KdPenyakit)
+		if i, seen := index[key]; seen {
+			if out[i].IDCondition == "" && (r.IDCondition != "" || (r.DiagStatus == "Ranap" && out[i].DiagStatus != "Ranap")) {
+				out[i] = r
+			}
+			continue
+		}
+		index[key] = len(out)
+		out = append(out, r)
+	}
+	return out
+}
+
+// diagnosisIssue flags a visit whose prioritas doesn't yield exactly one primary
+type diagnosisIssue struct {
+	NoRawat   string `json:"no_rawat"`
+	Primaries int    `json:"primaries"`
+	Chosen    string `json:"chosen_primary"`
+	Issue     string `json:"issue"`
+}
+
+// rankDiagnoses ranks each visit's diagnoses by prioritas and marks exactly
+// one as primary. Visits with no prioritas=1 (lowest prioritas wins) or with
+// several (first one wins) are returned as issues.
+func rankDiagnoses(rows []ConditionRow) []diagnosisIssue {
+	byVisit := map[string][]int{}
+	var order []string
+	for i, r := range rows {
+		if _, ok := byVisit[r.NoRawat]; !ok {
+			order = append(order, r.NoRawat)
+		}
+		byVisit[r.NoRawat] = append(byVisit[r.NoRawat], i)
+	}
+
+	var issues []diagnosisIssue
+	for _, noRawat := range order {
+		idx := byVisit[noRawat]
+		sort.SliceStable(idx, func(x, y int) bool { return rows[idx[x]].Prioritas < rows[idx[y]].Prioritas })
+		primaries := 0
+		for rank, i := range idx {
+			rows[i].Rank = rank + 1
+			rows[i].Primary = rank == 0
+			if rows[i].Prioritas == 1 {
+				primaries++
+			}
+		}
+		chosen := rows[idx[0]].KdPenyakit
+		switch {
+		case primaries == 0:
+			issues = append(issues, diagnosisIssue{NoRawat: noRawat, Primaries: 0, Chosen: chosen, Issue: "no primary diagnosis (prioritas=1)"})
+		case primaries > 1:
+			issues = append(issues, diagnosisIssue{NoRawat: noRawat, Primaries: primaries, Chosen: chosen, Issue: "multiple primary diagnoses"})
+		}
+	}
+	return issues
+}
+
+// diagnosisJSON is one Encounter.diagnosis entry for a sent Condition (see
+// linkEncounterDiagnoses). The diagnosis role, DD for the discharge diagnoses
+// of a Ranap stay, belongs here as use, not in Condition.category.
+func diagnosisJSON(row ConditionRow, conditionID string) map[string]interface{} {
 	return map[string]interface{}{
+		"condition": map[string]interface{}{"reference": "Condition/" + conditionID, "display": row.NmPenyakit},
+		"use": map[string]interface{}{
+			"coding": []interface{}{
+				map[string]interface{}{"system": "http://terminology.hl7.org/CodeSystem/diagnosis-role", "code": "DD", "display": "Discharge diagnosis"},
+			},
+		},
+		"rank": row.Rank,
+	}
+}
+
+func buildConditionJSON(row ConditionRow, patientID, encounterID string) map[string]interface{} {
+	clinicalCode, clinicalDisplay := conditionClinicalStatus(row.StatusSrc)
+	cond := map[string]interface{}{
 		"resourceType": "Condition",
 		"clinicalStatus": map[string]interface{}{
 			"coding": []interface{}{
 				map[string]interface{}{
-					"system": "http://terminology.hl7.org/CodeSystem/condition-clinical",
-					"code":   "active",
+					"system":  "http://terminology.hl7.org/CodeSystem/condition-clinical",
+					"code":    clinicalCode,
+					"display": clinicalDisplay,
+				},
+			},
+		},
+		"verificationStatus": map[string]interface{}{
+			"coding": []interface{}{
+				map[string]interface{}{
+					"system":  "http://terminology.hl7.org/CodeSystem/condition-ver-status",
+					"code":    "confirmed",
+					"display": "Confirmed",
 				},
 			},
 		},
@@ -107,6 +339,13 @@ func buildConditionJSON(row ConditionRow, patientID, encounterID string) map[str
 			"reference": "Encounter/" + encounterID,
 		},
 	}
+	if row.Onset != "" {
+		cond["onsetDateTime"] = strings.ReplaceAll(row.Onset, " ", "T") + "+07:00"
+	}
+	if row.Discharge != "" {
+		cond["recordedDate"] = strings.ReplaceAll(row.Discharge, " ", "T") + "+07:00"
+	}
+	return withMetaProfile(cond)
 }
 
 // ============================================================
@@ -114,15 +353,9 @@ func buildConditionJSON(row ConditionRow, patientID, encounterID string) map[str
 // ============================================================
 
 func (a *App) handlePendingConditions(w http.ResponseWriter, r *http.Request) {
-	tgl1 := r.URL.Query().Get("tgl1")
-	tgl2 := r.URL.Query().Get("tgl2")
-	if tgl1 == "" || tgl2 == "" {
-		today := time.Now().Format("2006-01-02")
-		tgl1 = today
-		tgl2 = today
-	}
+	f := a.pendingFilterFromQuery(r)
 
-	rows, err := queryPendingConditions(a.db, tgl1, tgl2)
+	rows, err := queryPendingConditions(r.Context(), a.db, f)
 	if err != nil {
 		jsonError(w, err.Error(), 500)
 		return
@@ -135,87 +368,217 @@ func (a *App) handlePendingConditions(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	jsonResponse(w, map[string]interface{}{
-		"tgl1":          tgl1,
-		"tgl2":          tgl2,
-		"total":         len(rows),
-		"pending_count": len(pending),
-		"pending":       pending,
-	})
-}
-
-func (a *App) handleSendConditions(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Tgl1 string `json:"tgl1"`
-		Tgl2 string `json:"tgl2"`
+	resp := map[string]interface{}{
+		"tgl1":              f.Tgl1,
+		"tgl2":              f.Tgl2,
+		"total":             len(rows),
+		"pending_count":     len(pending),
+		"pending":           pending,
+		"primary_diagnosis": rankDiagnoses(rows),
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "invalid request body", 400)
+	blocked, err := queryBlockedConditions(r.Context(), a.db, f)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
 		return
 	}
-	if req.Tgl1 == "" || req.Tgl2 == "" {
-		jsonError(w, "tgl1 and tgl2 required", 400)
-		return
+	resp["blocked_count"] = len(blocked)
+	if r.URL.Query().Get("blocked") == "true" {
+		resp["blocked"] = blocked
+	}
+	if a.requiresVerification("Condition") {
+		keys := make([]string, len(pending))
+		for i, p := range pending {
+			keys[i] = p.jobKey()
+		}
+		verified := a.verifiedKeys("Condition", keys)
+		for i := range pending {
+			pending[i].Verified = verified[pending[i].jobKey()]
+		}
+		resp["unverified_count"] = len(pending) - len(verified)
 	}
+	writePending(w, r, resp)
+}
 
-	rows, err := queryPendingConditions(a.db, req.Tgl1, req.Tgl2)
-	if err != nil {
-		jsonError(w, err.Error(), 500)
+func (a *App) handleSendConditions(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.decodeSendRequest(w, r)
+	if !ok {
 		return
 	}
+	res, done, err := a.batch(r.Context()).sendConditions(f)
+	writeBatch(w, res, done, err, "results", nil)
+}
 
-	var results []map[string]interface{}
-	sentCount := 0
-	failCount := 0
+// sendConditions sends every pending condition in f, then links the sent
+// Conditions of each touched visit into its Encounter.diagnosis
+func (a *App) sendConditions(f PendingFilter) (*batchResult, int, error) {
+	res := a.newBatchResult()
+	var all []ConditionRow
+	sent := map[string]string{} // jobKey -> new id_condition
+	touched := map[string]bool{}
 
-	for _, row := range rows {
+	done, err := eachChunk(a.ctx, f, a.cfg.ChunkDays, func(cf PendingFilter) ([]ConditionRow, error) {
+		rows, err := queryPendingConditions(a.ctx, a.db, cf)
+		for _, issue := range rankDiagnoses(rows) {
+			logWarnf("⚠️ condition %s: %s, using %s as primary", issue.NoRawat, issue.Issue, issue.Chosen)
+		}
+		all = append(all, rows...)
+		return rows, err
+	}, func(row ConditionRow) {
 		if row.IDCondition != "" {
-			continue // already sent
+			return // already sent
+		}
+		if a.requiresVerification("Condition") && !a.isVerified("Condition", row.jobKey()) {
+			res.add(map[string]interface{}{
+				"no_rawat": row.NoRawat, "kd_penyakit": row.KdPenyakit, "status": "skipped", "reason": "awaiting verification",
+			})
+			return
+		}
+
+		if a.enqueueRow("Condition", row.jobKey(), row.NoRawat) {
+			return
 		}
 
 		// Lookup patient
-		patientID, err := a.ss.LookupPatient(row.NoKTPPasien)
+		patientID, err := a.lookupPatient(row.NoKTPPasien)
 		if err != nil {
-			results = append(results, map[string]interface{}{
+			st := a.lookupStatus(err)
+			res.add(map[string]interface{}{
 				"no_rawat":    row.NoRawat,
 				"kd_penyakit": row.KdPenyakit,
-				"status":      "failed",
+				"status":      st,
 				"error":       err.Error(),
 			})
-			failCount++
-			continue
+			return
 		}
 
 		// Build and send condition via job
-		condJSON := buildConditionJSON(row, patientID, row.IDEncounter)
-		fhirID, err := a.sendViaJob("Condition", idempKey(row.NoRawat, row.KdPenyakit), condJSON, a.ss.SendCondition)
+		if row.OriginRawat != "" && row.OriginRawat != row.NoRawat && row.OriginEnc == "" {
+			logWarnf("⚠️ condition %s/%s: origin visit %s has no Encounter yet, using this visit's",
+				row.NoRawat, row.KdPenyakit, row.OriginRawat)
+		}
+		condJSON := buildConditionJSON(row, patientID, row.encounterID())
+		fhirID, err := a.sendViaJob("Condition", row.jobKey(), condJSON, a.ss.SendCondition)
 		if err != nil {
-			results = append(results, map[string]interface{}{
+			res.add(res.withResponse(map[string]interface{}{
 				"no_rawat": row.NoRawat, "kd_penyakit": row.KdPenyakit, "status": "failed", "error": err.Error(),
-			})
-			failCount++
-			continue
+			}, err))
+			return
 		}
 		if fhirID == "" {
-			continue
+			return
 		}
 
 		_, err = a.db.Exec("INSERT INTO satu_sehat_condition (no_rawat, kd_penyakit, id_condition) VALUES (?, ?, ?)",
 			row.NoRawat, row.KdPenyakit, fhirID)
 		if err != nil {
-			log.Printf("⚠️ save condition to DB failed: %v", err)
+			logErrorf("❌ save condition to DB failed: %v", err)
 		}
 		a.saveSendLog(row.NoRawat, "Condition", fhirID, "success", "")
+		sent[row.jobKey()] = fhirID
+		touched[row.NoRawat] = true
 
-		results = append(results, map[string]interface{}{
+		res.add(map[string]interface{}{
 			"no_rawat": row.NoRawat, "kd_penyakit": row.KdPenyakit, "status": "success", "id_condition": fhirID,
+			"rank": row.Rank, "primary": row.Primary,
 		})
-		sentCount++
+	})
+
+	for _, visit := range sentByVisit(all, sent) {
+		if !touched[visit[0].NoRawat] {
+			continue
+		}
+		if lerr := a.linkEncounterDiagnoses(visit); lerr != nil {
+			logWarnf("⚠️ encounter diagnosis %s: %v", visit[0].NoRawat, lerr)
+		}
+	}
+	return res, done, err
+}
+
+// ============================================================
+// ENCOUNTER DIAGNOSIS
+// ============================================================
+
+// sentByVisit groups the rows that have a Condition on SatuSehat (already
+// tracked, or newly sent as recorded in sent) by no_rawat, in row order. A
+// row repeated across chunk windows (a Ranap diagnosis overlaps each window
+// of its stay) is kept once. Rows whose Condition references an origin
+// visit's Encounter are left out: they do not belong in this visit's
+// Encounter.diagnosis.
+func sentByVisit(rows []ConditionRow, sent map[string]string) [][]ConditionRow {
+	index := map[string]int{}
+	kept := map[string]bool{}
+	var visits [][]ConditionRow
+	for _, r := range rows {
+		if id, ok := sent[r.jobKey()]; ok {
+			r.IDCondition = id
+		}
+		if r.IDCondition == "" || kept[r.jobKey()] || r.encounterID() != r.IDEncounter {
+			continue
+		}
+		kept[r.jobKey()] = true
+		i, seen := index[r.NoRawat]
+		if !seen {
+			i = len(visits)
+			index[r.NoRawat] = i
+			visits = append(visits, nil)
+		}
+		visits[i] = append(visits[i], r)
+	}
+	return visits
+}
+
+// linkEncounterDiagnoses PUTs the visit's Encounter with diagnosis[] built from
+// its sent Conditions, ranked by prioritas (rank 1 = primary). rows come from
+// sentByVisit, so every Condition references that Encounter.
+func (a *App) linkEncounterDiagnoses(rows []ConditionRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].Rank < rows[j].Rank })
+	var diagnosis []interface{}
+	for i, r := range rows {
+		r.Rank = i + 1
+		diagnosis = append(diagnosis, diagnosisJSON(r, r.IDCondition))
 	}
 
-	jsonResponse(w, map[string]interface{}{
-		"sent":    sentCount,
-		"failed":  failCount,
-		"results": results,
+	encounterID := rows[0].IDEncounter
+	enc, err := a.ss.GetEncounter(encounterID)
+	if err != nil {
+		return err
+	}
+	enc["diagnosis"] = diagnosis
+	if err := a.ss.UpdateEncounter(encounterID, enc); err != nil {
+		return err
+	}
+	logInfof("🔗 Encounter %s (%s): %d diagnosis linked", encounterID, rows[0].NoRawat, len(diagnosis))
+	return nil
+}
+
+// handleLinkEncounterDiagnoses (re)links diagnosis[] for every visit in the
+// window that has sent Conditions, e.g. for conditions sent before this existed
+func (a *App) handleLinkEncounterDiagnoses(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.decodeSendRequest(w, r)
+	if !ok {
+		return
+	}
+	a = a.batch(r.Context())
+	res := a.newBatchResult()
+	linked := map[string]bool{} // a Ranap stay reappears in each window it overlaps
+	done, err := eachChunk(a.ctx, f, a.cfg.ChunkDays, func(cf PendingFilter) ([][]ConditionRow, error) {
+		rows, err := queryPendingConditions(a.ctx, a.db, cf)
+		return sentByVisit(rows, nil), err
+	}, func(visit []ConditionRow) {
+		if linked[visit[0].NoRawat] {
+			return
+		}
+		linked[visit[0].NoRawat] = true
+		detail := map[string]interface{}{
+			"no_rawat": visit[0].NoRawat, "id_encounter": visit[0].IDEncounter, "diagnosis": len(visit), "status": "success",
+		}
+		if err := a.linkEncounterDiagnoses(visit); err != nil {
+			detail["status"], detail["error"] = "failed", err.Error()
+		}
+		res.add(detail)
 	})
+	writeBatch(w, res, done, err, "details", nil)
 }
@@ -50,6 +50,11 @@ body{font-family:'Inter',sans-serif;background:var(--bg);color:var(--text);min-h
   outline:none;transition:border .2s;
 }
 .controls input[type=date]:focus{border-color:var(--accent)}
+.jobs-filter{
+  background:var(--card);border:1px solid var(--border);color:var(--text);
+  padding:4px 8px;border-radius:var(--radius-sm);font-family:inherit;font-size:12px;outline:none;
+}
+.jobs-pager{display:flex;align-items:center;justify-content:flex-end;gap:8px;margin-top:8px;font-size:12px;color:var(--text-muted)}
 .btn{
   padding:8px 16px;border-radius:var(--radius-sm);border:none;cursor:pointer;
   font-family:inherit;font-size:13px;font-weight:600;transition:all .2s;
@@ -124,6 +129,7 @@ tr:hover td{background:rgba(99,102,241,.04)}
   animation:slideIn .3s ease;box-shadow:0 4px 16px rgba(0,0,0,.4);max-width:360px}
 .toast-success{background:rgba(34,197,94,.9);color:#fff}
 .toast-error{background:rgba(239,68,68,.9);color:#fff}
+.toast-warning{background:rgba(245,158,11,.9);color:#fff}
 @keyframes slideIn{from{transform:translateX(100%);opacity:0}to{transform:translateX(0);opacity:1}}
 /* Responsive */
 @media(max-width:768px){
@@ -147,6 +153,7 @@ tr:hover td{background:rgba(99,102,241,.04)}
   <label>Sampai</label>
   <input type="date" id="tgl2">
   <button class="btn btn-primary" onclick="checkAll()">🔍 Check Semua</button>
+  <button class="btn btn-success" id="sendAllBtn" onclick="sendAll()">🚀 Kirim Semua</button>
   <button class="btn btn-outline" onclick="refreshHealth()">🔄 Refresh Status</button>
 </div>
 
@@ -164,7 +171,13 @@ tr:hover td{background:rgba(99,102,241,.04)}
 
 <div class="log-section">
   <h2>📦 Integration Jobs
-    <button class="btn btn-outline btn-sm" onclick="loadJobs()" style="margin-left:auto">Refresh</button>
+    <input class="jobs-filter" id="jobsResource" placeholder="Resource (mis. Condition)" onchange="loadJobs(1)" style="margin-left:auto">
+    <input class="jobs-filter" id="jobsKey" placeholder="Key (no_rawat)" onchange="loadJobs(1)">
+    <select class="jobs-filter" id="jobsStatus" onchange="loadJobs(1)">
+      <option value="">Semua status</option><option value="failed">failed</option>
+      <option value="pending">pending</option><option value="success">success</option>
+    </select>
+    <button class="btn btn-outline btn-sm" onclick="loadJobs()">Refresh</button>
     <button class="btn btn-danger btn-sm" id="retryBtn" onclick="retryFailed()">🔄 Retry Failed</button>
   </h2>
   <div class="card-stats" style="margin-bottom:16px">
@@ -178,53 +191,45 @@ tr:hover td{background:rgba(99,102,241,.04)}
       <tbody id="jobsBody"><tr><td colspan="7" style="text-align:center;color:var(--text-dim);padding:24px">Klik refresh untuk memuat jobs</td></tr></tbody>
     </table>
   </div>
+  <div class="jobs-pager">
+    <button class="btn btn-outline btn-sm" id="jobsPrev" onclick="loadJobs(jobsPage-1)" disabled>‹</button>
+    <span id="jobsPageInfo">—</span>
+    <button class="btn btn-outline btn-sm" id="jobsNext" onclick="loadJobs(jobsPage+1)" disabled>›</button>
+  </div>
 </div>
 
 <div class="toast-container" id="toasts"></div>
 
 <script>
-const resources = [
-  {key:'encounter', label:'Encounter Ralan', emoji:'🏨', pending:'/api/encounters/pending', send:'/api/encounters/send'},
-  {key:'encounter-ranap', label:'Encounter Ranap', emoji:'🛏️', pending:'/api/encounters-ranap/pending', send:'/api/encounters-ranap/send'},
-  {key:'condition', label:'Condition (ICD-10)', emoji:'🩺', pending:'/api/conditions/pending', send:'/api/conditions/send'},
-  {key:'ttv-suhu', label:'TTV Suhu', emoji:'🌡️', pending:'/api/observations-ttv/suhu/pending', send:'/api/observations-ttv/suhu/send'},
-  {key:'ttv-nadi', label:'TTV Nadi', emoji:'💓', pending:'/api/observations-ttv/nadi/pending', send:'/api/observations-ttv/nadi/send'},
-  {key:'ttv-tensi', label:'TTV Tensi', emoji:'🩸', pending:'/api/observations-ttv/tensi/pending', send:'/api/observations-ttv/tensi/send'},
-  {key:'ttv-respirasi', label:'TTV Respirasi', emoji:'🫁', pending:'/api/observations-ttv/respirasi/pending', send:'/api/observations-ttv/respirasi/send'},
-  {key:'ttv-spo2', label:'TTV SpO2', emoji:'🫀', pending:'/api/observations-ttv/spo2/pending', send:'/api/observations-ttv/spo2/send'},
-  {key:'ttv-gcs', label:'TTV GCS', emoji:'🧠', pending:'/api/observations-ttv/gcs/pending', send:'/api/observations-ttv/gcs/send'},
-  {key:'ttv-tb', label:'TTV Tinggi Badan', emoji:'📏', pending:'/api/observations-ttv/tb/pending', send:'/api/observations-ttv/tb/send'},
-  {key:'ttv-bb', label:'TTV Berat Badan', emoji:'⚖️', pending:'/api/observations-ttv/bb/pending', send:'/api/observations-ttv/bb/send'},
-  {key:'ttv-lp', label:'TTV Lingkar Perut', emoji:'📐', pending:'/api/observations-ttv/lp/pending', send:'/api/observations-ttv/lp/send'},
-  {key:'lab', label:'Observation Lab', emoji:'🔬', pending:'/api/observations-lab/pending', send:'/api/observations-lab/send'},
-  {key:'rad', label:'Observation Radiologi', emoji:'☢️', pending:'/api/observations-rad/pending', send:'/api/observations-rad/send'},
-  {key:'procedure', label:'Procedure (ICD-9)', emoji:'🔧', pending:'/api/procedures/pending', send:'/api/procedures/send'},
-  {key:'medreq', label:'Medication Request', emoji:'💊', pending:'/api/medication-requests/pending', send:'/api/medication-requests/send'},
-  {key:'meddisp', label:'Medication Dispense', emoji:'💉', pending:'/api/medication-dispenses/pending', send:'/api/medication-dispenses/send'},
-];
+let resources = [];
 
 // Set default dates to today
 const today = new Date().toISOString().slice(0,10);
 document.getElementById('tgl1').value = today;
 document.getElementById('tgl2').value = today;
 
-// Build resource cards
-const grid = document.getElementById('resourceGrid');
-resources.forEach(res => {
-  grid.innerHTML += '<div class="card" id="card-'+res.key+'">'
-    +'<div class="card-title"><span class="emoji">'+res.emoji+'</span>'+res.label+'</div>'
-    +'<div class="card-stats">'
-    +'<div class="stat"><div class="stat-value pending" id="'+res.key+'-pending">—</div><div class="stat-label">Pending</div></div>'
-    +'<div class="stat"><div class="stat-value sent" id="'+res.key+'-sent">—</div><div class="stat-label">Sent</div></div>'
-    +'<div class="stat"><div class="stat-value total" id="'+res.key+'-total">—</div><div class="stat-label">Total</div></div>'
-    +'</div>'
-    +'<div class="card-actions">'
-    +'<button class="btn btn-outline btn-sm" onclick="checkResource(\''+res.key+'\')">🔍 Check</button>'
-    +'<button class="btn btn-success btn-sm" id="send-'+res.key+'" onclick="sendResource(\''+res.key+'\')">🚀 Send</button>'
-    +'</div>'
-    +'<div class="card-status" id="status-'+res.key+'"></div>'
-    +'</div>';
-});
+// Build resource cards from the flows enabled by SS_ENABLED_RESOURCES
+async function loadResources(){
+  const d = await (await fetch('/api/resources')).json();
+  resources = (d.resources||[]).filter(r=>r.enabled);
+  const grid = document.getElementById('resourceGrid');
+  grid.innerHTML = '';
+  resources.forEach(res => {
+    grid.innerHTML += '<div class="card" id="card-'+res.key+'">'
+      +'<div class="card-title"><span class="emoji">'+res.emoji+'</span>'+res.label+'</div>'
+      +'<div class="card-stats">'
+      +'<div class="stat"><div class="stat-value pending" id="'+res.key+'-pending">—</div><div class="stat-label">Pending</div></div>'
+      +'<div class="stat"><div class="stat-value sent" id="'+res.key+'-sent">—</div><div class="stat-label">Sent</div></div>'
+      +'<div class="stat"><div class="stat-value total" id="'+res.key+'-total">—</div><div class="stat-label">Total</div></div>'
+      +'</div>'
+      +'<div class="card-actions">'
+      +'<button class="btn btn-outline btn-sm" onclick="checkResource(\''+res.key+'\')">🔍 Check</button>'
+      +'<button class="btn btn-success btn-sm" id="send-'+res.key+'" onclick="sendResource(\''+res.key+'\')">🚀 Send</button>'
+      +'</div>'
+      +'<div class="card-status" id="status-'+res.key+'"></div>'
+      +'</div>';
+  });
+}
 
 function getDates(){
   return {tgl1: document.getElementById('tgl1').value, tgl2: document.getElementById('tgl2').value};
@@ -234,6 +239,7 @@ function findRes(key){ return resources.find(r=>r.key===key); }
 
 function setCardStatus(key, msg, isError){
   const el = document.getElementById('status-'+key);
+  if(!el) return;
   el.textContent = msg;
   el.classList.add('visible');
   el.classList.toggle('error', !!isError);
@@ -269,17 +275,30 @@ async function checkResource(key){
   const {tgl1,tgl2} = getDates();
   setCardStatus(key, 'Checking...');
   try{
-    const r = await fetch(res.pending+'?tgl1='+tgl1+'&tgl2='+tgl2);
+    const r = await fetch(res.pending+'?tgl1='+tgl1+'&tgl2='+tgl2+'&count_only=true');
     const d = await r.json();
     document.getElementById(key+'-pending').textContent = d.pending_count ?? d.pending?.length ?? 0;
     document.getElementById(key+'-sent').textContent = d.sent_count ?? 0;
     document.getElementById(key+'-total').textContent = d.total ?? 0;
-    setCardStatus(key, 'Checked: '+tgl1+' → '+tgl2);
+    const blocked = d.blocked_count ? ' · ⛔ '+d.blocked_count+' blocked (send encounter first)' : '';
+    setCardStatus(key, 'Checked: '+tgl1+' → '+tgl2+blocked);
   }catch(e){
     setCardStatus(key, 'Error: '+e.message, true);
   }
 }
 
+// waitBatch waits for the rows a send queued (SS_ASYNC_SEND) to be sent by
+// the worker and adds their outcome to the send response d
+async function waitBatch(key, d){
+  while((d.queued??0)>0){
+    await new Promise(ok=>setTimeout(ok, 2000));
+    const b = (await (await fetch('/api/jobs?batch_id='+d.batch_id+'&limit=1')).json()).batch||{};
+    if(b.status==='done') return {...d, sent:(d.sent??0)+(b.success??0), failed:(d.failed??0)+(b.failed??0)};
+    setCardStatus(key, 'Queued... ⏳ '+(b.pending??0)+' | ✅ '+(b.success??0)+' | ❌ '+(b.failed??0));
+  }
+  return d;
+}
+
 async function sendResource(key){
   const res = findRes(key);
   const {tgl1,tgl2} = getDates();
@@ -288,14 +307,23 @@ async function sendResource(key){
   btn.innerHTML = '<span class="spinner"></span> Sending...';
   setCardStatus(key, 'Sending...');
   try{
-    const r = await fetch(res.send,{
-      method:'POST',headers:{'Content-Type':'application/json'},
-      body:JSON.stringify({tgl1,tgl2})
-    });
-    const d = await r.json();
-    const sent = d.sent??0, failed = d.failed??0;
-    setCardStatus(key, '✅ Sent: '+sent+' | ❌ Failed: '+failed);
-    toast(res.label+': '+sent+' sent, '+failed+' failed', sent>0?'success':'error');
+    // each request sends at most SS_MAX_BATCH rows; repeat while rows remain
+    let sent = 0, failed = 0, skipped = 0;
+    for(;;){
+      const r = await fetch(res.send,{
+        method:'POST',headers:{'Content-Type':'application/json'},
+        body:JSON.stringify({tgl1,tgl2})
+      });
+      let d = await r.json();
+      if(!r.ok) throw new Error(d.error||('HTTP '+r.status));
+      d = await waitBatch(key, d);
+      sent += d.sent??0; failed += d.failed??0; skipped += d.skipped??0;
+      if(!d.remaining || (d.sent??0)+(d.failed??0)===0) break;
+      setCardStatus(key, 'Sending... ✅ '+sent+' | ❌ '+failed+' | ⏳ '+d.remaining+' left to check');
+    }
+    setCardStatus(key, '✅ Sent: '+sent+' | ❌ Failed: '+failed+' | ⏭️ Skipped: '+skipped);
+    toast(res.label+': '+sent+' sent, '+failed+' failed, '+skipped+' skipped',
+      failed>0?'error':skipped>0?'warning':'success');
     checkResource(key);
     loadLogs();
   }catch(e){
@@ -311,6 +339,41 @@ function checkAll(){
   resources.forEach(r=>checkResource(r.key));
 }
 
+// sendAll sends every enabled resource of the range in dependency order
+async function sendAll(){
+  const {tgl1,tgl2} = getDates();
+  if(!confirm('Kirim semua resource '+tgl1+' → '+tgl2+'?')) return;
+  const btn = document.getElementById('sendAllBtn');
+  btn.disabled = true;
+  btn.innerHTML = '<span class="spinner"></span> Sending...';
+  try{
+    let sent = 0, failed = 0, skipped = 0;
+    for(;;){
+      const r = await fetch('/api/send-all',{
+        method:'POST',headers:{'Content-Type':'application/json'},
+        body:JSON.stringify({tgl1,tgl2})
+      });
+      let d = await r.json();
+      if(!r.ok) throw new Error(d.error||('HTTP '+r.status));
+      d = await waitBatch('all', d);
+      sent += d.sent??0; failed += d.failed??0; skipped += d.skipped??0;
+      (d.resources||[]).forEach(x=>{
+        if(findRes(x.resource)) setCardStatus(x.resource, '✅ Sent: '+(x.sent??0)+' | ❌ Failed: '+(x.failed??0)+' | ⏭️ Skipped: '+(x.skipped??0), !!x.error);
+      });
+      if(!d.remaining || (d.sent??0)+(d.failed??0)===0) break;
+    }
+    toast('Kirim semua: '+sent+' sent, '+failed+' failed, '+skipped+' skipped',
+      failed>0?'error':skipped>0?'warning':'success');
+    checkAll();
+    loadLogs();
+  }catch(e){
+    toast('Kirim semua: '+e.message, 'error');
+  }finally{
+    btn.disabled = false;
+    btn.innerHTML = '🚀 Kirim Semua';
+  }
+}
+
 async function loadLogs(){
   try{
     const {tgl1,tgl2} = getDates();
@@ -336,13 +399,27 @@ async function loadLogs(){
 }
 
 // Init
+loadResources();
 refreshHealth();
 
-async function loadJobs(){
+const jobsPerPage = 100;
+let jobsPage = 1;
+
+async function loadJobs(page){
+  if(page) jobsPage = page;
   try{
     const {tgl1,tgl2} = getDates();
-    const r = await fetch('/api/jobs?tgl1='+tgl1+'&tgl2='+tgl2+'&limit=100');
+    const q = new URLSearchParams({tgl1, tgl2, limit: jobsPerPage, page: jobsPage});
+    for(const [param,id] of [['resource_type','jobsResource'],['idempotency_key','jobsKey'],['status','jobsStatus']]){
+      const v = document.getElementById(id).value.trim();
+      if(v) q.set(param, v);
+    }
+    const r = await fetch('/api/jobs?'+q);
     const d = await r.json();
+    const pages = Math.max(1, Math.ceil((d.matched??0)/jobsPerPage));
+    document.getElementById('jobsPageInfo').textContent = 'Hal. '+jobsPage+' / '+pages+' ('+(d.matched??0)+' jobs)';
+    document.getElementById('jobsPrev').disabled = jobsPage<=1;
+    document.getElementById('jobsNext').disabled = jobsPage>=pages;
     document.getElementById('jobs-pending').textContent = d.pending??0;
     document.getElementById('jobs-success').textContent = d.success??0;
     document.getElementById('jobs-failed').textContent = d.failed??0;
@@ -355,7 +432,7 @@ async function loadJobs(){
       const badgeClass = j.status==='success'?'badge-success':j.status==='failed'?'badge-failed':'badge-skipped';
       const fhirShort = j.fhir_id ? j.fhir_id.substring(0,12)+'...' : '—';
       const errShort = j.error_message ? j.error_message.substring(0,40) : '—';
-      return '<tr><td>'+j.id+'</td><td>'+j.resource_type+'</td>'
+      return '<tr><td><a href="/api/jobs/'+j.id+'" target="_blank">'+j.id+'</a></td><td>'+j.resource_type+'</td>'
         +'<td style="font-family:monospace;font-size:11px">'+j.idempotency_key.substring(0,30)+'</td>'
         +'<td><span class="badge '+badgeClass+'">'+j.status+'</span></td>'
         +'<td style="font-family:monospace;font-size:11px;color:var(--text-dim)">'+fhirShort+'</td>'
@@ -377,7 +454,8 @@ async function retryFailed(){
       body:JSON.stringify({status:'failed'})
     });
     const d = await r.json();
-    toast('Retry: '+d.succeeded+' succeeded, '+d.still_failed+' still failed', d.succeeded>0?'success':'error');
+    toast('Retry: '+d.succeeded+' succeeded, '+d.still_failed+' still failed, '+(d.skipped??0)+' skipped',
+      d.still_failed>0?'error':d.succeeded>0?'success':'warning');
     loadJobs();
     loadLogs();
   }catch(e){
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+)
+
+// ============================================================
+// DEVICE (optional Observation.device reference)
+// ============================================================
+
+// satu_sehat_mapping_device maps a scope + ref to a SatuSehat Device. For scope
+// 'lab' ref is kd_jenis_prw, for 'ttv' it is the TTV type name; ref '*' is the
+// fallback for the whole scope.
+const createDeviceTableSQL = `CREATE TABLE IF NOT EXISTS satu_sehat_mapping_device (
+	scope         VARCHAR(10)  NOT NULL,
+	ref           VARCHAR(50)  NOT NULL DEFAULT '*',
+	device_name   VARCHAR(200) NOT NULL,
+	serial_number VARCHAR(100) DEFAULT '',
+	id_device     VARCHAR(100) DEFAULT '',
+	PRIMARY KEY (scope, ref)
+)`
+
+type DeviceRow struct {
+	Scope        string
+	Ref          string
+	DeviceName   string
+	SerialNumber string
+	IDDevice     string
+}
+
+func initDeviceTable(db *sql.DB) {
+	if _, err := db.Exec(createDeviceTableSQL); err != nil {
+		logErrorf("❌ create satu_sehat_mapping_device table: %v", err)
+	}
+}
+
+func queryDevices(db *sql.DB) ([]DeviceRow, error) {
+	rows, err := db.Query(`SELECT scope, ref, device_name, IFNULL(serial_number,''), IFNULL(id_device,'')
+		FROM satu_sehat_mapping_device ORDER BY scope, ref`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []DeviceRow
+	for rows.Next() {
+		var r DeviceRow
+		if err := rows.Scan(&r.Scope, &r.Ref, &r.DeviceName, &r.SerialNumber, &r.IDDevice); err != nil {
+			logWarnf("⚠️ scan device: %v", err)
+			continue
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// deviceMap holds synced Device IDs keyed by scope|ref
+type deviceMap map[string]string
+
+// loadDeviceMap loads synced devices once per batch; an empty map disables device references
+func loadDeviceMap(db *sql.DB) deviceMap {
+	m := deviceMap{}
+	rows, err := queryDevices(db)
+	if err != nil {
+		return m
+	}
+	for _, r := range rows {
+		if r.IDDevice != "" {
+			m[idempKey(r.Scope, r.Ref)] = r.IDDevice
+		}
+	}
+	return m
+}
+
+// attach sets obs.device for scope/ref, falling back to the scope's '*' entry
+func (m deviceMap) attach(obs map[string]interface{}, scope, ref string) {
+	id, ok := m[idempKey(scope, ref)]
+	if !ok {
+		id, ok = m[idempKey(scope, "*")]
+	}
+	if ok {
+		obs["device"] = map[string]interface{}{"reference": "Device/" + id}
+	}
+}
+
+func buildDeviceJSON(row DeviceRow, orgID string) map[string]interface{} {
+	value := row.SerialNumber
+	if value == "" {
+		value = row.Scope + "-" + row.Ref
+	}
+	dev := map[string]interface{}{
+		"resourceType": "Device",
+		"identifier": []interface{}{
+			map[string]interface{}{"system": sysID("device", orgID), "value": value},
+		},
+		"status":     "active",
+		"deviceName": []interface{}{map[string]interface{}{"name": row.DeviceName, "type": "user-friendly-name"}},
+		"owner":      map[string]interface{}{"reference": "Organization/" + orgID},
+	}
+	if row.SerialNumber != "" {
+		dev["serialNumber"] = row.SerialNumber
+	}
+	return withMetaProfile(dev)
+}
+
+// ============================================================
+// DEVICE HANDLERS
+// ============================================================
+
+func (a *App) handleListDevices(w http.ResponseWriter, r *http.Request) {
+	rows, err := queryDevices(a.db)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{"total": len(rows), "devices": rows})
+}
+
+// handleSyncDevices creates a SatuSehat Device for every mapping row without id_device
+func (a *App) handleSyncDevices(w http.ResponseWriter, r *http.Request) {
+	rows, err := queryDevices(a.db)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	a = a.batch(r.Context())
+	res := a.newBatchResult()
+	for _, row := range rows {
+		if row.IDDevice != "" {
+			continue
+		}
+		fhirID, err := a.sendViaJob("Device", idempKey(row.Scope, row.Ref), buildDeviceJSON(row, a.cfg.SSOrgID), a.ss.SendDevice)
+		if err != nil {
+			res.add(res.withResponse(map[string]interface{}{"scope": row.Scope, "ref": row.Ref, "status": "failed", "error": err.Error()}, err))
+			continue
+		}
+		if fhirID == "" {
+			continue
+		}
+		if _, dbErr := a.db.Exec("UPDATE satu_sehat_mapping_device SET id_device=? WHERE scope=? AND ref=?",
+			fhirID, row.Scope, row.Ref); dbErr != nil {
+			logErrorf("❌ save device %s: %v", fhirID, dbErr)
+		}
+		res.add(map[string]interface{}{"scope": row.Scope, "ref": row.Ref, "status": "success", "fhir_id": fhirID})
+	}
+	jsonResponse(w, res.toJSON("details"))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ============================================================
+// DUPLICATE REJECTIONS (resource already in SatuSehat)
+// ============================================================
+
+// isDuplicateError reports whether SatuSehat rejected a POST because a
+// resource with the same identifier already exists: an OperationOutcome
+// issue with code "duplicate", or diagnostics saying so
+func isDuplicateError(err error) bool {
+	var re *responseError
+	if !errors.As(err, &re) {
+		return false
+	}
+	issues, _ := re.result["issue"].([]interface{})
+	for _, i := range issues {
+		issue, _ := i.(map[string]interface{})
+		if issue["code"] == "duplicate" {
+			return true
+		}
+		text, _ := issue["diagnostics"].(string)
+		if details, ok := issue["details"].(map[string]interface{}); ok {
+			detailText, _ := details["text"].(string)
+			text += " " + detailText
+		}
+		text = strings.ToLower(text)
+		if strings.Contains(text, "duplicate") || strings.Contains(text, "already exist") {
+			return true
+		}
+	}
+	return false
+}
+
+// payloadIdentifiers returns the system/value pairs of payload's identifier,
+// a list on most resources and a single object on Composition
+func payloadIdentifiers(payload map[string]interface{}) [][2]string {
+	var list []interface{}
+	switch v := payload["identifier"].(type) {
+	case []interface{}:
+		list = v
+	case map[string]interface{}:
+		list = []interface{}{v}
+	}
+	var pairs [][2]string
+	for _, item := range list {
+		ident, _ := item.(map[string]interface{})
+		system, _ := ident["system"].(string)
+		value, _ := ident["value"].(string)
+		if system != "" && value != "" {
+			pairs = append(pairs, [2]string{system, value})
+		}
+	}
+	return pairs
+}
+
+// adoptDuplicate resolves a duplicate rejection of payload (sendErr) to the
+// id of the resource already in SatuSehat, found by payload's identifiers.
+// It returns ok=false when sendErr is not a duplicate or the existing
+// resource is not exactly one match, leaving the job failed as before.
+func (a *App) adoptDuplicate(payload map[string]interface{}, sendErr error) (string, bool) {
+	if !isDuplicateError(sendErr) {
+		return "", false
+	}
+	rt, _ := payload["resourceType"].(string)
+	ids := map[string]bool{}
+	for _, ident := range payloadIdentifiers(payload) {
+		found, err := a.ss.FindByIdentifier(rt, ident[0], ident[1])
+		if err != nil {
+			logWarnf("⚠️ %s duplicate: search %s|%s: %v", rt, ident[0], ident[1], err)
+			return "", false
+		}
+		for _, id := range found {
+			ids[id] = true
+		}
+	}
+	if len(ids) != 1 {
+		logWarnf("⚠️ %s rejected as duplicate, but %s", rt, duplicateMatches(len(ids)))
+		return "", false
+	}
+	for id := range ids {
+		logInfof("🔗 %s already in SatuSehat, adopting %s", rt, id)
+		return id, true
+	}
+	return "", false
+}
+
+// duplicateMatches explains why a duplicate could not be adopted
+func duplicateMatches(n int) string {
+	if n == 0 {
+		return "no existing resource matches its identifier"
+	}
+	return fmt.Sprintf("%d existing resources match its identifier, resolve manually", n)
+}
@@ -1,12 +1,10 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
-	"time"
 )
 
 // ============================================================
@@ -28,11 +26,24 @@ type EncounterRow struct {
 	IDLokasiSS    string
 	SttsRawat     string
 	StatusLanjut  string
-	TglPulang     string
+	TglPulang     string // ralan: registration time; ranap: last kamar_inap discharge, "" while admitted
+	PoliAsal      string // reg_periksa.kd_poli the patient was admitted from
+	Dirujuk       bool   // the visit has a rujuk_masuk
+	SttsPulang    string // ranap: kamar_inap.stts_pulang of the last discharge
+	Keluhan       string // chief complaint of the first examination, "" if none
 	IDEncounter   string // empty if not yet sent
 }
 
-func queryPendingEncounters(db *sql.DB, tgl1, tgl2 string) ([]EncounterRow, error) {
+// encounterIGDPoli is the kd_poli of the emergency department (SS_IGD_POLI);
+// ranap stays admitted from it get admitSource emd
+var encounterIGDPoli = "IGDK"
+
+// jobKey is the idempotency key of this row's send job
+func (r EncounterRow) jobKey() string {
+	return idempKey(r.NoRawat)
+}
+
+func queryPendingEncounters(ctx context.Context, db *sql.DB, f PendingFilter) ([]EncounterRow, error) {
 	query := `
 		SELECT reg_periksa.tgl_registrasi, reg_periksa.jam_reg, reg_periksa.no_rawat,
 			pasien.nm_pasien, pasien.no_ktp, reg_periksa.no_rkm_medis,
@@ -41,6 +52,8 @@ func queryPendingEncounters(db *sql.DB, tgl1, tgl2 string) ([]EncounterRow, erro
 			satu_sehat_mapping_lokasi_ralan.id_lokasi_satusehat,
 			reg_periksa.stts, reg_periksa.status_lanjut,
 			CONCAT(reg_periksa.tgl_registrasi,'T',reg_periksa.jam_reg,'+07:00') as pulang,
+			reg_periksa.kd_poli, 0, '',
+			` + keluhanSQL("pemeriksaan_ralan") + ` as keluhan,
 			IFNULL(satu_sehat_encounter.id_encounter,'') as id_encounter
 		FROM reg_periksa
 		INNER JOIN pasien ON reg_periksa.no_rkm_medis = pasien.no_rkm_medis
@@ -49,12 +62,13 @@ func queryPendingEncounters(db *sql.DB, tgl1, tgl2 string) ([]EncounterRow, erro
 		INNER JOIN satu_sehat_mapping_lokasi_ralan ON satu_sehat_mapping_lokasi_ralan.kd_poli = poliklinik.kd_poli
 		LEFT JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
 		WHERE reg_periksa.status_bayar = 'Sudah Bayar'
-			AND reg_periksa.tgl_registrasi BETWEEN ? AND ?`
+			AND ` + f.rangeSQL(registrationDate) + f.unitSQL() + `
+		ORDER BY reg_periksa.tgl_registrasi ` + f.orderSQL() + `, reg_periksa.jam_reg ` + f.orderSQL()
 
-	return scanEncounterRows(db, query, tgl1, tgl2)
+	return scanEncounterRows(ctx, db, query, append(f.rangeArgs(1), f.unitArgs()...)...)
 }
 
-func queryPendingEncountersRanap(db *sql.DB, tgl1, tgl2 string) ([]EncounterRow, error) {
+func queryPendingEncountersRanap(ctx context.Context, db *sql.DB, f PendingFilter) ([]EncounterRow, error) {
 	query := `
 		SELECT reg_periksa.tgl_registrasi, reg_periksa.jam_reg, reg_periksa.no_rawat,
 			pasien.nm_pasien, pasien.no_ktp, reg_periksa.no_rkm_medis,
@@ -62,7 +76,19 @@ func queryPendingEncountersRanap(db *sql.DB, tgl1, tgl2 string) ([]EncounterRow,
 			kamar_inap.kd_kamar, bangsal.nm_bangsal,
 			satu_sehat_mapping_lokasi_ranap.id_lokasi_satusehat,
 			reg_periksa.stts, reg_periksa.status_lanjut,
-			CONCAT(reg_periksa.tgl_registrasi,'T',reg_periksa.jam_reg,'+07:00') as pulang,
+			IFNULL((SELECT CONCAT(keluar.tgl_keluar,'T',keluar.jam_keluar,'+07:00') FROM kamar_inap keluar
+				WHERE keluar.no_rawat = reg_periksa.no_rawat
+					AND NOT EXISTS (SELECT 1 FROM kamar_inap dirawat
+						WHERE dirawat.no_rawat = reg_periksa.no_rawat AND dirawat.tgl_keluar = '0000-00-00')
+				ORDER BY keluar.tgl_keluar DESC, keluar.jam_keluar DESC LIMIT 1), '') as pulang,
+			reg_periksa.kd_poli,
+			EXISTS (SELECT 1 FROM rujuk_masuk WHERE rujuk_masuk.no_rawat = reg_periksa.no_rawat) as dirujuk,
+			IFNULL((SELECT keluar.stts_pulang FROM kamar_inap keluar
+				WHERE keluar.no_rawat = reg_periksa.no_rawat
+					AND NOT EXISTS (SELECT 1 FROM kamar_inap dirawat
+						WHERE dirawat.no_rawat = reg_periksa.no_rawat AND dirawat.tgl_keluar = '0000-00-00')
+				ORDER BY keluar.tgl_keluar DESC, keluar.jam_keluar DESC LIMIT 1), '') as stts_pulang,
+			COALESCE(NULLIF(` + keluhanSQL("pemeriksaan_ralan") + `,''), ` + keluhanSQL("pemeriksaan_ranap") + `) as keluhan,
 			IFNULL(satu_sehat_encounter.id_encounter,'') as id_encounter
 		FROM reg_periksa
 		INNER JOIN pasien ON reg_periksa.no_rkm_medis = pasien.no_rkm_medis
@@ -73,13 +99,23 @@ func queryPendingEncountersRanap(db *sql.DB, tgl1, tgl2 string) ([]EncounterRow,
 		INNER JOIN satu_sehat_mapping_lokasi_ranap ON satu_sehat_mapping_lokasi_ranap.kd_kamar = kamar_inap.kd_kamar
 		LEFT JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
 		WHERE reg_periksa.status_lanjut = 'Ranap'
-			AND reg_periksa.tgl_registrasi BETWEEN ? AND ?`
+			AND ` + f.rangeSQL(registrationDate) + f.unitSQL() + `
+		ORDER BY reg_periksa.tgl_registrasi ` + f.orderSQL() + `, reg_periksa.jam_reg ` + f.orderSQL()
 
-	return scanEncounterRows(db, query, tgl1, tgl2)
+	return scanEncounterRows(ctx, db, query, append(f.rangeArgs(1), f.unitArgs()...)...)
 }
 
-func scanEncounterRows(db *sql.DB, query, tgl1, tgl2 string) ([]EncounterRow, error) {
-	rows, err := db.Query(query, tgl1, tgl2)
+// keluhanSQL selects the first non-empty keluhan of the visit from table
+// (pemeriksaan_ralan or pemeriksaan_ranap); a ranap stay falls back from the
+// IGD/poli examination to the ward one
+func keluhanSQL(table string) string {
+	return `IFNULL((SELECT TRIM(` + table + `.keluhan) FROM ` + table + `
+				WHERE ` + table + `.no_rawat = reg_periksa.no_rawat AND TRIM(` + table + `.keluhan) NOT IN ('', '-')
+				ORDER BY ` + table + `.tgl_perawatan, ` + table + `.jam_rawat LIMIT 1), '')`
+}
+
+func scanEncounterRows(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]EncounterRow, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("query encounters: %w", err)
 	}
@@ -92,9 +128,10 @@ func scanEncounterRows(db *sql.DB, query, tgl1, tgl2 string) ([]EncounterRow, er
 			&r.NmPasien, &r.NoKTPPasien, &r.NoRKMMedis,
 			&r.KdDokter, &r.NamaDokter, &r.NoKTPDokter,
 			&r.KdPoli, &r.NmPoli, &r.IDLokasiSS,
-			&r.SttsRawat, &r.StatusLanjut, &r.TglPulang, &r.IDEncounter)
+			&r.SttsRawat, &r.StatusLanjut, &r.TglPulang,
+			&r.PoliAsal, &r.Dirujuk, &r.SttsPulang, &r.Keluhan, &r.IDEncounter)
 		if err != nil {
-			log.Printf("⚠️ scan encounter row: %v", err)
+			logWarnf("⚠️ scan encounter row: %v", err)
 			continue
 		}
 		results = append(results, r)
@@ -102,6 +139,81 @@ func scanEncounterRows(db *sql.DB, query, tgl1, tgl2 string) ([]EncounterRow, er
 	return results, nil
 }
 
+// encounterPeriod is the Encounter period: a ranap stay ends at its last
+// kamar_inap discharge and stays open (no end) while the patient is admitted
+func encounterPeriod(row EncounterRow, startTime string) map[string]interface{} {
+	period := map[string]interface{}{"start": startTime}
+	if row.StatusLanjut != "Ralan" && row.TglPulang != "" {
+		period["end"] = row.TglPulang
+	}
+	return period
+}
+
+// admitSources are the admit-source codes of a ranap stay
+var admitSources = map[string]string{
+	"gp":   "General Practitioner referral",
+	"emd":  "From accident/emergency department",
+	"outp": "From outpatient department",
+}
+
+// admitSource is where a ranap stay came from: a referral, the IGD or a poli
+func admitSource(row EncounterRow) string {
+	switch {
+	case row.Dirujuk:
+		return "gp"
+	case row.PoliAsal == encounterIGDPoli:
+		return "emd"
+	}
+	return "outp"
+}
+
+// dischargeDispositions maps kamar_inap.stts_pulang to a discharge-disposition
+// code. Statuses that are not a discharge (Pindah Kamar, -) are left out.
+var dischargeDispositions = map[string][2]string{
+	"Sehat":                   {"home", "Home"},
+	"Sembuh":                  {"home", "Home"},
+	"Membaik":                 {"home", "Home"},
+	"Atas Persetujuan Dokter": {"home", "Home"},
+	"Isoman":                  {"home", "Home"},
+	"Rujuk":                   {"other-hcf", "Other healthcare facility"},
+	"APS":                     {"aadvice", "Left against advice"},
+	"Pulang Paksa":            {"aadvice", "Left against advice"},
+	"Atas Permintaan Sendiri": {"aadvice", "Left against advice"},
+	"Meninggal":               {"exp", "Expired"},
+	"+":                       {"exp", "Expired"},
+	"Lain-lain":               {"oth", "Other"},
+}
+
+// encounterHospitalization is the hospitalization element of a ranap stay;
+// dischargeDisposition is only set once the patient is discharged
+func encounterHospitalization(row EncounterRow) map[string]interface{} {
+	code := admitSource(row)
+	hosp := map[string]interface{}{
+		"admitSource": map[string]interface{}{
+			"coding": []interface{}{
+				map[string]interface{}{
+					"system":  "http://terminology.hl7.org/CodeSystem/admit-source",
+					"code":    code,
+					"display": admitSources[code],
+				},
+			},
+		},
+	}
+	if d, ok := dischargeDispositions[row.SttsPulang]; ok && row.TglPulang != "" {
+		hosp["dischargeDisposition"] = map[string]interface{}{
+			"coding": []interface{}{
+				map[string]interface{}{
+					"system":  "http://terminology.hl7.org/CodeSystem/discharge-disposition",
+					"code":    d[0],
+					"display": d[1],
+				},
+			},
+			"text": row.SttsPulang,
+		}
+	}
+	return hosp
+}
+
 func buildEncounterJSON(row EncounterRow, patientID, practitionerID, orgID string) map[string]interface{} {
 	classCode := "AMB"
 	classDisplay := "ambulatory"
@@ -111,8 +223,12 @@ func buildEncounterJSON(row EncounterRow, patientID, practitionerID, orgID strin
 	}
 
 	startTime := row.TglRegistrasi + "T" + row.JamReg + "+07:00"
+	arrived := map[string]interface{}{"start": startTime}
+	if row.TglPulang != "" {
+		arrived["end"] = row.TglPulang
+	}
 
-	return map[string]interface{}{
+	enc := map[string]interface{}{
 		"resourceType": "Encounter",
 		"status":       "arrived",
 		"class": map[string]interface{}{
@@ -125,27 +241,9 @@ func buildEncounterJSON(row EncounterRow, patientID, practitionerID, orgID strin
 			"display":   row.NmPasien,
 		},
 		"participant": []interface{}{
-			map[string]interface{}{
-				"type": []interface{}{
-					map[string]interface{}{
-						"coding": []interface{}{
-							map[string]interface{}{
-								"system":  "http://terminology.hl7.org/CodeSystem/v3-ParticipationType",
-								"code":    "ATND",
-								"display": "attender",
-							},
-						},
-					},
-				},
-				"individual": map[string]interface{}{
-					"reference": "Practitioner/" + practitionerID,
-					"display":   row.NamaDokter,
-				},
-			},
-		},
-		"period": map[string]interface{}{
-			"start": startTime,
+			encounterParticipant(practitionerID, row.NamaDokter, "ATND"),
 		},
+		"period": encounterPeriod(row, startTime),
 		"location": []interface{}{
 			map[string]interface{}{
 				"location": map[string]interface{}{
@@ -157,10 +255,7 @@ func buildEncounterJSON(row EncounterRow, patientID, practitionerID, orgID strin
 		"statusHistory": []interface{}{
 			map[string]interface{}{
 				"status": "arrived",
-				"period": map[string]interface{}{
-					"start": startTime,
-					"end":   row.TglPulang,
-				},
+				"period": arrived,
 			},
 		},
 		"serviceProvider": map[string]interface{}{
@@ -168,11 +263,130 @@ func buildEncounterJSON(row EncounterRow, patientID, practitionerID, orgID strin
 		},
 		"identifier": []interface{}{
 			map[string]interface{}{
-				"system": "http://sys-ids.kemkes.go.id/encounter/" + orgID,
+				"system": sysID("encounter", orgID),
 				"value":  row.NoRawat,
 			},
 		},
 	}
+	if row.StatusLanjut == "Ranap" {
+		enc["hospitalization"] = encounterHospitalization(row)
+	}
+	if row.Keluhan != "" {
+		// Text only: the Conditions are sent after (and reference) the Encounter
+		enc["reasonCode"] = []interface{}{map[string]interface{}{"text": row.Keluhan}}
+	}
+	return withMetaProfile(enc)
+}
+
+// participationTypes are the v3-ParticipationType codes used on Encounters
+var participationTypes = map[string]string{"ATND": "attender", "ADM": "admitter"}
+
+// encounterParticipant is one participant of the given participation types
+func encounterParticipant(practitionerID, name string, codes ...string) map[string]interface{} {
+	types := make([]interface{}, len(codes))
+	for i, code := range codes {
+		types[i] = map[string]interface{}{
+			"coding": []interface{}{
+				map[string]interface{}{
+					"system":  "http://terminology.hl7.org/CodeSystem/v3-ParticipationType",
+					"code":    code,
+					"display": participationTypes[code],
+				},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"type": types,
+		"individual": map[string]interface{}{
+			"reference": "Practitioner/" + practitionerID,
+			"display":   name,
+		},
+	}
+}
+
+type dpjpRow struct {
+	KdDokter string
+	Nama     string
+	NoKTP    string
+}
+
+func queryDPJP(ctx context.Context, db *sql.DB, noRawat string) ([]dpjpRow, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT dpjp_ranap.kd_dokter, pegawai.nama, pegawai.no_ktp
+		FROM dpjp_ranap
+		INNER JOIN pegawai ON pegawai.nik = dpjp_ranap.kd_dokter
+		WHERE dpjp_ranap.no_rawat = ?`, noRawat)
+	if err != nil {
+		return nil, fmt.Errorf("query dpjp_ranap: %w", err)
+	}
+	defer rows.Close()
+
+	var results []dpjpRow
+	for rows.Next() {
+		var r dpjpRow
+		if err := rows.Scan(&r.KdDokter, &r.Nama, &r.NoKTP); err != nil {
+			logWarnf("⚠️ scan dpjp row: %v", err)
+			continue
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// attachDPJP replaces the single ATND participant of a ranap Encounter with
+// the registering doctor as admitter (ADM) and every DPJP from dpjp_ranap as
+// attender (ATND); a doctor who is both gets both types. Without DPJP rows the
+// Encounter keeps the registering doctor as its attender.
+func (a *App) attachDPJP(enc map[string]interface{}, row EncounterRow, practitionerID string) error {
+	dpjps, err := queryDPJP(a.ctx, a.db, row.NoRawat)
+	if err != nil || len(dpjps) == 0 {
+		return err
+	}
+	admitter := []string{"ADM"}
+	var attenders []interface{}
+	for _, d := range dpjps {
+		if d.KdDokter == row.KdDokter {
+			admitter = append(admitter, "ATND")
+			continue
+		}
+		if !a.canLookupPractitioner(d.NoKTP, d.Nama) {
+			logWarnf("⚠️ DPJP %s of %s has no NIK, left out of the Encounter", d.Nama, row.NoRawat)
+			continue
+		}
+		id, err := a.lookupPractitioner(d.NoKTP, d.Nama)
+		if err != nil {
+			return fmt.Errorf("DPJP %s: %w", d.Nama, err)
+		}
+		attenders = append(attenders, encounterParticipant(id, d.Nama, "ATND"))
+	}
+	if len(attenders) == 0 && len(admitter) == 1 {
+		return nil // no usable DPJP, keep the registering doctor as attender
+	}
+	enc["participant"] = append([]interface{}{encounterParticipant(practitionerID, row.NamaDokter, admitter...)}, attenders...)
+	return nil
+}
+
+// encounterSender POSTs an Encounter, or with SS_SEARCH_BEFORE_CREATE first
+// looks it up by its no_rawat identifier and adopts the id of a single
+// existing match (created out-of-band, or our tracking row was lost)
+func (a *App) encounterSender(noRawat string) func(map[string]interface{}) (string, error) {
+	if !a.cfg.SearchBeforeCreate {
+		return a.ss.SendEncounter
+	}
+	return func(enc map[string]interface{}) (string, error) {
+		ids, err := a.ss.FindByIdentifier("Encounter", sysID("encounter", a.cfg.SSOrgID), noRawat)
+		if err != nil {
+			return "", fmt.Errorf("search existing encounter: %w", err)
+		}
+		switch len(ids) {
+		case 0:
+			return a.ss.SendEncounter(enc)
+		case 1:
+			logInfof("🔗 Encounter %s already in SatuSehat, adopting %s", noRawat, ids[0])
+			return ids[0], nil
+		}
+		return "", fmt.Errorf("%d Encounters in SatuSehat already carry identifier %s, resolve manually", len(ids), noRawat)
+	}
 }
 
 // ============================================================
@@ -180,15 +394,13 @@ func buildEncounterJSON(row EncounterRow, patientID, practitionerID, orgID strin
 // ============================================================
 
 func (a *App) handlePendingEncounters(w http.ResponseWriter, r *http.Request) {
-	tgl1 := r.URL.Query().Get("tgl1")
-	tgl2 := r.URL.Query().Get("tgl2")
-	if tgl1 == "" || tgl2 == "" {
-		today := time.Now().Format("2006-01-02")
-		tgl1 = today
-		tgl2 = today
+	f := a.pendingFilterFromQuery(r)
+	if err := a.checkUnit(r.Context(), f, false); err != nil {
+		jsonError(w, err.Error(), 400)
+		return
 	}
 
-	rows, err := queryPendingEncounters(a.db, tgl1, tgl2)
+	rows, err := queryPendingEncounters(r.Context(), a.db, f)
 	if err != nil {
 		jsonError(w, err.Error(), 500)
 		return
@@ -205,9 +417,9 @@ func (a *App) handlePendingEncounters(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	jsonResponse(w, map[string]interface{}{
-		"tgl1":          tgl1,
-		"tgl2":          tgl2,
+	writePending(w, r, map[string]interface{}{
+		"tgl1":          f.Tgl1,
+		"tgl2":          f.Tgl2,
 		"total":         len(rows),
 		"pending_count": len(pending),
 		"sent_count":    len(sent),
@@ -216,102 +428,105 @@ func (a *App) handlePendingEncounters(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *App) handleSendEncounters(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Tgl1 string `json:"tgl1"`
-		Tgl2 string `json:"tgl2"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "invalid request body", 400)
-		return
-	}
-	if req.Tgl1 == "" || req.Tgl2 == "" {
-		jsonError(w, "tgl1 and tgl2 required", 400)
+	f, ok := a.decodeSendRequest(w, r)
+	if !ok {
 		return
 	}
-
-	rows, err := queryPendingEncounters(a.db, req.Tgl1, req.Tgl2)
-	if err != nil {
-		jsonError(w, err.Error(), 500)
+	if err := a.checkUnit(r.Context(), f, false); err != nil {
+		jsonError(w, err.Error(), 400)
 		return
 	}
+	res, done, err := a.batch(r.Context()).sendEncounters(f)
+	writeBatch(w, res, done, err, "results", map[string]interface{}{"by_location": res.countBy("location")})
+}
 
-	var results []map[string]interface{}
-	sentCount := 0
-	failCount := 0
+// sendEncounters sends every pending ralan encounter in f. With
+// SS_ENCOUNTER_WORKERS > 1 each window is split by location and the locations
+// are sent concurrently.
+func (a *App) sendEncounters(f PendingFilter) (*batchResult, int, error) {
+	res := a.newBatchResult()
 
-	for _, row := range rows {
+	send := func(row EncounterRow) {
+		add := func(d map[string]interface{}) {
+			d["location"] = row.NmPoli
+			res.add(d)
+		}
 		if row.IDEncounter != "" {
-			continue // already sent
+			return // already sent
 		}
-		if row.NoKTPPasien == "" || row.NoKTPDokter == "" {
-			results = append(results, map[string]interface{}{
+		if row.NoKTPPasien == "" || !a.canLookupPractitioner(row.NoKTPDokter, row.NamaDokter) {
+			add(map[string]interface{}{
 				"no_rawat": row.NoRawat,
 				"status":   "skipped",
 				"reason":   "missing NIK pasien or dokter",
 			})
-			failCount++
-			continue
+			return
+		}
+
+		if a.enqueueRow("Encounter", row.jobKey(), row.NoRawat) {
+			return
 		}
 
 		// Lookup patient
-		patientID, err := a.ss.LookupPatient(row.NoKTPPasien)
+		patientID, err := a.lookupPatient(row.NoKTPPasien)
 		if err != nil {
-			results = append(results, map[string]interface{}{
+			st := a.lookupStatus(err)
+			add(map[string]interface{}{
 				"no_rawat": row.NoRawat,
-				"status":   "failed",
+				"status":   st,
 				"step":     "lookup_patient",
 				"error":    err.Error(),
 			})
-			failCount++
-			continue
+			return
 		}
 
 		// Lookup practitioner
-		practID, err := a.ss.LookupPractitioner(row.NoKTPDokter)
+		practID, err := a.lookupPractitioner(row.NoKTPDokter, row.NamaDokter)
 		if err != nil {
-			results = append(results, map[string]interface{}{
+			st := a.lookupStatus(err)
+			add(map[string]interface{}{
 				"no_rawat": row.NoRawat,
-				"status":   "failed",
+				"status":   st,
 				"step":     "lookup_practitioner",
 				"error":    err.Error(),
 			})
-			failCount++
-			continue
+			return
 		}
 
 		// Build and send encounter via job
 		encJSON := buildEncounterJSON(row, patientID, practID, a.cfg.SSOrgID)
-		fhirID, err := a.sendViaJob("Encounter", idempKey(row.NoRawat), encJSON, a.ss.SendEncounter)
+		a.attachReferral(encJSON, row, patientID)
+		fhirID, err := a.sendViaJob("Encounter", row.jobKey(), encJSON, a.encounterSender(row.NoRawat))
 		if err != nil {
-			results = append(results, map[string]interface{}{
+			add(res.withResponse(map[string]interface{}{
 				"no_rawat": row.NoRawat, "status": "failed", "step": "send_encounter", "error": err.Error(),
-			})
-			failCount++
-			continue
+			}, err))
+			return
 		}
 		if fhirID == "" {
-			continue // already processed via job
+			return // already processed via job
 		}
 
 		// Save to tracking table (Khanza compatibility)
 		_, err = a.db.Exec("INSERT INTO satu_sehat_encounter (no_rawat, id_encounter) VALUES (?, ?)",
 			row.NoRawat, fhirID)
 		if err != nil {
-			log.Printf("⚠️ save encounter to DB failed: %v", err)
+			logErrorf("❌ save encounter to DB failed: %v", err)
 		}
 		a.saveSendLog(row.NoRawat, "Encounter", fhirID, "success", "")
 
-		results = append(results, map[string]interface{}{
+		add(map[string]interface{}{
 			"no_rawat": row.NoRawat, "status": "success", "id_encounter": fhirID,
 		})
-		sentCount++
 	}
 
-	jsonResponse(w, map[string]interface{}{
-		"sent":    sentCount,
-		"failed":  failCount,
-		"results": results,
+	done, err := eachChunk(a.ctx, f, a.cfg.ChunkDays, func(cf PendingFilter) ([][]EncounterRow, error) {
+		rows, err := queryPendingEncounters(a.ctx, a.db, cf)
+		return [][]EncounterRow{rows}, err
+	}, func(rows []EncounterRow) {
+		forEachPartition(a.ctx, rows, func(r EncounterRow) string { return r.IDLokasiSS }, live.get().EncounterWorkers, send)
 	})
+	return res, done, err
 }
 
 // ============================================================
@@ -319,15 +534,13 @@ func (a *App) handleSendEncounters(w http.ResponseWriter, r *http.Request) {
 // ============================================================
 
 func (a *App) handlePendingEncountersRanap(w http.ResponseWriter, r *http.Request) {
-	tgl1 := r.URL.Query().Get("tgl1")
-	tgl2 := r.URL.Query().Get("tgl2")
-	if tgl1 == "" || tgl2 == "" {
-		today := time.Now().Format("2006-01-02")
-		tgl1 = today
-		tgl2 = today
+	f := a.pendingFilterFromQuery(r)
+	if err := a.checkUnit(r.Context(), f, true); err != nil {
+		jsonError(w, err.Error(), 400)
+		return
 	}
 
-	rows, err := queryPendingEncountersRanap(a.db, tgl1, tgl2)
+	rows, err := queryPendingEncountersRanap(r.Context(), a.db, f)
 	if err != nil {
 		jsonError(w, err.Error(), 500)
 		return
@@ -342,97 +555,110 @@ func (a *App) handlePendingEncountersRanap(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	jsonResponse(w, map[string]interface{}{
-		"tgl1": tgl1, "tgl2": tgl2,
+	writePending(w, r, map[string]interface{}{
+		"tgl1": f.Tgl1, "tgl2": f.Tgl2,
 		"total": len(rows), "pending_count": len(pending), "sent_count": len(sent),
 		"pending": pending,
 	})
 }
 
 func (a *App) handleSendEncountersRanap(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Tgl1 string `json:"tgl1"`
-		Tgl2 string `json:"tgl2"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "invalid request body", 400)
+	f, ok := a.decodeSendRequest(w, r)
+	if !ok {
 		return
 	}
-	if req.Tgl1 == "" || req.Tgl2 == "" {
-		jsonError(w, "tgl1 and tgl2 required", 400)
-		return
-	}
-
-	rows, err := queryPendingEncountersRanap(a.db, req.Tgl1, req.Tgl2)
-	if err != nil {
-		jsonError(w, err.Error(), 500)
+	if err := a.checkUnit(r.Context(), f, true); err != nil {
+		jsonError(w, err.Error(), 400)
 		return
 	}
+	res, done, err := a.batch(r.Context()).sendEncountersRanap(f)
+	writeBatch(w, res, done, err, "results", map[string]interface{}{"by_location": res.countBy("location")})
+}
 
-	var results []map[string]interface{}
-	sentCount, failCount := 0, 0
+// sendEncountersRanap sends every pending ranap encounter in f (partitioned
+// by location like sendEncounters)
+func (a *App) sendEncountersRanap(f PendingFilter) (*batchResult, int, error) {
+	res := a.newBatchResult()
 
-	for _, row := range rows {
+	send := func(row EncounterRow) {
+		add := func(d map[string]interface{}) {
+			d["location"] = row.NmPoli
+			res.add(d)
+		}
 		if row.IDEncounter != "" {
-			continue
+			return
 		}
-		if row.NoKTPPasien == "" || row.NoKTPDokter == "" {
+		if row.NoKTPPasien == "" || !a.canLookupPractitioner(row.NoKTPDokter, row.NamaDokter) {
 			a.saveSendLog(row.NoRawat, "EncounterRanap", "", "skipped", "missing NIK")
-			results = append(results, map[string]interface{}{
+			add(map[string]interface{}{
 				"no_rawat": row.NoRawat, "status": "skipped", "reason": "missing NIK",
 			})
-			failCount++
-			continue
+			return
 		}
 
-		patientID, err := a.ss.LookupPatient(row.NoKTPPasien)
+		if a.enqueueRow("EncounterRanap", row.jobKey(), row.NoRawat) {
+			return
+		}
+
+		patientID, err := a.lookupPatient(row.NoKTPPasien)
 		if err != nil {
-			a.saveSendLog(row.NoRawat, "EncounterRanap", "", "failed", err.Error())
-			results = append(results, map[string]interface{}{
-				"no_rawat": row.NoRawat, "status": "failed", "step": "lookup_patient", "error": err.Error(),
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, "EncounterRanap", "", st, err.Error())
+			add(map[string]interface{}{
+				"no_rawat": row.NoRawat, "status": st, "step": "lookup_patient", "error": err.Error(),
 			})
-			failCount++
-			continue
+			return
 		}
 
-		practID, err := a.ss.LookupPractitioner(row.NoKTPDokter)
+		practID, err := a.lookupPractitioner(row.NoKTPDokter, row.NamaDokter)
 		if err != nil {
-			a.saveSendLog(row.NoRawat, "EncounterRanap", "", "failed", err.Error())
-			results = append(results, map[string]interface{}{
-				"no_rawat": row.NoRawat, "status": "failed", "step": "lookup_practitioner", "error": err.Error(),
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, "EncounterRanap", "", st, err.Error())
+			add(map[string]interface{}{
+				"no_rawat": row.NoRawat, "status": st, "step": "lookup_practitioner", "error": err.Error(),
 			})
-			failCount++
-			continue
+			return
 		}
 
 		encJSON := buildEncounterJSON(row, patientID, practID, a.cfg.SSOrgID)
-		fhirID, err := a.sendViaJob("EncounterRanap", idempKey(row.NoRawat), encJSON, a.ss.SendEncounter)
+		if err := a.attachDPJP(encJSON, row, practID); err != nil {
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, "EncounterRanap", "", st, err.Error())
+			add(map[string]interface{}{
+				"no_rawat": row.NoRawat, "status": st, "step": "lookup_dpjp", "error": err.Error(),
+			})
+			return
+		}
+		a.attachReferral(encJSON, row, patientID)
+		fhirID, err := a.sendViaJob("EncounterRanap", row.jobKey(), encJSON, a.encounterSender(row.NoRawat))
 		if err != nil {
 			a.saveSendLog(row.NoRawat, "EncounterRanap", "", "failed", err.Error())
-			results = append(results, map[string]interface{}{
+			add(res.withResponse(map[string]interface{}{
 				"no_rawat": row.NoRawat, "status": "failed", "step": "send_encounter", "error": err.Error(),
-			})
-			failCount++
-			continue
+			}, err))
+			return
 		}
 		if fhirID == "" {
-			continue
+			return
 		}
 
 		_, err = a.db.Exec("INSERT INTO satu_sehat_encounter (no_rawat, id_encounter) VALUES (?, ?)",
 			row.NoRawat, fhirID)
 		if err != nil {
-			log.Printf("⚠️ save encounter ranap to DB failed: %v", err)
+			logErrorf("❌ save encounter ranap to DB failed: %v", err)
 		}
 		a.saveSendLog(row.NoRawat, "EncounterRanap", fhirID, "success", "")
 
-		results = append(results, map[string]interface{}{
+		add(map[string]interface{}{
 			"no_rawat": row.NoRawat, "status": "success", "id_encounter": fhirID,
 		})
-		sentCount++
 	}
 
-	jsonResponse(w, map[string]interface{}{
-		"sent": sentCount, "failed": failCount, "results": results,
+	done, err := eachChunk(a.ctx, f, a.cfg.ChunkDays, func(cf PendingFilter) ([][]EncounterRow, error) {
+		rows, err := queryPendingEncountersRanap(a.ctx, a.db, cf)
+		return [][]EncounterRow{rows}, err
+	}, func(rows []EncounterRow) {
+		forEachPartition(a.ctx, rows, func(r EncounterRow) string { return r.IDLokasiSS }, live.get().EncounterWorkers, send)
 	})
+	return res, done, err
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// ============================================================
+// FHIR HELPERS
+// ============================================================
+
+// displayText joins the non-empty segments with ", " and trims stray
+// separators so empty names never leave dangling commas behind.
+func displayText(segments ...string) string {
+	var parts []string
+	for _, s := range segments {
+		s = strings.Trim(strings.TrimSpace(s), ",")
+		s = strings.TrimSpace(s)
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// displayWords joins the non-empty words with a single space
+func displayWords(words ...string) string {
+	var parts []string
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			parts = append(parts, w)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// labeled returns "label value", or "" when value is empty
+func labeled(label, value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+	return label + " " + value
+}
+
+const truncatedMarker = "...[truncated]"
+
+// truncateText cuts s to at most max runes including the truncation marker,
+// never splitting a rune or a trailing "<br>". max <= 0 disables the limit.
+func truncateText(s string, max int) (string, bool) {
+	runes := []rune(s)
+	if max <= 0 || len(runes) <= max {
+		return s, false
+	}
+	keep := max - len([]rune(truncatedMarker))
+	if keep < 0 {
+		keep = 0
+	}
+	cut := string(runes[:keep])
+	if i := strings.LastIndex(cut, "<"); i >= 0 && !strings.Contains(cut[i:], ">") {
+		cut = cut[:i] // don't leave half a <br>
+	}
+	return cut + truncatedMarker, true
+}
+
+// observationPerformers references the practitioner and the performing
+// organization, as the SatuSehat lab/imaging profiles expect
+func observationPerformers(practitionerID, orgID string) []interface{} {
+	return []interface{}{
+		map[string]interface{}{"reference": "Practitioner/" + practitionerID},
+		map[string]interface{}{"reference": "Organization/" + orgID},
+	}
+}
+
+// futureGrace is how far past now a timestamp may lie (clock skew between the
+// Khanza workstations and this server) before SatuSehat would reject it
+const futureGrace = 5 * time.Minute
+
+// futureTimestamp returns the first of effectiveDateTime, authoredOn and
+// performedPeriod start/end in payload that lies after now + futureGrace,
+// as "field value", or "" when none does. Unparsable values are left to
+// SatuSehat to reject.
+func futureTimestamp(payload map[string]interface{}) string {
+	fields := []string{"effectiveDateTime", "authoredOn"}
+	values := map[string]interface{}{"effectiveDateTime": payload["effectiveDateTime"], "authoredOn": payload["authoredOn"]}
+	if period, ok := payload["performedPeriod"].(map[string]interface{}); ok {
+		fields = append(fields, "performedPeriod.start", "performedPeriod.end")
+		values["performedPeriod.start"], values["performedPeriod.end"] = period["start"], period["end"]
+	}
+	limit := time.Now().Add(futureGrace)
+	for _, field := range fields {
+		v, _ := values[field].(string)
+		if t, err := time.Parse(time.RFC3339, v); err == nil && t.After(limit) {
+			return field + " " + v
+		}
+	}
+	return ""
+}
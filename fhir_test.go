@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestDisplayText(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []string
+		want     string
+	}{
+		{"no segments", nil, ""},
+		{"all empty", []string{"", ""}, ""},
+		{"whitespace only", []string{"  ", "\t", " , "}, ""},
+		{"single", []string{"Budi"}, "Budi"},
+		{"mixed", []string{"Budi", "", "  Poli Umum ", "dr. Ani"}, "Budi, Poli Umum, dr. Ani"},
+		{"stray separators", []string{"Budi,", ", Poli Umum", ","}, "Budi, Poli Umum"},
+		{"inner comma kept", []string{"Santoso, S.Kom", "Poli"}, "Santoso, S.Kom, Poli"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := displayText(tt.segments...); got != tt.want {
+				t.Errorf("displayText(%q) = %q, want %q", tt.segments, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================
+// PENDING FILTER (shared by pending + send endpoints)
+// ============================================================
+
+type PendingFilter struct {
+	Tgl1    string `json:"tgl1,omitempty"`
+	Tgl2    string `json:"tgl2,omitempty"`
+	Order   string `json:"order,omitempty"`    // "asc" (oldest first) or "desc" (newest first)
+	NoRawat string `json:"no_rawat,omitempty"` // optional single visit; the date range may then be empty
+	// Optional department of the encounter queries: kd_poli (ralan),
+	// kd_bangsal / kd_kamar (ranap)
+	KdPoli    string `json:"kd_poli,omitempty"`
+	KdBangsal string `json:"kd_bangsal,omitempty"`
+	KdKamar   string `json:"kd_kamar,omitempty"`
+}
+
+// maxRangeDays caps the tgl1–tgl2 span of the report endpoints, whose
+// per-day results grow with the range
+const maxRangeDays = 366
+
+// rangeSQL is the WHERE condition restricting a pending query to f: col within
+// tgl1–tgl2 and, with NoRawat, only that visit. rangeArgs(n) returns its
+// placeholder values repeated for n UNION parts.
+func (f PendingFilter) rangeSQL(col string) string {
+	var conds []string
+	if f.Tgl1 != "" && f.Tgl2 != "" {
+		conds = append(conds, col+" BETWEEN ? AND ?")
+	}
+	if f.NoRawat != "" {
+		conds = append(conds, "reg_periksa.no_rawat = ?")
+	}
+	if len(conds) == 0 {
+		return "1=0"
+	}
+	return strings.Join(conds, " AND ")
+}
+
+func (f PendingFilter) rangeArgs(n int) []interface{} {
+	var one []interface{}
+	if f.Tgl1 != "" && f.Tgl2 != "" {
+		one = append(one, f.Tgl1, f.Tgl2)
+	}
+	if f.NoRawat != "" {
+		one = append(one, f.NoRawat)
+	}
+	var args []interface{}
+	for i := 0; i < n; i++ {
+		args = append(args, one...)
+	}
+	return args
+}
+
+// unitSQL is the " AND ..." department condition of the encounter queries,
+// unitArgs its placeholder values
+func (f PendingFilter) unitSQL() string {
+	var conds []string
+	if f.KdPoli != "" {
+		conds = append(conds, " AND reg_periksa.kd_poli = ?")
+	}
+	if f.KdBangsal != "" {
+		conds = append(conds, " AND bangsal.kd_bangsal = ?")
+	}
+	if f.KdKamar != "" {
+		conds = append(conds, " AND kamar_inap.kd_kamar = ?")
+	}
+	return strings.Join(conds, "")
+}
+
+func (f PendingFilter) unitArgs() []interface{} {
+	var args []interface{}
+	for _, v := range []string{f.KdPoli, f.KdBangsal, f.KdKamar} {
+		if v != "" {
+			args = append(args, v)
+		}
+	}
+	return args
+}
+
+// hasUnit reports whether f filters on a department
+func (f PendingFilter) hasUnit() bool {
+	return f.KdPoli != "" || f.KdBangsal != "" || f.KdKamar != ""
+}
+
+// checkUnit validates the department filter of an encounter query: only the
+// codes of its kind (ranap or not) and only codes that exist in Khanza
+func (a *App) checkUnit(ctx context.Context, f PendingFilter, ranap bool) error {
+	if ranap && f.KdPoli != "" {
+		return fmt.Errorf("kd_poli only applies to ralan encounters, use kd_bangsal or kd_kamar")
+	}
+	if !ranap && (f.KdBangsal != "" || f.KdKamar != "") {
+		return fmt.Errorf("kd_bangsal and kd_kamar only apply to ranap encounters, use kd_poli")
+	}
+	for _, c := range []struct{ param, table, column, value string }{
+		{"kd_poli", "poliklinik", "kd_poli", f.KdPoli},
+		{"kd_bangsal", "bangsal", "kd_bangsal", f.KdBangsal},
+		{"kd_kamar", "kamar", "kd_kamar", f.KdKamar},
+	} {
+		if c.value == "" {
+			continue
+		}
+		var n int
+		if err := a.db.QueryRowContext(ctx,
+			"SELECT COUNT(*) FROM "+c.table+" WHERE "+c.column+" = ?", c.value).Scan(&n); err != nil {
+			return fmt.Errorf("check %s: %w", c.param, err)
+		}
+		if n == 0 {
+			return fmt.Errorf("unknown %s %q", c.param, c.value)
+		}
+	}
+	return nil
+}
+
+// orderSQL returns the SQL sort direction, defaulting to oldest-first
+func (f PendingFilter) orderSQL() string {
+	if strings.EqualFold(f.Order, "desc") {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+// pendingFilterFromQuery reads tgl1/tgl2/order/no_rawat from the query string.
+// The dates default to today unless no_rawat is given.
+func (a *App) pendingFilterFromQuery(r *http.Request) PendingFilter {
+	q := r.URL.Query()
+	f := PendingFilter{Tgl1: q.Get("tgl1"), Tgl2: q.Get("tgl2"), Order: q.Get("order"), NoRawat: q.Get("no_rawat"),
+		KdPoli: q.Get("kd_poli"), KdBangsal: q.Get("kd_bangsal"), KdKamar: q.Get("kd_kamar")}
+	if (f.Tgl1 == "" || f.Tgl2 == "") && f.NoRawat == "" {
+		today := time.Now().Format("2006-01-02")
+		f.Tgl1, f.Tgl2 = today, today
+	}
+	if f.Order == "" {
+		f.Order = a.cfg.SendOrder
+	}
+	return f
+}
+
+// writePending writes a pending-list response, dropping the "pending" rows
+// when the caller only wants the counts (?count_only=true)
+func writePending(w http.ResponseWriter, r *http.Request, resp map[string]interface{}) {
+	if countOnly, _ := strconv.ParseBool(r.URL.Query().Get("count_only")); countOnly {
+		delete(resp, "pending")
+	}
+	jsonResponse(w, resp)
+}
+
+// sendRequest is the common JSON body of every POST .../send endpoint
+type sendRequest struct {
+	Tgl1    string `json:"tgl1"`
+	Tgl2    string `json:"tgl2"`
+	Order   string `json:"order"`
+	NoRawat string `json:"no_rawat"`
+	MaxRows *int   `json:"max_rows"` // overrides SS_MAX_BATCH, 0 = no cap
+
+	KdPoli    string `json:"kd_poli"` // encounter endpoints only
+	KdBangsal string `json:"kd_bangsal"`
+	KdKamar   string `json:"kd_kamar"`
+}
+
+// decodeSendRequest parses and validates a send body. On failure it writes
+// the error response and returns false.
+func (a *App) decodeSendRequest(w http.ResponseWriter, r *http.Request) (PendingFilter, bool) {
+	var req sendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request body", 400)
+		return PendingFilter{}, false
+	}
+	if (req.Tgl1 == "" || req.Tgl2 == "") && req.NoRawat == "" {
+		jsonError(w, "tgl1 and tgl2 (or no_rawat) required", 400)
+		return PendingFilter{}, false
+	}
+	if req.MaxRows != nil {
+		if *req.MaxRows < 0 {
+			jsonError(w, "max_rows must be >= 0", 400)
+			return PendingFilter{}, false
+		}
+		if l := rowLimitFrom(r.Context()); l != nil {
+			l.max = *req.MaxRows
+		}
+	}
+	f := PendingFilter{Tgl1: req.Tgl1, Tgl2: req.Tgl2, Order: req.Order, NoRawat: req.NoRawat,
+		KdPoli: req.KdPoli, KdBangsal: req.KdBangsal, KdKamar: req.KdKamar}
+	if f.Order == "" {
+		f.Order = a.cfg.SendOrder
+	}
+	return f, true
+}
+
+// chunks splits [Tgl1, Tgl2] into windows of at most days days, in the
+// filter's sort order. days <= 0 or unparsable dates return f as one window.
+func (f PendingFilter) chunks(days int) []PendingFilter {
+	start, err1 := time.Parse("2006-01-02", f.Tgl1)
+	end, err2 := time.Parse("2006-01-02", f.Tgl2)
+	if days <= 0 || err1 != nil || err2 != nil || end.Before(start) {
+		return []PendingFilter{f}
+	}
+	var out []PendingFilter
+	for d := start; !d.After(end); d = d.AddDate(0, 0, days) {
+		last := d.AddDate(0, 0, days-1)
+		if last.After(end) {
+			last = end
+		}
+		c := f
+		c.Tgl1, c.Tgl2 = d.Format("2006-01-02"), last.Format("2006-01-02")
+		out = append(out, c)
+	}
+	if f.orderSQL() == "DESC" {
+		for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+	}
+	return out
+}
+
+// eachChunk queries f one window at a time and hands every row to fn, so a
+// wide tgl1–tgl2 range is never loaded at once. Rows already handed to fn stay
+// processed if a later window fails; it returns how many windows completed.
+// Cancelling ctx stops before the next row. Once the request's rowLimit is
+// reached the remaining rows are only counted. In queue mode each window is
+// recorded as the filter of the rows queued from it.
+func eachChunk[T any](ctx context.Context, f PendingFilter, days int, query func(PendingFilter) ([]T, error), fn func(T)) (int, error) {
+	windows := f.chunks(days)
+	limit := rowLimitFrom(ctx)
+	queue := enqueuedFrom(ctx)
+	for i, cf := range windows {
+		queue.setWindow(cf)
+		rows, err := query(cf)
+		if err != nil {
+			return i, fmt.Errorf("window %s..%s: %w", cf.Tgl1, cf.Tgl2, err)
+		}
+		for _, row := range rows {
+			if err := ctx.Err(); err != nil {
+				return i, fmt.Errorf("window %s..%s: cancelled: %w", cf.Tgl1, cf.Tgl2, err)
+			}
+			if limit.reached() {
+				limit.skip(rowCount(row))
+				continue
+			}
+			fn(row)
+		}
+	}
+	return len(windows), nil
+}
+
+// ============================================================
+// DATE FILTER COLUMN (SS_DATE_FILTER)
+// ============================================================
+
+const registrationDate = "reg_periksa.tgl_registrasi"
+
+// dateFilterChoices lists, per resource, the dates its pending query may filter
+// on instead of the registration date ("registrasi", always allowed)
+var dateFilterChoices = map[string]map[string]string{
+	"Observation_Lab":    {"hasil": "permintaan_lab.tgl_hasil"},
+	"Observation_Rad":    {"hasil": "permintaan_radiologi.tgl_hasil"},
+	"MedicationRequest":  {"peresepan": "resep_obat.tgl_peresepan"},
+	"MedicationDispense": {"validasi": "detail_pemberian_obat.tgl_perawatan"},
+}
+
+// dateFilterExprs holds the configured column per resource, set once at startup
+var dateFilterExprs = map[string]string{}
+
+// setDateFilters applies SS_DATE_FILTER ("Resource:choice,...")
+func setDateFilters(m map[string]string) error {
+	for res, choice := range m {
+		if choice == "registrasi" {
+			continue
+		}
+		expr, ok := dateFilterChoices[res][choice]
+		if !ok {
+			return fmt.Errorf("SS_DATE_FILTER %s:%s is not supported", res, choice)
+		}
+		dateFilterExprs[res] = expr
+	}
+	return nil
+}
+
+// dateFilterColumn returns the column resource's pending query filters tgl1–tgl2 on
+func dateFilterColumn(resource string) string {
+	if expr, ok := dateFilterExprs[resource]; ok {
+		return expr
+	}
+	return registrationDate
+}
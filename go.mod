@@ -3,8 +3,10 @@ module satusehat-service
 go 1.25.5
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
 	github.com/go-sql-driver/mysql v1.9.3
 	github.com/joho/godotenv v1.5.1
+	golang.org/x/time v0.15.0
 )
 
 require filippo.io/edwards25519 v1.1.0 // indirect
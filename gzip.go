@@ -0,0 +1,88 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// ============================================================
+// GZIP RESPONSES
+// ============================================================
+
+// gzipMinSize is the smallest response worth compressing (about one packet)
+const gzipMinSize = 1400
+
+// gzipSkipPaths are served uncompressed: the CSV exports stream their rows,
+// which the gzip writer would hold back until a block fills
+var gzipSkipPaths = map[string]bool{
+	"/api/logs/export.csv": true,
+	"/api/jobs/export.csv": true,
+}
+
+// withGzip compresses responses for clients sending Accept-Encoding: gzip.
+// The first gzipMinSize bytes are buffered so small responses go out as-is.
+func withGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if gzipSkipPaths[r.URL.Path] || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status int
+	buf    []byte
+	gz     *gzip.Writer
+	plain  bool // headers sent uncompressed, pass writes through
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	g.status = status
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	switch {
+	case g.gz != nil:
+		return g.gz.Write(p)
+	case g.plain:
+		return g.ResponseWriter.Write(p)
+	}
+	g.buf = append(g.buf, p...)
+	if len(g.buf) < gzipMinSize {
+		return len(p), nil
+	}
+	h := g.Header()
+	if h.Get("Content-Encoding") != "" {
+		g.plain = true
+		g.ResponseWriter.WriteHeader(g.status)
+	} else {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.ResponseWriter.WriteHeader(g.status)
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	buf := g.buf
+	g.buf = nil
+	if _, err := g.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// close finishes the gzip stream, or sends a response that stayed below gzipMinSize as-is
+func (g *gzipResponseWriter) close() {
+	switch {
+	case g.gz != nil:
+		g.gz.Close()
+	case !g.plain:
+		g.ResponseWriter.WriteHeader(g.status)
+		g.ResponseWriter.Write(g.buf)
+	}
+}
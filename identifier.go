@@ -0,0 +1,28 @@
+package main
+
+import "strings"
+
+// ============================================================
+// IDENTIFIER SYSTEMS (SS_IDENTIFIER_BASE, SS_NIK_SYSTEM)
+// ============================================================
+
+// identifierBase prefixes the facility identifier systems ({base}/encounter/{org} ...)
+var identifierBase = "http://sys-ids.kemkes.go.id"
+
+// nikSystem is the identifier system Patient/Practitioner NIK lookups search on
+var nikSystem = "https://fhir.kemkes.go.id/id/nik"
+
+// setIdentifierSystems overrides the defaults; empty values keep them
+func setIdentifierSystems(base, nik string) {
+	if base != "" {
+		identifierBase = strings.TrimRight(base, "/")
+	}
+	if nik != "" {
+		nikSystem = nik
+	}
+}
+
+// sysID is the identifier system of kind (e.g. "encounter", "prescription-item") for orgID
+func sysID(kind, orgID string) string {
+	return identifierBase + "/" + kind + "/" + orgID
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -23,27 +26,45 @@ const createJobsTableSQL = `CREATE TABLE IF NOT EXISTS mera_integration_jobs (
 	fhir_id         VARCHAR(100) DEFAULT '',
 	error_message   TEXT,
 	retry_count     INT          DEFAULT 0,
+	next_retry_at   DATETIME     NULL,
+	batch_id        VARCHAR(36)  DEFAULT '',
+	org             VARCHAR(50)  DEFAULT '',
 	created_at      TIMESTAMP    DEFAULT CURRENT_TIMESTAMP,
 	updated_at      TIMESTAMP    DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
 	UNIQUE KEY uk_idemp (resource_type, idempotency_key),
 	INDEX idx_status (status),
-	INDEX idx_created (created_at)
+	INDEX idx_created (created_at),
+	INDEX idx_batch (batch_id),
+	INDEX idx_next_retry (next_retry_at)
 )`
 
-// createJob inserts a new job. Returns jobID, or 0 if the key already exists.
-func createJob(db *sql.DB, resourceType, idempotencyKey string, payload map[string]interface{}) int64 {
+// createJobAttemptsTableSQL keeps one row per send attempt of a job, so the
+// errors of earlier retries survive the next attempt
+const createJobAttemptsTableSQL = `CREATE TABLE IF NOT EXISTS mera_integration_job_attempts (
+	id            BIGINT AUTO_INCREMENT PRIMARY KEY,
+	job_id        BIGINT       NOT NULL,
+	status        VARCHAR(20)  NOT NULL,
+	fhir_id       VARCHAR(100) DEFAULT '',
+	error_message TEXT,
+	attempted_at  TIMESTAMP    DEFAULT CURRENT_TIMESTAMP,
+	INDEX idx_job (job_id)
+)`
+
+// createJob inserts a new job tagged with batchID and the org it is sent as.
+// Returns jobID, or 0 if the key already exists.
+func createJob(db *sql.DB, resourceType, idempotencyKey string, payload map[string]interface{}, batchID, org string) int64 {
 	payloadJSON, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("⚠️ marshal job payload: %v", err)
+		logErrorf("❌ marshal job payload: %v", err)
 		return 0
 	}
 
 	res, err := db.Exec(
-		`INSERT IGNORE INTO mera_integration_jobs (resource_type, idempotency_key, payload, status)
-		 VALUES (?, ?, ?, 'pending')`,
-		resourceType, idempotencyKey, payloadJSON)
+		`INSERT IGNORE INTO mera_integration_jobs (resource_type, idempotency_key, payload, status, batch_id, org)
+		 VALUES (?, ?, ?, 'pending', ?, ?)`,
+		resourceType, idempotencyKey, payloadJSON, batchID, org)
 	if err != nil {
-		log.Printf("⚠️ create job: %v", err)
+		logErrorf("❌ create job: %v", err)
 		return 0
 	}
 
@@ -55,23 +76,93 @@ func createJob(db *sql.DB, resourceType, idempotencyKey string, payload map[stri
 	return id
 }
 
-// completeJob marks a job as success with the FHIR ID
+// completeJob marks a job as success with the FHIR ID. A successful
+// Encounter also releases the failed jobs of the same visit.
 func completeJob(db *sql.DB, jobID int64, fhirID string) {
 	_, err := db.Exec(
 		`UPDATE mera_integration_jobs SET status='success', fhir_id=?, error_message='' WHERE id=?`,
 		fhirID, jobID)
 	if err != nil {
-		log.Printf("⚠️ complete job %d: %v", jobID, err)
+		logErrorf("❌ complete job %d: %v", jobID, err)
+		return
+	}
+	recordJobAttempt(db, jobID, "success", fhirID, "")
+
+	var resourceType, key string
+	if err := db.QueryRow(`SELECT resource_type, idempotency_key FROM mera_integration_jobs WHERE id=?`, jobID).
+		Scan(&resourceType, &key); err != nil {
+		return
+	}
+	if resourceType == "Encounter" || resourceType == "EncounterRanap" {
+		releaseDependentJobs(db, key)
 	}
 }
 
-// failJob marks a job as failed and increments retry_count
-func failJob(db *sql.DB, jobID int64, errMsg string) {
+// releaseDependentJobs resets retry_count of the failed and pending jobs of
+// the visit noRawat so a later retry picks them up again even if they hit the
+// max-retries limit while the Encounter was missing. A job belongs to the
+// visit by the first part of its key: no_rawat itself (Condition, TTV,
+// Procedure, MedicationDispense, Composition, ...), or one of the visit's lab
+// and radiology noorder (Specimen, Observation) or no_resep
+// (MedicationRequest). A pending job keeps its due time, so rows queued by
+// SS_ASYNC_SEND stay due for the worker.
+func releaseDependentJobs(db *sql.DB, noRawat string) {
+	res, err := db.Exec(
+		`UPDATE mera_integration_jobs SET retry_count=0, next_retry_at=IF(status='failed', NULL, next_retry_at)
+		 WHERE status IN ('failed','pending') AND resource_type NOT IN ('Encounter','EncounterRanap')
+		   AND SUBSTRING_INDEX(idempotency_key, '|', 1) IN (
+			SELECT ?
+			UNION SELECT noorder FROM permintaan_lab WHERE no_rawat = ?
+			UNION SELECT noorder FROM permintaan_radiologi WHERE no_rawat = ?
+			UNION SELECT no_resep FROM resep_obat WHERE no_rawat = ?)`,
+		noRawat, noRawat, noRawat, noRawat)
+	if err != nil {
+		logErrorf("❌ release jobs of %s: %v", noRawat, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		logInfof("🔓 Encounter %s sent, %d dependent job(s) eligible for retry", noRawat, n)
+	}
+}
+
+// likePrefix escapes LIKE wildcards in prefix and appends %
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+}
+
+// jobFHIRID returns the fhir_id of a successful job, or "" if there is none
+func jobFHIRID(db *sql.DB, resourceType, idempotencyKey string) string {
+	var id string
+	db.QueryRow(`SELECT fhir_id FROM mera_integration_jobs
+		WHERE resource_type=? AND idempotency_key=? AND status='success'`, resourceType, idempotencyKey).Scan(&id)
+	return id
+}
+
+// failJob marks a job as failed and schedules the next retry after
+// SS_RETRY_BACKOFF * 2^(retry_count-1) seconds. A token failure is transient
+// and says nothing about the payload, so it does not use up a retry.
+func failJob(db *sql.DB, jobID int64, sendErr error) {
+	inc := 1
+	if errors.Is(sendErr, ErrTokenFailed) {
+		inc = 0
+	}
 	_, err := db.Exec(
-		`UPDATE mera_integration_jobs SET status='failed', error_message=?, retry_count=retry_count+1 WHERE id=?`,
-		errMsg, jobID)
+		`UPDATE mera_integration_jobs SET status='failed', error_message=?, retry_count=retry_count+?,
+			next_retry_at = NOW() + INTERVAL (? * POW(2, GREATEST(retry_count-1, 0))) SECOND
+		 WHERE id=?`,
+		sendErr.Error(), inc, max(live.get().RetryBackoff, 0), jobID)
 	if err != nil {
-		log.Printf("⚠️ fail job %d: %v", jobID, err)
+		logErrorf("❌ fail job %d: %v", jobID, err)
+	}
+	recordJobAttempt(db, jobID, "failed", "", sendErr.Error())
+}
+
+// recordJobAttempt appends one send attempt to the job's history
+func recordJobAttempt(db *sql.DB, jobID int64, status, fhirID, errMsg string) {
+	if _, err := db.Exec(
+		`INSERT INTO mera_integration_job_attempts (job_id, status, fhir_id, error_message) VALUES (?, ?, ?, ?)`,
+		jobID, status, fhirID, errMsg); err != nil {
+		logWarnf("⚠️ record attempt of job %d: %v", jobID, err)
 	}
 }
 
@@ -79,21 +170,40 @@ func failJob(db *sql.DB, jobID int64, errMsg string) {
 // RETRY LOGIC
 // ============================================================
 
-func (a *App) retryOneJob(jobID int64) map[string]interface{} {
-	var resourceType, payload, status string
+// retryOneJob re-sends the stored payload of a job, or builds and sends a
+// queued row. force also re-sends successful jobs and ignores the retry
+// limit, replacing fhir_id.
+func (a *App) retryOneJob(jobID int64, force bool) map[string]interface{} {
+	var resourceType, key, payload, status, nextRetry, org, batchID string
 	var retryCount int
 	err := a.db.QueryRow(
-		`SELECT resource_type, payload, status, retry_count FROM mera_integration_jobs WHERE id=?`, jobID,
-	).Scan(&resourceType, &payload, &status, &retryCount)
+		`SELECT resource_type, idempotency_key, payload, status, retry_count, org, batch_id,
+			IF(next_retry_at > NOW(), DATE_FORMAT(next_retry_at, '%Y-%m-%d %H:%i:%s'), '')
+		 FROM mera_integration_jobs WHERE id=?`, jobID,
+	).Scan(&resourceType, &key, &payload, &status, &retryCount, &org, &batchID, &nextRetry)
 	if err != nil {
 		return map[string]interface{}{"id": jobID, "status": "error", "error": "job not found"}
 	}
-	if status == "success" {
+	if status == "success" && !force {
 		return map[string]interface{}{"id": jobID, "status": "skipped", "reason": "already success"}
 	}
-	if retryCount >= 3 {
+	if retryCount >= 3 && !force {
 		return map[string]interface{}{"id": jobID, "status": "skipped", "reason": "max retries (3) reached"}
 	}
+	if nextRetry != "" && !force {
+		return map[string]interface{}{"id": jobID, "status": "skipped", "reason": "backoff until " + nextRetry}
+	}
+
+	// Re-send with the credentials of the org that created the job
+	a, ok := a.useOrg(org)
+	if !ok {
+		return map[string]interface{}{"id": jobID, "status": "error", "error": "org " + org + " is no longer configured"}
+	}
+
+	// A queued row (SS_ASYNC_SEND) has no payload yet: its send flow builds it
+	if row, ok := queuedRowOf(payload); ok {
+		return a.sendQueuedRow(jobID, resourceType, key, org, batchID, row)
+	}
 
 	// Parse payload
 	var fhirPayload map[string]interface{}
@@ -106,22 +216,37 @@ func (a *App) retryOneJob(jobID int64) map[string]interface{} {
 	var sendErr error
 	switch resourceType {
 	case "Encounter", "EncounterRanap":
-		fhirID, sendErr = a.ss.SendEncounter(fhirPayload)
+		fhirID, sendErr = a.encounterSender(key)(fhirPayload) // key is the no_rawat
 	case "Condition":
 		fhirID, sendErr = a.ss.SendCondition(fhirPayload)
 	case "Procedure":
 		fhirID, sendErr = a.ss.SendProcedure(fhirPayload)
+	case "ServiceRequest":
+		fhirID, sendErr = a.ss.SendServiceRequest(fhirPayload)
+	case "Specimen":
+		fhirID, sendErr = a.ss.SendSpecimen(fhirPayload)
 	case "MedicationRequest":
 		fhirID, sendErr = a.ss.SendMedicationRequest(fhirPayload)
 	case "MedicationDispense":
 		fhirID, sendErr = a.ss.SendMedicationDispense(fhirPayload)
+	case "Device":
+		fhirID, sendErr = a.ss.SendDevice(fhirPayload)
+	case "QuestionnaireResponse":
+		fhirID, sendErr = a.ss.SendQuestionnaireResponse(fhirPayload)
+	case "Composition":
+		fhirID, sendErr = a.ss.SendComposition(fhirPayload)
+	case "Patient":
+		fhirID, sendErr = a.ss.CreatePatient(fhirPayload)
 	default:
 		// Observation types (TTV, Lab, Rad)
 		fhirID, sendErr = a.ss.SendObservation(fhirPayload)
 	}
+	if id, ok := a.adoptDuplicate(fhirPayload, sendErr); ok {
+		fhirID, sendErr = id, nil
+	}
 
 	if sendErr != nil {
-		failJob(a.db, jobID, sendErr.Error())
+		failJob(a.db, jobID, sendErr)
 		return map[string]interface{}{"id": jobID, "status": "failed", "error": sendErr.Error(), "retry_count": retryCount + 1}
 	}
 
@@ -133,35 +258,111 @@ func (a *App) retryOneJob(jobID int64) map[string]interface{} {
 // HANDLERS
 // ============================================================
 
-func (a *App) handleListJobs(w http.ResponseWriter, r *http.Request) {
-	tgl1 := r.URL.Query().Get("tgl1")
-	tgl2 := r.URL.Query().Get("tgl2")
-	status := r.URL.Query().Get("status")
-	limit := r.URL.Query().Get("limit")
-	if limit == "" {
-		limit = "100"
-	}
-
-	query := `SELECT id, resource_type, idempotency_key, status, fhir_id, error_message, retry_count, created_at, updated_at
-		FROM mera_integration_jobs WHERE 1=1`
+// jobsWhere builds the filter of the job list from tgl1/tgl2, status,
+// batch_id, resource_type and idempotency_key (a substring)
+func jobsWhere(q url.Values) (string, []interface{}) {
+	where := " WHERE 1=1"
 	var args []interface{}
 
+	tgl1, tgl2 := q.Get("tgl1"), q.Get("tgl2")
 	if tgl1 != "" && tgl2 != "" {
-		query += " AND DATE(created_at) BETWEEN ? AND ?"
+		where += " AND DATE(created_at) BETWEEN ? AND ?"
 		args = append(args, tgl1, tgl2)
 	}
-	if status != "" {
-		query += " AND status = ?"
+	if status := q.Get("status"); status != "" {
+		where += " AND status = ?"
 		args = append(args, status)
 	}
-	query += " ORDER BY created_at DESC LIMIT ?"
-	limitInt, _ := strconv.Atoi(limit)
-	if limitInt <= 0 {
-		limitInt = 100
+	if batchID := q.Get("batch_id"); batchID != "" {
+		where += " AND batch_id = ?"
+		args = append(args, batchID)
+	}
+	if resType := q.Get("resource_type"); resType != "" {
+		where += " AND resource_type = ?"
+		args = append(args, resType)
 	}
-	args = append(args, limitInt)
+	if key := q.Get("idempotency_key"); key != "" {
+		where += " AND idempotency_key LIKE ?"
+		args = append(args, "%"+likePrefix(key))
+	}
+	return where, args
+}
 
-	rows, err := a.db.Query(query, args...)
+// jobsSortColumns are the columns the job list can be sorted on (?sort=)
+var jobsSortColumns = map[string]bool{"created_at": true, "updated_at": true, "retry_count": true}
+
+// jobsPage is the sorting and paging of a job list request
+type jobsPage struct {
+	Sort, Dir     string
+	Limit, Offset int
+}
+
+// parseJobsPage reads sort (default created_at), dir (asc|desc, default
+// desc), limit, and offset or a 1-based page of limit rows. defaultLimit <= 0
+// means no limit unless one is given explicitly; offset needs a limit.
+func parseJobsPage(q url.Values, defaultLimit int) (jobsPage, error) {
+	p := jobsPage{Sort: strings.ToLower(q.Get("sort")), Dir: strings.ToLower(q.Get("dir"))}
+	if p.Sort == "" {
+		p.Sort = "created_at"
+	}
+	if !jobsSortColumns[p.Sort] {
+		return p, fmt.Errorf("sort must be created_at, updated_at or retry_count")
+	}
+	switch p.Dir {
+	case "":
+		p.Dir = "desc"
+	case "asc", "desc":
+	default:
+		return p, fmt.Errorf("dir must be asc or desc")
+	}
+	if p.Limit, _ = strconv.Atoi(q.Get("limit")); p.Limit <= 0 {
+		p.Limit = max(defaultLimit, 0)
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("offset must be a number >= 0")
+		}
+		p.Offset = n
+	} else if v := q.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return p, fmt.Errorf("page must be a number >= 1")
+		}
+		p.Offset = (n - 1) * p.Limit
+	}
+	if p.Limit == 0 {
+		p.Offset = 0
+	}
+	return p, nil
+}
+
+// jobsQuery builds the job list query: jobsWhere's filter in parseJobsPage's
+// order and page. Rows with equal sort values keep a stable order by id.
+func jobsQuery(q url.Values, defaultLimit int) (string, []interface{}, jobsPage, error) {
+	page, err := parseJobsPage(q, defaultLimit)
+	if err != nil {
+		return "", nil, page, err
+	}
+	where, args := jobsWhere(q)
+	query := `SELECT id, resource_type, idempotency_key, status, fhir_id, IFNULL(error_message,''), retry_count, created_at, updated_at
+		FROM mera_integration_jobs` + where +
+		" ORDER BY " + page.Sort + " " + page.Dir + ", id " + page.Dir
+	if page.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, page.Limit, page.Offset)
+	}
+	return query, args, page, nil
+}
+
+func (a *App) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	query, args, page, err := jobsQuery(r.URL.Query(), 100)
+	if err != nil {
+		jsonError(w, err.Error(), 400)
+		return
+	}
+
+	rows, err := a.db.QueryContext(r.Context(), query, args...)
 	if err != nil {
 		jsonError(w, err.Error(), 500)
 		return
@@ -174,6 +375,7 @@ func (a *App) handleListJobs(w http.ResponseWriter, r *http.Request) {
 		var resType, idempKey, st, fhirID, errMsg string
 		var createdAt, updatedAt time.Time
 		if err := rows.Scan(&id, &resType, &idempKey, &st, &fhirID, &errMsg, &retryCount, &createdAt, &updatedAt); err != nil {
+			logWarnf("⚠️ scan job row: %v", err)
 			continue
 		}
 		jobs = append(jobs, map[string]interface{}{
@@ -198,9 +400,187 @@ func (a *App) handleListJobs(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	jsonResponse(w, map[string]interface{}{
+	// Jobs matching the filters across every page
+	where, whereArgs := jobsWhere(r.URL.Query())
+	matched := len(jobs)
+	if err := a.db.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM mera_integration_jobs"+where, whereArgs...).Scan(&matched); err != nil {
+		logWarnf("⚠️ count jobs: %v", err)
+	}
+
+	resp := map[string]interface{}{
 		"total": len(jobs), "pending": pending, "failed": failed, "success": success,
+		"matched": matched, "sort": page.Sort, "dir": page.Dir, "limit": page.Limit, "offset": page.Offset,
 		"jobs": jobs,
+	}
+	if batchID := r.URL.Query().Get("batch_id"); batchID != "" {
+		if b, err := a.batchProgress(r.Context(), batchID); err == nil {
+			resp["batch"] = b
+		}
+	}
+	jsonResponse(w, resp)
+}
+
+// handleGetJob returns one job with its full payload and every send attempt,
+// pretty-printed
+func (a *App) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		jsonError(w, "invalid job id", 400)
+		return
+	}
+	var resType, idempKey, payload, st, fhirID, errMsg, batchID, org string
+	var retryCount int
+	var nextRetry sql.NullTime
+	var createdAt, updatedAt time.Time
+	err = a.db.QueryRowContext(r.Context(),
+		`SELECT resource_type, idempotency_key, payload, status, fhir_id, IFNULL(error_message,''),
+			retry_count, next_retry_at, batch_id, org, created_at, updated_at
+		 FROM mera_integration_jobs WHERE id=?`, id,
+	).Scan(&resType, &idempKey, &payload, &st, &fhirID, &errMsg, &retryCount, &nextRetry, &batchID, &org, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		jsonError(w, "job not found", 404)
+		return
+	}
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+
+	attempts := []map[string]interface{}{}
+	rows, err := a.db.QueryContext(r.Context(),
+		`SELECT status, fhir_id, IFNULL(error_message,''), attempted_at
+		 FROM mera_integration_job_attempts WHERE job_id=? ORDER BY id`, id)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var aSt, aFHIRID, aErr string
+		var at time.Time
+		if err := rows.Scan(&aSt, &aFHIRID, &aErr, &at); err != nil {
+			continue
+		}
+		attempts = append(attempts, map[string]interface{}{
+			"status": aSt, "fhir_id": aFHIRID, "error_message": aErr, "attempted_at": at.Format(time.RFC3339),
+		})
+	}
+
+	job := map[string]interface{}{
+		"id": id, "resource_type": resType, "idempotency_key": idempKey,
+		"status": st, "fhir_id": fhirID, "error_message": errMsg,
+		"retry_count": retryCount, "next_retry_at": nil,
+		"batch_id": batchID, "org": org,
+		"created_at": createdAt.Format(time.RFC3339),
+		"updated_at": updatedAt.Format(time.RFC3339),
+		"payload":    json.RawMessage(payload),
+		"attempts":   attempts,
+	}
+	if nextRetry.Valid {
+		job["next_retry_at"] = nextRetry.Time.Format(time.RFC3339)
+	}
+	body, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// jobCounts tallies jobs by status
+type jobCounts struct {
+	Success int `json:"success"`
+	Failed  int `json:"failed"`
+	Pending int `json:"pending"`
+	Total   int `json:"total"`
+}
+
+func (c *jobCounts) add(status string, n int) {
+	switch status {
+	case "success":
+		c.Success += n
+	case "failed":
+		c.Failed += n
+	case "pending":
+		c.Pending += n
+	}
+	c.Total += n
+}
+
+// handleJobStats aggregates jobs created in tgl1–tgl2 (default the last 30
+// days) per day and per resource type, for trend charts and alerting. Days
+// without any job are included with zero counts. The range is capped at
+// maxRangeDays.
+func (a *App) handleJobStats(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	tgl1, tgl2 := q.Get("tgl1"), q.Get("tgl2")
+	if tgl1 == "" || tgl2 == "" {
+		now := time.Now()
+		tgl1, tgl2 = now.AddDate(0, 0, -29).Format("2006-01-02"), now.Format("2006-01-02")
+	}
+	start, err1 := time.Parse("2006-01-02", tgl1)
+	end, err2 := time.Parse("2006-01-02", tgl2)
+	if err1 != nil || err2 != nil || end.Before(start) {
+		jsonError(w, "tgl1 and tgl2 must be YYYY-MM-DD dates with tgl1 <= tgl2", 400)
+		return
+	}
+	if days := int(end.Sub(start).Hours()/24) + 1; days > maxRangeDays {
+		jsonError(w, fmt.Sprintf("tgl1–tgl2 spans %d days, at most %d allowed", days, maxRangeDays), 400)
+		return
+	}
+
+	rows, err := a.db.QueryContext(r.Context(),
+		`SELECT DATE(created_at), resource_type, status, COUNT(*)
+		FROM mera_integration_jobs WHERE DATE(created_at) BETWEEN ? AND ?
+		GROUP BY DATE(created_at), resource_type, status`, tgl1, tgl2)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+
+	var total jobCounts
+	perDay := map[string]*jobCounts{}
+	perResource := map[string]*jobCounts{}
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		perDay[d.Format("2006-01-02")] = &jobCounts{}
+	}
+	for rows.Next() {
+		var day time.Time
+		var resType, status string
+		var n int
+		if err := rows.Scan(&day, &resType, &status, &n); err != nil {
+			logWarnf("⚠️ scan job stats: %v", err)
+			continue
+		}
+		date := day.Format("2006-01-02")
+		if perDay[date] == nil {
+			perDay[date] = &jobCounts{}
+		}
+		if perResource[resType] == nil {
+			perResource[resType] = &jobCounts{}
+		}
+		perDay[date].add(status, n)
+		perResource[resType].add(status, n)
+		total.add(status, n)
+	}
+
+	days := make([]map[string]interface{}, 0, len(perDay))
+	for date, c := range perDay {
+		days = append(days, map[string]interface{}{"date": date, "success": c.Success, "failed": c.Failed, "pending": c.Pending, "total": c.Total})
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i]["date"].(string) < days[j]["date"].(string) })
+	resources := make([]map[string]interface{}, 0, len(perResource))
+	for rt, c := range perResource {
+		resources = append(resources, map[string]interface{}{"resource_type": rt, "success": c.Success, "failed": c.Failed, "pending": c.Pending, "total": c.Total})
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i]["resource_type"].(string) < resources[j]["resource_type"].(string)
+	})
+	jsonResponse(w, map[string]interface{}{
+		"tgl1": tgl1, "tgl2": tgl2, "totals": total,
+		"days": days, "resources": resources,
 	})
 }
 
@@ -213,17 +593,20 @@ func (a *App) handleRetryJobs(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "invalid request body", 400)
 		return
 	}
+	a = a.batch(r.Context())
 
 	var results []map[string]interface{}
 
 	if req.ID > 0 {
 		// Retry single job
-		result := a.retryOneJob(req.ID)
+		result := a.retryOneJob(req.ID, false)
 		results = append(results, result)
 	} else if req.Status == "failed" {
-		// Retry all failed jobs (retry_count < 3)
-		rows, err := a.db.Query(
-			`SELECT id FROM mera_integration_jobs WHERE status='failed' AND retry_count < 3 ORDER BY created_at LIMIT 100`)
+		// Retry all failed jobs (retry_count < 3) whose backoff has passed
+		rows, err := a.db.QueryContext(a.ctx,
+			`SELECT id FROM mera_integration_jobs
+			 WHERE status='failed' AND retry_count < 3 AND (next_retry_at IS NULL OR next_retry_at <= NOW())
+			 ORDER BY created_at LIMIT 100`)
 		if err != nil {
 			jsonError(w, err.Error(), 500)
 			return
@@ -237,35 +620,78 @@ func (a *App) handleRetryJobs(w http.ResponseWriter, r *http.Request) {
 		rows.Close()
 
 		for _, id := range ids {
-			results = append(results, a.retryOneJob(id))
+			if a.ctx.Err() != nil {
+				break // client went away
+			}
+			results = append(results, a.retryOneJob(id, false))
 		}
 	} else {
 		jsonError(w, "provide 'id' or 'status':'failed'", 400)
 		return
 	}
 
-	retried, succeeded, stillFailed := 0, 0, 0
+	retried, succeeded, stillFailed, skipped := 0, 0, 0, 0
 	for _, r := range results {
 		retried++
-		if r["status"] == "success" {
+		switch r["status"] {
+		case "success":
 			succeeded++
-		} else if r["status"] == "failed" {
+		case "failed":
 			stillFailed++
+		case "skipped":
+			skipped++
 		}
 	}
 
 	jsonResponse(w, map[string]interface{}{
-		"retried": retried, "succeeded": succeeded, "still_failed": stillFailed,
+		"retried": retried, "succeeded": succeeded, "still_failed": stillFailed, "skipped": skipped,
 		"details": results,
 	})
 }
 
+// handleReplayJob re-sends one job found by resource_type + idempotency_key,
+// e.g. a key copied from the log. force re-POSTs even a successful job, for
+// resources SatuSehat lost while we still hold the exact payload.
+func (a *App) handleReplayJob(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ResourceType   string `json:"resource_type"`
+		IdempotencyKey string `json:"idempotency_key"`
+		Force          bool   `json:"force"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ResourceType == "" || req.IdempotencyKey == "" {
+		jsonError(w, "invalid request body: resource_type and idempotency_key required", 400)
+		return
+	}
+	var jobID int64
+	err := a.db.QueryRowContext(r.Context(), `SELECT id FROM mera_integration_jobs WHERE resource_type=? AND idempotency_key=?`,
+		req.ResourceType, req.IdempotencyKey).Scan(&jobID)
+	if err == sql.ErrNoRows {
+		jsonError(w, "job not found", 404)
+		return
+	}
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	result := a.batch(r.Context()).retryOneJob(jobID, req.Force)
+	if req.Force && result["status"] == "success" {
+		logWarnf("⚠️ job %d (%s %s) force-replayed, new fhir_id %v", jobID, req.ResourceType, req.IdempotencyKey, result["fhir_id"])
+	}
+	jsonResponse(w, result)
+}
+
 func initJobsTable(db *sql.DB) {
 	_, err := db.Exec(createJobsTableSQL)
 	if err != nil {
-		log.Printf("⚠️ create mera_integration_jobs table: %v", err)
+		logErrorf("❌ create mera_integration_jobs table: %v", err)
 	} else {
-		log.Println("✅ mera_integration_jobs table ready")
+		ensureColumn(db, "mera_integration_jobs", "batch_id", "VARCHAR(36) DEFAULT '', ADD INDEX idx_batch (batch_id)")
+		ensureColumn(db, "mera_integration_jobs", "org", "VARCHAR(50) DEFAULT '' AFTER batch_id")
+		ensureColumn(db, "mera_integration_jobs", "next_retry_at", "DATETIME NULL AFTER retry_count, ADD INDEX idx_next_retry (next_retry_at)")
+		logInfof("✅ mera_integration_jobs table ready")
+	}
+	if _, err := db.Exec(createJobAttemptsTableSQL); err != nil {
+		logErrorf("❌ create mera_integration_job_attempts table: %v", err)
 	}
 }
 
@@ -282,19 +708,35 @@ func idempKey(parts ...string) string {
 }
 
 // sendViaJob wraps the job creation + send + complete/fail flow.
-// Returns (fhirID, error). If job already existed, returns ("", nil) to signal skip.
+// Returns (fhirID, error). If the job already existed it is not sent again:
+// the id of a successful job is returned, "" (skip) while it is still pending
+// or failed. A queued row (SS_ASYNC_SEND) is the exception: it is filled with
+// payload and sent.
 func (a *App) sendViaJob(resourceType, idempotencyKey string, payload map[string]interface{},
 	sendFn func(map[string]interface{}) (string, error)) (string, error) {
 
-	jobID := createJob(a.db, resourceType, idempotencyKey, payload)
+	// Rejected locally, no job: the payload is rebuilt on the next send
+	if err := validatePayload(payload); err != nil {
+		return "", err
+	}
+	jobID := createJob(a.db, resourceType, idempotencyKey, payload, a.batchID, a.org)
 	if jobID == 0 {
-		return "", nil // already processed
+		if jobID = fillQueuedJob(a.db, resourceType, idempotencyKey, payload); jobID == 0 {
+			// Already processed. A job that succeeded on retry (or by adopting
+			// a duplicate) hands back its id so the caller's tracking table
+			// catches up.
+			return jobFHIRID(a.db, resourceType, idempotencyKey), nil
+		}
 	}
+	rowLimitFrom(a.ctx).take()
 
 	fhirID, err := sendFn(payload)
+	if id, ok := a.adoptDuplicate(payload, err); ok {
+		fhirID, err = id, nil
+	}
 	if err != nil {
-		failJob(a.db, jobID, err.Error())
-		return "", fmt.Errorf("%w", err)
+		failJob(a.db, jobID, err)
+		return "", err
 	}
 
 	completeJob(a.db, jobID, fhirID)
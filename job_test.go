@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// TestListJobsNullError: jobs never failed have a NULL error_message; the
+// list reads it as "" instead of dropping the row on a scan error.
+func TestListJobsNullError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := &App{db: db}
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT id, resource_type, idempotency_key, status, fhir_id, IFNULL\\(error_message,''\\)").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "resource_type", "idempotency_key", "status", "fhir_id", "error_message", "retry_count", "created_at", "updated_at"}).
+			AddRow(1, "Condition", "2025/01/02/000001|A09", "pending", "", "", 0, now, now))
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM mera_integration_jobs").
+		WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow(1))
+
+	w := httptest.NewRecorder()
+	a.handleListJobs(w, httptest.NewRequest("GET", "/api/jobs", nil))
+	var resp struct {
+		Jobs []map[string]interface{} `json:"jobs"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Jobs) != 1 || resp.Jobs[0]["error_message"] != "" {
+		t.Fatalf("jobs = %v, want the one job with an empty error_message", resp.Jobs)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ============================================================
+// LOCATION MAPPING CHECK
+// ============================================================
+
+// locationMappings are the Khanza mapping tables that carry id_lokasi_satusehat,
+// with the local code column of each
+var locationMappings = []struct{ Table, CodeCol string }{
+	{"satu_sehat_mapping_lokasi_ralan", "kd_poli"},
+	{"satu_sehat_mapping_lokasi_ranap", "kd_kamar"},
+	{"satu_sehat_mapping_lokasi_depo_farmasi", "kd_bangsal"},
+}
+
+type LocationCheck struct {
+	IDLokasi string   `json:"id_lokasi_satusehat"`
+	Table    string   `json:"table"`
+	Codes    []string `json:"codes"`
+	Status   string   `json:"status"` // ok | not_found | wrong_org | error
+	Name     string   `json:"name,omitempty"`
+	OrgRef   string   `json:"managing_organization,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// queryMappedLocations lists every distinct id_lokasi_satusehat per mapping
+// table with the local codes that point at it. Missing tables are skipped.
+func (a *App) queryMappedLocations(ctx context.Context) []LocationCheck {
+	var out []LocationCheck
+	for _, m := range locationMappings {
+		rows, err := a.db.QueryContext(ctx, fmt.Sprintf(`SELECT id_lokasi_satusehat, GROUP_CONCAT(%s ORDER BY %s)
+			FROM %s WHERE id_lokasi_satusehat <> '' GROUP BY id_lokasi_satusehat`, m.CodeCol, m.CodeCol, m.Table))
+		if err != nil {
+			logWarnf("⚠️ query %s: %v", m.Table, err)
+			continue
+		}
+		for rows.Next() {
+			var id, codes string
+			if err := rows.Scan(&id, &codes); err != nil {
+				logWarnf("⚠️ scan %s: %v", m.Table, err)
+				continue
+			}
+			out = append(out, LocationCheck{IDLokasi: id, Table: m.Table, Codes: strings.Split(codes, ",")})
+		}
+		rows.Close()
+	}
+	return out
+}
+
+// checkLocation resolves Location/{id} and checks it is managed by SS_ORG_ID
+func (a *App) checkLocation(ctx context.Context, c *LocationCheck) {
+	code, result, err := a.ss.doRequestStatus(ctx, "GET", "/Location/"+c.IDLokasi, nil)
+	rt, _ := result["resourceType"].(string)
+	switch {
+	case err != nil:
+		c.Status, c.Error = "error", err.Error()
+	case code == http.StatusNotFound || rt == "OperationOutcome":
+		c.Status = "not_found"
+	case rt != "Location":
+		c.Status, c.Error = "error", fmt.Sprintf("unexpected response (HTTP %d)", code)
+	default:
+		c.Name, _ = result["name"].(string)
+		if org, ok := result["managingOrganization"].(map[string]interface{}); ok {
+			c.OrgRef, _ = org["reference"].(string)
+		}
+		c.Status = "ok"
+		if c.OrgRef != "Organization/"+a.cfg.SSOrgID {
+			c.Status = "wrong_org"
+		}
+	}
+}
+
+// verifyLocations checks every mapped location and tallies the outcomes
+func (a *App) verifyLocations(ctx context.Context) ([]LocationCheck, map[string]int) {
+	checks := a.queryMappedLocations(ctx)
+	summary := map[string]int{"ok": 0, "not_found": 0, "wrong_org": 0, "error": 0}
+	for i := range checks {
+		a.checkLocation(ctx, &checks[i])
+		summary[checks[i].Status]++
+		if checks[i].Status != "ok" {
+			logWarnf("⚠️ location %s (%s %s): %s %s", checks[i].IDLokasi, checks[i].Table,
+				strings.Join(checks[i].Codes, ","), checks[i].Status, checks[i].Error)
+		}
+	}
+	return checks, summary
+}
+
+func (a *App) handleVerifyLocations(w http.ResponseWriter, r *http.Request) {
+	checks, summary := a.verifyLocations(r.Context())
+	var problems []LocationCheck
+	for _, c := range checks {
+		if c.Status != "ok" {
+			problems = append(problems, c)
+		}
+	}
+	resp := map[string]interface{}{
+		"org_id": a.cfg.SSOrgID, "total": len(checks), "summary": summary, "problems": problems,
+	}
+	if r.URL.Query().Get("all") == "true" {
+		resp["locations"] = checks
+	}
+	jsonResponse(w, resp)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// ============================================================
+// LEVELED LOGGING
+// ============================================================
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug: "DEBUG",
+	levelInfo:  "INFO",
+	levelWarn:  "WARN",
+	levelError: "ERROR",
+}
+
+// minLogLevel is set from LOG_LEVEL at startup and on SIGHUP
+var minLogLevel atomic.Int32
+
+func init() { setLogLevel(levelInfo) }
+
+func setLogLevel(level logLevel) { minLogLevel.Store(int32(level)) }
+
+// logEnabled reports whether messages of level are written
+func logEnabled(level logLevel) bool { return int32(level) >= minLogLevel.Load() }
+
+// parseLogLevel maps LOG_LEVEL (debug|info|warn|error) to a level, defaulting to info
+func parseLogLevel(s string) logLevel {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return levelDebug
+	case "warn", "warning":
+		return levelWarn
+	case "error":
+		return levelError
+	default:
+		return levelInfo
+	}
+}
+
+// logf writes one line prefixed with its level so aggregators can filter on it
+func logf(level logLevel, format string, args ...interface{}) {
+	if !logEnabled(level) {
+		return
+	}
+	log.Printf("%-5s %s", logLevelNames[level], fmt.Sprintf(format, args...))
+}
+
+func logDebugf(format string, args ...interface{}) { logf(levelDebug, format, args...) }
+func logInfof(format string, args ...interface{})  { logf(levelInfo, format, args...) }
+func logWarnf(format string, args ...interface{})  { logf(levelWarn, format, args...) }
+func logErrorf(format string, args ...interface{}) { logf(levelError, format, args...) }
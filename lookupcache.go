@@ -0,0 +1,52 @@
+package main
+
+import "sync"
+
+// ============================================================
+// PER-REQUEST LOOKUP CACHE
+// ============================================================
+
+// lookupCache dedupes Patient/Practitioner lookups within one send request.
+// Concurrent callers for the same key wait for the first lookup instead of
+// issuing their own. Only successes are kept; a failed lookup is forgotten
+// once its waiters have seen the error, so a later row can try again.
+type lookupCache struct {
+	mu      sync.Mutex
+	entries map[string]*lookupEntry
+}
+
+type lookupEntry struct {
+	ready chan struct{}
+	id    string
+	err   error
+}
+
+func newLookupCache() *lookupCache {
+	return &lookupCache{entries: map[string]*lookupEntry{}}
+}
+
+// get returns the cached id for key, calling fn at most once at a time per
+// key. A nil cache just calls fn.
+func (c *lookupCache) get(key string, fn func() (string, error)) (string, error) {
+	if c == nil {
+		return fn()
+	}
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.mu.Unlock()
+		<-e.ready
+		return e.id, e.err
+	}
+	e := &lookupEntry{ready: make(chan struct{})}
+	c.entries[key] = e
+	c.mu.Unlock()
+
+	e.id, e.err = fn()
+	if e.err != nil {
+		c.mu.Lock()
+		delete(c.entries, key)
+		c.mu.Unlock()
+	}
+	close(e.ready)
+	return e.id, e.err
+}
@@ -1,17 +1,24 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/joho/godotenv"
 )
 
 // ============================================================
@@ -29,11 +36,62 @@ type Config struct {
 	SSAuthURL  string
 	SSFHIRURL  string
 	SSOrgID    string
+	SSEnv      string // "staging" / "production" preset for the two URLs above
 	Port       string
+
+	// DBConnectTimeout is how long startup keeps retrying the DB ping and first token
+	DBConnectTimeout time.Duration
+
+	ShutdownTimeout time.Duration
+	SendOrder       string
+	SendLogBatch    int
+	SendLogFlush    time.Duration
+	ExtraHeaders    map[string]string
+	RequestIDHeader string
+	NotFoundAsSkip  bool
+	HTTPAudit       bool
+	AdminAPIKey     string
+	ChunkDays       int
+	AllowNameLookup bool
+	// AllowPatientCreate POSTs a Patient from pasien when the NIK lookup finds none
+	AllowPatientCreate bool
+	LookupTimeout      time.Duration
+	LogLevel           string
+	Questionnaire      bool
+	RateLimit          float64 // FHIR requests/sec across all goroutines, 0 = unlimited
+	// RequireVerification lists resource types (Condition, MedicationDispense)
+	// that are only sent after POST .../verify
+	RequireVerification map[string]bool
+	RadMaxValueLen      int
+	LabMaxValueLen      int
+	ConditionStatusCol  string
+	ConditionOriginCol  string // diagnosa_pasien column with the no_rawat of the diagnosis' original visit
+	ResumeTable         string // Khanza resume table the Composition sections are read from
+	DispenserCol        string // detail_pemberian_obat column with the pegawai.nik of the dispensing pharmacist
+	EncounterWorkers    int    // concurrent location partitions per encounter batch, <= 1 = sequential
+	MaxBatch            int    // rows sent per send request at most, 0 = no cap
+	WebhookURL          string
+	WebhookSecret       string            // HMAC-SHA256 key for the X-Signature header, empty = unsigned
+	TokenAlertThreshold int               // consecutive token failures before the webhook fires, 0 = off
+	EnableUpdates       bool              // PUT sent vital signs again when their source value changed
+	VerifyLocations     bool              // check every mapped id_lokasi_satusehat at startup
+	ReferralMode        string            // "", "origin" or "servicerequest" (see referral.go)
+	IGDPoli             string            // kd_poli of the IGD, ranap admitSource emd
+	RequestLookupCache  bool              // share patient/practitioner lookups across one send request
+	DateFilter          map[string]string // resource → date the pending query filters on (see filter.go)
+	IdentifierBase      string            // base of the sys-ids identifier systems (see identifier.go)
+	NIKSystem           string            // identifier system of NIK lookups
+	MetaProfile         bool              // declare meta.profile on every resource (see profile.go)
+	MetaProfiles        string            // "Type=URL" overrides of the default profiles
+	RetryBackoff        int               // seconds before the first retry of a failed job, doubling per failure
+	SearchBeforeCreate  bool              // look an Encounter up by identifier before POSTing it
+	AsyncSend           bool              // send endpoints queue their rows for the background worker
+	DefaultPractNIK     string            // practitioner of Observations whose row has no dokter NIK, "" = skip them
+	EnabledResources    map[string]bool   // send flows in use (see resources.go), empty = all
 }
 
 func loadConfig() Config {
-	godotenv.Load() // ignore error — will use env vars if no .env
+	loadDotEnv() // no .env — will use env vars only
 	return Config{
 		DBHost:     getEnv("DB_HOST", "localhost"),
 		DBPort:     getEnv("DB_PORT", "3306"),
@@ -45,7 +103,53 @@ func loadConfig() Config {
 		SSAuthURL:  os.Getenv("SS_AUTH_URL"),
 		SSFHIRURL:  os.Getenv("SS_FHIR_URL"),
 		SSOrgID:    os.Getenv("SS_ORG_ID"),
+		SSEnv:      strings.ToLower(os.Getenv("SS_ENV")),
 		Port:       getEnv("PORT", "8089"),
+
+		ShutdownTimeout:     time.Duration(getEnvInt("SHUTDOWN_TIMEOUT", 60)) * time.Second,
+		DBConnectTimeout:    time.Duration(getEnvInt("DB_CONNECT_TIMEOUT", 60)) * time.Second,
+		SendOrder:           getEnv("SS_SEND_ORDER", "asc"),
+		SendLogBatch:        getEnvInt("SEND_LOG_BATCH", 50),
+		SendLogFlush:        time.Duration(getEnvInt("SEND_LOG_FLUSH_MS", 2000)) * time.Millisecond,
+		ExtraHeaders:        parseHeaderList(os.Getenv("EXTRA_HEADERS")),
+		RequestIDHeader:     os.Getenv("REQUEST_ID_HEADER"),
+		NotFoundAsSkip:      getEnvBool("SS_NOT_FOUND_AS_SKIP", false),
+		HTTPAudit:           getEnvBool("SS_HTTP_AUDIT", false),
+		AdminAPIKey:         os.Getenv("ADMIN_API_KEY"),
+		ChunkDays:           getEnvInt("SS_CHUNK_DAYS", 1),
+		AllowNameLookup:     getEnvBool("SS_ALLOW_NAME_LOOKUP", false),
+		AllowPatientCreate:  getEnvBool("SS_ALLOW_PATIENT_CREATE", false),
+		LookupTimeout:       time.Duration(getEnvInt("SS_LOOKUP_TIMEOUT", 10)) * time.Second,
+		LogLevel:            getEnv("LOG_LEVEL", "info"),
+		Questionnaire:       getEnvBool("SS_QUESTIONNAIRE_ENABLED", false),
+		RateLimit:           getEnvFloat("SS_RATE_LIMIT", 10),
+		RequireVerification: parseNameSet(getEnv("SS_REQUIRE_VERIFICATION", "")),
+		RadMaxValueLen:      getEnvInt("SS_RAD_MAX_VALUE_LENGTH", 10000),
+		LabMaxValueLen:      getEnvInt("SS_LAB_MAX_VALUE_LENGTH", 1000),
+		ConditionStatusCol:  getEnv("SS_CONDITION_STATUS_COLUMN", "status_penyakit"),
+		ConditionOriginCol:  os.Getenv("SS_CONDITION_ORIGIN_COLUMN"),
+		ResumeTable:         getEnv("SS_COMPOSITION_RESUME_TABLE", "resume_pasien_ranap"),
+		DispenserCol:        os.Getenv("SS_DISPENSER_COLUMN"),
+		EncounterWorkers:    getEnvInt("SS_ENCOUNTER_WORKERS", 1),
+		MaxBatch:            getEnvInt("SS_MAX_BATCH", 200),
+		WebhookURL:          os.Getenv("SS_WEBHOOK_URL"),
+		WebhookSecret:       os.Getenv("SS_WEBHOOK_SECRET"),
+		TokenAlertThreshold: getEnvInt("SS_TOKEN_ALERT_THRESHOLD", 3),
+		EnableUpdates:       getEnvBool("SS_ENABLE_UPDATES", false),
+		VerifyLocations:     getEnvBool("SS_VERIFY_LOCATIONS", false),
+		ReferralMode:        strings.ToLower(os.Getenv("SS_REFERRAL_MODE")),
+		IGDPoli:             getEnv("SS_IGD_POLI", "IGDK"),
+		RequestLookupCache:  getEnvBool("SS_REQUEST_LOOKUP_CACHE", true),
+		DateFilter:          parseHeaderList(os.Getenv("SS_DATE_FILTER")),
+		IdentifierBase:      getEnv("SS_IDENTIFIER_BASE", identifierBase),
+		MetaProfile:         getEnvBool("SS_META_PROFILE", false),
+		MetaProfiles:        os.Getenv("SS_META_PROFILES"),
+		NIKSystem:           getEnv("SS_NIK_SYSTEM", nikSystem),
+		RetryBackoff:        getEnvInt("SS_RETRY_BACKOFF", 60),
+		SearchBeforeCreate:  getEnvBool("SS_SEARCH_BEFORE_CREATE", false),
+		AsyncSend:           getEnvBool("SS_ASYNC_SEND", false),
+		DefaultPractNIK:     os.Getenv("SS_DEFAULT_PRACTITIONER_NIK"),
+		EnabledResources:    parseNameSet(strings.ToLower(os.Getenv("SS_ENABLED_RESOURCES"))),
 	}
 }
 
@@ -56,28 +160,296 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+// parseHeaderList parses "Key:Value,Key2:Value2" into a header map
+func parseHeaderList(s string) map[string]string {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(pair, ":")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			continue
+		}
+		headers[k] = strings.TrimSpace(v)
+	}
+	return headers
+}
+
+// parseNameSet parses "A,B" into a set, ignoring blanks
+func parseNameSet(s string) map[string]bool {
+	set := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			set[name] = true
+		}
+	}
+	return set
+}
+
+func getEnvInt(key string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return v
+	}
+	return fallback
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	if v, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+// ============================================================
+// CONFIG VALIDATION
+// ============================================================
+
+// SatuSehat org IDs are either the numeric IHS number of the parent
+// organization or the UUID of a sub-organization
+var (
+	orgIHSPattern  = regexp.MustCompile(`^\d{6,12}$`)
+	orgUUIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+// validateRequired lists every required setting left empty, so a fresh
+// install learns all of them at once instead of one restart per variable.
+// Run it after applyEnvPreset, which may fill the URLs.
+func (c Config) validateRequired() error {
+	var missing []string
+	for _, v := range []struct{ name, value string }{
+		{"SS_ORG_ID", c.SSOrgID},
+		{"SS_CLIENT_ID", c.SSClientID},
+		{"SS_CLIENT_SECRET", c.SSSecret},
+		{"SS_AUTH_URL", c.SSAuthURL},
+		{"SS_FHIR_URL", c.SSFHIRURL},
+	} {
+		if strings.TrimSpace(v.value) == "" {
+			missing = append(missing, v.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required settings: %s (SS_AUTH_URL/SS_FHIR_URL can come from SS_ENV)",
+			strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// validateOrgID checks that SS_ORG_ID looks like an IHS number or a UUID
+func validateOrgID(id string) error {
+	if id == "" {
+		return errors.New("SS_ORG_ID is empty")
+	}
+	if id != strings.TrimSpace(id) {
+		return fmt.Errorf("SS_ORG_ID %q has leading/trailing whitespace", id)
+	}
+	if !orgIHSPattern.MatchString(id) && !orgUUIDPattern.MatchString(id) {
+		return fmt.Errorf("SS_ORG_ID %q is neither a numeric IHS number nor a UUID", id)
+	}
+	return nil
+}
+
+// ssEnvPresets are the kemkes base URLs of each SS_ENV
+var ssEnvPresets = map[string]struct{ auth, fhir string }{
+	"staging": {
+		"https://api-satusehat-stg.dto.kemkes.go.id/oauth2/v1",
+		"https://api-satusehat-stg.dto.kemkes.go.id/fhir-r4/v1",
+	},
+	"production": {
+		"https://api-satusehat.kemkes.go.id/oauth2/v1",
+		"https://api-satusehat.kemkes.go.id/fhir-r4/v1",
+	},
+}
+
+// applyEnvPreset fills SS_AUTH_URL / SS_FHIR_URL left empty from the SS_ENV
+// preset; explicitly set URLs win
+func (c *Config) applyEnvPreset() error {
+	if c.SSEnv == "" {
+		return nil
+	}
+	p, ok := ssEnvPresets[c.SSEnv]
+	if !ok {
+		return fmt.Errorf("SS_ENV %q must be staging or production", c.SSEnv)
+	}
+	if c.SSAuthURL == "" {
+		c.SSAuthURL = p.auth
+	}
+	if c.SSFHIRURL == "" {
+		c.SSFHIRURL = p.fhir
+	}
+	return nil
+}
+
+// envName names the environment SS_FHIR_URL points at, for the startup log
+func (c Config) envName() string {
+	if c.isSandbox() {
+		return "staging"
+	}
+	return "production"
+}
+
+// isSandbox reports whether SS_FHIR_URL points at the staging/dev environment
+func (c Config) isSandbox() bool {
+	u := strings.ToLower(c.SSFHIRURL)
+	return strings.Contains(u, "-stg") || strings.Contains(u, "-dev") || strings.Contains(u, "sandbox")
+}
+
 // ============================================================
 // APP
 // ============================================================
 
 type App struct {
-	db  *sql.DB
-	ss  *SSClient
-	cfg Config
+	db      *sql.DB
+	ss      *SSClient
+	cfg     Config
+	logs    *sendLogWriter       // nil when SEND_LOG_BATCH <= 1 (synchronous inserts)
+	batchID string               // set on the per-request copy made by batch()
+	lookups *lookupCache         // per-request lookup cache, nil outside batch() or with SS_REQUEST_LOOKUP_CACHE=false
+	ctx     context.Context      // request context on batch() copies, Background otherwise
+	org     string               // SS_ORGS name a sends as, "" = SS_ORG_ID
+	orgs    map[string]orgClient // every configured org, "" = SS_ORG_ID
+	queue   *sendQueue           // worker sending queued rows, nil unless SS_ASYNC_SEND
 }
 
 // saveSendLog records every send attempt to satu_sehat_send_log
 func (a *App) saveSendLog(noRawat, resourceType, fhirID, status, errMsg string) {
-	_, err := a.db.Exec(`INSERT INTO satu_sehat_send_log
-		(no_rawat, resource_type, fhir_id, status, error_message)
-		VALUES (?, ?, ?, ?, ?)`,
-		noRawat, resourceType, fhirID, status, errMsg)
+	e := sendLogEntry{noRawat: noRawat, resourceType: resourceType, fhirID: fhirID, status: status, errMsg: errMsg, batchID: a.batchID}
+	if a.logs != nil {
+		a.logs.write(e)
+		return
+	}
+	insertSendLogs(a.db, []sendLogEntry{e})
+}
+
+// lookupStatus classifies a patient/practitioner lookup error. A not-found
+// (total:0) is "skipped" when SS_NOT_FOUND_AS_SKIP is on — the patient just
+// needs registering — everything else is "failed".
+func (a *App) lookupStatus(err error) string {
+	if a.cfg.NotFoundAsSkip && (errors.Is(err, ErrPatientNotFound) || errors.Is(err, ErrPractitionerNotFound)) {
+		return "skipped"
+	}
+	return "failed"
+}
+
+// canLookupPractitioner reports whether a practitioner can be resolved at all:
+// by NIK, or by name when SS_ALLOW_NAME_LOOKUP is on
+func (a *App) canLookupPractitioner(nik, name string) bool {
+	return nik != "" || (a.cfg.AllowNameLookup && name != "")
+}
+
+// observationPractitioner returns the NIK to resolve an Observation's
+// practitioner by: nik itself, or SS_DEFAULT_PRACTITIONER_NIK when the row has
+// no dokter that canLookupPractitioner could resolve
+func (a *App) observationPractitioner(nik, name, noRawat, resourceType string) string {
+	if a.canLookupPractitioner(nik, name) || a.cfg.DefaultPractNIK == "" {
+		return nik
+	}
+	logInfof("🩺 %s %s has no dokter NIK, attributed to default practitioner (SS_DEFAULT_PRACTITIONER_NIK)", resourceType, noRawat)
+	return a.cfg.DefaultPractNIK
+}
+
+// lookupContext bounds a single lookup by SS_LOOKUP_TIMEOUT so one slow
+// record can't stall a whole batch
+func (a *App) lookupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(a.ctx, a.cfg.LookupTimeout)
+}
+
+// lookupPatient resolves a patient by NIK within the lookup deadline, once
+// per send request
+func (a *App) lookupPatient(nik string) (string, error) {
+	return a.lookups.get("Patient|"+nik, func() (string, error) {
+		id, err := a.retryTransient("patient lookup", func() (string, error) {
+			ctx, cancel := a.lookupContext()
+			defer cancel()
+			id, err := a.ss.LookupPatient(ctx, nik)
+			return id, lookupTimeoutErr(ctx, err)
+		})
+		if err != nil {
+			return a.ensurePatient(nik, err)
+		}
+		return id, nil
+	})
+}
+
+// lookupPractitioner resolves a practitioner once per send request
+func (a *App) lookupPractitioner(nik, name string) (string, error) {
+	return a.lookups.get("Practitioner|"+nik+"|"+name, func() (string, error) {
+		return a.retryTransient("practitioner lookup", func() (string, error) {
+			return a.resolvePractitioner(nik, name)
+		})
+	})
+}
+
+// Inline retry of lookups that failed transiently
+const (
+	lookupAttempts     = 3
+	lookupRetryBackoff = 500 * time.Millisecond // doubled per attempt
+)
+
+// isTransient reports whether err may go away by itself: a 429/5xx answer or
+// a dropped connection. Not found, our own lookup deadline and token failures
+// (which have their own cooldown) are not.
+func isTransient(err error) bool {
+	if errors.Is(err, ErrTransient) {
+		return true
+	}
+	if errors.Is(err, ErrTokenFailed) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retryTransient calls lookup up to lookupAttempts times while it fails
+// transiently, so a momentary 429 does not fail an otherwise good row
+func (a *App) retryTransient(what string, lookup func() (string, error)) (string, error) {
+	for attempt := 1; ; attempt++ {
+		id, err := lookup()
+		if err == nil || attempt == lookupAttempts || !isTransient(err) {
+			return id, err
+		}
+		wait := lookupRetryBackoff << (attempt - 1)
+		logWarnf("⚠️ %s failed (attempt %d/%d), retrying in %s: %v", what, attempt, lookupAttempts, wait, err)
+		select {
+		case <-a.ctx.Done():
+			return id, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// resolvePractitioner resolves a practitioner by NIK, falling back to an
+// exact-one name match when the NIK is empty and SS_ALLOW_NAME_LOOKUP is on
+func (a *App) resolvePractitioner(nik, name string) (string, error) {
+	ctx, cancel := a.lookupContext()
+	defer cancel()
+	if nik != "" || !a.cfg.AllowNameLookup {
+		id, err := a.ss.LookupPractitioner(ctx, nik)
+		return id, lookupTimeoutErr(ctx, err)
+	}
+	id, err := a.ss.LookupPractitionerByName(ctx, name)
 	if err != nil {
-		log.Printf("⚠️ save send log: %v", err)
+		return "", lookupTimeoutErr(ctx, err)
 	}
+	logInfof("🔎 practitioner %q has no NIK, matched by NAME to Practitioner/%s", name, id)
+	return id, nil
+}
+
+// lookupTimeoutErr replaces the transport error of a lookup that hit its deadline with a clear message
+func lookupTimeoutErr(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("lookup timed out: %w", ctx.Err())
+	}
+	return err
 }
 
 func (a *App) handleHealth(w http.ResponseWriter, r *http.Request) {
+	a, _ = a.useOrg(orgFromContext(r.Context())) // token of the X-Org org, if any
 	err := a.db.Ping()
 	dbStatus := "ok"
 	if err != nil {
@@ -92,46 +464,109 @@ func (a *App) handleHealth(w http.ResponseWriter, r *http.Request) {
 		tokenStatus = "empty"
 	}
 
-	jsonResponse(w, map[string]interface{}{
-		"status":   "running",
-		"database": dbStatus,
-		"token":    tokenStatus,
-		"time":     time.Now().Format(time.RFC3339),
-	})
+	resp := map[string]interface{}{
+		"status":         "running",
+		"database":       dbStatus,
+		"token":          tokenStatus,
+		"token_failures": 0,
+		"time":           time.Now().Format(time.RFC3339),
+	}
+	if n, lastErr, at := a.ss.tokenMgr.Failures(); n > 0 {
+		resp["token_failures"] = n
+		resp["token_last_error"] = lastErr
+		resp["token_last_error_at"] = at.Format(time.RFC3339)
+	}
+	jsonResponse(w, resp)
+}
+
+// handleHealthSatuSehat checks token, FHIR base URL and org in one authenticated round trip
+func (a *App) handleHealthSatuSehat(w http.ResponseWriter, r *http.Request) {
+	a, _ = a.useOrg(orgFromContext(r.Context())) // token of the X-Org org, if any
+	resp := map[string]interface{}{
+		"auth_url": a.cfg.SSAuthURL,
+		"fhir_url": a.cfg.SSFHIRURL,
+		"org_id":   a.cfg.SSOrgID,
+		"sandbox":  a.cfg.isSandbox(),
+	}
+
+	start := time.Now()
+	if _, err := a.ss.tokenMgr.GetToken(); err != nil {
+		resp["status"] = "error"
+		resp["token"] = err.Error()
+		resp["hint"] = "check SS_AUTH_URL, SS_CLIENT_ID and SS_CLIENT_SECRET"
+		jsonResponse(w, resp)
+		return
+	}
+	resp["token"] = "ok"
+	resp["token_scope"] = a.ss.tokenMgr.Scope()
+	resp["token_latency_ms"] = time.Since(start).Milliseconds()
+
+	start = time.Now()
+	code, result, err := a.ss.doRequestStatus(r.Context(), "GET", "/Organization/"+a.cfg.SSOrgID, nil)
+	resp["fhir_latency_ms"] = time.Since(start).Milliseconds()
+	resp["fhir_status_code"] = code
+
+	rt, _ := result["resourceType"].(string)
+	switch {
+	case err != nil:
+		resp["status"] = "error"
+		resp["organization"] = err.Error()
+		resp["hint"] = "SS_FHIR_URL is unreachable"
+	case rt == "Organization":
+		resp["status"] = "ok"
+		resp["organization"] = "resolved"
+		resp["organization_name"] = result["name"]
+	case rt == "OperationOutcome":
+		resp["status"] = "error"
+		resp["organization"] = "not found"
+		resp["hint"] = "FHIR URL is reachable but SS_ORG_ID does not resolve"
+	default:
+		resp["status"] = "error"
+		resp["organization"] = "unexpected response"
+		resp["hint"] = "SS_FHIR_URL does not look like a FHIR endpoint (swapped with SS_AUTH_URL?)"
+	}
+	jsonResponse(w, resp)
 }
 
 // ============================================================
 // LOGS HANDLER
 // ============================================================
 
-func (a *App) handleLogs(w http.ResponseWriter, r *http.Request) {
-	tgl1 := r.URL.Query().Get("tgl1")
-	tgl2 := r.URL.Query().Get("tgl2")
-	status := r.URL.Query().Get("status")
-	limit := r.URL.Query().Get("limit")
-	if limit == "" {
-		limit = "100"
-	}
-
-	query := "SELECT id, no_rawat, resource_type, fhir_id, status, error_message, created_at FROM satu_sehat_send_log WHERE 1=1"
+// logsQuery builds the send-log query from tgl1/tgl2/status/limit.
+// defaultLimit <= 0 means no limit unless one is given explicitly.
+func logsQuery(q url.Values, defaultLimit int) (string, []interface{}) {
+	query := "SELECT id, no_rawat, resource_type, fhir_id, status, IFNULL(error_message,''), created_at FROM satu_sehat_send_log WHERE 1=1"
 	var args []interface{}
 
+	tgl1, tgl2 := q.Get("tgl1"), q.Get("tgl2")
 	if tgl1 != "" && tgl2 != "" {
 		query += " AND DATE(created_at) BETWEEN ? AND ?"
 		args = append(args, tgl1, tgl2)
 	}
-	if status != "" {
+	if status := q.Get("status"); status != "" {
 		query += " AND status = ?"
 		args = append(args, status)
 	}
-	query += " ORDER BY created_at DESC LIMIT ?"
-	limitInt, _ := strconv.Atoi(limit)
+	if batchID := q.Get("batch_id"); batchID != "" {
+		query += " AND batch_id = ?"
+		args = append(args, batchID)
+	}
+	query += " ORDER BY created_at DESC"
+	limitInt, _ := strconv.Atoi(q.Get("limit"))
 	if limitInt <= 0 {
-		limitInt = 100
+		limitInt = defaultLimit
 	}
-	args = append(args, limitInt)
+	if limitInt > 0 {
+		query += " LIMIT ?"
+		args = append(args, limitInt)
+	}
+	return query, args
+}
+
+func (a *App) handleLogs(w http.ResponseWriter, r *http.Request) {
+	query, args := logsQuery(r.URL.Query(), 100)
 
-	rows, err := a.db.Query(query, args...)
+	rows, err := a.db.QueryContext(r.Context(), query, args...)
 	if err != nil {
 		jsonError(w, err.Error(), 500)
 		return
@@ -144,6 +579,7 @@ func (a *App) handleLogs(w http.ResponseWriter, r *http.Request) {
 		var noRawat, resType, fhirID, st, errMsg string
 		var createdAt time.Time
 		if err := rows.Scan(&id, &noRawat, &resType, &fhirID, &st, &errMsg, &createdAt); err != nil {
+			logWarnf("⚠️ scan send log row: %v", err)
 			continue
 		}
 		logs = append(logs, map[string]interface{}{
@@ -159,6 +595,24 @@ func (a *App) handleLogs(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// ============================================================
+// SCHEMA HELPERS
+// ============================================================
+
+// ensureColumn adds an optional column to an existing Khanza table when it is
+// missing, so new mapping fields work without a manual migration
+func ensureColumn(db *sql.DB, table, column, definition string) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`, table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return
+	}
+	if _, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition); err != nil {
+		logErrorf("❌ add %s.%s: %v", table, column, err)
+	}
+}
+
 // ============================================================
 // JSON HELPERS
 // ============================================================
@@ -179,7 +633,7 @@ func cors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(204)
 			return
@@ -188,12 +642,98 @@ func cors(next http.Handler) http.Handler {
 	})
 }
 
+// routeMux is a ServeMux that remembers its patterns, so the startup log
+// lists exactly the routes registered
+type routeMux struct {
+	*http.ServeMux
+	patterns []string
+}
+
+func (m *routeMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.patterns = append(m.patterns, pattern)
+	m.ServeMux.HandleFunc(pattern, handler)
+}
+
 // ============================================================
 // MAIN
 // ============================================================
 
+// startupRetryInterval is the pause between startup connection attempts
+const startupRetryInterval = 3 * time.Second
+
+// retryStartup calls fn until it succeeds or timeout has passed, logging each
+// failed attempt, so the service survives a MySQL or network that comes up
+// after it (docker-compose). It returns the last error.
+func retryStartup(what string, timeout time.Duration, fn func() error) error {
+	deadline := time.Now().Add(timeout)
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(startupRetryInterval).After(deadline) {
+			return err
+		}
+		logWarnf("⚠️ %s failed (attempt %d), retrying in %s: %v", what, attempt, startupRetryInterval, err)
+		time.Sleep(startupRetryInterval)
+	}
+}
+
 func main() {
 	cfg := loadConfig()
+	setLogLevel(parseLogLevel(cfg.LogLevel))
+	if err := cfg.applyEnvPreset(); err != nil {
+		log.Fatalf("❌ Invalid config: %v", err)
+	}
+	if err := cfg.validateRequired(); err != nil {
+		log.Fatalf("❌ Invalid config: %v", err)
+	}
+	logRedact = getEnvBool("LOG_REDACT", cfg.envName() == "production")
+	if cfg.SSEnv != "" && cfg.SSEnv != cfg.envName() {
+		logWarnf("⚠️ SS_ENV=%s but SS_FHIR_URL %s looks like %s", cfg.SSEnv, cfg.SSFHIRURL, cfg.envName())
+	}
+	logInfof("🌐 SatuSehat environment: %s (%s)", cfg.envName(), cfg.SSFHIRURL)
+	for _, hint := range cfg.swappedURLHints() {
+		logWarnf("⚠️ SS_FHIR_URL and SS_AUTH_URL may be swapped: %s", hint)
+	}
+	if err := validateOrgID(cfg.SSOrgID); err != nil {
+		log.Fatalf("❌ Invalid config: %v", err)
+	}
+	if err := cfg.runtimeSettings().validate(); err != nil {
+		log.Fatalf("❌ Invalid config: %v", err)
+	}
+	live.set(cfg.runtimeSettings())
+	if cfg.ConditionStatusCol != "" && !sqlIdentPattern.MatchString(cfg.ConditionStatusCol) {
+		log.Fatalf("❌ Invalid config: SS_CONDITION_STATUS_COLUMN %q is not a column name", cfg.ConditionStatusCol)
+	}
+	conditionStatusColumn = cfg.ConditionStatusCol
+	if cfg.ConditionOriginCol != "" && !sqlIdentPattern.MatchString(cfg.ConditionOriginCol) {
+		log.Fatalf("❌ Invalid config: SS_CONDITION_ORIGIN_COLUMN %q is not a column name", cfg.ConditionOriginCol)
+	}
+	conditionOriginColumn = cfg.ConditionOriginCol
+	if cfg.DispenserCol != "" && !sqlIdentPattern.MatchString(cfg.DispenserCol) {
+		log.Fatalf("❌ Invalid config: SS_DISPENSER_COLUMN %q is not a column name", cfg.DispenserCol)
+	}
+	medDispDispenserColumn = cfg.DispenserCol
+	encounterIGDPoli = cfg.IGDPoli
+	if !sqlIdentPattern.MatchString(cfg.ResumeTable) {
+		log.Fatalf("❌ Invalid config: SS_COMPOSITION_RESUME_TABLE %q is not a table name", cfg.ResumeTable)
+	}
+	compositionResumeTable = cfg.ResumeTable
+	if err := setDateFilters(cfg.DateFilter); err != nil {
+		log.Fatalf("❌ Invalid config: %v", err)
+	}
+	setIdentifierSystems(cfg.IdentifierBase, cfg.NIKSystem)
+	if err := setMetaProfiles(cfg.MetaProfile, cfg.MetaProfiles); err != nil {
+		log.Fatalf("❌ Invalid config: %v", err)
+	}
+	orgCfgs, err := loadOrgConfigs(cfg)
+	if err != nil {
+		log.Fatalf("❌ Invalid config: %v", err)
+	}
+	if len(orgCfgs) > 0 {
+		logWarnf("⚠️ SS_ORGS: the satu_sehat_* tracking tables are shared by all orgs; each visit is sent once, as the org that sends it first. Send each org only its own visits (e.g. kd_poli / kd_bangsal)")
+	}
 
 	// Connect to DB
 	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
@@ -202,10 +742,10 @@ func main() {
 	if err != nil {
 		log.Fatalf("❌ DB open error: %v", err)
 	}
-	if err := db.Ping(); err != nil {
-		log.Fatalf("❌ DB ping error: %v", err)
+	if err := retryStartup("DB ping", cfg.DBConnectTimeout, db.Ping); err != nil {
+		log.Fatalf("❌ DB ping error after %s: %v", cfg.DBConnectTimeout, err)
 	}
-	log.Println("✅ Database connected:", cfg.DBName)
+	logInfof("✅ Database connected: %s", cfg.DBName)
 
 	// Auto-create send log table
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS satu_sehat_send_log (
@@ -215,74 +755,214 @@ func main() {
 		fhir_id VARCHAR(100) DEFAULT '',
 		status VARCHAR(20) DEFAULT 'pending',
 		error_message TEXT,
+		batch_id VARCHAR(36) DEFAULT '',
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		INDEX idx_no_rawat (no_rawat),
-		INDEX idx_status (status)
+		INDEX idx_status (status),
+		INDEX idx_batch (batch_id)
 	)`)
 	if err != nil {
-		log.Printf("⚠️ create send_log table: %v", err)
+		logErrorf("❌ create send_log table: %v", err)
 	} else {
-		log.Println("✅ Send log table ready")
+		ensureColumn(db, "satu_sehat_send_log", "batch_id", "VARCHAR(36) DEFAULT '', ADD INDEX idx_batch (batch_id)")
+		logInfof("✅ Send log table ready")
 	}
 
 	// Auto-create mera_integration_jobs table
 	initJobsTable(db)
+	initDeviceTable(db)
+	initDenominatorDisplay(db)
+	initLabCategory(db)
+	initRadBodySite(db)
+	initSpecimenMapping(db)
+	if cfg.Questionnaire {
+		initQuestionnaireTables(db)
+	}
+	initVerificationTable(db)
+	initCompositionTable(db)
+
+	// Optional satu_sehat_ttv_config overrides/extends the built-in TTV types
+	loadTTVConfigs(db)
+	checkEnabledResources(cfg)
+	if cfg.EnableUpdates {
+		initTTVValueHash(db)
+	}
 
-	// Init token manager and SS client
-	tokenMgr := NewTokenManager(cfg)
-	ssClient := NewSSClient(cfg, tokenMgr)
+	// Init token manager and SS client, one pair per organization
+	if cfg.HTTPAudit {
+		initAuditTable(db)
+	}
+	newClient := func(c Config, org string) *SSClient {
+		tm := NewTokenManager(c)
+		ss := NewSSClient(c, tm)
+		if c.WebhookURL != "" {
+			tm.onAlert = func(event string, failures int, lastErr string) {
+				data := map[string]interface{}{"failures": failures, "last_error": lastErr}
+				if org != "" {
+					data["org"] = org
+				}
+				postWebhook(c, event, data)
+			}
+		}
+		if c.HTTPAudit {
+			ss.audit = func(e httpAuditEntry) { saveHTTPAudit(db, e) }
+		}
+		if c.RequestIDHeader != "" {
+			ss.OnRequest(func(req *http.Request) {
+				req.Header.Set(c.RequestIDHeader, newRequestID())
+			})
+		}
+		return ss
+	}
+	ssClient := newClient(cfg, "")
+	tokenMgr := ssClient.tokenMgr
+	orgs := map[string]orgClient{"": {cfg: cfg, ss: ssClient}}
+	for name, c := range orgCfgs {
+		orgs[name] = orgClient{cfg: c, ss: newClient(c, name)}
+		logInfof("🏢 Org %s → %s", name, c.SSOrgID)
+	}
 
-	app := &App{db: db, ss: ssClient, cfg: cfg}
+	app := &App{db: db, ss: ssClient, cfg: cfg, ctx: context.Background(), orgs: orgs}
+	if cfg.SendLogBatch > 1 {
+		app.logs = newSendLogWriter(db, cfg.SendLogBatch, cfg.SendLogFlush)
+	}
+	if cfg.AsyncSend {
+		app.queue = newSendQueue(app)
+		app.queue.start()
+		logInfof("📬 Async send queue enabled")
+	}
 
 	// Routes
-	mux := http.NewServeMux()
+	mux := &routeMux{ServeMux: http.NewServeMux()}
 	mux.HandleFunc("GET /", app.handleDashboard)
 	mux.HandleFunc("GET /api/health", app.handleHealth)
+	mux.HandleFunc("GET /api/resources", app.handleResources)
+	mux.HandleFunc("GET /api/health/satusehat", app.handleHealthSatuSehat)
+	mux.HandleFunc("GET /api/status/watermarks", app.handleWatermarks)
 	mux.HandleFunc("GET /api/encounters/pending", app.handlePendingEncounters)
-	mux.HandleFunc("POST /api/encounters/send", app.handleSendEncounters)
+	mux.HandleFunc("POST /api/encounters/send", app.sendRoute("encounter", app.handleSendEncounters))
+	mux.HandleFunc("GET /api/encounters/preview", app.handlePreviewEncounter)
 	mux.HandleFunc("GET /api/encounters-ranap/pending", app.handlePendingEncountersRanap)
-	mux.HandleFunc("POST /api/encounters-ranap/send", app.handleSendEncountersRanap)
+	mux.HandleFunc("POST /api/encounters-ranap/send", app.sendRoute("encounter-ranap", app.handleSendEncountersRanap))
 	mux.HandleFunc("GET /api/conditions/pending", app.handlePendingConditions)
-	mux.HandleFunc("POST /api/conditions/send", app.handleSendConditions)
+	mux.HandleFunc("POST /api/conditions/send", app.sendRoute("condition", app.handleSendConditions))
+	mux.HandleFunc("GET /api/conditions/preview", app.handlePreviewCondition)
+	mux.HandleFunc("POST /api/conditions/link-encounter", app.enabledOnly("condition", withVerbose(app.notifyBatch("condition", app.handleLinkEncounterDiagnoses))))
+	mux.HandleFunc("POST /api/conditions/verify", app.handleVerifyConditions)
 	mux.HandleFunc("GET /api/logs", app.handleLogs)
+	mux.HandleFunc("GET /api/logs/export.csv", app.handleExportLogsCSV)
 	mux.HandleFunc("GET /api/observations-ttv/{type}/pending", app.handlePendingTTV)
-	mux.HandleFunc("POST /api/observations-ttv/{type}/send", app.handleSendTTV)
+	mux.HandleFunc("POST /api/observations-ttv/{type}/send", app.sendRoute("ttv-{type}", app.handleSendTTV))
+	mux.HandleFunc("GET /api/observations-ttv/{type}/preview", app.handlePreviewTTV)
+	mux.HandleFunc("GET /api/specimens-lab/pending", app.handlePendingLabSpecimens)
+	mux.HandleFunc("POST /api/specimens-lab/send", app.sendRoute("lab", app.handleSendLabSpecimens))
 	mux.HandleFunc("GET /api/observations-lab/pending", app.handlePendingLabObs)
-	mux.HandleFunc("POST /api/observations-lab/send", app.handleSendLabObs)
+	mux.HandleFunc("POST /api/observations-lab/send", app.sendRoute("lab", app.handleSendLabObs))
+	mux.HandleFunc("GET /api/observations-lab/preview", app.handlePreviewLabObs)
 	mux.HandleFunc("GET /api/observations-rad/pending", app.handlePendingRadObs)
-	mux.HandleFunc("POST /api/observations-rad/send", app.handleSendRadObs)
+	mux.HandleFunc("POST /api/observations-rad/send", app.sendRoute("rad", app.handleSendRadObs))
+	mux.HandleFunc("GET /api/observations-rad/preview", app.handlePreviewRadObs)
 	mux.HandleFunc("GET /api/procedures/pending", app.handlePendingProcedures)
-	mux.HandleFunc("POST /api/procedures/send", app.handleSendProcedures)
+	mux.HandleFunc("POST /api/procedures/send", app.sendRoute("procedure", app.handleSendProcedures))
+	mux.HandleFunc("GET /api/procedures/preview", app.handlePreviewProcedure)
 	mux.HandleFunc("GET /api/medication-requests/pending", app.handlePendingMedReq)
-	mux.HandleFunc("POST /api/medication-requests/send", app.handleSendMedReq)
+	mux.HandleFunc("POST /api/medication-requests/send", app.sendRoute("medreq", app.handleSendMedReq))
+	mux.HandleFunc("GET /api/medication-requests/preview", app.handlePreviewMedReq)
 	mux.HandleFunc("GET /api/medication-dispenses/pending", app.handlePendingMedDisp)
-	mux.HandleFunc("POST /api/medication-dispenses/send", app.handleSendMedDisp)
+	mux.HandleFunc("POST /api/medication-dispenses/send", app.sendRoute("meddisp", app.handleSendMedDisp))
+	mux.HandleFunc("GET /api/medication-dispenses/preview", app.handlePreviewMedDisp)
+	mux.HandleFunc("POST /api/medication-dispenses/verify", app.handleVerifyMedDisp)
+	mux.HandleFunc("GET /api/compositions/pending", app.handlePendingCompositions)
+	mux.HandleFunc("POST /api/compositions/send", app.sendRoute("composition", app.handleSendCompositions))
+	mux.HandleFunc("GET /api/compositions/preview", app.handlePreviewComposition)
 	mux.HandleFunc("GET /api/jobs", app.handleListJobs)
+	mux.HandleFunc("GET /api/jobs/export.csv", app.handleExportJobsCSV)
+	mux.HandleFunc("GET /api/jobs/stats", app.handleJobStats)
+	mux.HandleFunc("GET /api/jobs/{id}", app.handleGetJob)
 	mux.HandleFunc("POST /api/jobs/retry", app.handleRetryJobs)
+	mux.HandleFunc("POST /api/jobs/replay", app.requireAdmin(app.handleReplayJob))
+	mux.HandleFunc("POST /api/jobs/{id}/patch", app.requireAdmin(app.handlePatchJob))
+	mux.HandleFunc("POST /api/send-all", withVerbose(app.withRowLimit(app.queued(app.notifyBatch("all", app.handleSendAll)))))
+	mux.HandleFunc("POST /api/resend", withVerbose(app.queued(app.notifyBatch("resend", app.handleResend))))
+	mux.HandleFunc("GET /api/locations/verify", app.handleVerifyLocations)
+	mux.HandleFunc("GET /api/mapping/gaps", app.handleMappingGaps)
+	mux.HandleFunc("GET /api/mapping/top-gaps", app.handleMappingTopGaps)
+	mux.HandleFunc("GET /api/devices", app.handleListDevices)
+	mux.HandleFunc("POST /api/devices/sync", withVerbose(app.notifyBatch("device", app.handleSyncDevices)))
+	mux.HandleFunc("POST /api/audit/{id}/replay", app.requireAdmin(app.handleReplayAudit))
+	mux.HandleFunc("POST /api/maintenance/prune", app.requireAdmin(app.handlePrune))
+	if cfg.Questionnaire {
+		mux.HandleFunc("GET /api/questionnaires", app.handleListQuestionnaires)
+		mux.HandleFunc("GET /api/questionnaires/{form}/pending", app.handlePendingQuestionnaire)
+		mux.HandleFunc("POST /api/questionnaires/{form}/send", withVerbose(app.queued(app.notifyBatch("questionnaire-{form}", app.handleSendQuestionnaire))))
+	}
 
 	// Print routes
-	log.Println("📋 Routes:")
-	log.Println("  GET  /api/health")
-	log.Println("  GET  /api/encounters/pending")
-	log.Println("  POST /api/encounters/send")
-	log.Println("  GET  /api/encounters-ranap/pending")
-	log.Println("  POST /api/encounters-ranap/send")
-	log.Println("  GET  /api/conditions/pending")
-	log.Println("  POST /api/conditions/send")
-	log.Println("  GET  /api/logs")
+	logInfof("📋 Routes:")
+	for _, p := range mux.patterns {
+		method, path, _ := strings.Cut(p, " ")
+		logInfof("  %-4s %s", method, path)
+	}
 
 	addr := ":" + cfg.Port
-	log.Printf("🚀 Satu Sehat service running on http://localhost%s", addr)
+	srv := &http.Server{Addr: addr, Handler: cors(withGzip(app.withOrg(mux)))}
+	logInfof("🚀 Satu Sehat service running on http://localhost%s", addr)
 
-	// Startup: test token
+	// Startup: test token (and in sandbox, that the org actually resolves)
 	go func() {
-		token, err := tokenMgr.GetToken()
+		var token string
+		err := retryStartup("Initial token fetch", cfg.DBConnectTimeout, func() (err error) {
+			token, err = tokenMgr.GetToken()
+			return err
+		})
+		probeSwappedURLs(cfg, token, err)
 		if err != nil {
-			log.Printf("⚠️ Initial token fetch failed: %v", err)
-		} else {
-			log.Printf("✅ Token OK (%d chars)", len(token))
+			logWarnf("⚠️ Initial token fetch failed: %v", err)
+			return
+		}
+		logInfof("✅ Token OK (%d chars)", len(token))
+		if cfg.isSandbox() && cfg.SSOrgID != "" {
+			if err := ssClient.VerifyOrganization(cfg.SSOrgID); err != nil {
+				logWarnf("⚠️ SS_ORG_ID %s does not resolve in sandbox: %v", cfg.SSOrgID, err)
+			} else {
+				logInfof("✅ Organization %s resolved", cfg.SSOrgID)
+			}
+		}
+		if cfg.VerifyLocations {
+			_, summary := app.verifyLocations(context.Background())
+			logInfof("📍 Location mapping: %d ok, %d not found, %d other org, %d error",
+				summary["ok"], summary["not_found"], summary["wrong_org"], summary["error"])
 		}
 	}()
 
-	log.Fatal(http.ListenAndServe(addr, cors(mux)))
+	app.watchReload()
+
+	// Stop accepting requests on SIGINT/SIGTERM, let in-flight sends finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("❌ HTTP server: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	logInfof("🛑 Shutting down, waiting up to %s for in-flight requests...", cfg.ShutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logWarnf("⚠️ shutdown: %v", err)
+	}
+	if app.queue != nil {
+		app.queue.close(shutdownCtx)
+	}
+
+	if app.logs != nil {
+		app.logs.Close()
+	}
+	db.Close()
+	logInfof("👋 Satu Sehat service stopped")
 }
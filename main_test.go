@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func validConfig() Config {
+	return Config{
+		SSOrgID:    "100000001",
+		SSClientID: "client",
+		SSSecret:   "secret",
+		SSAuthURL:  "https://api-satusehat-stg.dto.kemkes.go.id/oauth2/v1",
+		SSFHIRURL:  "https://api-satusehat-stg.dto.kemkes.go.id/fhir-r4/v1",
+	}
+}
+
+func TestValidateRequiredValid(t *testing.T) {
+	if err := validConfig().validateRequired(); err != nil {
+		t.Fatalf("validateRequired() = %v, want nil", err)
+	}
+}
+
+func TestValidateRequiredMissing(t *testing.T) {
+	tests := []struct {
+		setting string
+		clear   func(*Config)
+	}{
+		{"SS_ORG_ID", func(c *Config) { c.SSOrgID = "" }},
+		{"SS_CLIENT_ID", func(c *Config) { c.SSClientID = "" }},
+		{"SS_CLIENT_SECRET", func(c *Config) { c.SSSecret = " " }},
+		{"SS_AUTH_URL", func(c *Config) { c.SSAuthURL = "" }},
+		{"SS_FHIR_URL", func(c *Config) { c.SSFHIRURL = "\t" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.setting, func(t *testing.T) {
+			cfg := validConfig()
+			tt.clear(&cfg)
+			err := cfg.validateRequired()
+			if err == nil {
+				t.Fatalf("validateRequired() = nil, want %s reported missing", tt.setting)
+			}
+			missing, _, _ := strings.Cut(strings.TrimPrefix(err.Error(), "missing required settings: "), " (")
+			if missing != tt.setting {
+				t.Errorf("validateRequired() reports %q missing, want only %s", missing, tt.setting)
+			}
+		})
+	}
+}
+
+func TestValidateRequiredAllMissing(t *testing.T) {
+	err := Config{}.validateRequired()
+	if err == nil {
+		t.Fatal("validateRequired() = nil for an empty config")
+	}
+	want := "SS_ORG_ID, SS_CLIENT_ID, SS_CLIENT_SECRET, SS_AUTH_URL, SS_FHIR_URL"
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("validateRequired() = %q, want it to list %s", err, want)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ============================================================
+// MAINTENANCE (prune old send logs and jobs)
+// ============================================================
+
+// handlePrune deletes satu_sehat_send_log rows and finished
+// mera_integration_jobs (with their attempts) created before before_date.
+// Failed rows are kept for audit unless keep_failed is false; pending jobs
+// are never touched. Everything is deleted in one transaction.
+func (a *App) handlePrune(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		BeforeDate string `json:"before_date"`
+		KeepFailed *bool  `json:"keep_failed"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request body: "+err.Error(), 400)
+		return
+	}
+	if _, err := time.Parse("2006-01-02", req.BeforeDate); err != nil {
+		jsonError(w, "before_date must be YYYY-MM-DD", 400)
+		return
+	}
+	keepFailed := req.KeepFailed == nil || *req.KeepFailed
+	logStatus, jobStatus := "status IN ('success','skipped')", "status = 'success'"
+	if !keepFailed {
+		logStatus, jobStatus = "1=1", "status IN ('success','failed')"
+	}
+
+	tx, err := a.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	defer tx.Rollback()
+	logs, err := tx.ExecContext(r.Context(),
+		`DELETE FROM satu_sehat_send_log WHERE created_at < ? AND `+logStatus, req.BeforeDate)
+	if err != nil {
+		jsonError(w, "prune send log: "+err.Error(), 500)
+		return
+	}
+	attempts, err := tx.ExecContext(r.Context(),
+		`DELETE mera_integration_job_attempts FROM mera_integration_job_attempts
+		 JOIN mera_integration_jobs ON mera_integration_jobs.id = mera_integration_job_attempts.job_id
+		 WHERE mera_integration_jobs.created_at < ? AND mera_integration_jobs.`+jobStatus, req.BeforeDate)
+	if err != nil {
+		jsonError(w, "prune job attempts: "+err.Error(), 500)
+		return
+	}
+	jobs, err := tx.ExecContext(r.Context(),
+		`DELETE FROM mera_integration_jobs WHERE created_at < ? AND `+jobStatus, req.BeforeDate)
+	if err != nil {
+		jsonError(w, "prune jobs: "+err.Error(), 500)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		jsonError(w, "commit: "+err.Error(), 500)
+		return
+	}
+	nLogs, _ := logs.RowsAffected()
+	nAttempts, _ := attempts.RowsAffected()
+	nJobs, _ := jobs.RowsAffected()
+	logInfof("🧹 pruned before %s: %d send log rows, %d jobs, %d job attempts (keep_failed=%v)",
+		req.BeforeDate, nLogs, nJobs, nAttempts, keepFailed)
+	jsonResponse(w, map[string]interface{}{
+		"before_date": req.BeforeDate,
+		"keep_failed": keepFailed,
+		"deleted": map[string]int64{
+			"send_log":     nLogs,
+			"jobs":         nJobs,
+			"job_attempts": nAttempts,
+		},
+	})
+}
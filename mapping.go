@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ============================================================
+// MAPPING GAPS
+// ============================================================
+
+// gapSource finds source codes a pending query drops because its INNER JOIN
+// on Mapping finds nothing. From LEFT JOINs the mapping, Missing selects the
+// unmatched rows and DateCol is filtered like the resource's pending query.
+type gapSource struct {
+	Resource string
+	Mapping  string
+	From     string
+	Missing  string
+	Code     string
+	Name     string
+	DateCol  string
+}
+
+type mappingGap struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	Rows int    `json:"rows"`
+}
+
+type mappingGapGroup struct {
+	Resource string       `json:"resource"`
+	Mapping  string       `json:"mapping"`
+	Missing  []mappingGap `json:"missing"`
+	Error    string       `json:"error,omitempty"`
+}
+
+func gapSources() []gapSource {
+	return []gapSource{
+		{"Encounter", "satu_sehat_mapping_lokasi_ralan", `reg_periksa
+			INNER JOIN poliklinik ON poliklinik.kd_poli = reg_periksa.kd_poli
+			LEFT JOIN satu_sehat_mapping_lokasi_ralan ON satu_sehat_mapping_lokasi_ralan.kd_poli = reg_periksa.kd_poli`,
+			"satu_sehat_mapping_lokasi_ralan.kd_poli IS NULL AND reg_periksa.status_lanjut = 'Ralan'",
+			"reg_periksa.kd_poli", "poliklinik.nm_poli", registrationDate},
+		{"EncounterRanap", "satu_sehat_mapping_lokasi_ranap", `reg_periksa
+			INNER JOIN kamar_inap ON kamar_inap.no_rawat = reg_periksa.no_rawat
+			INNER JOIN kamar ON kamar.kd_kamar = kamar_inap.kd_kamar
+			INNER JOIN bangsal ON bangsal.kd_bangsal = kamar.kd_bangsal
+			LEFT JOIN satu_sehat_mapping_lokasi_ranap ON satu_sehat_mapping_lokasi_ranap.kd_kamar = kamar_inap.kd_kamar`,
+			"satu_sehat_mapping_lokasi_ranap.kd_kamar IS NULL",
+			"kamar_inap.kd_kamar", "bangsal.nm_bangsal", registrationDate},
+		{"Condition", "penyakit", `reg_periksa
+			INNER JOIN diagnosa_pasien ON diagnosa_pasien.no_rawat = reg_periksa.no_rawat
+			LEFT JOIN penyakit ON penyakit.kd_penyakit = diagnosa_pasien.kd_penyakit`,
+			"penyakit.kd_penyakit IS NULL",
+			"diagnosa_pasien.kd_penyakit", "''", registrationDate},
+		{"Procedure", "icd9", `reg_periksa
+			INNER JOIN prosedur_pasien ON prosedur_pasien.no_rawat = reg_periksa.no_rawat
+			LEFT JOIN icd9 ON icd9.kode = prosedur_pasien.kode`,
+			"icd9.kode IS NULL",
+			"prosedur_pasien.kode", "''", registrationDate},
+		{"Observation_Lab", "satu_sehat_mapping_lab", `reg_periksa
+			INNER JOIN permintaan_lab ON permintaan_lab.no_rawat = reg_periksa.no_rawat
+			INNER JOIN permintaan_detail_permintaan_lab ON permintaan_detail_permintaan_lab.noorder = permintaan_lab.noorder
+			INNER JOIN template_laboratorium ON template_laboratorium.id_template = permintaan_detail_permintaan_lab.id_template
+			LEFT JOIN satu_sehat_mapping_lab ON satu_sehat_mapping_lab.id_template = permintaan_detail_permintaan_lab.id_template`,
+			"satu_sehat_mapping_lab.id_template IS NULL",
+			"permintaan_detail_permintaan_lab.id_template", "template_laboratorium.Pemeriksaan", dateFilterColumn("Observation_Lab")},
+		{"Observation_Rad", "satu_sehat_mapping_radiologi", `reg_periksa
+			INNER JOIN permintaan_radiologi ON permintaan_radiologi.no_rawat = reg_periksa.no_rawat
+			INNER JOIN permintaan_pemeriksaan_radiologi ON permintaan_pemeriksaan_radiologi.noorder = permintaan_radiologi.noorder
+			INNER JOIN jns_perawatan_radiologi ON jns_perawatan_radiologi.kd_jenis_prw = permintaan_pemeriksaan_radiologi.kd_jenis_prw
+			LEFT JOIN satu_sehat_mapping_radiologi ON satu_sehat_mapping_radiologi.kd_jenis_prw = permintaan_pemeriksaan_radiologi.kd_jenis_prw`,
+			"satu_sehat_mapping_radiologi.kd_jenis_prw IS NULL",
+			"permintaan_pemeriksaan_radiologi.kd_jenis_prw", "jns_perawatan_radiologi.nm_perawatan", dateFilterColumn("Observation_Rad")},
+		{"MedicationRequest", "satu_sehat_mapping_obat", `reg_periksa
+			INNER JOIN resep_obat ON resep_obat.no_rawat = reg_periksa.no_rawat
+			INNER JOIN resep_dokter ON resep_dokter.no_resep = resep_obat.no_resep
+			LEFT JOIN databarang ON databarang.kode_brng = resep_dokter.kode_brng
+			LEFT JOIN satu_sehat_mapping_obat ON satu_sehat_mapping_obat.kode_brng = resep_dokter.kode_brng`,
+			"satu_sehat_mapping_obat.kode_brng IS NULL",
+			"resep_dokter.kode_brng", "IFNULL(databarang.nama_brng,'')", dateFilterColumn("MedicationRequest")},
+		{"MedicationRequest", "satu_sehat_mapping_obat (racikan)", `reg_periksa
+			INNER JOIN resep_obat ON resep_obat.no_rawat = reg_periksa.no_rawat
+			INNER JOIN resep_dokter_racikan_detail ON resep_dokter_racikan_detail.no_resep = resep_obat.no_resep
+			LEFT JOIN databarang ON databarang.kode_brng = resep_dokter_racikan_detail.kode_brng
+			LEFT JOIN satu_sehat_mapping_obat ON satu_sehat_mapping_obat.kode_brng = resep_dokter_racikan_detail.kode_brng`,
+			"satu_sehat_mapping_obat.kode_brng IS NULL",
+			"resep_dokter_racikan_detail.kode_brng", "IFNULL(databarang.nama_brng,'')", dateFilterColumn("MedicationRequest")},
+		{"MedicationDispense", "satu_sehat_mapping_obat", `reg_periksa
+			INNER JOIN detail_pemberian_obat ON detail_pemberian_obat.no_rawat = reg_periksa.no_rawat
+			LEFT JOIN databarang ON databarang.kode_brng = detail_pemberian_obat.kode_brng
+			LEFT JOIN satu_sehat_mapping_obat ON satu_sehat_mapping_obat.kode_brng = detail_pemberian_obat.kode_brng`,
+			"satu_sehat_mapping_obat.kode_brng IS NULL",
+			"detail_pemberian_obat.kode_brng", "IFNULL(databarang.nama_brng,'')", dateFilterColumn("MedicationDispense")},
+		{"MedicationDispense", "satu_sehat_medication", `reg_periksa
+			INNER JOIN detail_pemberian_obat ON detail_pemberian_obat.no_rawat = reg_periksa.no_rawat
+			INNER JOIN satu_sehat_mapping_obat ON satu_sehat_mapping_obat.kode_brng = detail_pemberian_obat.kode_brng
+			LEFT JOIN satu_sehat_medication ON satu_sehat_medication.kode_brng = detail_pemberian_obat.kode_brng`,
+			"satu_sehat_medication.kode_brng IS NULL",
+			"detail_pemberian_obat.kode_brng", "satu_sehat_mapping_obat.obat_display", dateFilterColumn("MedicationDispense")},
+		{"MedicationDispense", "satu_sehat_mapping_lokasi_depo_farmasi", `reg_periksa
+			INNER JOIN detail_pemberian_obat ON detail_pemberian_obat.no_rawat = reg_periksa.no_rawat
+			INNER JOIN bangsal ON bangsal.kd_bangsal = detail_pemberian_obat.kd_bangsal
+			LEFT JOIN satu_sehat_mapping_lokasi_depo_farmasi ON satu_sehat_mapping_lokasi_depo_farmasi.kd_bangsal = detail_pemberian_obat.kd_bangsal`,
+			"satu_sehat_mapping_lokasi_depo_farmasi.kd_bangsal IS NULL",
+			"detail_pemberian_obat.kd_bangsal", "bangsal.nm_bangsal", dateFilterColumn("MedicationDispense")},
+	}
+}
+
+// queryMappingGaps lists the unmapped codes of one source in f, most frequent first
+func queryMappingGaps(ctx context.Context, db *sql.DB, src gapSource, f PendingFilter) ([]mappingGap, error) {
+	query := fmt.Sprintf(`SELECT %[1]s, %[2]s, COUNT(*) FROM %[3]s
+		WHERE %[4]s AND %[5]s
+		GROUP BY %[1]s, %[2]s
+		ORDER BY COUNT(*) DESC`, src.Code, src.Name, src.From, src.Missing, f.rangeSQL(src.DateCol))
+	rows, err := db.QueryContext(ctx, query, f.rangeArgs(1)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	gaps := []mappingGap{}
+	for rows.Next() {
+		var g mappingGap
+		if err := rows.Scan(&g.Code, &g.Name, &g.Rows); err != nil {
+			logWarnf("⚠️ scan mapping gap %s: %v", src.Mapping, err)
+			continue
+		}
+		gaps = append(gaps, g)
+	}
+	return gaps, nil
+}
+
+func (a *App) handleMappingGaps(w http.ResponseWriter, r *http.Request) {
+	f := a.pendingFilterFromQuery(r)
+	var groups []mappingGapGroup
+	total := 0
+	for _, src := range gapSources() {
+		g := mappingGapGroup{Resource: src.Resource, Mapping: src.Mapping}
+		gaps, err := queryMappingGaps(r.Context(), a.db, src, f)
+		if err != nil {
+			g.Error = err.Error()
+		} else {
+			g.Missing = gaps
+			total += len(gaps)
+		}
+		groups = append(groups, g)
+	}
+	jsonResponse(w, map[string]interface{}{
+		"tgl1": f.Tgl1, "tgl2": f.Tgl2, "total_gaps": total, "resources": groups,
+	})
+}
+
+// topGap is one unmapped code with the pending rows it blocks per resource;
+// a drug missing from satu_sehat_mapping_obat blocks requests and dispenses alike
+type topGap struct {
+	Code   string         `json:"code"`
+	Name   string         `json:"name"`
+	Rows   int            `json:"rows"`
+	Blocks map[string]int `json:"blocks"`
+}
+
+type topGapGroup struct {
+	Mapping    string   `json:"mapping"`
+	TotalCodes int      `json:"total_codes"`
+	TotalRows  int      `json:"total_rows"`
+	Top        []topGap `json:"top"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// handleMappingTopGaps is the mapping worklist: the unmapped codes of each
+// mapping table ranked by how many pending rows they block, ?limit= per
+// table (default 10), tables blocking the most rows first
+func (a *App) handleMappingTopGaps(w http.ResponseWriter, r *http.Request) {
+	f := a.pendingFilterFromQuery(r)
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			jsonError(w, "limit must be a positive number", 400)
+			return
+		}
+		limit = n
+	}
+
+	groups := map[string]*topGapGroup{}
+	codes := map[string]map[string]*topGap{}
+	var order []string
+	for _, src := range gapSources() {
+		mapping, _, _ := strings.Cut(src.Mapping, " ") // racikan shares satu_sehat_mapping_obat
+		g, ok := groups[mapping]
+		if !ok {
+			g = &topGapGroup{Mapping: mapping}
+			groups[mapping], codes[mapping] = g, map[string]*topGap{}
+			order = append(order, mapping)
+		}
+		gaps, err := queryMappingGaps(r.Context(), a.db, src, f)
+		if err != nil {
+			g.Errors = append(g.Errors, src.Resource+": "+err.Error())
+			continue
+		}
+		for _, gap := range gaps {
+			t, ok := codes[mapping][gap.Code]
+			if !ok {
+				t = &topGap{Code: gap.Code, Name: gap.Name, Blocks: map[string]int{}}
+				codes[mapping][gap.Code] = t
+			}
+			t.Rows += gap.Rows
+			t.Blocks[src.Resource] += gap.Rows
+			g.TotalRows += gap.Rows
+		}
+	}
+
+	list := make([]topGapGroup, 0, len(order))
+	for _, mapping := range order {
+		g := groups[mapping]
+		ranked := make([]topGap, 0, len(codes[mapping]))
+		for _, t := range codes[mapping] {
+			ranked = append(ranked, *t)
+		}
+		sort.Slice(ranked, func(i, j int) bool {
+			if ranked[i].Rows != ranked[j].Rows {
+				return ranked[i].Rows > ranked[j].Rows
+			}
+			return ranked[i].Code < ranked[j].Code
+		})
+		g.TotalCodes = len(ranked)
+		g.Top = ranked[:min(limit, len(ranked))]
+		list = append(list, *g)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].TotalRows > list[j].TotalRows })
+	jsonResponse(w, map[string]interface{}{
+		"tgl1": f.Tgl1, "tgl2": f.Tgl2, "limit": limit, "mappings": list,
+	})
+}
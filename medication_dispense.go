@@ -1,14 +1,11 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
-	"strconv"
 	"strings"
-	"time"
 )
 
 // ============================================================
@@ -35,6 +32,7 @@ type MedDispRow struct {
 	RouteDisplay string
 	DenomCode    string
 	DenomSystem  string
+	DenomDisplay string
 	TglPeresepan string
 	Jml          string
 	IDMedication string
@@ -47,9 +45,46 @@ type MedDispRow struct {
 	SttsLanjut   string
 	IDLocation   string
 	NmBangsal    string
+	Verified     bool // only meaningful when MedicationDispense requires verification
+
+	// Dispensing pharmacist, empty unless SS_DISPENSER_COLUMN is set and filled
+	NmApoteker    string
+	NoKTPApoteker string
+}
+
+// medDispDispenserColumn is the detail_pemberian_obat column holding the
+// pegawai.nik of the pharmacist who dispensed the item (SS_DISPENSER_COLUMN,
+// validated at startup; "" = the prescriber is the performer)
+var medDispDispenserColumn = ""
+
+// dispenserSQL returns the select expressions and join of the dispensing
+// pharmacist's name and NIK
+func dispenserSQL() (string, string) {
+	if medDispDispenserColumn == "" {
+		return "'', ''", ""
+	}
+	return "IFNULL(apoteker.nama,''), IFNULL(apoteker.no_ktp,'')", `
+		LEFT JOIN pegawai apoteker ON apoteker.nik = detail_pemberian_obat.` + medDispDispenserColumn
+}
+
+// dispenser returns the NIK and name of the practitioner performing row's
+// dispense: the pharmacist when one is recorded and can be looked up,
+// otherwise the prescriber
+func (a *App) dispenser(row MedDispRow) (string, string) {
+	if a.canLookupPractitioner(row.NoKTPApoteker, row.NmApoteker) {
+		return row.NoKTPApoteker, row.NmApoteker
+	}
+	return row.NoKTPDokter, row.NmDokter
+}
+
+// jobKey is the idempotency key of this row's send job
+func (r MedDispRow) jobKey() string {
+	return idempKey(r.NoRawat, r.TglValidasi, r.KodeBrng, r.NoBatch, r.NoFaktur)
 }
 
-func queryPendingMedDisp(db *sql.DB, tgl1, tgl2 string) ([]MedDispRow, error) {
+func queryPendingMedDisp(ctx context.Context, db *sql.DB, f PendingFilter) ([]MedDispRow, error) {
+	dateCol := dateFilterColumn("MedicationDispense")
+	dispenserExpr, dispenserJoin := dispenserSQL()
 	query := `
 		SELECT reg_periksa.no_rawat, reg_periksa.no_rkm_medis, pasien.nm_pasien, pasien.no_ktp,
 			pegawai.nama, pegawai.no_ktp as ktppraktisi, satu_sehat_encounter.id_encounter,
@@ -58,6 +93,7 @@ func queryPendingMedDisp(db *sql.DB, tgl1, tgl2 string) ([]MedDispRow, error) {
 			satu_sehat_mapping_obat.form_code, satu_sehat_mapping_obat.form_system, satu_sehat_mapping_obat.form_display,
 			satu_sehat_mapping_obat.route_code, satu_sehat_mapping_obat.route_system, satu_sehat_mapping_obat.route_display,
 			satu_sehat_mapping_obat.denominator_code, satu_sehat_mapping_obat.denominator_system,
+			IFNULL(satu_sehat_mapping_obat.denominator_display,'') as denominator_display,
 			CONCAT(resep_obat.tgl_peresepan,' ',resep_obat.jam_peresepan) as tgl_peresepan,
 			detail_pemberian_obat.jml, satu_sehat_medication.id_medication,
 			aturan_pakai.aturan, resep_obat.no_resep,
@@ -65,7 +101,8 @@ func queryPendingMedDisp(db *sql.DB, tgl1, tgl2 string) ([]MedDispRow, error) {
 			detail_pemberian_obat.no_batch, detail_pemberian_obat.no_faktur,
 			CONCAT(detail_pemberian_obat.tgl_perawatan,' ',detail_pemberian_obat.jam) as tgl_validasi,
 			'Ralan' as stts_lanjut,
-			satu_sehat_mapping_lokasi_depo_farmasi.id_lokasi_satusehat, bangsal.nm_bangsal
+			satu_sehat_mapping_lokasi_depo_farmasi.id_lokasi_satusehat, bangsal.nm_bangsal,
+			` + dispenserExpr + `
 		FROM reg_periksa
 		INNER JOIN pasien ON reg_periksa.no_rkm_medis = pasien.no_rkm_medis
 		INNER JOIN resep_obat ON reg_periksa.no_rawat = resep_obat.no_rawat
@@ -81,14 +118,14 @@ func queryPendingMedDisp(db *sql.DB, tgl1, tgl2 string) ([]MedDispRow, error) {
 		INNER JOIN satu_sehat_mapping_obat ON satu_sehat_mapping_obat.kode_brng = detail_pemberian_obat.kode_brng
 		INNER JOIN bangsal ON bangsal.kd_bangsal = detail_pemberian_obat.kd_bangsal
 		INNER JOIN satu_sehat_mapping_lokasi_depo_farmasi ON satu_sehat_mapping_lokasi_depo_farmasi.kd_bangsal = bangsal.kd_bangsal
-		INNER JOIN satu_sehat_medication ON satu_sehat_medication.kode_brng = satu_sehat_mapping_obat.kode_brng
+		INNER JOIN satu_sehat_medication ON satu_sehat_medication.kode_brng = satu_sehat_mapping_obat.kode_brng` + dispenserJoin + `
 		LEFT JOIN satu_sehat_medicationdispense ON satu_sehat_medicationdispense.no_rawat = detail_pemberian_obat.no_rawat
 			AND satu_sehat_medicationdispense.tgl_perawatan = detail_pemberian_obat.tgl_perawatan
 			AND satu_sehat_medicationdispense.jam = detail_pemberian_obat.jam
 			AND satu_sehat_medicationdispense.kode_brng = detail_pemberian_obat.kode_brng
 			AND satu_sehat_medicationdispense.no_batch = detail_pemberian_obat.no_batch
 			AND satu_sehat_medicationdispense.no_faktur = detail_pemberian_obat.no_faktur
-		WHERE reg_periksa.tgl_registrasi BETWEEN ? AND ?
+		WHERE ` + f.rangeSQL(dateCol) + `
 		  AND reg_periksa.status_lanjut = 'Ralan'
 
 		UNION ALL
@@ -100,6 +137,7 @@ func queryPendingMedDisp(db *sql.DB, tgl1, tgl2 string) ([]MedDispRow, error) {
 			satu_sehat_mapping_obat.form_code, satu_sehat_mapping_obat.form_system, satu_sehat_mapping_obat.form_display,
 			satu_sehat_mapping_obat.route_code, satu_sehat_mapping_obat.route_system, satu_sehat_mapping_obat.route_display,
 			satu_sehat_mapping_obat.denominator_code, satu_sehat_mapping_obat.denominator_system,
+			IFNULL(satu_sehat_mapping_obat.denominator_display,'') as denominator_display,
 			CONCAT(resep_obat.tgl_peresepan,' ',resep_obat.jam_peresepan) as tgl_peresepan,
 			detail_pemberian_obat.jml, satu_sehat_medication.id_medication,
 			aturan_pakai.aturan, resep_obat.no_resep,
@@ -107,7 +145,8 @@ func queryPendingMedDisp(db *sql.DB, tgl1, tgl2 string) ([]MedDispRow, error) {
 			detail_pemberian_obat.no_batch, detail_pemberian_obat.no_faktur,
 			CONCAT(detail_pemberian_obat.tgl_perawatan,' ',detail_pemberian_obat.jam) as tgl_validasi,
 			'Ranap' as stts_lanjut,
-			satu_sehat_mapping_lokasi_depo_farmasi.id_lokasi_satusehat, bangsal.nm_bangsal
+			satu_sehat_mapping_lokasi_depo_farmasi.id_lokasi_satusehat, bangsal.nm_bangsal,
+			` + dispenserExpr + `
 		FROM reg_periksa
 		INNER JOIN pasien ON reg_periksa.no_rkm_medis = pasien.no_rkm_medis
 		INNER JOIN resep_obat ON reg_periksa.no_rawat = resep_obat.no_rawat
@@ -123,17 +162,18 @@ func queryPendingMedDisp(db *sql.DB, tgl1, tgl2 string) ([]MedDispRow, error) {
 		INNER JOIN satu_sehat_mapping_obat ON satu_sehat_mapping_obat.kode_brng = detail_pemberian_obat.kode_brng
 		INNER JOIN bangsal ON bangsal.kd_bangsal = detail_pemberian_obat.kd_bangsal
 		INNER JOIN satu_sehat_mapping_lokasi_depo_farmasi ON satu_sehat_mapping_lokasi_depo_farmasi.kd_bangsal = bangsal.kd_bangsal
-		INNER JOIN satu_sehat_medication ON satu_sehat_medication.kode_brng = satu_sehat_mapping_obat.kode_brng
+		INNER JOIN satu_sehat_medication ON satu_sehat_medication.kode_brng = satu_sehat_mapping_obat.kode_brng` + dispenserJoin + `
 		LEFT JOIN satu_sehat_medicationdispense ON satu_sehat_medicationdispense.no_rawat = detail_pemberian_obat.no_rawat
 			AND satu_sehat_medicationdispense.tgl_perawatan = detail_pemberian_obat.tgl_perawatan
 			AND satu_sehat_medicationdispense.jam = detail_pemberian_obat.jam
 			AND satu_sehat_medicationdispense.kode_brng = detail_pemberian_obat.kode_brng
 			AND satu_sehat_medicationdispense.no_batch = detail_pemberian_obat.no_batch
 			AND satu_sehat_medicationdispense.no_faktur = detail_pemberian_obat.no_faktur
-		WHERE reg_periksa.tgl_registrasi BETWEEN ? AND ?
-		  AND reg_periksa.status_lanjut = 'Ranap'`
+		WHERE ` + f.rangeSQL(dateCol) + `
+		  AND reg_periksa.status_lanjut = 'Ranap'
+		ORDER BY tgl_validasi ` + f.orderSQL()
 
-	rows, err := db.Query(query, tgl1, tgl2, tgl1, tgl2)
+	rows, err := db.QueryContext(ctx, query, f.rangeArgs(2)...)
 	if err != nil {
 		return nil, fmt.Errorf("query medication dispense: %w", err)
 	}
@@ -147,12 +187,13 @@ func queryPendingMedDisp(db *sql.DB, tgl1, tgl2 string) ([]MedDispRow, error) {
 			&r.ObatCode, &r.ObatSystem, &r.KodeBrng, &r.ObatDisplay,
 			&r.FormCode, &r.FormSystem, &r.FormDisplay,
 			&r.RouteCode, &r.RouteSystem, &r.RouteDisplay,
-			&r.DenomCode, &r.DenomSystem,
+			&r.DenomCode, &r.DenomSystem, &r.DenomDisplay,
 			&r.TglPeresepan, &r.Jml, &r.IDMedication,
 			&r.AturanPakai, &r.NoResep, &r.IDMedDisp,
 			&r.NoBatch, &r.NoFaktur, &r.TglValidasi,
-			&r.SttsLanjut, &r.IDLocation, &r.NmBangsal); err != nil {
-			log.Printf("⚠️ scan med disp: %v", err)
+			&r.SttsLanjut, &r.IDLocation, &r.NmBangsal,
+			&r.NmApoteker, &r.NoKTPApoteker); err != nil {
+			logWarnf("⚠️ scan med disp: %v", err)
 			continue
 		}
 		results = append(results, r)
@@ -171,11 +212,11 @@ func lookupMedReqID(db *sql.DB, noResep, kodeBrng string) string {
 	return id
 }
 
-func buildMedDispJSON(row MedDispRow, patientID, practitionerID, orgID, medReqID string) map[string]interface{} {
-	signa1, signa2 := parseSigna(row.AturanPakai)
-	signa1f, _ := strconv.ParseFloat(signa1, 64)
-	signa2f, _ := strconv.ParseFloat(signa2, 64)
-	jmlf, _ := strconv.ParseFloat(row.Jml, 64)
+// buildMedDispJSON builds the dispense performed by performerID (see
+// App.dispenser); the prescriber is only referenced through medReqID
+func buildMedDispJSON(row MedDispRow, patientID, performerID, performerName, orgID, medReqID string) map[string]interface{} {
+	signa1f, signa2f := parseSigna(row.AturanPakai)
+	jmlf := parseQuantity(row.Jml)
 
 	catCode, catDisplay := "outpatient", "Outpatient"
 	if row.SttsLanjut == "Ranap" {
@@ -188,8 +229,8 @@ func buildMedDispJSON(row MedDispRow, patientID, practitionerID, orgID, medReqID
 	md := map[string]interface{}{
 		"resourceType": "MedicationDispense",
 		"identifier": []interface{}{
-			map[string]interface{}{"system": "http://sys-ids.kemkes.go.id/medicationdispense/" + orgID, "use": "official", "value": row.NoResep},
-			map[string]interface{}{"system": "http://sys-ids.kemkes.go.id/medicationdispense-item/" + orgID, "use": "official", "value": row.KodeBrng},
+			map[string]interface{}{"system": sysID("medicationdispense", orgID), "use": "official", "value": row.NoResep},
+			map[string]interface{}{"system": sysID("medicationdispense-item", orgID), "use": "official", "value": row.KodeBrng},
 		},
 		"status": "completed",
 		"category": map[string]interface{}{
@@ -199,10 +240,10 @@ func buildMedDispJSON(row MedDispRow, patientID, practitionerID, orgID, medReqID
 		"subject":             map[string]interface{}{"reference": "Patient/" + patientID, "display": row.NmPasien},
 		"context":             map[string]interface{}{"reference": "Encounter/" + row.IDEncounter},
 		"performer": []interface{}{
-			map[string]interface{}{"actor": map[string]interface{}{"reference": "Practitioner/" + practitionerID, "display": row.NmDokter}},
+			map[string]interface{}{"actor": map[string]interface{}{"reference": "Practitioner/" + performerID, "display": performerName}},
 		},
 		"location":       map[string]interface{}{"reference": "Location/" + row.IDLocation, "display": row.NmBangsal},
-		"quantity":       map[string]interface{}{"system": row.DenomSystem, "code": row.DenomCode, "value": jmlf},
+		"quantity":       map[string]interface{}{"unit": denomUnit(row.DenomCode, row.DenomDisplay), "system": row.DenomSystem, "code": row.DenomCode, "value": jmlf},
 		"whenPrepared":   whenPrepared,
 		"whenHandedOver": whenHandedOver,
 		"dosageInstruction": []interface{}{
@@ -211,7 +252,7 @@ func buildMedDispJSON(row MedDispRow, patientID, practitionerID, orgID, medReqID
 				"timing": map[string]interface{}{"repeat": map[string]interface{}{"frequency": signa2f, "period": 1, "periodUnit": "d"}},
 				"route":  map[string]interface{}{"coding": []interface{}{map[string]interface{}{"system": row.RouteSystem, "code": row.RouteCode, "display": row.RouteDisplay}}},
 				"doseAndRate": []interface{}{
-					map[string]interface{}{"doseQuantity": map[string]interface{}{"value": signa1f, "unit": row.DenomCode, "system": row.DenomSystem, "code": row.DenomCode}},
+					map[string]interface{}{"doseQuantity": map[string]interface{}{"value": signa1f, "unit": denomUnit(row.DenomCode, row.DenomDisplay), "system": row.DenomSystem, "code": row.DenomCode}},
 				},
 			},
 		},
@@ -219,7 +260,7 @@ func buildMedDispJSON(row MedDispRow, patientID, practitionerID, orgID, medReqID
 	if medReqID != "" {
 		md["authorizingPrescription"] = []interface{}{map[string]interface{}{"reference": "MedicationRequest/" + medReqID}}
 	}
-	return md
+	return withMetaProfile(md)
 }
 
 // ============================================================
@@ -227,13 +268,8 @@ func buildMedDispJSON(row MedDispRow, patientID, practitionerID, orgID, medReqID
 // ============================================================
 
 func (a *App) handlePendingMedDisp(w http.ResponseWriter, r *http.Request) {
-	tgl1 := r.URL.Query().Get("tgl1")
-	tgl2 := r.URL.Query().Get("tgl2")
-	if tgl1 == "" || tgl2 == "" {
-		today := time.Now().Format("2006-01-02")
-		tgl1, tgl2 = today, today
-	}
-	rows, err := queryPendingMedDisp(a.db, tgl1, tgl2)
+	f := a.pendingFilterFromQuery(r)
+	rows, err := queryPendingMedDisp(r.Context(), a.db, f)
 	if err != nil {
 		jsonError(w, err.Error(), 500)
 		return
@@ -246,68 +282,80 @@ func (a *App) handlePendingMedDisp(w http.ResponseWriter, r *http.Request) {
 			sent = append(sent, row)
 		}
 	}
-	jsonResponse(w, map[string]interface{}{
-		"tgl1": tgl1, "tgl2": tgl2,
+	resp := map[string]interface{}{
+		"tgl1": f.Tgl1, "tgl2": f.Tgl2,
 		"total": len(rows), "pending_count": len(pending), "sent_count": len(sent),
 		"pending": pending,
-	})
+	}
+	if a.requiresVerification("MedicationDispense") {
+		keys := make([]string, len(pending))
+		for i, p := range pending {
+			keys[i] = p.jobKey()
+		}
+		verified := a.verifiedKeys("MedicationDispense", keys)
+		for i := range pending {
+			pending[i].Verified = verified[pending[i].jobKey()]
+		}
+		resp["unverified_count"] = len(pending) - len(verified)
+	}
+	writePending(w, r, resp)
 }
 
 func (a *App) handleSendMedDisp(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Tgl1 string `json:"tgl1"`
-		Tgl2 string `json:"tgl2"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "invalid request body", 400)
-		return
-	}
-	if req.Tgl1 == "" || req.Tgl2 == "" {
-		jsonError(w, "tgl1 and tgl2 required", 400)
-		return
-	}
-	rows, err := queryPendingMedDisp(a.db, req.Tgl1, req.Tgl2)
-	if err != nil {
-		jsonError(w, err.Error(), 500)
+	f, ok := a.decodeSendRequest(w, r)
+	if !ok {
 		return
 	}
-	var results []map[string]interface{}
-	sentCount, failCount := 0, 0
-	for _, row := range rows {
+	res, done, err := a.batch(r.Context()).sendMedDisp(f)
+	writeBatch(w, res, done, err, "details", nil)
+}
+
+// sendMedDisp sends every pending medication dispense in f
+func (a *App) sendMedDisp(f PendingFilter) (*batchResult, int, error) {
+	res := a.newBatchResult()
+	done, err := eachChunk(a.ctx, f, a.cfg.ChunkDays, func(cf PendingFilter) ([]MedDispRow, error) {
+		return queryPendingMedDisp(a.ctx, a.db, cf)
+	}, func(row MedDispRow) {
 		if row.IDMedDisp != "" {
-			continue
+			return
 		}
-		if row.NoKTPPasien == "" || row.NoKTPDokter == "" {
+		if a.requiresVerification("MedicationDispense") && !a.isVerified("MedicationDispense", row.jobKey()) {
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": "skipped", "reason": "awaiting verification"})
+			return
+		}
+		performerNIK, performerName := a.dispenser(row)
+		if row.NoKTPPasien == "" || !a.canLookupPractitioner(performerNIK, performerName) {
 			a.saveSendLog(row.NoRawat, "MedicationDispense", "", "skipped", "missing NIK")
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": "skipped", "reason": "missing NIK"})
-			failCount++
-			continue
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": "skipped", "reason": "missing NIK"})
+			return
+		}
+		if a.enqueueRow("MedicationDispense", row.jobKey(), row.NoRawat) {
+			return
 		}
-		patientID, err := a.ss.LookupPatient(row.NoKTPPasien)
+		patientID, err := a.lookupPatient(row.NoKTPPasien)
 		if err != nil {
-			a.saveSendLog(row.NoRawat, "MedicationDispense", "", "failed", "patient lookup: "+err.Error())
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": "failed", "error": err.Error()})
-			failCount++
-			continue
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, "MedicationDispense", "", st, "patient lookup: "+err.Error())
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": st, "error": err.Error()})
+			return
 		}
-		practID, err := a.ss.LookupPractitioner(row.NoKTPDokter)
+		practID, err := a.lookupPractitioner(performerNIK, performerName)
 		if err != nil {
-			a.saveSendLog(row.NoRawat, "MedicationDispense", "", "failed", "practitioner lookup: "+err.Error())
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": "failed", "error": err.Error()})
-			failCount++
-			continue
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, "MedicationDispense", "", st, "practitioner lookup: "+err.Error())
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": st, "error": err.Error()})
+			return
 		}
 		medReqID := lookupMedReqID(a.db, row.NoResep, row.KodeBrng)
-		md := buildMedDispJSON(row, patientID, practID, a.cfg.SSOrgID, medReqID)
-		fhirID, err := a.sendViaJob("MedicationDispense", idempKey(row.NoRawat, row.TglValidasi, row.KodeBrng, row.NoBatch, row.NoFaktur), md, a.ss.SendMedicationDispense)
+		md := buildMedDispJSON(row, patientID, practID, performerName, a.cfg.SSOrgID, medReqID)
+		fhirID, err := a.sendViaJob("MedicationDispense", row.jobKey(), md, a.ss.SendMedicationDispense)
 		if err != nil {
 			a.saveSendLog(row.NoRawat, "MedicationDispense", "", "failed", err.Error())
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": "failed", "error": err.Error()})
-			failCount++
-			continue
+			res.add(res.withResponse(map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": "failed", "error": err.Error()}, err))
+			return
 		}
 		if fhirID == "" {
-			continue
+			return
 		}
 		tglParts := strings.SplitN(row.TglValidasi, " ", 2)
 		tglPerawatan := tglParts[0]
@@ -319,14 +367,13 @@ func (a *App) handleSendMedDisp(w http.ResponseWriter, r *http.Request) {
 			"INSERT INTO satu_sehat_medicationdispense (no_rawat, tgl_perawatan, jam, kode_brng, no_batch, no_faktur, id_medicationdispanse) VALUES (?,?,?,?,?,?,?)",
 			row.NoRawat, tglPerawatan, jam, row.KodeBrng, row.NoBatch, row.NoFaktur, fhirID)
 		if dbErr != nil {
-			log.Printf("⚠️ save med disp %s: %v", fhirID, dbErr)
+			logErrorf("❌ save med disp %s: %v", fhirID, dbErr)
 		}
 		a.saveSendLog(row.NoRawat, "MedicationDispense", fhirID, "success", "")
-		results = append(results, map[string]interface{}{
+		res.add(map[string]interface{}{
 			"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "obat": row.ObatDisplay,
 			"status": "success", "fhir_id": fhirID,
 		})
-		sentCount++
-	}
-	jsonResponse(w, map[string]interface{}{"sent": sentCount, "failed": failCount, "details": results})
+	})
+	return res, done, err
 }
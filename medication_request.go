@@ -1,15 +1,12 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"regexp"
-	"strconv"
 	"strings"
-	"time"
 )
 
 // ============================================================
@@ -36,6 +33,7 @@ type MedReqRow struct {
 	RouteDisplay string
 	DenomCode    string
 	DenomSystem  string
+	DenomDisplay string
 	TglPeresepan string
 	Jml          string
 	IDMedication string
@@ -46,7 +44,30 @@ type MedReqRow struct {
 	SttsLanjut   string
 }
 
-func queryPendingMedReq(db *sql.DB, tgl1, tgl2 string) ([]MedReqRow, error) {
+// jobKey is the idempotency key of this row's send job (racikan add no_racik)
+func (r MedReqRow) jobKey() string {
+	if r.NoRacik != "" {
+		return idempKey(r.NoResep, r.KodeBrng, r.NoRacik)
+	}
+	return idempKey(r.NoResep, r.KodeBrng)
+}
+
+// initDenominatorDisplay adds satu_sehat_mapping_obat.denominator_display
+// (human unit, e.g. "Tablet" for code TAB) when the column is missing
+func initDenominatorDisplay(db *sql.DB) {
+	ensureColumn(db, "satu_sehat_mapping_obat", "denominator_display", "VARCHAR(100) DEFAULT '' AFTER denominator_system")
+}
+
+// denomUnit is the human-readable dose unit, falling back to the code for mappings without a display
+func denomUnit(code, display string) string {
+	if display != "" {
+		return display
+	}
+	return code
+}
+
+func queryPendingMedReq(ctx context.Context, db *sql.DB, f PendingFilter) ([]MedReqRow, error) {
+	dateCol := dateFilterColumn("MedicationRequest")
 	query := `
 		SELECT reg_periksa.no_rawat, reg_periksa.no_rkm_medis, pasien.nm_pasien, pasien.no_ktp,
 			pegawai.nama, pegawai.no_ktp as ktppraktisi, satu_sehat_encounter.id_encounter,
@@ -55,8 +76,9 @@ func queryPendingMedReq(db *sql.DB, tgl1, tgl2 string) ([]MedReqRow, error) {
 			satu_sehat_mapping_obat.form_code, satu_sehat_mapping_obat.form_system, satu_sehat_mapping_obat.form_display,
 			satu_sehat_mapping_obat.route_code, satu_sehat_mapping_obat.route_system, satu_sehat_mapping_obat.route_display,
 			satu_sehat_mapping_obat.denominator_code, satu_sehat_mapping_obat.denominator_system,
+			IFNULL(satu_sehat_mapping_obat.denominator_display,'') as denominator_display,
 			CONCAT(resep_obat.tgl_peresepan,' ',resep_obat.jam_peresepan) as tgl_peresepan,
-			resep_dokter.jml, satu_sehat_medication.id_medication,
+			resep_dokter.jml, IFNULL(satu_sehat_medication.id_medication,'') as id_medication,
 			resep_dokter.aturan_pakai, resep_dokter.no_resep,
 			IFNULL(satu_sehat_medicationrequest.id_medicationrequest,'') as id_medicationrequest,
 			'' as no_racik, 'Ralan' as stts_lanjut
@@ -67,10 +89,10 @@ func queryPendingMedReq(db *sql.DB, tgl1, tgl2 string) ([]MedReqRow, error) {
 		INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
 		INNER JOIN resep_dokter ON resep_dokter.no_resep = resep_obat.no_resep
 		INNER JOIN satu_sehat_mapping_obat ON satu_sehat_mapping_obat.kode_brng = resep_dokter.kode_brng
-		INNER JOIN satu_sehat_medication ON satu_sehat_medication.kode_brng = satu_sehat_mapping_obat.kode_brng
+		LEFT JOIN satu_sehat_medication ON satu_sehat_medication.kode_brng = satu_sehat_mapping_obat.kode_brng
 		LEFT JOIN satu_sehat_medicationrequest ON satu_sehat_medicationrequest.no_resep = resep_dokter.no_resep
 			AND satu_sehat_medicationrequest.kode_brng = resep_dokter.kode_brng
-		WHERE reg_periksa.tgl_registrasi BETWEEN ? AND ?
+		WHERE ` + f.rangeSQL(dateCol) + `
 		  AND reg_periksa.status_lanjut = 'Ralan'
 
 		UNION ALL
@@ -82,8 +104,9 @@ func queryPendingMedReq(db *sql.DB, tgl1, tgl2 string) ([]MedReqRow, error) {
 			satu_sehat_mapping_obat.form_code, satu_sehat_mapping_obat.form_system, satu_sehat_mapping_obat.form_display,
 			satu_sehat_mapping_obat.route_code, satu_sehat_mapping_obat.route_system, satu_sehat_mapping_obat.route_display,
 			satu_sehat_mapping_obat.denominator_code, satu_sehat_mapping_obat.denominator_system,
+			IFNULL(satu_sehat_mapping_obat.denominator_display,'') as denominator_display,
 			CONCAT(resep_obat.tgl_peresepan,' ',resep_obat.jam_peresepan) as tgl_peresepan,
-			resep_dokter.jml, satu_sehat_medication.id_medication,
+			resep_dokter.jml, IFNULL(satu_sehat_medication.id_medication,'') as id_medication,
 			resep_dokter.aturan_pakai, resep_dokter.no_resep,
 			IFNULL(satu_sehat_medicationrequest.id_medicationrequest,'') as id_medicationrequest,
 			'' as no_racik, 'Ranap' as stts_lanjut
@@ -94,10 +117,10 @@ func queryPendingMedReq(db *sql.DB, tgl1, tgl2 string) ([]MedReqRow, error) {
 		INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
 		INNER JOIN resep_dokter ON resep_dokter.no_resep = resep_obat.no_resep
 		INNER JOIN satu_sehat_mapping_obat ON satu_sehat_mapping_obat.kode_brng = resep_dokter.kode_brng
-		INNER JOIN satu_sehat_medication ON satu_sehat_medication.kode_brng = satu_sehat_mapping_obat.kode_brng
+		LEFT JOIN satu_sehat_medication ON satu_sehat_medication.kode_brng = satu_sehat_mapping_obat.kode_brng
 		LEFT JOIN satu_sehat_medicationrequest ON satu_sehat_medicationrequest.no_resep = resep_dokter.no_resep
 			AND satu_sehat_medicationrequest.kode_brng = resep_dokter.kode_brng
-		WHERE reg_periksa.tgl_registrasi BETWEEN ? AND ?
+		WHERE ` + f.rangeSQL(dateCol) + `
 		  AND reg_periksa.status_lanjut = 'Ranap'
 
 		UNION ALL
@@ -109,8 +132,9 @@ func queryPendingMedReq(db *sql.DB, tgl1, tgl2 string) ([]MedReqRow, error) {
 			satu_sehat_mapping_obat.form_code, satu_sehat_mapping_obat.form_system, satu_sehat_mapping_obat.form_display,
 			satu_sehat_mapping_obat.route_code, satu_sehat_mapping_obat.route_system, satu_sehat_mapping_obat.route_display,
 			satu_sehat_mapping_obat.denominator_code, satu_sehat_mapping_obat.denominator_system,
+			IFNULL(satu_sehat_mapping_obat.denominator_display,'') as denominator_display,
 			CONCAT(resep_obat.tgl_peresepan,' ',resep_obat.jam_peresepan) as tgl_peresepan,
-			resep_dokter_racikan_detail.jml, satu_sehat_medication.id_medication,
+			resep_dokter_racikan_detail.jml, IFNULL(satu_sehat_medication.id_medication,'') as id_medication,
 			resep_dokter_racikan.aturan_pakai, resep_dokter_racikan.no_resep,
 			IFNULL(satu_sehat_medicationrequest_racikan.id_medicationrequest,'') as id_medicationrequest,
 			resep_dokter_racikan_detail.no_racik, 'Ralan' as stts_lanjut
@@ -123,11 +147,11 @@ func queryPendingMedReq(db *sql.DB, tgl1, tgl2 string) ([]MedReqRow, error) {
 		INNER JOIN resep_dokter_racikan_detail ON resep_dokter_racikan_detail.no_resep = resep_dokter_racikan.no_resep
 			AND resep_dokter_racikan_detail.no_racik = resep_dokter_racikan.no_racik
 		INNER JOIN satu_sehat_mapping_obat ON satu_sehat_mapping_obat.kode_brng = resep_dokter_racikan_detail.kode_brng
-		INNER JOIN satu_sehat_medication ON satu_sehat_medication.kode_brng = satu_sehat_mapping_obat.kode_brng
+		LEFT JOIN satu_sehat_medication ON satu_sehat_medication.kode_brng = satu_sehat_mapping_obat.kode_brng
 		LEFT JOIN satu_sehat_medicationrequest_racikan ON satu_sehat_medicationrequest_racikan.no_resep = resep_dokter_racikan_detail.no_resep
 			AND satu_sehat_medicationrequest_racikan.kode_brng = resep_dokter_racikan_detail.kode_brng
 			AND satu_sehat_medicationrequest_racikan.no_racik = resep_dokter_racikan_detail.no_racik
-		WHERE reg_periksa.tgl_registrasi BETWEEN ? AND ?
+		WHERE ` + f.rangeSQL(dateCol) + `
 		  AND reg_periksa.status_lanjut = 'Ralan'
 
 		UNION ALL
@@ -139,8 +163,9 @@ func queryPendingMedReq(db *sql.DB, tgl1, tgl2 string) ([]MedReqRow, error) {
 			satu_sehat_mapping_obat.form_code, satu_sehat_mapping_obat.form_system, satu_sehat_mapping_obat.form_display,
 			satu_sehat_mapping_obat.route_code, satu_sehat_mapping_obat.route_system, satu_sehat_mapping_obat.route_display,
 			satu_sehat_mapping_obat.denominator_code, satu_sehat_mapping_obat.denominator_system,
+			IFNULL(satu_sehat_mapping_obat.denominator_display,'') as denominator_display,
 			CONCAT(resep_obat.tgl_peresepan,' ',resep_obat.jam_peresepan) as tgl_peresepan,
-			resep_dokter_racikan_detail.jml, satu_sehat_medication.id_medication,
+			resep_dokter_racikan_detail.jml, IFNULL(satu_sehat_medication.id_medication,'') as id_medication,
 			resep_dokter_racikan.aturan_pakai, resep_dokter_racikan.no_resep,
 			IFNULL(satu_sehat_medicationrequest_racikan.id_medicationrequest,'') as id_medicationrequest,
 			resep_dokter_racikan_detail.no_racik, 'Ranap' as stts_lanjut
@@ -153,14 +178,15 @@ func queryPendingMedReq(db *sql.DB, tgl1, tgl2 string) ([]MedReqRow, error) {
 		INNER JOIN resep_dokter_racikan_detail ON resep_dokter_racikan_detail.no_resep = resep_dokter_racikan.no_resep
 			AND resep_dokter_racikan_detail.no_racik = resep_dokter_racikan.no_racik
 		INNER JOIN satu_sehat_mapping_obat ON satu_sehat_mapping_obat.kode_brng = resep_dokter_racikan_detail.kode_brng
-		INNER JOIN satu_sehat_medication ON satu_sehat_medication.kode_brng = satu_sehat_mapping_obat.kode_brng
+		LEFT JOIN satu_sehat_medication ON satu_sehat_medication.kode_brng = satu_sehat_mapping_obat.kode_brng
 		LEFT JOIN satu_sehat_medicationrequest_racikan ON satu_sehat_medicationrequest_racikan.no_resep = resep_dokter_racikan_detail.no_resep
 			AND satu_sehat_medicationrequest_racikan.kode_brng = resep_dokter_racikan_detail.kode_brng
 			AND satu_sehat_medicationrequest_racikan.no_racik = resep_dokter_racikan_detail.no_racik
-		WHERE reg_periksa.tgl_registrasi BETWEEN ? AND ?
-		  AND reg_periksa.status_lanjut = 'Ranap'`
+		WHERE ` + f.rangeSQL(dateCol) + `
+		  AND reg_periksa.status_lanjut = 'Ranap'
+		ORDER BY tgl_peresepan ` + f.orderSQL()
 
-	rows, err := db.Query(query, tgl1, tgl2, tgl1, tgl2, tgl1, tgl2, tgl1, tgl2)
+	rows, err := db.QueryContext(ctx, query, f.rangeArgs(4)...)
 	if err != nil {
 		return nil, fmt.Errorf("query medication requests: %w", err)
 	}
@@ -174,11 +200,11 @@ func queryPendingMedReq(db *sql.DB, tgl1, tgl2 string) ([]MedReqRow, error) {
 			&r.ObatCode, &r.ObatSystem, &r.KodeBrng, &r.ObatDisplay,
 			&r.FormCode, &r.FormSystem, &r.FormDisplay,
 			&r.RouteCode, &r.RouteSystem, &r.RouteDisplay,
-			&r.DenomCode, &r.DenomSystem,
+			&r.DenomCode, &r.DenomSystem, &r.DenomDisplay,
 			&r.TglPeresepan, &r.Jml, &r.IDMedication,
 			&r.AturanPakai, &r.NoResep, &r.IDMedReq,
 			&r.NoRacik, &r.SttsLanjut); err != nil {
-			log.Printf("⚠️ scan med req: %v", err)
+			logWarnf("⚠️ scan med req: %v", err)
 			continue
 		}
 		results = append(results, r)
@@ -186,32 +212,36 @@ func queryPendingMedReq(db *sql.DB, tgl1, tgl2 string) ([]MedReqRow, error) {
 	return results, nil
 }
 
-// parseSigna parses "signa1 x signa2" from aturan_pakai, returns (dose, frequency)
-func parseSigna(aturan string) (string, string) {
+// quantityPattern matches the first number of a Khanza quantity, with an
+// optional decimal comma or dot
+var quantityPattern = regexp.MustCompile(`[0-9]+(?:[.,][0-9]+)?`)
+
+// parseQuantity reads the number in a value like "10", "0,5" or "10 tablet",
+// ignoring trailing unit text. 0 when there is none.
+func parseQuantity(s string) float64 {
+	return parseFloat(strings.Replace(quantityPattern.FindString(s), ",", ".", 1))
+}
+
+// parseSigna parses "signa1 x signa2" from aturan_pakai ("3 x 1", "0,5 x 2"),
+// returns (dose, frequency); a part without a number is 1. When only signa1
+// has a number ("2 x sehari") it counts the times a day: dose 1, frequency 2.
+func parseSigna(aturan string) (float64, float64) {
 	parts := strings.SplitN(strings.ToLower(aturan), "x", 2)
-	signa1, signa2 := "1", "1"
-	if len(parts) >= 1 {
-		s := strings.TrimSpace(parts[0])
-		s = regexp.MustCompile(`[^0-9.]+`).ReplaceAllString(s, "")
-		if s != "" {
-			signa1 = s
+	signa := [2]float64{1, 1}
+	for i, p := range parts {
+		if v := parseQuantity(p); v > 0 {
+			signa[i] = v
 		}
 	}
-	if len(parts) >= 2 {
-		s := strings.TrimSpace(parts[1])
-		s = regexp.MustCompile(`[^0-9.]+`).ReplaceAllString(s, "")
-		if s != "" {
-			signa2 = s
-		}
+	if len(parts) == 2 && quantityPattern.FindString(parts[1]) == "" {
+		return 1, signa[0]
 	}
-	return signa1, signa2
+	return signa[0], signa[1]
 }
 
 func buildMedReqJSON(row MedReqRow, patientID, practitionerID, orgID string) map[string]interface{} {
-	signa1, signa2 := parseSigna(row.AturanPakai)
-	signa1f, _ := strconv.ParseFloat(signa1, 64)
-	signa2f, _ := strconv.ParseFloat(signa2, 64)
-	jmlf, _ := strconv.ParseFloat(row.Jml, 64)
+	signa1f, signa2f := parseSigna(row.AturanPakai)
+	jmlf := parseQuantity(row.Jml)
 
 	catCode, catDisplay := "outpatient", "Outpatient"
 	if row.SttsLanjut == "Ranap" {
@@ -225,37 +255,46 @@ func buildMedReqJSON(row MedReqRow, patientID, practitionerID, orgID string) map
 
 	authoredOn := strings.ReplaceAll(row.TglPeresepan, " ", "T") + "+07:00"
 
-	return map[string]interface{}{
+	medReq := map[string]interface{}{
 		"resourceType": "MedicationRequest",
 		"identifier": []interface{}{
-			map[string]interface{}{"system": "http://sys-ids.kemkes.go.id/prescription/" + orgID, "use": "official", "value": prescValue},
-			map[string]interface{}{"system": "http://sys-ids.kemkes.go.id/prescription-item/" + orgID, "use": "official", "value": row.KodeBrng},
+			map[string]interface{}{"system": sysID("prescription", orgID), "use": "official", "value": prescValue},
+			map[string]interface{}{"system": sysID("prescription-item", orgID), "use": "official", "value": row.KodeBrng},
 		},
 		"status": "completed",
 		"intent": "order",
 		"category": []interface{}{
 			map[string]interface{}{"coding": []interface{}{map[string]interface{}{"system": "http://terminology.hl7.org/CodeSystem/medicationrequest-category", "code": catCode, "display": catDisplay}}},
 		},
-		"medicationReference": map[string]interface{}{"reference": "Medication/" + row.IDMedication, "display": row.ObatDisplay},
-		"subject":             map[string]interface{}{"reference": "Patient/" + patientID, "display": row.NmPasien},
-		"encounter":           map[string]interface{}{"reference": "Encounter/" + row.IDEncounter},
-		"authoredOn":          authoredOn,
-		"requester":           map[string]interface{}{"reference": "Practitioner/" + practitionerID, "display": row.NmDokter},
+		"subject":    map[string]interface{}{"reference": "Patient/" + patientID, "display": row.NmPasien},
+		"encounter":  map[string]interface{}{"reference": "Encounter/" + row.IDEncounter},
+		"authoredOn": authoredOn,
+		"requester":  map[string]interface{}{"reference": "Practitioner/" + practitionerID, "display": row.NmDokter},
 		"dosageInstruction": []interface{}{
 			map[string]interface{}{
 				"sequence": 1, "patientInstruction": row.AturanPakai,
 				"timing": map[string]interface{}{"repeat": map[string]interface{}{"frequency": signa2f, "period": 1, "periodUnit": "d"}},
 				"route":  map[string]interface{}{"coding": []interface{}{map[string]interface{}{"system": row.RouteSystem, "code": row.RouteCode, "display": row.RouteDisplay}}},
 				"doseAndRate": []interface{}{
-					map[string]interface{}{"doseQuantity": map[string]interface{}{"value": signa1f, "unit": row.DenomCode, "system": row.DenomSystem, "code": row.DenomCode}},
+					map[string]interface{}{"doseQuantity": map[string]interface{}{"value": signa1f, "unit": denomUnit(row.DenomCode, row.DenomDisplay), "system": row.DenomSystem, "code": row.DenomCode}},
 				},
 			},
 		},
 		"dispenseRequest": map[string]interface{}{
-			"quantity":  map[string]interface{}{"value": jmlf, "unit": row.DenomCode, "system": row.DenomSystem, "code": row.DenomCode},
+			"quantity":  map[string]interface{}{"value": jmlf, "unit": denomUnit(row.DenomCode, row.DenomDisplay), "system": row.DenomSystem, "code": row.DenomCode},
 			"performer": map[string]interface{}{"reference": "Organization/" + orgID},
 		},
 	}
+	if row.IDMedication != "" {
+		medReq["medicationReference"] = map[string]interface{}{"reference": "Medication/" + row.IDMedication, "display": row.ObatDisplay}
+	} else {
+		// no Medication resource provisioned yet: code the drug inline from satu_sehat_mapping_obat
+		medReq["medicationCodeableConcept"] = map[string]interface{}{
+			"coding": []interface{}{map[string]interface{}{"system": row.ObatSystem, "code": row.ObatCode, "display": row.ObatDisplay}},
+			"text":   row.ObatDisplay,
+		}
+	}
+	return withMetaProfile(medReq)
 }
 
 // ============================================================
@@ -263,13 +302,8 @@ func buildMedReqJSON(row MedReqRow, patientID, practitionerID, orgID string) map
 // ============================================================
 
 func (a *App) handlePendingMedReq(w http.ResponseWriter, r *http.Request) {
-	tgl1 := r.URL.Query().Get("tgl1")
-	tgl2 := r.URL.Query().Get("tgl2")
-	if tgl1 == "" || tgl2 == "" {
-		today := time.Now().Format("2006-01-02")
-		tgl1, tgl2 = today, today
-	}
-	rows, err := queryPendingMedReq(a.db, tgl1, tgl2)
+	f := a.pendingFilterFromQuery(r)
+	rows, err := queryPendingMedReq(r.Context(), a.db, f)
 	if err != nil {
 		jsonError(w, err.Error(), 500)
 		return
@@ -282,89 +316,84 @@ func (a *App) handlePendingMedReq(w http.ResponseWriter, r *http.Request) {
 			sent = append(sent, row)
 		}
 	}
-	jsonResponse(w, map[string]interface{}{
-		"tgl1": tgl1, "tgl2": tgl2,
+	writePending(w, r, map[string]interface{}{
+		"tgl1": f.Tgl1, "tgl2": f.Tgl2,
 		"total": len(rows), "pending_count": len(pending), "sent_count": len(sent),
 		"pending": pending,
 	})
 }
 
 func (a *App) handleSendMedReq(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Tgl1 string `json:"tgl1"`
-		Tgl2 string `json:"tgl2"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "invalid request body", 400)
+	f, ok := a.decodeSendRequest(w, r)
+	if !ok {
 		return
 	}
-	if req.Tgl1 == "" || req.Tgl2 == "" {
-		jsonError(w, "tgl1 and tgl2 required", 400)
-		return
-	}
-	rows, err := queryPendingMedReq(a.db, req.Tgl1, req.Tgl2)
-	if err != nil {
-		jsonError(w, err.Error(), 500)
-		return
-	}
-	var results []map[string]interface{}
-	sentCount, failCount := 0, 0
-	for _, row := range rows {
+	res, done, err := a.batch(r.Context()).sendMedReq(f)
+	writeBatch(w, res, done, err, "details", nil)
+}
+
+// sendMedReq sends every pending medication request in f
+func (a *App) sendMedReq(f PendingFilter) (*batchResult, int, error) {
+	res := a.newBatchResult()
+	done, err := eachChunk(a.ctx, f, a.cfg.ChunkDays, func(cf PendingFilter) ([]MedReqRow, error) {
+		return queryPendingMedReq(a.ctx, a.db, cf)
+	}, func(row MedReqRow) {
 		if row.IDMedReq != "" {
-			continue
+			return
 		}
-		if row.NoKTPPasien == "" || row.NoKTPDokter == "" {
+		if row.NoKTPPasien == "" || !a.canLookupPractitioner(row.NoKTPDokter, row.NmDokter) {
 			a.saveSendLog(row.NoRawat, "MedicationRequest", "", "skipped", "missing NIK")
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": "skipped", "reason": "missing NIK"})
-			failCount++
-			continue
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": "skipped", "reason": "missing NIK"})
+			return
+		}
+		if a.enqueueRow("MedicationRequest", row.jobKey(), row.NoRawat) {
+			return
 		}
-		patientID, err := a.ss.LookupPatient(row.NoKTPPasien)
+		patientID, err := a.lookupPatient(row.NoKTPPasien)
 		if err != nil {
-			a.saveSendLog(row.NoRawat, "MedicationRequest", "", "failed", "patient lookup: "+err.Error())
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": "failed", "error": err.Error()})
-			failCount++
-			continue
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, "MedicationRequest", "", st, "patient lookup: "+err.Error())
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": st, "error": err.Error()})
+			return
 		}
-		practID, err := a.ss.LookupPractitioner(row.NoKTPDokter)
+		practID, err := a.lookupPractitioner(row.NoKTPDokter, row.NmDokter)
 		if err != nil {
-			a.saveSendLog(row.NoRawat, "MedicationRequest", "", "failed", "practitioner lookup: "+err.Error())
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": "failed", "error": err.Error()})
-			failCount++
-			continue
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, "MedicationRequest", "", st, "practitioner lookup: "+err.Error())
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": st, "error": err.Error()})
+			return
 		}
 		mr := buildMedReqJSON(row, patientID, practID, a.cfg.SSOrgID)
-		ikey := idempKey(row.NoResep, row.KodeBrng)
-		if row.NoRacik != "" {
-			ikey = idempKey(row.NoResep, row.KodeBrng, row.NoRacik)
+		if ts := futureTimestamp(mr); ts != "" {
+			a.saveSendLog(row.NoRawat, "MedicationRequest", "", "skipped", "future timestamp: "+ts)
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": "skipped", "reason": "future timestamp", "timestamp": ts})
+			return
 		}
-		fhirID, err := a.sendViaJob("MedicationRequest", ikey, mr, a.ss.SendMedicationRequest)
+		fhirID, err := a.sendViaJob("MedicationRequest", row.jobKey(), mr, a.ss.SendMedicationRequest)
 		if err != nil {
 			a.saveSendLog(row.NoRawat, "MedicationRequest", "", "failed", err.Error())
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": "failed", "error": err.Error()})
-			failCount++
-			continue
+			res.add(res.withResponse(map[string]interface{}{"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "status": "failed", "error": err.Error()}, err))
+			return
 		}
 		if fhirID == "" {
-			continue
+			return
 		}
 		if row.NoRacik == "" {
 			_, dbErr := a.db.Exec("INSERT INTO satu_sehat_medicationrequest (no_resep, kode_brng, id_medicationrequest) VALUES (?,?,?)", row.NoResep, row.KodeBrng, fhirID)
 			if dbErr != nil {
-				log.Printf("⚠️ save med req %s: %v", fhirID, dbErr)
+				logErrorf("❌ save med req %s: %v", fhirID, dbErr)
 			}
 		} else {
 			_, dbErr := a.db.Exec("INSERT INTO satu_sehat_medicationrequest_racikan (no_resep, kode_brng, no_racik, id_medicationrequest) VALUES (?,?,?,?)", row.NoResep, row.KodeBrng, row.NoRacik, fhirID)
 			if dbErr != nil {
-				log.Printf("⚠️ save med req racikan %s: %v", fhirID, dbErr)
+				logErrorf("❌ save med req racikan %s: %v", fhirID, dbErr)
 			}
 		}
 		a.saveSendLog(row.NoRawat, "MedicationRequest", fhirID, "success", "")
-		results = append(results, map[string]interface{}{
+		res.add(map[string]interface{}{
 			"no_rawat": row.NoRawat, "kode_brng": row.KodeBrng, "obat": row.ObatDisplay,
 			"status": "success", "fhir_id": fhirID,
 		})
-		sentCount++
-	}
-	jsonResponse(w, map[string]interface{}{"sent": sentCount, "failed": failCount, "details": results})
+	})
+	return res, done, err
 }
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestParseQuantity(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+	}{
+		{"0,5", 0.5},
+		{"0.5", 0.5},
+		{"10", 10},
+		{"10 tablet", 10},
+		{"tablet", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := parseQuantity(tt.in); got != tt.want {
+			t.Errorf("parseQuantity(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseSigna(t *testing.T) {
+	tests := []struct {
+		in              string
+		dose, frequency float64
+	}{
+		{"3 x 1", 3, 1},
+		{"0,5 x 2", 0.5, 2},
+		{"2 x sehari", 1, 2},
+		{"2X SEHARI", 1, 2},
+		{"10", 10, 1},
+		{"sesudah makan", 1, 1},
+		{"", 1, 1},
+	}
+	for _, tt := range tests {
+		dose, frequency := parseSigna(tt.in)
+		if dose != tt.dose || frequency != tt.frequency {
+			t.Errorf("parseSigna(%q) = (%v, %v), want (%v, %v)", tt.in, dose, frequency, tt.dose, tt.frequency)
+		}
+	}
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
-	"time"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 // ============================================================
@@ -37,23 +38,60 @@ type LabRow struct {
 	Satuan        string
 	NilaiRujukan  string
 	Keterangan    string
+	CatCode       string // satu_sehat_mapping_lab.category_* override, empty = laboratory
+	CatSystem     string
+	CatDisplay    string
 }
 
-func queryPendingLabObs(db *sql.DB, tgl1, tgl2 string) ([]LabRow, error) {
+// jobKey is the idempotency key of this row's send job
+func (r LabRow) jobKey() string {
+	return idempKey(r.NoOrder, r.IDTemplate, r.KdJenisPrw)
+}
+
+// initLabCategory adds the optional per-template category override columns to
+// satu_sehat_mapping_lab
+func initLabCategory(db *sql.DB) {
+	ensureColumn(db, "satu_sehat_mapping_lab", "category_code", "VARCHAR(50) DEFAULT ''")
+	ensureColumn(db, "satu_sehat_mapping_lab", "category_system", "VARCHAR(200) DEFAULT ''")
+	ensureColumn(db, "satu_sehat_mapping_lab", "category_display", "VARCHAR(200) DEFAULT ''")
+}
+
+const observationCategorySystem = "http://terminology.hl7.org/CodeSystem/observation-category"
+
+// labCategory is Observation.category for a lab row. An override in the
+// observation-category system (or without a system) replaces "laboratory";
+// one from another system (e.g. LOINC section codes for microbiology) is
+// added as a second coding next to it.
+func labCategory(row LabRow) []interface{} {
+	lab := map[string]interface{}{"system": observationCategorySystem, "code": "laboratory", "display": "Laboratory"}
+	coding := []interface{}{lab}
+	switch {
+	case row.CatCode == "":
+	case row.CatSystem == "" || row.CatSystem == observationCategorySystem:
+		lab["code"], lab["display"] = row.CatCode, row.CatDisplay
+	default:
+		coding = append(coding, map[string]interface{}{"system": row.CatSystem, "code": row.CatCode, "display": row.CatDisplay})
+	}
+	return []interface{}{map[string]interface{}{"coding": coding}}
+}
+
+func queryPendingLabObs(ctx context.Context, db *sql.DB, f PendingFilter) ([]LabRow, error) {
 	query := `
 		SELECT reg_periksa.no_rawat, reg_periksa.no_rkm_medis, pasien.nm_pasien, pasien.no_ktp,
 			permintaan_lab.noorder, permintaan_lab.tgl_hasil, permintaan_lab.jam_hasil,
 			template_laboratorium.Pemeriksaan,
 			satu_sehat_mapping_lab.code, satu_sehat_mapping_lab.system, satu_sehat_mapping_lab.display,
 			detail_periksa_lab.nilai, permintaan_detail_permintaan_lab.id_template,
-			satu_sehat_specimen_lab.id_specimen,
+			IFNULL(satu_sehat_specimen_lab.id_specimen,''),
 			periksa_lab.kd_dokter, pegawai.nama, pegawai.no_ktp as ktppraktisi,
 			satu_sehat_encounter.id_encounter,
 			IFNULL(satu_sehat_observation_lab.id_observation,'') as id_observation,
 			detail_periksa_lab.kd_jenis_prw,
 			template_laboratorium.satuan,
 			detail_periksa_lab.nilai_rujukan,
-			detail_periksa_lab.keterangan
+			detail_periksa_lab.keterangan,
+			IFNULL(satu_sehat_mapping_lab.category_code,''), IFNULL(satu_sehat_mapping_lab.category_system,''),
+			IFNULL(satu_sehat_mapping_lab.category_display,'')
 		FROM reg_periksa
 		INNER JOIN pasien ON reg_periksa.no_rkm_medis = pasien.no_rkm_medis
 		INNER JOIN permintaan_lab ON permintaan_lab.no_rawat = reg_periksa.no_rawat
@@ -75,9 +113,10 @@ func queryPendingLabObs(db *sql.DB, tgl1, tgl2 string) ([]LabRow, error) {
 			AND satu_sehat_specimen_lab.kd_jenis_prw = satu_sehat_observation_lab.kd_jenis_prw
 		INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
 		INNER JOIN pegawai ON periksa_lab.kd_dokter = pegawai.nik
-		WHERE reg_periksa.tgl_registrasi BETWEEN ? AND ?`
+		WHERE ` + f.rangeSQL(dateFilterColumn("Observation_Lab")) + `
+		ORDER BY permintaan_lab.tgl_hasil ` + f.orderSQL() + `, permintaan_lab.jam_hasil ` + f.orderSQL()
 
-	rows, err := db.Query(query, tgl1, tgl2)
+	rows, err := db.QueryContext(ctx, query, f.rangeArgs(1)...)
 	if err != nil {
 		return nil, fmt.Errorf("query lab obs: %w", err)
 	}
@@ -91,8 +130,9 @@ func queryPendingLabObs(db *sql.DB, tgl1, tgl2 string) ([]LabRow, error) {
 			&r.Code, &r.System, &r.Display, &r.Nilai, &r.IDTemplate,
 			&r.IDSpecimen, &r.KdDokter, &r.NamaDokter, &r.NoKTPDokter,
 			&r.IDEncounter, &r.IDObservation, &r.KdJenisPrw,
-			&r.Satuan, &r.NilaiRujukan, &r.Keterangan); err != nil {
-			log.Printf("⚠️ scan lab obs: %v", err)
+			&r.Satuan, &r.NilaiRujukan, &r.Keterangan,
+			&r.CatCode, &r.CatSystem, &r.CatDisplay); err != nil {
+			logWarnf("⚠️ scan lab obs: %v", err)
 			continue
 		}
 		results = append(results, r)
@@ -100,33 +140,189 @@ func queryPendingLabObs(db *sql.DB, tgl1, tgl2 string) ([]LabRow, error) {
 	return results, nil
 }
 
-func buildLabObservationJSON(row LabRow, patientID, practitionerID, orgID string) map[string]interface{} {
+// labNoteInlineLen is the longest keterangan still inlined into valueString;
+// longer ones only go to Observation.note
+const labNoteInlineLen = 100
+
+// buildLabObservationJSON builds the lab Observation; a valueString longer
+// than maxLen runes (SS_LAB_MAX_VALUE_LENGTH) is truncated with a marker
+func buildLabObservationJSON(row LabRow, patientID, practitionerID, orgID string, maxLen int) map[string]interface{} {
 	effectiveDateTime := row.TglHasil + "T" + row.JamHasil + "+07:00"
-	valueStr := "Hasil Lab : " + row.Nilai + " " + row.Satuan + ", Nilai Rujukan : " + row.NilaiRujukan
-	if row.Keterangan != "" {
-		valueStr += ", Keterangan : " + row.Keterangan
+	keterangan := row.Keterangan
+	longNote := len([]rune(keterangan)) > labNoteInlineLen
+	if longNote {
+		keterangan = ""
 	}
-	return map[string]interface{}{
+	valueStr := displayText(
+		labeled("Hasil Lab :", displayWords(row.Nilai, row.Satuan)),
+		labeled("Nilai Rujukan :", row.NilaiRujukan),
+		labeled("Keterangan :", keterangan))
+	if cut, truncated := truncateText(valueStr, maxLen); truncated {
+		logWarnf("⚠️ lab value %s/%s truncated from %d to %d chars", row.NoOrder, row.IDTemplate, len([]rune(valueStr)), maxLen)
+		valueStr = cut
+	}
+	obs := map[string]interface{}{
 		"resourceType": "Observation",
 		"identifier": []interface{}{
-			map[string]interface{}{"system": "http://sys-ids.kemkes.go.id/observation/" + orgID, "value": row.NoOrder + "." + row.IDTemplate},
-		},
-		"status": "final",
-		"category": []interface{}{
-			map[string]interface{}{"coding": []interface{}{map[string]interface{}{"system": "http://terminology.hl7.org/CodeSystem/observation-category", "code": "laboratory", "display": "Laboratory"}}},
+			map[string]interface{}{"system": sysID("observation", orgID), "value": row.NoOrder + "." + row.IDTemplate},
 		},
+		"status":   "final",
+		"category": labCategory(row),
 		"code": map[string]interface{}{
 			"coding": []interface{}{map[string]interface{}{"system": row.System, "code": row.Code, "display": row.Display}},
 		},
 		"subject":   map[string]interface{}{"reference": "Patient/" + patientID},
-		"performer": []interface{}{map[string]interface{}{"reference": "Practitioner/" + practitionerID}},
+		"performer": observationPerformers(practitionerID, orgID),
 		"encounter": map[string]interface{}{
 			"reference": "Encounter/" + row.IDEncounter,
-			"display":   "Hasil Pemeriksaan Lab " + row.Pemeriksaan + " No.Rawat " + row.NoRawat + ", Atas Nama Pasien " + row.NmPasien + ", No.RM " + row.NoRM,
+			"display": displayText(
+				displayWords("Hasil Pemeriksaan Lab", row.Pemeriksaan, labeled("No.Rawat", row.NoRawat)),
+				labeled("Atas Nama Pasien", row.NmPasien), labeled("No.RM", row.NoRM)),
 		},
 		"specimen":          map[string]interface{}{"reference": "Specimen/" + row.IDSpecimen},
 		"effectiveDateTime": effectiveDateTime,
-		"valueString":       valueStr,
+	}
+
+	// Numeric result with a known unit → valueQuantity + referenceRange;
+	// qualitative results ("Positif", "Negatif", ...) stay as valueString
+	value, isNum := parseLabNumber(row.Nilai)
+	rr, hasRange := parseRefRange(row.NilaiRujukan)
+	if isNum && hasRange {
+		obs["interpretation"] = []interface{}{rr.interpret(value)}
+	}
+	ucum, hasUnit := labUCUM(row.Satuan)
+	if !isNum || !hasUnit {
+		obs["valueString"] = valueStr
+		if longNote {
+			obs["note"] = []interface{}{map[string]interface{}{"text": row.Keterangan}}
+		}
+		return withMetaProfile(obs)
+	}
+	quantity := func(v float64) map[string]interface{} {
+		return map[string]interface{}{"value": v, "unit": row.Satuan, "system": "http://unitsofmeasure.org", "code": ucum}
+	}
+	obs["valueQuantity"] = quantity(value)
+	if hasRange {
+		rng := map[string]interface{}{"text": row.NilaiRujukan}
+		if rr.Low != nil {
+			rng["low"] = quantity(*rr.Low)
+		}
+		if rr.High != nil {
+			rng["high"] = quantity(*rr.High)
+		}
+		obs["referenceRange"] = []interface{}{rng}
+	}
+	if row.Keterangan != "" {
+		obs["note"] = []interface{}{map[string]interface{}{"text": row.Keterangan}}
+	}
+	return withMetaProfile(obs)
+}
+
+// ============================================================
+// LAB VALUE PARSING
+// ============================================================
+
+// labUnits maps Khanza template_laboratorium.satuan spellings (lowercased) to UCUM codes
+var labUnits = map[string]string{
+	"%":       "%",
+	"mg/dl":   "mg/dL",
+	"g/dl":    "g/dL",
+	"gr/dl":   "g/dL",
+	"mg/l":    "mg/L",
+	"g/l":     "g/L",
+	"mmol/l":  "mmol/L",
+	"umol/l":  "umol/L",
+	"µmol/l":  "umol/L",
+	"meq/l":   "meq/L",
+	"ng/ml":   "ng/mL",
+	"pg/ml":   "pg/mL",
+	"u/l":     "U/L",
+	"iu/l":    "[IU]/L",
+	"mu/l":    "m[IU]/L",
+	"uiu/ml":  "u[IU]/mL",
+	"µiu/ml":  "u[IU]/mL",
+	"fl":      "fL",
+	"pg":      "pg",
+	"mm/jam":  "mm/h",
+	"detik":   "s",
+	"menit":   "min",
+	"/ul":     "/uL",
+	"sel/ul":  "/uL",
+	"10^3/ul": "10*3/uL",
+	"10^6/ul": "10*6/uL",
+	"ribu/ul": "10*3/uL",
+	"juta/ul": "10*6/uL",
+	"rb/ul":   "10*3/uL",
+	"jt/ul":   "10*6/uL",
+}
+
+// labUCUM returns the UCUM code for a Khanza lab unit
+func labUCUM(satuan string) (string, bool) {
+	code, ok := labUnits[strings.ToLower(strings.TrimSpace(satuan))]
+	return code, ok
+}
+
+// parseLabNumber parses a lab value like "5,4" or "120" (decimal comma allowed)
+func parseLabNumber(s string) (float64, bool) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), ",", ".")
+	if s == "" {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// refRange is a parsed nilai_rujukan; a nil bound means open-ended
+type refRange struct {
+	Low  *float64
+	High *float64
+}
+
+var (
+	rangePattern     = regexp.MustCompile(`^\s*(\d+(?:[.,]\d+)?)\s*[-–]\s*(\d+(?:[.,]\d+)?)\s*$`)
+	upperOnlyPattern = regexp.MustCompile(`^\s*(?:<=?|≤)\s*(\d+(?:[.,]\d+)?)\s*$`)
+	lowerOnlyPattern = regexp.MustCompile(`^\s*(?:>=?|≥)\s*(\d+(?:[.,]\d+)?)\s*$`)
+)
+
+// parseRefRange parses a nilai_rujukan like "70-110", "3,5 - 5,0", "<200" or ">40"
+func parseRefRange(s string) (refRange, bool) {
+	if m := rangePattern.FindStringSubmatch(s); m != nil {
+		low, ok1 := parseLabNumber(m[1])
+		high, ok2 := parseLabNumber(m[2])
+		if !ok1 || !ok2 {
+			return refRange{}, false
+		}
+		return refRange{Low: &low, High: &high}, true
+	}
+	if m := upperOnlyPattern.FindStringSubmatch(s); m != nil {
+		if high, ok := parseLabNumber(m[1]); ok {
+			return refRange{High: &high}, true
+		}
+	}
+	if m := lowerOnlyPattern.FindStringSubmatch(s); m != nil {
+		if low, ok := parseLabNumber(m[1]); ok {
+			return refRange{Low: &low}, true
+		}
+	}
+	return refRange{}, false
+}
+
+// interpret returns the v3-ObservationInterpretation coding (H/L/N) for v
+func (rr refRange) interpret(v float64) map[string]interface{} {
+	code, display := "N", "Normal"
+	switch {
+	case rr.High != nil && v > *rr.High:
+		code, display = "H", "High"
+	case rr.Low != nil && v < *rr.Low:
+		code, display = "L", "Low"
+	}
+	return map[string]interface{}{
+		"coding": []interface{}{
+			map[string]interface{}{"system": "http://terminology.hl7.org/CodeSystem/v3-ObservationInterpretation", "code": code, "display": display},
+		},
 	}
 }
 
@@ -135,13 +331,8 @@ func buildLabObservationJSON(row LabRow, patientID, practitionerID, orgID string
 // ============================================================
 
 func (a *App) handlePendingLabObs(w http.ResponseWriter, r *http.Request) {
-	tgl1 := r.URL.Query().Get("tgl1")
-	tgl2 := r.URL.Query().Get("tgl2")
-	if tgl1 == "" || tgl2 == "" {
-		today := time.Now().Format("2006-01-02")
-		tgl1, tgl2 = today, today
-	}
-	rows, err := queryPendingLabObs(a.db, tgl1, tgl2)
+	f := a.pendingFilterFromQuery(r)
+	rows, err := queryPendingLabObs(r.Context(), a.db, f)
 	if err != nil {
 		jsonError(w, err.Error(), 500)
 		return
@@ -154,80 +345,90 @@ func (a *App) handlePendingLabObs(w http.ResponseWriter, r *http.Request) {
 			sent = append(sent, row)
 		}
 	}
-	jsonResponse(w, map[string]interface{}{
-		"tgl1": tgl1, "tgl2": tgl2,
+	writePending(w, r, map[string]interface{}{
+		"tgl1": f.Tgl1, "tgl2": f.Tgl2,
 		"total": len(rows), "pending_count": len(pending), "sent_count": len(sent),
 		"pending": pending,
 	})
 }
 
 func (a *App) handleSendLabObs(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Tgl1 string `json:"tgl1"`
-		Tgl2 string `json:"tgl2"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "invalid request body", 400)
+	f, ok := a.decodeSendRequest(w, r)
+	if !ok {
 		return
 	}
-	if req.Tgl1 == "" || req.Tgl2 == "" {
-		jsonError(w, "tgl1 and tgl2 required", 400)
-		return
-	}
-	rows, err := queryPendingLabObs(a.db, req.Tgl1, req.Tgl2)
-	if err != nil {
-		jsonError(w, err.Error(), 500)
-		return
+	res, done, err := a.batch(r.Context()).sendLabObs(f)
+	writeBatch(w, res, done, err, "details", nil)
+}
+
+// sendLabObs creates the missing Specimens in f, then sends every pending lab
+// observation. Specimen outcomes are reported with "step":"specimen".
+func (a *App) sendLabObs(f PendingFilter) (*batchResult, int, error) {
+	res := a.newBatchResult()
+	if _, err := a.sendLabSpecimens(res, f); err != nil {
+		logWarnf("⚠️ lab specimens: %v", err)
 	}
-	var results []map[string]interface{}
-	sentCount, failCount := 0, 0
-	for _, row := range rows {
+	devices := loadDeviceMap(a.db)
+	done, err := eachChunk(a.ctx, f, a.cfg.ChunkDays, func(cf PendingFilter) ([]LabRow, error) {
+		return queryPendingLabObs(a.ctx, a.db, cf)
+	}, func(row LabRow) {
 		if row.IDObservation != "" {
-			continue
+			return
+		}
+		if row.IDSpecimen == "" {
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": "skipped", "reason": "specimen not sent"})
+			return
 		}
-		if row.NoKTPPasien == "" || row.NoKTPDokter == "" {
+		row.NoKTPDokter = a.observationPractitioner(row.NoKTPDokter, row.NamaDokter, row.NoRawat, "Observation_Lab")
+		if row.NoKTPPasien == "" || !a.canLookupPractitioner(row.NoKTPDokter, row.NamaDokter) {
 			a.saveSendLog(row.NoRawat, "Observation_Lab", "", "skipped", "missing NIK")
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": "skipped", "reason": "missing NIK"})
-			failCount++
-			continue
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": "skipped", "reason": "missing NIK"})
+			return
+		}
+		if a.enqueueRow("Observation_Lab", row.jobKey(), row.NoRawat) {
+			return
 		}
-		patientID, err := a.ss.LookupPatient(row.NoKTPPasien)
+		patientID, err := a.lookupPatient(row.NoKTPPasien)
 		if err != nil {
-			a.saveSendLog(row.NoRawat, "Observation_Lab", "", "failed", "patient lookup: "+err.Error())
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": "failed", "error": "patient lookup: " + err.Error()})
-			failCount++
-			continue
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, "Observation_Lab", "", st, "patient lookup: "+err.Error())
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": st, "error": "patient lookup: " + err.Error()})
+			return
 		}
-		practitionerID, err := a.ss.LookupPractitioner(row.NoKTPDokter)
+		practitionerID, err := a.lookupPractitioner(row.NoKTPDokter, row.NamaDokter)
 		if err != nil {
-			a.saveSendLog(row.NoRawat, "Observation_Lab", "", "failed", "practitioner lookup: "+err.Error())
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": "failed", "error": "practitioner lookup: " + err.Error()})
-			failCount++
-			continue
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, "Observation_Lab", "", st, "practitioner lookup: "+err.Error())
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": st, "error": "practitioner lookup: " + err.Error()})
+			return
+		}
+		obs := buildLabObservationJSON(row, patientID, practitionerID, a.cfg.SSOrgID, a.cfg.LabMaxValueLen)
+		if ts := futureTimestamp(obs); ts != "" {
+			a.saveSendLog(row.NoRawat, "Observation_Lab", "", "skipped", "future timestamp: "+ts)
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": "skipped", "reason": "future timestamp", "timestamp": ts})
+			return
 		}
-		obs := buildLabObservationJSON(row, patientID, practitionerID, a.cfg.SSOrgID)
-		fhirID, err := a.sendViaJob("Observation_Lab", idempKey(row.NoOrder, row.IDTemplate, row.KdJenisPrw), obs, a.ss.SendObservation)
+		devices.attach(obs, "lab", row.KdJenisPrw)
+		fhirID, err := a.sendViaJob("Observation_Lab", row.jobKey(), obs, a.ss.SendObservation)
 		if err != nil {
 			a.saveSendLog(row.NoRawat, "Observation_Lab", "", "failed", err.Error())
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": "failed", "error": err.Error()})
-			failCount++
-			continue
+			res.add(res.withResponse(map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": "failed", "error": err.Error()}, err))
+			return
 		}
 		if fhirID == "" {
-			continue
+			return
 		}
 		_, dbErr := a.db.Exec(
 			"INSERT INTO satu_sehat_observation_lab (noorder, id_template, kd_jenis_prw, id_observation) VALUES (?,?,?,?)",
 			row.NoOrder, row.IDTemplate, row.KdJenisPrw, fhirID)
 		if dbErr != nil {
-			log.Printf("⚠️ save lab observation %s: %v", fhirID, dbErr)
+			logErrorf("❌ save lab observation %s: %v", fhirID, dbErr)
 		}
 		a.saveSendLog(row.NoRawat, "Observation_Lab", fhirID, "success", "")
-		results = append(results, map[string]interface{}{
+		res.add(map[string]interface{}{
 			"no_rawat": row.NoRawat, "noorder": row.NoOrder, "pemeriksaan": row.Pemeriksaan,
 			"status": "success", "fhir_id": fhirID,
 		})
-		sentCount++
-	}
-	jsonResponse(w, map[string]interface{}{"sent": sentCount, "failed": failCount, "details": results})
+	})
+	return res, done, err
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// TestLabObsSendDeduped: sending the same lab row twice (a resend, or two
+// overlapping send requests) reaches SatuSehat once; the second send finds
+// the row's job key taken and only reads back its id.
+func TestLabObsSendDeduped(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := &App{db: db, ctx: context.Background()}
+	row := LabRow{NoOrder: "PK202501020001", IDTemplate: "12", KdJenisPrw: "J000123"}
+
+	// first send: new job, sent, completed
+	mock.ExpectExec("INSERT IGNORE INTO mera_integration_jobs").
+		WithArgs("Observation_Lab", row.jobKey(), sqlmock.AnyArg(), "", "").
+		WillReturnResult(sqlmock.NewResult(9, 1))
+	mock.ExpectExec("UPDATE mera_integration_jobs SET status='success'").
+		WithArgs("obs-1", 9).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO mera_integration_job_attempts").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT resource_type, idempotency_key FROM mera_integration_jobs").
+		WillReturnRows(sqlmock.NewRows([]string{"resource_type", "idempotency_key"}).AddRow("Observation_Lab", row.jobKey()))
+	// second send: the key exists and is not a queued row
+	mock.ExpectExec("INSERT IGNORE INTO mera_integration_jobs").
+		WithArgs("Observation_Lab", row.jobKey(), sqlmock.AnyArg(), "", "").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE mera_integration_jobs SET payload=\\?").
+		WithArgs(sqlmock.AnyArg(), "Observation_Lab", row.jobKey()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT fhir_id FROM mera_integration_jobs").
+		WithArgs("Observation_Lab", row.jobKey()).
+		WillReturnRows(sqlmock.NewRows([]string{"fhir_id"}).AddRow("obs-1"))
+
+	sent := 0
+	send := func(map[string]interface{}) (string, error) { sent++; return "obs-1", nil }
+	obs := map[string]interface{}{
+		"resourceType": "Observation",
+		"subject":      map[string]interface{}{"reference": "Patient/P1"},
+		"encounter":    map[string]interface{}{"reference": "Encounter/E1"},
+	}
+
+	if id, err := a.sendViaJob("Observation_Lab", row.jobKey(), obs, send); err != nil || id != "obs-1" {
+		t.Fatalf("first send = %q, %v; want obs-1, nil", id, err)
+	}
+	if id, err := a.sendViaJob("Observation_Lab", row.jobKey(), obs, send); err != nil || id != "obs-1" {
+		t.Fatalf("repeated send = %q, %v; want the first send's obs-1", id, err)
+	}
+	if sent != 1 {
+		t.Fatalf("sent %d times, want 1", sent)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,13 +1,11 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
-	"time"
 )
 
 // ============================================================
@@ -34,9 +32,26 @@ type RadRow struct {
 	NoKTPDokter   string
 	IDEncounter   string
 	IDObservation string
+
+	// satu_sehat_mapping_radiologi.body_site_*, empty = no bodySite
+	BodySiteCode    string
+	BodySiteSystem  string
+	BodySiteDisplay string
+}
+
+// jobKey is the idempotency key of this row's send job
+func (r RadRow) jobKey() string {
+	return idempKey(r.NoOrder, r.KdJenisPrw)
+}
+
+// initRadBodySite adds the optional body site columns to satu_sehat_mapping_radiologi
+func initRadBodySite(db *sql.DB) {
+	ensureColumn(db, "satu_sehat_mapping_radiologi", "body_site_code", "VARCHAR(50) DEFAULT ''")
+	ensureColumn(db, "satu_sehat_mapping_radiologi", "body_site_system", "VARCHAR(200) DEFAULT ''")
+	ensureColumn(db, "satu_sehat_mapping_radiologi", "body_site_display", "VARCHAR(200) DEFAULT ''")
 }
 
-func queryPendingRadObs(db *sql.DB, tgl1, tgl2 string) ([]RadRow, error) {
+func queryPendingRadObs(ctx context.Context, db *sql.DB, f PendingFilter) ([]RadRow, error) {
 	query := `
 		SELECT reg_periksa.no_rawat, reg_periksa.no_rkm_medis, pasien.nm_pasien, pasien.no_ktp,
 			permintaan_radiologi.noorder, permintaan_radiologi.tgl_hasil, permintaan_radiologi.jam_hasil,
@@ -47,7 +62,9 @@ func queryPendingRadObs(db *sql.DB, tgl1, tgl2 string) ([]RadRow, error) {
 			satu_sehat_specimen_radiologi.id_specimen,
 			periksa_radiologi.kd_dokter, pegawai.nama, pegawai.no_ktp as ktppraktisi,
 			satu_sehat_encounter.id_encounter,
-			IFNULL(satu_sehat_observation_radiologi.id_observation,'') as id_observation
+			IFNULL(satu_sehat_observation_radiologi.id_observation,'') as id_observation,
+			IFNULL(satu_sehat_mapping_radiologi.body_site_code,''), IFNULL(satu_sehat_mapping_radiologi.body_site_system,''),
+			IFNULL(satu_sehat_mapping_radiologi.body_site_display,'')
 		FROM reg_periksa
 		INNER JOIN pasien ON reg_periksa.no_rkm_medis = pasien.no_rkm_medis
 		INNER JOIN permintaan_radiologi ON permintaan_radiologi.no_rawat = reg_periksa.no_rawat
@@ -67,9 +84,10 @@ func queryPendingRadObs(db *sql.DB, tgl1, tgl2 string) ([]RadRow, error) {
 			AND satu_sehat_specimen_radiologi.kd_jenis_prw = satu_sehat_observation_radiologi.kd_jenis_prw
 		INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
 		INNER JOIN pegawai ON periksa_radiologi.kd_dokter = pegawai.nik
-		WHERE reg_periksa.tgl_registrasi BETWEEN ? AND ?`
+		WHERE ` + f.rangeSQL(dateFilterColumn("Observation_Rad")) + `
+		ORDER BY permintaan_radiologi.tgl_hasil ` + f.orderSQL() + `, permintaan_radiologi.jam_hasil ` + f.orderSQL()
 
-	rows, err := db.Query(query, tgl1, tgl2)
+	rows, err := db.QueryContext(ctx, query, f.rangeArgs(1)...)
 	if err != nil {
 		return nil, fmt.Errorf("query rad obs: %w", err)
 	}
@@ -83,8 +101,9 @@ func queryPendingRadObs(db *sql.DB, tgl1, tgl2 string) ([]RadRow, error) {
 			&r.Code, &r.System, &r.Display, &r.Hasil,
 			&r.KdJenisPrw, &r.IDSpecimen,
 			&r.KdDokter, &r.NamaDokter, &r.NoKTPDokter,
-			&r.IDEncounter, &r.IDObservation); err != nil {
-			log.Printf("⚠️ scan rad obs: %v", err)
+			&r.IDEncounter, &r.IDObservation,
+			&r.BodySiteCode, &r.BodySiteSystem, &r.BodySiteDisplay); err != nil {
+			logWarnf("⚠️ scan rad obs: %v", err)
 			continue
 		}
 		results = append(results, r)
@@ -92,16 +111,22 @@ func queryPendingRadObs(db *sql.DB, tgl1, tgl2 string) ([]RadRow, error) {
 	return results, nil
 }
 
-func buildRadObservationJSON(row RadRow, patientID, practitionerID, orgID string) map[string]interface{} {
+// buildRadObservationJSON builds the imaging Observation; hasil longer than
+// maxLen runes (SS_RAD_MAX_VALUE_LENGTH) is truncated with a marker
+func buildRadObservationJSON(row RadRow, patientID, practitionerID, orgID string, maxLen int) map[string]interface{} {
 	effectiveDateTime := row.TglHasil + "T" + row.JamHasil + "+07:00"
 	hasilClean := strings.ReplaceAll(row.Hasil, "\r\n", "<br>")
 	hasilClean = strings.ReplaceAll(hasilClean, "\n", "<br>")
 	hasilClean = strings.ReplaceAll(hasilClean, "\t", " ")
+	if cut, truncated := truncateText(hasilClean, maxLen); truncated {
+		logWarnf("⚠️ rad hasil %s/%s truncated from %d to %d chars", row.NoOrder, row.KdJenisPrw, len([]rune(hasilClean)), maxLen)
+		hasilClean = cut
+	}
 
-	return map[string]interface{}{
+	obs := map[string]interface{}{
 		"resourceType": "Observation",
 		"identifier": []interface{}{
-			map[string]interface{}{"system": "http://sys-ids.kemkes.go.id/observation/" + orgID, "value": row.NoOrder + "." + row.KdJenisPrw},
+			map[string]interface{}{"system": sysID("observation", orgID), "value": row.NoOrder + "." + row.KdJenisPrw},
 		},
 		"status": "final",
 		"category": []interface{}{
@@ -111,15 +136,27 @@ func buildRadObservationJSON(row RadRow, patientID, practitionerID, orgID string
 			"coding": []interface{}{map[string]interface{}{"system": row.System, "code": row.Code, "display": row.Display}},
 		},
 		"subject":   map[string]interface{}{"reference": "Patient/" + patientID},
-		"performer": []interface{}{map[string]interface{}{"reference": "Practitioner/" + practitionerID}},
+		"performer": observationPerformers(practitionerID, orgID),
 		"encounter": map[string]interface{}{
 			"reference": "Encounter/" + row.IDEncounter,
-			"display":   "Hasil Pemeriksaan Radiologi " + row.NmPerawatan + " No.Rawat " + row.NoRawat + ", Atas Nama Pasien " + row.NmPasien + ", No.RM " + row.NoRM,
+			"display": displayText(
+				displayWords("Hasil Pemeriksaan Radiologi", row.NmPerawatan, labeled("No.Rawat", row.NoRawat)),
+				labeled("Atas Nama Pasien", row.NmPasien), labeled("No.RM", row.NoRM)),
 		},
 		"specimen":          map[string]interface{}{"reference": "Specimen/" + row.IDSpecimen},
 		"effectiveDateTime": effectiveDateTime,
 		"valueString":       hasilClean,
 	}
+	if row.BodySiteCode != "" {
+		system := row.BodySiteSystem
+		if system == "" {
+			system = "http://snomed.info/sct"
+		}
+		obs["bodySite"] = map[string]interface{}{
+			"coding": []interface{}{map[string]interface{}{"system": system, "code": row.BodySiteCode, "display": row.BodySiteDisplay}},
+		}
+	}
+	return withMetaProfile(obs)
 }
 
 // ============================================================
@@ -127,13 +164,8 @@ func buildRadObservationJSON(row RadRow, patientID, practitionerID, orgID string
 // ============================================================
 
 func (a *App) handlePendingRadObs(w http.ResponseWriter, r *http.Request) {
-	tgl1 := r.URL.Query().Get("tgl1")
-	tgl2 := r.URL.Query().Get("tgl2")
-	if tgl1 == "" || tgl2 == "" {
-		today := time.Now().Format("2006-01-02")
-		tgl1, tgl2 = today, today
-	}
-	rows, err := queryPendingRadObs(a.db, tgl1, tgl2)
+	f := a.pendingFilterFromQuery(r)
+	rows, err := queryPendingRadObs(r.Context(), a.db, f)
 	if err != nil {
 		jsonError(w, err.Error(), 500)
 		return
@@ -146,80 +178,80 @@ func (a *App) handlePendingRadObs(w http.ResponseWriter, r *http.Request) {
 			sent = append(sent, row)
 		}
 	}
-	jsonResponse(w, map[string]interface{}{
-		"tgl1": tgl1, "tgl2": tgl2,
+	writePending(w, r, map[string]interface{}{
+		"tgl1": f.Tgl1, "tgl2": f.Tgl2,
 		"total": len(rows), "pending_count": len(pending), "sent_count": len(sent),
 		"pending": pending,
 	})
 }
 
 func (a *App) handleSendRadObs(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Tgl1 string `json:"tgl1"`
-		Tgl2 string `json:"tgl2"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "invalid request body", 400)
-		return
-	}
-	if req.Tgl1 == "" || req.Tgl2 == "" {
-		jsonError(w, "tgl1 and tgl2 required", 400)
-		return
-	}
-	rows, err := queryPendingRadObs(a.db, req.Tgl1, req.Tgl2)
-	if err != nil {
-		jsonError(w, err.Error(), 500)
+	f, ok := a.decodeSendRequest(w, r)
+	if !ok {
 		return
 	}
-	var results []map[string]interface{}
-	sentCount, failCount := 0, 0
-	for _, row := range rows {
+	res, done, err := a.batch(r.Context()).sendRadObs(f)
+	writeBatch(w, res, done, err, "details", nil)
+}
+
+// sendRadObs sends every pending radiology observation in f
+func (a *App) sendRadObs(f PendingFilter) (*batchResult, int, error) {
+	res := a.newBatchResult()
+	done, err := eachChunk(a.ctx, f, a.cfg.ChunkDays, func(cf PendingFilter) ([]RadRow, error) {
+		return queryPendingRadObs(a.ctx, a.db, cf)
+	}, func(row RadRow) {
 		if row.IDObservation != "" {
-			continue
+			return
 		}
-		if row.NoKTPPasien == "" || row.NoKTPDokter == "" {
+		row.NoKTPDokter = a.observationPractitioner(row.NoKTPDokter, row.NamaDokter, row.NoRawat, "Observation_Rad")
+		if row.NoKTPPasien == "" || !a.canLookupPractitioner(row.NoKTPDokter, row.NamaDokter) {
 			a.saveSendLog(row.NoRawat, "Observation_Rad", "", "skipped", "missing NIK")
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": "skipped", "reason": "missing NIK"})
-			failCount++
-			continue
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": "skipped", "reason": "missing NIK"})
+			return
+		}
+		if a.enqueueRow("Observation_Rad", row.jobKey(), row.NoRawat) {
+			return
 		}
-		patientID, err := a.ss.LookupPatient(row.NoKTPPasien)
+		patientID, err := a.lookupPatient(row.NoKTPPasien)
 		if err != nil {
-			a.saveSendLog(row.NoRawat, "Observation_Rad", "", "failed", "patient lookup: "+err.Error())
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": "failed", "error": "patient lookup: " + err.Error()})
-			failCount++
-			continue
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, "Observation_Rad", "", st, "patient lookup: "+err.Error())
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": st, "error": "patient lookup: " + err.Error()})
+			return
 		}
-		practitionerID, err := a.ss.LookupPractitioner(row.NoKTPDokter)
+		practitionerID, err := a.lookupPractitioner(row.NoKTPDokter, row.NamaDokter)
 		if err != nil {
-			a.saveSendLog(row.NoRawat, "Observation_Rad", "", "failed", "practitioner lookup: "+err.Error())
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": "failed", "error": "practitioner lookup: " + err.Error()})
-			failCount++
-			continue
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, "Observation_Rad", "", st, "practitioner lookup: "+err.Error())
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": st, "error": "practitioner lookup: " + err.Error()})
+			return
 		}
-		obs := buildRadObservationJSON(row, patientID, practitionerID, a.cfg.SSOrgID)
-		fhirID, err := a.sendViaJob("Observation_Rad", idempKey(row.NoOrder, row.KdJenisPrw), obs, a.ss.SendObservation)
+		obs := buildRadObservationJSON(row, patientID, practitionerID, a.cfg.SSOrgID, a.cfg.RadMaxValueLen)
+		if ts := futureTimestamp(obs); ts != "" {
+			a.saveSendLog(row.NoRawat, "Observation_Rad", "", "skipped", "future timestamp: "+ts)
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": "skipped", "reason": "future timestamp", "timestamp": ts})
+			return
+		}
+		fhirID, err := a.sendViaJob("Observation_Rad", row.jobKey(), obs, a.ss.SendObservation)
 		if err != nil {
 			a.saveSendLog(row.NoRawat, "Observation_Rad", "", "failed", err.Error())
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": "failed", "error": err.Error()})
-			failCount++
-			continue
+			res.add(res.withResponse(map[string]interface{}{"no_rawat": row.NoRawat, "noorder": row.NoOrder, "status": "failed", "error": err.Error()}, err))
+			return
 		}
 		if fhirID == "" {
-			continue
+			return
 		}
 		_, dbErr := a.db.Exec(
 			"INSERT INTO satu_sehat_observation_radiologi (noorder, kd_jenis_prw, id_observation) VALUES (?,?,?)",
 			row.NoOrder, row.KdJenisPrw, fhirID)
 		if dbErr != nil {
-			log.Printf("⚠️ save rad observation %s: %v", fhirID, dbErr)
+			logErrorf("❌ save rad observation %s: %v", fhirID, dbErr)
 		}
 		a.saveSendLog(row.NoRawat, "Observation_Rad", fhirID, "success", "")
-		results = append(results, map[string]interface{}{
+		res.add(map[string]interface{}{
 			"no_rawat": row.NoRawat, "noorder": row.NoOrder, "pemeriksaan": row.NmPerawatan,
 			"status": "success", "fhir_id": fhirID,
 		})
-		sentCount++
-	}
-	jsonResponse(w, map[string]interface{}{"sent": sentCount, "failed": failCount, "details": results})
+	})
+	return res, done, err
 }
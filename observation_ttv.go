@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"time"
 )
 
 // ============================================================
@@ -23,19 +26,185 @@ type TTVConfig struct {
 	UnitCode     string
 	DBColumn     string
 	TrackTable   string
-	IsComponent  bool
+	Components   []TTVComponent // non-empty for a panel sent as Observation.component
+	Min, Max     float64        // plausible value range (each part of a panel), 0 = open
+	// Normal range sent as referenceRange (non-component types), 0 = no bound
+	NormalLow, NormalHigh float64
+}
+
+// TTVComponent is one component of a panel type, read from the Part-th
+// "/"-separated field of the source value (tensi "120/80": 0 and 1)
+type TTVComponent struct {
+	LOINCCode    string `json:"code"`
+	LOINCDisplay string `json:"display"`
+	Part         int    `json:"part"`
+	Unit         string `json:"unit"`      // empty = the type's Unit
+	UnitCode     string `json:"unit_code"` // empty = the type's UnitCode
+}
+
+// bloodPressureComponents splits tensi "120/80" into systolic and diastolic.
+// It is also the panel of a satu_sehat_ttv_config row with is_component=1
+// and no components.
+var bloodPressureComponents = []TTVComponent{
+	{"8480-6", "Systolic blood pressure", 0, "mmHg", "mm[Hg]"},
+	{"8462-4", "Diastolic blood pressure", 1, "mmHg", "mm[Hg]"},
 }
 
 var ttvConfigs = []TTVConfig{
-	{"suhu", "8310-5", "Body temperature", "degree Celsius", "Cel", "suhu_tubuh", "satu_sehat_observationttvsuhu", false},
-	{"respirasi", "9279-1", "Respiratory rate", "breaths/minute", "/min", "respirasi", "satu_sehat_observationttvrespirasi", false},
-	{"nadi", "8867-4", "Heart rate", "beats/minute", "/min", "nadi", "satu_sehat_observationttvnadi", false},
-	{"spo2", "2708-6", "Oxygen saturation", "%", "%", "spo2", "satu_sehat_observationttvspo2", false},
-	{"gcs", "9269-2", "Glasgow coma score total", "{score}", "{score}", "gcs", "satu_sehat_observationttvgcs", false},
-	{"tensi", "35094-2", "Blood pressure panel", "mmHg", "mm[Hg]", "tensi", "satu_sehat_observationttvtensi", true},
-	{"tb", "8302-2", "Body height", "centimeter", "cm", "tinggi", "satu_sehat_observationttvtb", false},
-	{"bb", "29463-7", "Body Weight", "kilogram", "kg", "berat", "satu_sehat_observationttvbb", false},
-	{"lp", "8280-0", "Waist Circumference at umbilicus by Tape measure", "centimeter", "cm", "lingkar_perut", "satu_sehat_observationttvlp", false},
+	{"suhu", "8310-5", "Body temperature", "degree Celsius", "Cel", "suhu_tubuh", "satu_sehat_observationttvsuhu", nil, 30, 45, 36.5, 37.5},
+	{"respirasi", "9279-1", "Respiratory rate", "breaths/minute", "/min", "respirasi", "satu_sehat_observationttvrespirasi", nil, 1, 80, 12, 20},
+	{"nadi", "8867-4", "Heart rate", "beats/minute", "/min", "nadi", "satu_sehat_observationttvnadi", nil, 20, 300, 60, 100},
+	{"spo2", "2708-6", "Oxygen saturation", "%", "%", "spo2", "satu_sehat_observationttvspo2", nil, 50, 100, 95, 100},
+	{"gcs", "9269-2", "Glasgow coma score total", "{score}", "{score}", "gcs", "satu_sehat_observationttvgcs", nil, 3, 15, 0, 0},
+	{"tensi", "35094-2", "Blood pressure panel", "mmHg", "mm[Hg]", "tensi", "satu_sehat_observationttvtensi", bloodPressureComponents, 20, 300, 0, 0},
+	{"tb", "8302-2", "Body height", "centimeter", "cm", "tinggi", "satu_sehat_observationttvtb", nil, 30, 250, 0, 0},
+	{"bb", "29463-7", "Body Weight", "kilogram", "kg", "berat", "satu_sehat_observationttvbb", nil, 0.5, 400, 0, 0},
+	{"lp", "8280-0", "Waist Circumference at umbilicus by Tape measure", "centimeter", "cm", "lingkar_perut", "satu_sehat_observationttvlp", nil, 30, 250, 0, 0},
+}
+
+// sqlIdentPattern guards table/column names that get interpolated into TTV queries
+var sqlIdentPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// loadTTVConfigs merges rows from the optional satu_sehat_ttv_config table over
+// the built-in ttvConfigs (matched by name; unknown names are added). A missing
+// table just leaves the built-in defaults in place. A NULL min_value/max_value
+// keeps the built-in plausible range.
+func loadTTVConfigs(db *sql.DB) {
+	if _, err := db.Exec(`SELECT 1 FROM satu_sehat_ttv_config LIMIT 1`); err != nil {
+		logInfof("ℹ️ satu_sehat_ttv_config not loaded, using built-in TTV types: %v", err)
+		return
+	}
+	ensureColumn(db, "satu_sehat_ttv_config", "min_value", "DOUBLE NULL")
+	ensureColumn(db, "satu_sehat_ttv_config", "max_value", "DOUBLE NULL")
+	ensureColumn(db, "satu_sehat_ttv_config", "normal_low", "DOUBLE NULL")
+	ensureColumn(db, "satu_sehat_ttv_config", "normal_high", "DOUBLE NULL")
+	ensureColumn(db, "satu_sehat_ttv_config", "components", "TEXT NULL")
+	rows, err := db.Query(`SELECT name, loinc_code, loinc_display, unit, unit_code, db_column, track_table, is_component,
+			min_value, max_value, normal_low, normal_high, IFNULL(components,'')
+		FROM satu_sehat_ttv_config`)
+	if err != nil {
+		logInfof("ℹ️ satu_sehat_ttv_config not loaded, using built-in TTV types: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	loaded := 0
+	for rows.Next() {
+		var c TTVConfig
+		var isComponent bool
+		var components string
+		var minVal, maxVal, normalLow, normalHigh sql.NullFloat64
+		if err := rows.Scan(&c.Name, &c.LOINCCode, &c.LOINCDisplay, &c.Unit, &c.UnitCode,
+			&c.DBColumn, &c.TrackTable, &isComponent, &minVal, &maxVal, &normalLow, &normalHigh, &components); err != nil {
+			logWarnf("⚠️ scan ttv config: %v", err)
+			continue
+		}
+		if c.Name == "" || !sqlIdentPattern.MatchString(c.DBColumn) || !sqlIdentPattern.MatchString(c.TrackTable) {
+			logWarnf("⚠️ ttv config %q: invalid name/db_column/track_table, ignored", c.Name)
+			continue
+		}
+		existing := findTTVConfig(c.Name)
+		if err := c.setComponents(isComponent, components, existing); err != nil {
+			logWarnf("⚠️ ttv config %q: %v, ignored", c.Name, err)
+			continue
+		}
+		if existing != nil {
+			c.Min, c.Max = existing.Min, existing.Max
+			c.NormalLow, c.NormalHigh = existing.NormalLow, existing.NormalHigh
+		}
+		if minVal.Valid {
+			c.Min = minVal.Float64
+		}
+		if maxVal.Valid {
+			c.Max = maxVal.Float64
+		}
+		if normalLow.Valid {
+			c.NormalLow = normalLow.Float64
+		}
+		if normalHigh.Valid {
+			c.NormalHigh = normalHigh.Float64
+		}
+		if existing != nil {
+			*existing = c
+		} else {
+			ttvConfigs = append(ttvConfigs, c)
+		}
+		loaded++
+	}
+	logInfof("✅ TTV config: %d row(s) from satu_sehat_ttv_config, %d type(s) active", loaded, len(ttvConfigs))
+}
+
+// setComponents sets c's panel from the components column: a JSON list of
+// {"code","display","part","unit","unit_code"}. An empty column with
+// is_component=1 keeps the panel of the built-in type, or blood pressure.
+func (c *TTVConfig) setComponents(isComponent bool, components string, existing *TTVConfig) error {
+	if strings.TrimSpace(components) == "" {
+		switch {
+		case !isComponent:
+			c.Components = nil
+		case existing != nil && len(existing.Components) > 0:
+			c.Components = existing.Components
+		default:
+			c.Components = bloodPressureComponents
+		}
+		return nil
+	}
+	var comps []TTVComponent
+	if err := json.Unmarshal([]byte(components), &comps); err != nil {
+		return fmt.Errorf("invalid components: %w", err)
+	}
+	for i, comp := range comps {
+		if comp.LOINCCode == "" || comp.Part < 0 {
+			return fmt.Errorf("component %d needs a code and a part >= 0", i)
+		}
+		if comp.Unit == "" {
+			comps[i].Unit, comps[i].UnitCode = c.Unit, c.UnitCode
+		}
+	}
+	c.Components = comps
+	return nil
+}
+
+// parts returns the "/"-separated fields of a panel value, or nil when their
+// number does not match the declared components
+func (c TTVConfig) parts(value string) []string {
+	n := 0
+	for _, comp := range c.Components {
+		n = max(n, comp.Part+1)
+	}
+	parts := strings.Split(value, "/")
+	if len(parts) != n {
+		return nil
+	}
+	return parts
+}
+
+// ttvTrackHash makes queryPendingTTV read value_hash from the track tables.
+// Set from SS_ENABLE_UPDATES at startup, after initTTVValueHash added the column.
+var ttvTrackHash = false
+
+// initTTVValueHash adds value_hash to every TTV track table so sent values
+// can be compared with later corrections
+func initTTVValueHash(db *sql.DB) {
+	for _, c := range ttvConfigs {
+		ensureColumn(db, c.TrackTable, "value_hash", "VARCHAR(64) DEFAULT ''")
+	}
+	ttvTrackHash = true
+}
+
+// ttvValueHash fingerprints a source value as it is sent
+func ttvValueHash(value string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(value)))
+	return hex.EncodeToString(sum[:])
+}
+
+// ttvNames lists the configured TTV types for error messages
+func ttvNames() string {
+	names := make([]string, len(ttvConfigs))
+	for i, c := range ttvConfigs {
+		names[i] = c.Name
+	}
+	return strings.Join(names, ",")
 }
 
 type TTVRow struct {
@@ -50,10 +219,45 @@ type TTVRow struct {
 	JamRawat      string
 	Value         string
 	IDObservation string
+	SentHash      string `json:"-"` // value_hash of the sent value; only read with SS_ENABLE_UPDATES
+}
+
+// jobKey is the idempotency key of this row's send job
+func (r TTVRow) jobKey() string {
+	return idempKey(r.NoRawat, r.TglPerawatan, r.JamRawat, r.SttsLanjut)
 }
 
-func queryPendingTTV(db *sql.DB, cfg TTVConfig, tgl1, tgl2 string) ([]TTVRow, error) {
+// ttvTrackedSQL selects column of the track row of the reading in src
+// (pemeriksaan_ralan or pemeriksaan_ranap). A correlated lookup rather than a
+// LEFT JOIN keeps every (tgl_perawatan, jam_rawat) reading at exactly one row,
+// even when the track table holds duplicate rows for it.
+func ttvTrackedSQL(cfg TTVConfig, src, status, column string) string {
+	return fmt.Sprintf(`IFNULL((SELECT MAX(t.%[4]s) FROM %[1]s t
+			WHERE t.no_rawat = %[2]s.no_rawat AND t.tgl_perawatan = %[2]s.tgl_perawatan
+				AND t.jam_rawat = %[2]s.jam_rawat AND t.status = '%[3]s'),'')`,
+		cfg.TrackTable, src, status, column)
+}
+
+// queryPendingTTV returns one row per reading of cfg's type: every distinct
+// (no_rawat, tgl_perawatan, jam_rawat, status), so a ward recording vitals
+// several times in one visit yields several Observations
+func queryPendingTTV(ctx context.Context, db *sql.DB, cfg TTVConfig, f PendingFilter) ([]TTVRow, error) {
 	var results []TTVRow
+	seen := map[string]bool{}
+	add := func(r TTVRow) {
+		if seen[r.jobKey()] {
+			logWarnf("⚠️ ttv %s: duplicate reading %s %s %s of %s ignored", cfg.Name, r.SttsLanjut, r.TglPerawatan, r.JamRawat, r.NoRawat)
+			return
+		}
+		seen[r.jobKey()] = true
+		results = append(results, r)
+	}
+	hashExpr := func(src, status string) string {
+		if !ttvTrackHash {
+			return "''"
+		}
+		return ttvTrackedSQL(cfg, src, status, "value_hash")
+	}
 
 	queryRalan := fmt.Sprintf(`
 		SELECT reg_periksa.no_rawat, pasien.nm_pasien, pasien.no_ktp,
@@ -62,23 +266,18 @@ func queryPendingTTV(db *sql.DB, cfg TTVConfig, tgl1, tgl2 string) ([]TTVRow, er
 			satu_sehat_encounter.id_encounter,
 			pemeriksaan_ralan.tgl_perawatan, pemeriksaan_ralan.jam_rawat,
 			pemeriksaan_ralan.%s,
-			IFNULL(%s.id_observation,'') as id_observation
+			%s as id_observation, %s
 		FROM reg_periksa
 		INNER JOIN pasien ON reg_periksa.no_rkm_medis = pasien.no_rkm_medis
 		INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
 		INNER JOIN pemeriksaan_ralan ON pemeriksaan_ralan.no_rawat = reg_periksa.no_rawat
 		INNER JOIN pegawai ON pemeriksaan_ralan.nip = pegawai.nik
-		LEFT JOIN %s ON %s.no_rawat = pemeriksaan_ralan.no_rawat
-			AND %s.tgl_perawatan = pemeriksaan_ralan.tgl_perawatan
-			AND %s.jam_rawat = pemeriksaan_ralan.jam_rawat
-			AND %s.status = 'Ralan'
 		WHERE pemeriksaan_ralan.%s <> ''
-			AND reg_periksa.tgl_registrasi BETWEEN ? AND ?`,
-		cfg.DBColumn, cfg.TrackTable,
-		cfg.TrackTable, cfg.TrackTable, cfg.TrackTable, cfg.TrackTable, cfg.TrackTable,
+			AND `+f.rangeSQL(registrationDate),
+		cfg.DBColumn, ttvTrackedSQL(cfg, "pemeriksaan_ralan", "Ralan", "id_observation"), hashExpr("pemeriksaan_ralan", "Ralan"),
 		cfg.DBColumn)
 
-	rows, err := db.Query(queryRalan, tgl1, tgl2)
+	rows, err := db.QueryContext(ctx, queryRalan, f.rangeArgs(1)...)
 	if err != nil {
 		return nil, fmt.Errorf("query ttv %s ralan: %w", cfg.Name, err)
 	}
@@ -86,11 +285,11 @@ func queryPendingTTV(db *sql.DB, cfg TTVConfig, tgl1, tgl2 string) ([]TTVRow, er
 		var r TTVRow
 		if err := rows.Scan(&r.NoRawat, &r.NmPasien, &r.NoKTPPasien,
 			&r.NoKTPDokter, &r.NamaDokter, &r.SttsLanjut,
-			&r.IDEncounter, &r.TglPerawatan, &r.JamRawat, &r.Value, &r.IDObservation); err != nil {
-			log.Printf("⚠️ scan ttv %s ralan: %v", cfg.Name, err)
+			&r.IDEncounter, &r.TglPerawatan, &r.JamRawat, &r.Value, &r.IDObservation, &r.SentHash); err != nil {
+			logWarnf("⚠️ scan ttv %s ralan: %v", cfg.Name, err)
 			continue
 		}
-		results = append(results, r)
+		add(r)
 	}
 	rows.Close()
 
@@ -101,23 +300,18 @@ func queryPendingTTV(db *sql.DB, cfg TTVConfig, tgl1, tgl2 string) ([]TTVRow, er
 			satu_sehat_encounter.id_encounter,
 			pemeriksaan_ranap.tgl_perawatan, pemeriksaan_ranap.jam_rawat,
 			pemeriksaan_ranap.%s,
-			IFNULL(%s.id_observation,'') as id_observation
+			%s as id_observation, %s
 		FROM reg_periksa
 		INNER JOIN pasien ON reg_periksa.no_rkm_medis = pasien.no_rkm_medis
 		INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
 		INNER JOIN pemeriksaan_ranap ON pemeriksaan_ranap.no_rawat = reg_periksa.no_rawat
 		INNER JOIN pegawai ON pemeriksaan_ranap.nip = pegawai.nik
-		LEFT JOIN %s ON %s.no_rawat = pemeriksaan_ranap.no_rawat
-			AND %s.tgl_perawatan = pemeriksaan_ranap.tgl_perawatan
-			AND %s.jam_rawat = pemeriksaan_ranap.jam_rawat
-			AND %s.status = 'Ranap'
 		WHERE pemeriksaan_ranap.%s <> ''
-			AND reg_periksa.tgl_registrasi BETWEEN ? AND ?`,
-		cfg.DBColumn, cfg.TrackTable,
-		cfg.TrackTable, cfg.TrackTable, cfg.TrackTable, cfg.TrackTable, cfg.TrackTable,
+			AND `+f.rangeSQL(registrationDate),
+		cfg.DBColumn, ttvTrackedSQL(cfg, "pemeriksaan_ranap", "Ranap", "id_observation"), hashExpr("pemeriksaan_ranap", "Ranap"),
 		cfg.DBColumn)
 
-	rows2, err := db.Query(queryRanap, tgl1, tgl2)
+	rows2, err := db.QueryContext(ctx, queryRanap, f.rangeArgs(1)...)
 	if err != nil {
 		return results, fmt.Errorf("query ttv %s ranap: %w", cfg.Name, err)
 	}
@@ -126,16 +320,26 @@ func queryPendingTTV(db *sql.DB, cfg TTVConfig, tgl1, tgl2 string) ([]TTVRow, er
 		var r TTVRow
 		if err := rows2.Scan(&r.NoRawat, &r.NmPasien, &r.NoKTPPasien,
 			&r.NoKTPDokter, &r.NamaDokter, &r.SttsLanjut,
-			&r.IDEncounter, &r.TglPerawatan, &r.JamRawat, &r.Value, &r.IDObservation); err != nil {
-			log.Printf("⚠️ scan ttv %s ranap: %v", cfg.Name, err)
+			&r.IDEncounter, &r.TglPerawatan, &r.JamRawat, &r.Value, &r.IDObservation, &r.SentHash); err != nil {
+			logWarnf("⚠️ scan ttv %s ranap: %v", cfg.Name, err)
 			continue
 		}
-		results = append(results, r)
+		add(r)
 	}
+
+	// Ralan and ranap come from separate queries, so order the merged set here
+	sort.SliceStable(results, func(i, j int) bool {
+		ti := results[i].TglPerawatan + " " + results[i].JamRawat
+		tj := results[j].TglPerawatan + " " + results[j].JamRawat
+		if f.orderSQL() == "DESC" {
+			return ti > tj
+		}
+		return ti < tj
+	})
 	return results, nil
 }
 
-func buildObservationJSON(row TTVRow, cfg TTVConfig, patientID, practitionerID string) map[string]interface{} {
+func buildObservationJSON(row TTVRow, cfg TTVConfig, patientID, practitionerID, orgID string) map[string]interface{} {
 	effectiveDateTime := row.TglPerawatan + "T" + row.JamRawat + "+07:00"
 	obs := map[string]interface{}{
 		"resourceType": "Observation",
@@ -161,45 +365,78 @@ func buildObservationJSON(row TTVRow, cfg TTVConfig, patientID, practitionerID s
 			},
 		},
 		"subject":   map[string]interface{}{"reference": "Patient/" + patientID},
-		"performer": []interface{}{map[string]interface{}{"reference": "Practitioner/" + practitionerID}},
+		"performer": observationPerformers(practitionerID, orgID),
 		"encounter": map[string]interface{}{
 			"reference": "Encounter/" + row.IDEncounter,
-			"display":   "Pemeriksaan Fisik " + cfg.LOINCDisplay + ", Pasien " + row.NmPasien,
+			"display":   displayText(displayWords("Pemeriksaan Fisik", cfg.LOINCDisplay), labeled("Pasien", row.NmPasien)),
 		},
 		"effectiveDateTime": effectiveDateTime,
 	}
 
-	if cfg.IsComponent {
+	if len(cfg.Components) > 0 {
 		parts := strings.Split(row.Value, "/")
-		sistole, diastole := "0", "0"
-		if len(parts) >= 1 && parts[0] != "" {
-			sistole = strings.ReplaceAll(parts[0], ",", ".")
-		}
-		if len(parts) >= 2 && parts[1] != "" {
-			diastole = strings.ReplaceAll(parts[1], ",", ".")
-		}
-		obs["component"] = []interface{}{
-			map[string]interface{}{
-				"code": map[string]interface{}{
-					"coding": []interface{}{map[string]interface{}{"system": "http://loinc.org", "code": "8480-6", "display": "Systolic blood pressure"}},
-				},
-				"valueQuantity": map[string]interface{}{"value": parseFloat(sistole), "unit": "mmHg", "system": "http://unitsofmeasure.org", "code": "mm[Hg]"},
-			},
-			map[string]interface{}{
+		var components []interface{}
+		for _, comp := range cfg.Components {
+			val := "0"
+			if comp.Part < len(parts) && parts[comp.Part] != "" {
+				val = strings.ReplaceAll(parts[comp.Part], ",", ".")
+			}
+			components = append(components, map[string]interface{}{
 				"code": map[string]interface{}{
-					"coding": []interface{}{map[string]interface{}{"system": "http://loinc.org", "code": "8462-4", "display": "Diastolic blood pressure"}},
+					"coding": []interface{}{map[string]interface{}{"system": "http://loinc.org", "code": comp.LOINCCode, "display": comp.LOINCDisplay}},
 				},
-				"valueQuantity": map[string]interface{}{"value": parseFloat(diastole), "unit": "mmHg", "system": "http://unitsofmeasure.org", "code": "mm[Hg]"},
-			},
+				"valueQuantity": map[string]interface{}{"value": parseFloat(val), "unit": comp.Unit, "system": "http://unitsofmeasure.org", "code": comp.UnitCode},
+			})
 		}
+		obs["component"] = components
 	} else {
 		valStr := strings.ReplaceAll(row.Value, ",", ".")
 		obs["valueQuantity"] = map[string]interface{}{
 			"value": parseFloat(valStr), "unit": cfg.Unit, "system": "http://unitsofmeasure.org", "code": cfg.UnitCode,
 		}
+		if rr := cfg.referenceRange(); rr != nil {
+			obs["referenceRange"] = []interface{}{rr}
+		}
 	}
 
-	return obs
+	return withMetaProfile(obs)
+}
+
+// referenceRange is the normal range of a non-component type, nil when none
+// is defined (e.g. height or weight)
+func (c TTVConfig) referenceRange() map[string]interface{} {
+	if len(c.Components) > 0 || (c.NormalLow == 0 && c.NormalHigh == 0) {
+		return nil
+	}
+	bound := func(v float64) map[string]interface{} {
+		return map[string]interface{}{"value": v, "unit": c.Unit, "system": "http://unitsofmeasure.org", "code": c.UnitCode}
+	}
+	rr := map[string]interface{}{}
+	if c.NormalLow != 0 {
+		rr["low"] = bound(c.NormalLow)
+	}
+	if c.NormalHigh != 0 {
+		rr["high"] = bound(c.NormalHigh)
+	}
+	return rr
+}
+
+// plausible reports whether value (every part of a "120/80" panel value) is
+// non-zero and within the type's Min–Max. "0", "0,0" or "-" are not.
+func (c TTVConfig) plausible(value string) bool {
+	parts := []string{value}
+	if len(c.Components) > 0 {
+		if parts = c.parts(value); parts == nil {
+			return false
+		}
+	}
+	for _, p := range parts {
+		v := parseFloat(strings.ReplaceAll(p, ",", "."))
+		if v == 0 || (c.Min != 0 && v < c.Min) || (c.Max != 0 && v > c.Max) {
+			return false
+		}
+	}
+	return true
 }
 
 func parseFloat(s string) float64 {
@@ -220,16 +457,11 @@ func (a *App) handlePendingTTV(w http.ResponseWriter, r *http.Request) {
 	ttvType := r.PathValue("type")
 	cfg := findTTVConfig(ttvType)
 	if cfg == nil {
-		jsonError(w, "unknown TTV type: "+ttvType+". Valid: suhu,respirasi,nadi,spo2,gcs,tensi,tb,bb,lp", 400)
+		jsonError(w, "unknown TTV type: "+ttvType+". Valid: "+ttvNames(), 400)
 		return
 	}
-	tgl1 := r.URL.Query().Get("tgl1")
-	tgl2 := r.URL.Query().Get("tgl2")
-	if tgl1 == "" || tgl2 == "" {
-		today := time.Now().Format("2006-01-02")
-		tgl1, tgl2 = today, today
-	}
-	rows, err := queryPendingTTV(a.db, *cfg, tgl1, tgl2)
+	f := a.pendingFilterFromQuery(r)
+	rows, err := queryPendingTTV(r.Context(), a.db, *cfg, f)
 	if err != nil {
 		jsonError(w, err.Error(), 500)
 		return
@@ -242,8 +474,8 @@ func (a *App) handlePendingTTV(w http.ResponseWriter, r *http.Request) {
 			sent = append(sent, row)
 		}
 	}
-	jsonResponse(w, map[string]interface{}{
-		"type": ttvType, "tgl1": tgl1, "tgl2": tgl2,
+	writePending(w, r, map[string]interface{}{
+		"type": ttvType, "tgl1": f.Tgl1, "tgl2": f.Tgl2,
 		"total": len(rows), "pending_count": len(pending), "sent_count": len(sent),
 		"pending": pending,
 	})
@@ -256,72 +488,115 @@ func (a *App) handleSendTTV(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "unknown TTV type: "+ttvType, 400)
 		return
 	}
-	var req struct {
-		Tgl1 string `json:"tgl1"`
-		Tgl2 string `json:"tgl2"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "invalid request body", 400)
+	f, ok := a.decodeSendRequest(w, r)
+	if !ok {
 		return
 	}
-	if req.Tgl1 == "" || req.Tgl2 == "" {
-		jsonError(w, "tgl1 and tgl2 required", 400)
-		return
+	res, done, err := a.batch(r.Context()).sendTTV(cfg, f)
+	writeBatch(w, res, done, err, "details", map[string]interface{}{"type": ttvType})
+}
+
+// ttvDrifted reports whether an already sent row's source value changed since
+// it was sent. Rows sent before SS_ENABLE_UPDATES have no hash yet; their
+// current value is recorded as the baseline instead.
+func (a *App) ttvDrifted(cfg *TTVConfig, row TTVRow) bool {
+	if !a.cfg.EnableUpdates {
+		return false
+	}
+	h := ttvValueHash(row.Value)
+	if row.SentHash == "" {
+		a.saveTTVHash(cfg, row, h)
+		return false
 	}
-	rows, err := queryPendingTTV(a.db, *cfg, req.Tgl1, req.Tgl2)
+	return row.SentHash != h
+}
+
+func (a *App) saveTTVHash(cfg *TTVConfig, row TTVRow, h string) {
+	_, err := a.db.Exec("UPDATE "+cfg.TrackTable+" SET value_hash=? WHERE no_rawat=? AND tgl_perawatan=? AND jam_rawat=? AND status=?",
+		h, row.NoRawat, row.TglPerawatan, row.JamRawat, row.SttsLanjut)
 	if err != nil {
-		jsonError(w, err.Error(), 500)
-		return
+		logErrorf("❌ save value_hash to %s: %v", cfg.TrackTable, err)
 	}
-	var results []map[string]interface{}
-	sentCount, failCount := 0, 0
+}
+
+// sendTTV sends every pending vital sign of one TTV type in f. With
+// SS_ENABLE_UPDATES, sent rows whose value was corrected are PUT again.
+func (a *App) sendTTV(cfg *TTVConfig, f PendingFilter) (*batchResult, int, error) {
+	res := a.newBatchResult()
 	resourceLabel := "Observation_" + cfg.Name
-	for _, row := range rows {
-		if row.IDObservation != "" {
-			continue
+	devices := loadDeviceMap(a.db)
+	done, err := eachChunk(a.ctx, f, a.cfg.ChunkDays, func(cf PendingFilter) ([]TTVRow, error) {
+		return queryPendingTTV(a.ctx, a.db, *cfg, cf)
+	}, func(row TTVRow) {
+		if row.IDObservation != "" && !a.ttvDrifted(cfg, row) {
+			return
 		}
-		if row.NoKTPPasien == "" || row.NoKTPDokter == "" {
+		if !cfg.plausible(row.Value) {
+			a.saveSendLog(row.NoRawat, resourceLabel, "", "skipped", fmt.Sprintf("implausible value %q", row.Value))
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "status": "skipped", "reason": "implausible value", "value": row.Value})
+			return
+		}
+		row.NoKTPDokter = a.observationPractitioner(row.NoKTPDokter, row.NamaDokter, row.NoRawat, resourceLabel)
+		if row.NoKTPPasien == "" || !a.canLookupPractitioner(row.NoKTPDokter, row.NamaDokter) {
 			a.saveSendLog(row.NoRawat, resourceLabel, "", "skipped", "missing NIK")
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "status": "skipped", "reason": "missing NIK"})
-			failCount++
-			continue
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "status": "skipped", "reason": "missing NIK"})
+			return
 		}
-		patientID, err := a.ss.LookupPatient(row.NoKTPPasien)
+		if a.enqueueRow("Observation_"+cfg.Name, row.jobKey(), row.NoRawat) {
+			return
+		}
+		patientID, err := a.lookupPatient(row.NoKTPPasien)
 		if err != nil {
-			a.saveSendLog(row.NoRawat, resourceLabel, "", "failed", "patient lookup: "+err.Error())
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "status": "failed", "error": "patient lookup: " + err.Error()})
-			failCount++
-			continue
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, resourceLabel, "", st, "patient lookup: "+err.Error())
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "status": st, "error": "patient lookup: " + err.Error()})
+			return
 		}
-		practitionerID, err := a.ss.LookupPractitioner(row.NoKTPDokter)
+		practitionerID, err := a.lookupPractitioner(row.NoKTPDokter, row.NamaDokter)
 		if err != nil {
-			a.saveSendLog(row.NoRawat, resourceLabel, "", "failed", "practitioner lookup: "+err.Error())
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "status": "failed", "error": "practitioner lookup: " + err.Error()})
-			failCount++
-			continue
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, resourceLabel, "", st, "practitioner lookup: "+err.Error())
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "status": st, "error": "practitioner lookup: " + err.Error()})
+			return
 		}
-		obs := buildObservationJSON(row, *cfg, patientID, practitionerID)
-		fhirID, err := a.sendViaJob("Observation_"+cfg.Name, idempKey(row.NoRawat, row.TglPerawatan, row.JamRawat, row.SttsLanjut), obs, a.ss.SendObservation)
+		obs := buildObservationJSON(row, *cfg, patientID, practitionerID, a.cfg.SSOrgID)
+		if ts := futureTimestamp(obs); ts != "" {
+			a.saveSendLog(row.NoRawat, resourceLabel, "", "skipped", "future timestamp: "+ts)
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "status": "skipped", "reason": "future timestamp", "timestamp": ts})
+			return
+		}
+		devices.attach(obs, "ttv", cfg.Name)
+		if row.IDObservation != "" {
+			if err := a.ss.UpdateObservation(row.IDObservation, obs); err != nil {
+				a.saveSendLog(row.NoRawat, resourceLabel, row.IDObservation, "failed", "update: "+err.Error())
+				res.add(res.withResponse(map[string]interface{}{"no_rawat": row.NoRawat, "status": "failed", "fhir_id": row.IDObservation, "error": "update: " + err.Error()}, err))
+				return
+			}
+			a.saveTTVHash(cfg, row, ttvValueHash(row.Value))
+			logInfof("✏️ %s %s corrected to %q", resourceLabel, row.IDObservation, row.Value)
+			a.saveSendLog(row.NoRawat, resourceLabel, row.IDObservation, "success", "")
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "status": "success", "fhir_id": row.IDObservation, "action": "updated"})
+			return
+		}
+		fhirID, err := a.sendViaJob("Observation_"+cfg.Name, row.jobKey(), obs, a.ss.SendObservation)
 		if err != nil {
 			a.saveSendLog(row.NoRawat, resourceLabel, "", "failed", err.Error())
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "status": "failed", "error": err.Error()})
-			failCount++
-			continue
+			res.add(res.withResponse(map[string]interface{}{"no_rawat": row.NoRawat, "status": "failed", "error": err.Error()}, err))
+			return
 		}
 		if fhirID == "" {
-			continue
+			return
 		}
 		_, dbErr := a.db.Exec(
 			fmt.Sprintf("INSERT INTO %s (no_rawat, tgl_perawatan, jam_rawat, status, id_observation) VALUES (?,?,?,?,?)", cfg.TrackTable),
 			row.NoRawat, row.TglPerawatan, row.JamRawat, row.SttsLanjut, fhirID)
 		if dbErr != nil {
-			log.Printf("⚠️ save observation %s to %s: %v", fhirID, cfg.TrackTable, dbErr)
+			logErrorf("❌ save observation %s to %s: %v", fhirID, cfg.TrackTable, dbErr)
+		} else if ttvTrackHash {
+			a.saveTTVHash(cfg, row, ttvValueHash(row.Value))
 		}
 		a.saveSendLog(row.NoRawat, resourceLabel, fhirID, "success", "")
-		results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "status": "success", "fhir_id": fhirID})
-		sentCount++
-	}
-	jsonResponse(w, map[string]interface{}{
-		"type": ttvType, "sent": sentCount, "failed": failCount, "details": results,
+		res.add(map[string]interface{}{"no_rawat": row.NoRawat, "status": "success", "fhir_id": fhirID})
 	})
+	return res, done, err
 }
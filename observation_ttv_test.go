@@ -0,0 +1,89 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var ttvColumns = []string{"no_rawat", "nm_pasien", "no_ktp", "ktpdokter", "nama", "stts_lanjut",
+	"id_encounter", "tgl_perawatan", "jam_rawat", "suhu_tubuh", "id_observation", "value_hash"}
+
+// TestPendingTTVThreeReadings: three suhu readings of one visit, the first
+// already tracked. Only the other two are pending.
+func TestPendingTTVThreeReadings(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// each reading is matched to its own track row by date, time and status
+	tracked := func(src, status string) string {
+		return regexp.QuoteMeta("t.no_rawat = " + src + ".no_rawat AND t.tgl_perawatan = " + src +
+			".tgl_perawatan AND t.jam_rawat = " + src + ".jam_rawat AND t.status = '" + status + "'")
+	}
+	mock.ExpectQuery(tracked("pemeriksaan_ralan", "Ralan")).WithArgs("2025/01/02/000001").
+		WillReturnRows(sqlmock.NewRows(ttvColumns).
+			AddRow("2025/01/02/000001", "Budi", "3201", "3202", "dr. Ani", "Ralan", "enc-1", "2025-01-02", "18:00:00", "37.8", "", "").
+			AddRow("2025/01/02/000001", "Budi", "3201", "3202", "dr. Ani", "Ralan", "enc-1", "2025-01-02", "08:00:00", "36.5", "obs-1", "").
+			AddRow("2025/01/02/000001", "Budi", "3201", "3202", "dr. Ani", "Ralan", "enc-1", "2025-01-02", "12:00:00", "37.1", "", ""))
+	mock.ExpectQuery(tracked("pemeriksaan_ranap", "Ranap")).WithArgs("2025/01/02/000001").
+		WillReturnRows(sqlmock.NewRows(ttvColumns))
+
+	a := &App{db: db, cfg: Config{SendOrder: "asc"}}
+	req := httptest.NewRequest("GET", "/api/ttv/suhu/pending?no_rawat=2025/01/02/000001", nil)
+	req.SetPathValue("type", "suhu")
+	w := httptest.NewRecorder()
+	a.handlePendingTTV(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Total        int      `json:"total"`
+		PendingCount int      `json:"pending_count"`
+		SentCount    int      `json:"sent_count"`
+		Pending      []TTVRow `json:"pending"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Total != 3 || resp.SentCount != 1 || resp.PendingCount != 2 {
+		t.Fatalf("total/sent/pending = %d/%d/%d, want 3/1/2", resp.Total, resp.SentCount, resp.PendingCount)
+	}
+	for i, want := range []string{"12:00:00", "18:00:00"} {
+		if got := resp.Pending[i]; got.JamRawat != want || got.IDObservation != "" {
+			t.Errorf("pending[%d] = %s %q, want the untracked %s reading", i, got.JamRawat, got.IDObservation, want)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestQueryPendingTTVDuplicateReading: a reading returned twice (duplicate
+// Khanza rows) is kept once, so it is not sent twice
+func TestQueryPendingTTVDuplicateReading(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	row := []driver.Value{"2025/01/02/000001", "Budi", "3201", "3202", "dr. Ani", "Ralan", "enc-1", "2025-01-02", "08:00:00", "36.5", "", ""}
+	mock.ExpectQuery("pemeriksaan_ralan").WillReturnRows(sqlmock.NewRows(ttvColumns).AddRow(row...).AddRow(row...))
+	mock.ExpectQuery("pemeriksaan_ranap").WillReturnRows(sqlmock.NewRows(ttvColumns))
+
+	rows, err := queryPendingTTV(t.Context(), db, *findTTVConfig("suhu"), PendingFilter{NoRawat: "2025/01/02/000001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 {
+		t.Errorf("got %d rows, want the duplicate reading once", len(rows))
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ============================================================
+// MULTI-ORGANIZATION (SS_ORGS)
+// ============================================================
+
+// All orgs read the one Khanza database and share its satu_sehat_* tracking
+// tables and jobs, which are keyed by visit, not by org: a row sent as one org
+// counts as sent for every org. Callers keep each org to its own visits.
+
+// orgClient is the config and FHIR client of one organization. Each has its
+// own TokenManager, so tokens are fetched and refreshed per org.
+type orgClient struct {
+	cfg Config
+	ss  *SSClient
+}
+
+// loadOrgConfigs builds one Config per name in SS_ORGS from
+// SS_ORG_<NAME>_ID / _CLIENT_ID / _CLIENT_SECRET, sharing everything else
+// with base. Names are matched case-insensitively.
+func loadOrgConfigs(base Config) (map[string]Config, error) {
+	orgs := map[string]Config{}
+	for name := range parseNameSet(os.Getenv("SS_ORGS")) {
+		name = strings.ToLower(name)
+		prefix := "SS_ORG_" + strings.ToUpper(name) + "_"
+		c := base
+		c.SSOrgID = os.Getenv(prefix + "ID")
+		c.SSClientID = os.Getenv(prefix + "CLIENT_ID")
+		c.SSSecret = os.Getenv(prefix + "CLIENT_SECRET")
+		c.AllowPatientCreate = getEnvBool(prefix+"ALLOW_PATIENT_CREATE", base.AllowPatientCreate)
+		if err := validateOrgID(c.SSOrgID); err != nil {
+			return nil, fmt.Errorf("org %s: %w", name, err)
+		}
+		if c.SSClientID == "" || c.SSSecret == "" {
+			return nil, fmt.Errorf("org %s: %sCLIENT_ID and %sCLIENT_SECRET are required", name, prefix, prefix)
+		}
+		orgs[name] = c
+	}
+	return orgs, nil
+}
+
+// orgKey carries the org selected for a request in its context
+type orgKey struct{}
+
+func orgFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(orgKey{}).(string)
+	return name
+}
+
+// withOrg selects the organization of a request from the X-Org header, the
+// ?org= parameter or the "org" field of a JSON body. Requests without one use
+// SS_ORG_ID; an unknown org is rejected.
+func (a *App) withOrg(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.Header.Get("X-Org")
+		if name == "" {
+			name = r.URL.Query().Get("org")
+		}
+		if name == "" && r.Method == http.MethodPost && r.Body != nil {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				jsonError(w, "read request body: "+err.Error(), 400)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			var sel struct {
+				Org string `json:"org"`
+			}
+			json.Unmarshal(body, &sel) // not JSON (or no org) → default org
+			name = sel.Org
+		}
+		if name = strings.ToLower(name); name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, ok := a.orgs[name]; !ok {
+			jsonError(w, "unknown org: "+name, 400)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), orgKey{}, name)))
+	})
+}
+
+// useOrg returns a copy of a that sends as org name ("" = SS_ORG_ID),
+// keeping a's batch id and context. ok is false for an unknown org.
+func (a *App) useOrg(name string) (*App, bool) {
+	if name == a.org {
+		return a, true
+	}
+	o, ok := a.orgs[name]
+	if !ok {
+		return a, false
+	}
+	b := *a
+	b.org, b.cfg = name, o.cfg
+	ss := *o.ss
+	ss.batchID, ss.ctx = a.ss.batchID, a.ss.ctx
+	b.ss = &ss
+	return &b, true
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ============================================================
+// JSON PATCH (fix one field of a stored job payload)
+// ============================================================
+
+// patchOp is one RFC 6902 operation
+type patchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// splitPointer parses a JSON Pointer (RFC 6901) into its unescaped tokens
+func splitPointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, fmt.Errorf("path %q must start with /", ptr)
+	}
+	tokens := strings.Split(ptr[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens, nil
+}
+
+// arrayIndex resolves token as an index into a list of n elements; "-"
+// (append) and n itself are only valid when adding
+func arrayIndex(token string, n int, adding bool) (int, error) {
+	if token == "-" && adding {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > n || (i == n && !adding) {
+		return 0, fmt.Errorf("array index %q out of range", token)
+	}
+	return i, nil
+}
+
+// patchAt applies fn to the parent of the last token of path in doc and
+// returns the (possibly replaced) document
+func patchAt(doc interface{}, tokens []string, fn func(parent interface{}, last string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return fn(doc, tokens[0])
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("path member %q not found", tokens[0])
+		}
+		child, err := patchAt(child, tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		node[tokens[0]] = child
+		return node, nil
+	case []interface{}:
+		i, err := arrayIndex(tokens[0], len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		child, err := patchAt(node[i], tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = child
+		return node, nil
+	}
+	return nil, fmt.Errorf("path member %q is not an object or array", tokens[0])
+}
+
+// pointerGet returns the value at ptr
+func pointerGet(doc interface{}, ptr string) (interface{}, error) {
+	tokens, err := splitPointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			v, ok := node[t]
+			if !ok {
+				return nil, fmt.Errorf("path %q not found", ptr)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(t, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("path %q not found", ptr)
+		}
+	}
+	return doc, nil
+}
+
+func pointerAdd(doc interface{}, ptr string, value interface{}, replace bool) (interface{}, error) {
+	tokens, err := splitPointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return patchAt(doc, tokens, func(parent interface{}, last string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := node[last]; replace && !ok {
+				return nil, fmt.Errorf("path %q not found", ptr)
+			}
+			node[last] = value
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(last, len(node), !replace)
+			if err != nil {
+				return nil, err
+			}
+			if replace {
+				node[i] = value
+				return node, nil
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("parent of %q is not an object or array", ptr)
+	})
+}
+
+func pointerRemove(doc interface{}, ptr string) (interface{}, error) {
+	tokens, err := splitPointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("cannot remove the whole document")
+	}
+	return patchAt(doc, tokens, func(parent interface{}, last string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := node[last]; !ok {
+				return nil, fmt.Errorf("path %q not found", ptr)
+			}
+			delete(node, last)
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(last, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:i], node[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("parent of %q is not an object or array", ptr)
+	})
+}
+
+// applyJSONPatch applies ops to doc in order; any failing op fails the whole
+// patch (doc may then be partly modified, callers work on a fresh copy)
+func applyJSONPatch(doc interface{}, ops []patchOp) (interface{}, error) {
+	var err error
+	for i, op := range ops {
+		switch op.Op {
+		case "add":
+			doc, err = pointerAdd(doc, op.Path, op.Value, false)
+		case "replace":
+			doc, err = pointerAdd(doc, op.Path, op.Value, true)
+		case "remove":
+			doc, err = pointerRemove(doc, op.Path)
+		case "move", "copy":
+			var v interface{}
+			if v, err = pointerGet(doc, op.From); err == nil {
+				if op.Op == "move" {
+					doc, err = pointerRemove(doc, op.From)
+				} else {
+					v = deepCopyJSON(v)
+				}
+			}
+			if err == nil {
+				doc, err = pointerAdd(doc, op.Path, v, false)
+			}
+		case "test":
+			var v interface{}
+			if v, err = pointerGet(doc, op.Path); err == nil && !reflect.DeepEqual(v, op.Value) {
+				err = fmt.Errorf("test of %q failed", op.Path)
+			}
+		default:
+			err = fmt.Errorf("unknown op %q", op.Op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("op %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+// deepCopyJSON copies a decoded JSON value
+func deepCopyJSON(v interface{}) interface{} {
+	b, _ := json.Marshal(v)
+	var out interface{}
+	json.Unmarshal(b, &out)
+	return out
+}
+
+// handlePatchJob applies a JSON Patch to the stored payload of job {id}.
+// A job SatuSehat accepted (fhir_id set) is patched remotely with HTTP PATCH;
+// a failed one is re-POSTed with the corrected payload, ignoring the retry
+// limit. The stored payload is only replaced when SatuSehat accepts it.
+func (a *App) handlePatchJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		jsonError(w, "invalid job id", 400)
+		return
+	}
+	var raw []interface{} // sent to SatuSehat as given
+	var ops []patchOp
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil || len(raw) == 0 {
+		jsonError(w, "body must be a non-empty JSON Patch array", 400)
+		return
+	}
+	if b, _ := json.Marshal(raw); json.Unmarshal(b, &ops) != nil {
+		jsonError(w, "body must be a JSON Patch array of operations", 400)
+		return
+	}
+
+	var payload, status, fhirID, org string
+	err = a.db.QueryRowContext(r.Context(),
+		`SELECT payload, status, fhir_id, org FROM mera_integration_jobs WHERE id=?`, id).
+		Scan(&payload, &status, &fhirID, &org)
+	if err == sql.ErrNoRows {
+		jsonError(w, "job not found", 404)
+		return
+	}
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	if status == "pending" {
+		jsonError(w, "job is still pending", 409)
+		return
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal([]byte(payload), &doc); err != nil {
+		jsonError(w, "invalid stored payload", 500)
+		return
+	}
+	patched, err := applyJSONPatch(doc, ops)
+	if err != nil {
+		jsonError(w, "patch: "+err.Error(), 422)
+		return
+	}
+	resource, ok := patched.(map[string]interface{})
+	if !ok {
+		jsonError(w, "patched payload is not a FHIR resource", 422)
+		return
+	}
+	patchedJSON, _ := json.Marshal(resource)
+
+	a = a.batch(r.Context())
+	if status == "success" && fhirID != "" {
+		a, ok := a.useOrg(org)
+		if !ok {
+			jsonError(w, "org "+org+" is no longer configured", 409)
+			return
+		}
+		rt, _ := resource["resourceType"].(string)
+		if err := a.ss.SendPatch(rt, fhirID, raw); err != nil {
+			recordJobAttempt(a.db, id, "failed", fhirID, "patch: "+err.Error())
+			jsonResponse(w, map[string]interface{}{"id": id, "status": "failed", "error": err.Error()})
+			return
+		}
+		if _, err := a.db.Exec(`UPDATE mera_integration_jobs SET payload=? WHERE id=?`, patchedJSON, id); err != nil {
+			logErrorf("❌ save patched payload of job %d: %v", id, err)
+		}
+		recordJobAttempt(a.db, id, "patched", fhirID, "")
+		logInfof("🩹 job %d: %s/%s patched (%d op)", id, rt, fhirID, len(ops))
+		jsonResponse(w, map[string]interface{}{"id": id, "status": "patched", "fhir_id": fhirID})
+		return
+	}
+
+	// Not in SatuSehat yet: re-POST the corrected payload, keeping the old one
+	// if it is rejected again
+	if _, err := a.db.Exec(`UPDATE mera_integration_jobs SET payload=? WHERE id=?`, patchedJSON, id); err != nil {
+		jsonError(w, "save patched payload: "+err.Error(), 500)
+		return
+	}
+	result := a.retryOneJob(id, true)
+	if result["status"] != "success" {
+		a.db.Exec(`UPDATE mera_integration_jobs SET payload=? WHERE id=?`, payload, id)
+	}
+	jsonResponse(w, result)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ============================================================
+// PATIENT CREATE (SS_ALLOW_PATIENT_CREATE)
+// ============================================================
+
+// patientDemographics is the Khanza pasien data a Patient is created from
+type patientDemographics struct {
+	NIK      string
+	NoRM     string
+	Nama     string
+	JK       string // L / P
+	TglLahir string // YYYY-MM-DD
+	Alamat   string
+	NoTlp    string
+}
+
+func queryPatientDemographics(ctx context.Context, db *sql.DB, nik string) (*patientDemographics, error) {
+	var p patientDemographics
+	err := db.QueryRowContext(ctx, `
+		SELECT no_ktp, no_rkm_medis, nm_pasien, jk, IFNULL(tgl_lahir,''), IFNULL(alamat,''), IFNULL(no_tlp,'')
+		FROM pasien WHERE no_ktp = ? ORDER BY no_rkm_medis LIMIT 1`, nik).Scan(
+		&p.NIK, &p.NoRM, &p.Nama, &p.JK, &p.TglLahir, &p.Alamat, &p.NoTlp)
+	if err != nil {
+		return nil, fmt.Errorf("pasien NIK %s: %w", nik, err)
+	}
+	return &p, nil
+}
+
+// patientGender maps Khanza jk to the FHIR administrative gender
+func patientGender(jk string) string {
+	switch strings.ToUpper(strings.TrimSpace(jk)) {
+	case "L":
+		return "male"
+	case "P":
+		return "female"
+	}
+	return "unknown"
+}
+
+func buildPatientJSON(p patientDemographics, orgID string) map[string]interface{} {
+	patient := map[string]interface{}{
+		"resourceType": "Patient",
+		"identifier": []interface{}{
+			map[string]interface{}{"use": "official", "system": nikSystem, "value": p.NIK},
+			map[string]interface{}{"use": "usual", "system": sysID("mrn", orgID), "value": p.NoRM},
+		},
+		"active":               true,
+		"name":                 []interface{}{map[string]interface{}{"use": "official", "text": p.Nama}},
+		"gender":               patientGender(p.JK),
+		"deceasedBoolean":      false,
+		"multipleBirthInteger": 0,
+	}
+	if p.TglLahir != "" && p.TglLahir != "0000-00-00" {
+		patient["birthDate"] = p.TglLahir
+	}
+	if tlp := strings.TrimSpace(p.NoTlp); tlp != "" {
+		patient["telecom"] = []interface{}{
+			map[string]interface{}{"system": "phone", "value": tlp, "use": "mobile"},
+		}
+	}
+	if alamat := strings.TrimSpace(p.Alamat); alamat != "" && alamat != "-" {
+		patient["address"] = []interface{}{
+			map[string]interface{}{"use": "home", "line": []interface{}{alamat}, "country": "ID"},
+		}
+	}
+	return withMetaProfile(patient)
+}
+
+// ensurePatient creates the Patient of nik from pasien demographics when the
+// lookup found none and the org may register patients. The create goes
+// through a job keyed on the NIK, so a patient is never created twice.
+func (a *App) ensurePatient(nik string, lookupErr error) (string, error) {
+	if !a.cfg.AllowPatientCreate || !errors.Is(lookupErr, ErrPatientNotFound) {
+		return "", lookupErr
+	}
+	if id := jobFHIRID(a.db, "Patient", nik); id != "" {
+		return id, nil // created earlier, the registry may not index it yet
+	}
+	p, err := queryPatientDemographics(a.ctx, a.db, nik)
+	if err != nil {
+		return "", fmt.Errorf("%w (create: %v)", lookupErr, err)
+	}
+	id, err := a.sendViaJob("Patient", nik, buildPatientJSON(*p, a.cfg.SSOrgID), a.ss.CreatePatient)
+	if err != nil {
+		return "", fmt.Errorf("create patient NIK %s: %w", nik, err)
+	}
+	if id == "" {
+		return "", fmt.Errorf("%w (create of NIK %s already pending)", lookupErr, nik)
+	}
+	logInfof("🆕 Patient RM %s not in SatuSehat, created Patient/%s", p.NoRM, id)
+	return id, nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ============================================================
+// PREVIEW (built FHIR payload of one record, never sent)
+// ============================================================
+
+// previewFilter selects one visit regardless of its date
+func (a *App) previewFilter(r *http.Request) (PendingFilter, bool) {
+	noRawat := r.URL.Query().Get("no_rawat")
+	return PendingFilter{NoRawat: noRawat, Order: a.cfg.SendOrder}, noRawat != ""
+}
+
+// queryMatches reports whether every given query parameter equals its field;
+// parameters left out of the query string match anything
+func queryMatches(r *http.Request, fields map[string]string) bool {
+	q := r.URL.Query()
+	for param, value := range fields {
+		if v := q.Get(param); v != "" && v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// pickPreviewRow returns the single row of rows that match. On no or several
+// matches it writes the error response (naming keys to narrow down) and returns false.
+func pickPreviewRow[T any](w http.ResponseWriter, rows []T, match func(T) bool, keys string) (T, bool) {
+	var found []T
+	for _, row := range rows {
+		if match(row) {
+			found = append(found, row)
+		}
+	}
+	switch len(found) {
+	case 0:
+		var zero T
+		jsonError(w, "record not found (or not mapped / its Encounter not sent yet)", 404)
+		return zero, false
+	case 1:
+		return found[0], true
+	}
+	jsonError(w, fmt.Sprintf("%d records match, narrow down with %s", len(found), keys), 400)
+	return found[0], false
+}
+
+// writePreview writes payload pretty-printed, named after the record
+func writePreview(w http.ResponseWriter, resourceType, name string, payload map[string]interface{}) {
+	body, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	name = strings.NewReplacer("/", "", " ", "_").Replace(name)
+	w.Header().Set("Content-Type", "application/fhir+json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s-%s.json"`, resourceType, name))
+	w.Write(body)
+}
+
+// previewLookups resolves the patient and, unless practNIK and practName are
+// both empty, the practitioner. A failure writes a 502 and returns false.
+func (a *App) previewLookups(w http.ResponseWriter, patientNIK, practNIK, practName string) (string, string, bool) {
+	if patientNIK == "" {
+		jsonError(w, "missing NIK pasien", 422)
+		return "", "", false
+	}
+	patientID, err := a.lookupPatient(patientNIK)
+	if err != nil {
+		jsonError(w, "patient lookup: "+err.Error(), 502)
+		return "", "", false
+	}
+	if practNIK == "" && practName == "" {
+		return patientID, "", true
+	}
+	if !a.canLookupPractitioner(practNIK, practName) {
+		jsonError(w, "missing NIK dokter", 422)
+		return "", "", false
+	}
+	practID, err := a.lookupPractitioner(practNIK, practName)
+	if err != nil {
+		jsonError(w, "practitioner lookup: "+err.Error(), 502)
+		return "", "", false
+	}
+	return patientID, practID, true
+}
+
+// ============================================================
+// PREVIEW HANDLERS
+// ============================================================
+
+func (a *App) handlePreviewEncounter(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.previewFilter(r)
+	if !ok {
+		jsonError(w, "no_rawat required", 400)
+		return
+	}
+	a = a.batch(r.Context())
+	resourceType := "Encounter"
+	rows, err := queryPendingEncounters(a.ctx, a.db, f)
+	if err == nil && len(rows) == 0 {
+		resourceType = "EncounterRanap"
+		rows, err = queryPendingEncountersRanap(a.ctx, a.db, f)
+	}
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	row, ok := pickPreviewRow(w, rows, func(EncounterRow) bool { return true }, "no_rawat")
+	if !ok {
+		return
+	}
+	patientID, practID, ok := a.previewLookups(w, row.NoKTPPasien, row.NoKTPDokter, row.NamaDokter)
+	if !ok {
+		return
+	}
+	enc := buildEncounterJSON(row, patientID, practID, a.cfg.SSOrgID)
+	if resourceType == "EncounterRanap" {
+		if err := a.attachDPJP(enc, row, practID); err != nil {
+			jsonError(w, err.Error(), 502)
+			return
+		}
+	}
+	if a.cfg.ReferralMode == referralOrigin {
+		a.attachReferral(enc, row, patientID) // servicerequest mode would send the ServiceRequest
+	}
+	writePreview(w, resourceType, row.NoRawat, enc)
+}
+
+func (a *App) handlePreviewCondition(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.previewFilter(r)
+	if !ok {
+		jsonError(w, "no_rawat required", 400)
+		return
+	}
+	a = a.batch(r.Context())
+	rows, err := queryPendingConditions(a.ctx, a.db, f)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	row, ok := pickPreviewRow(w, rows, func(row ConditionRow) bool {
+		return queryMatches(r, map[string]string{"kd_penyakit": row.KdPenyakit})
+	}, "kd_penyakit")
+	if !ok {
+		return
+	}
+	patientID, _, ok := a.previewLookups(w, row.NoKTPPasien, "", "")
+	if !ok {
+		return
+	}
+	writePreview(w, "Condition", row.NoRawat+"-"+row.KdPenyakit, buildConditionJSON(row, patientID, row.encounterID()))
+}
+
+func (a *App) handlePreviewProcedure(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.previewFilter(r)
+	if !ok {
+		jsonError(w, "no_rawat required", 400)
+		return
+	}
+	a = a.batch(r.Context())
+	rows, err := queryPendingProcedures(a.ctx, a.db, f)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	row, ok := pickPreviewRow(w, rows, func(row ProcedureRow) bool {
+		return queryMatches(r, map[string]string{"kode": row.KodeICD9})
+	}, "kode")
+	if !ok {
+		return
+	}
+	patientID, _, ok := a.previewLookups(w, row.NoKTPPasien, "", "")
+	if !ok {
+		return
+	}
+	writePreview(w, "Procedure", row.NoRawat+"-"+row.KodeICD9, buildProcedureJSON(row, patientID))
+}
+
+func (a *App) handlePreviewTTV(w http.ResponseWriter, r *http.Request) {
+	cfg := findTTVConfig(r.PathValue("type"))
+	if cfg == nil {
+		jsonError(w, "unknown TTV type: "+r.PathValue("type")+". Valid: "+ttvNames(), 400)
+		return
+	}
+	f, ok := a.previewFilter(r)
+	if !ok {
+		jsonError(w, "no_rawat required", 400)
+		return
+	}
+	a = a.batch(r.Context())
+	rows, err := queryPendingTTV(a.ctx, a.db, *cfg, f)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	row, ok := pickPreviewRow(w, rows, func(row TTVRow) bool {
+		return queryMatches(r, map[string]string{"tgl_perawatan": row.TglPerawatan, "jam_rawat": row.JamRawat, "status": row.SttsLanjut})
+	}, "tgl_perawatan, jam_rawat, status")
+	if !ok {
+		return
+	}
+	patientID, practID, ok := a.previewLookups(w, row.NoKTPPasien, row.NoKTPDokter, row.NamaDokter)
+	if !ok {
+		return
+	}
+	obs := buildObservationJSON(row, *cfg, patientID, practID, a.cfg.SSOrgID)
+	loadDeviceMap(a.db).attach(obs, "ttv", cfg.Name)
+	writePreview(w, "Observation_"+cfg.Name, row.NoRawat+"-"+row.TglPerawatan+"-"+row.JamRawat, obs)
+}
+
+func (a *App) handlePreviewLabObs(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.previewFilter(r)
+	if !ok {
+		jsonError(w, "no_rawat required", 400)
+		return
+	}
+	a = a.batch(r.Context())
+	rows, err := queryPendingLabObs(a.ctx, a.db, f)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	row, ok := pickPreviewRow(w, rows, func(row LabRow) bool {
+		return queryMatches(r, map[string]string{"noorder": row.NoOrder, "id_template": row.IDTemplate, "kd_jenis_prw": row.KdJenisPrw})
+	}, "noorder, id_template, kd_jenis_prw")
+	if !ok {
+		return
+	}
+	patientID, practID, ok := a.previewLookups(w, row.NoKTPPasien, row.NoKTPDokter, row.NamaDokter)
+	if !ok {
+		return
+	}
+	obs := buildLabObservationJSON(row, patientID, practID, a.cfg.SSOrgID, a.cfg.LabMaxValueLen)
+	loadDeviceMap(a.db).attach(obs, "lab", row.KdJenisPrw)
+	writePreview(w, "Observation_Lab", row.NoOrder+"-"+row.IDTemplate, obs)
+}
+
+func (a *App) handlePreviewRadObs(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.previewFilter(r)
+	if !ok {
+		jsonError(w, "no_rawat required", 400)
+		return
+	}
+	a = a.batch(r.Context())
+	rows, err := queryPendingRadObs(a.ctx, a.db, f)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	row, ok := pickPreviewRow(w, rows, func(row RadRow) bool {
+		return queryMatches(r, map[string]string{"noorder": row.NoOrder, "kd_jenis_prw": row.KdJenisPrw})
+	}, "noorder, kd_jenis_prw")
+	if !ok {
+		return
+	}
+	patientID, practID, ok := a.previewLookups(w, row.NoKTPPasien, row.NoKTPDokter, row.NamaDokter)
+	if !ok {
+		return
+	}
+	writePreview(w, "Observation_Rad", row.NoOrder+"-"+row.KdJenisPrw,
+		buildRadObservationJSON(row, patientID, practID, a.cfg.SSOrgID, a.cfg.RadMaxValueLen))
+}
+
+func (a *App) handlePreviewMedReq(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.previewFilter(r)
+	if !ok {
+		jsonError(w, "no_rawat required", 400)
+		return
+	}
+	a = a.batch(r.Context())
+	rows, err := queryPendingMedReq(a.ctx, a.db, f)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	row, ok := pickPreviewRow(w, rows, func(row MedReqRow) bool {
+		return queryMatches(r, map[string]string{"no_resep": row.NoResep, "kode_brng": row.KodeBrng, "no_racik": row.NoRacik})
+	}, "no_resep, kode_brng, no_racik")
+	if !ok {
+		return
+	}
+	patientID, practID, ok := a.previewLookups(w, row.NoKTPPasien, row.NoKTPDokter, row.NmDokter)
+	if !ok {
+		return
+	}
+	writePreview(w, "MedicationRequest", row.jobKey(), buildMedReqJSON(row, patientID, practID, a.cfg.SSOrgID))
+}
+
+func (a *App) handlePreviewMedDisp(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.previewFilter(r)
+	if !ok {
+		jsonError(w, "no_rawat required", 400)
+		return
+	}
+	a = a.batch(r.Context())
+	rows, err := queryPendingMedDisp(a.ctx, a.db, f)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	row, ok := pickPreviewRow(w, rows, func(row MedDispRow) bool {
+		return queryMatches(r, map[string]string{"tgl_validasi": row.TglValidasi, "kode_brng": row.KodeBrng,
+			"no_batch": row.NoBatch, "no_faktur": row.NoFaktur})
+	}, "tgl_validasi, kode_brng, no_batch, no_faktur")
+	if !ok {
+		return
+	}
+	performerNIK, performerName := a.dispenser(row)
+	patientID, practID, ok := a.previewLookups(w, row.NoKTPPasien, performerNIK, performerName)
+	if !ok {
+		return
+	}
+	medReqID := lookupMedReqID(a.db, row.NoResep, row.KodeBrng)
+	writePreview(w, "MedicationDispense", row.jobKey(), buildMedDispJSON(row, patientID, practID, performerName, a.cfg.SSOrgID, medReqID))
+}
@@ -1,12 +1,10 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
-	"time"
 )
 
 // ============================================================
@@ -29,7 +27,12 @@ type ProcedureRow struct {
 	StatusProc    string
 }
 
-func queryPendingProcedures(db *sql.DB, tgl1, tgl2 string) ([]ProcedureRow, error) {
+// jobKey is the idempotency key of this row's send job
+func (r ProcedureRow) jobKey() string {
+	return idempKey(r.NoRawat, r.KodeICD9, r.StatusProc)
+}
+
+func queryPendingProcedures(ctx context.Context, db *sql.DB, f PendingFilter) ([]ProcedureRow, error) {
 	query := `
 		SELECT reg_periksa.no_rawat, reg_periksa.no_rkm_medis, pasien.nm_pasien, pasien.no_ktp,
 			CONCAT(reg_periksa.tgl_registrasi,'T',reg_periksa.jam_reg,'+07:00') as tgl_reg,
@@ -47,9 +50,10 @@ func queryPendingProcedures(db *sql.DB, tgl1, tgl2 string) ([]ProcedureRow, erro
 		LEFT JOIN satu_sehat_procedure ON satu_sehat_procedure.no_rawat = prosedur_pasien.no_rawat
 			AND satu_sehat_procedure.kode = prosedur_pasien.kode
 			AND satu_sehat_procedure.status = prosedur_pasien.status
-		WHERE reg_periksa.tgl_registrasi BETWEEN ? AND ?`
+		WHERE ` + f.rangeSQL(registrationDate) + `
+		ORDER BY reg_periksa.tgl_registrasi ` + f.orderSQL() + `, reg_periksa.jam_reg ` + f.orderSQL()
 
-	rows, err := db.Query(query, tgl1, tgl2)
+	rows, err := db.QueryContext(ctx, query, f.rangeArgs(1)...)
 	if err != nil {
 		return nil, fmt.Errorf("query procedures: %w", err)
 	}
@@ -62,7 +66,7 @@ func queryPendingProcedures(db *sql.DB, tgl1, tgl2 string) ([]ProcedureRow, erro
 			&r.TglRegistrasi, &r.TglPulang, &r.Stts, &r.SttsLanjut,
 			&r.IDEncounter, &r.KodeICD9, &r.NamaProsedur,
 			&r.IDProcedure, &r.StatusProc); err != nil {
-			log.Printf("⚠️ scan procedure: %v", err)
+			logWarnf("⚠️ scan procedure: %v", err)
 			continue
 		}
 		results = append(results, r)
@@ -71,7 +75,7 @@ func queryPendingProcedures(db *sql.DB, tgl1, tgl2 string) ([]ProcedureRow, erro
 }
 
 func buildProcedureJSON(row ProcedureRow, patientID string) map[string]interface{} {
-	return map[string]interface{}{
+	return withMetaProfile(map[string]interface{}{
 		"resourceType": "Procedure",
 		"status":       "completed",
 		"category": map[string]interface{}{
@@ -88,10 +92,11 @@ func buildProcedureJSON(row ProcedureRow, patientID string) map[string]interface
 		"subject": map[string]interface{}{"reference": "Patient/" + patientID, "display": row.NmPasien},
 		"encounter": map[string]interface{}{
 			"reference": "Encounter/" + row.IDEncounter,
-			"display":   "Prosedur " + row.NmPasien + " selama kunjungan/dirawat dari tanggal " + row.TglRegistrasi + " sampai " + row.TglPulang,
+			"display": displayWords("Prosedur", row.NmPasien,
+				labeled("selama kunjungan/dirawat dari tanggal", row.TglRegistrasi), labeled("sampai", row.TglPulang)),
 		},
 		"performedPeriod": map[string]interface{}{"start": row.TglRegistrasi, "end": row.TglPulang},
-	}
+	})
 }
 
 // ============================================================
@@ -99,13 +104,8 @@ func buildProcedureJSON(row ProcedureRow, patientID string) map[string]interface
 // ============================================================
 
 func (a *App) handlePendingProcedures(w http.ResponseWriter, r *http.Request) {
-	tgl1 := r.URL.Query().Get("tgl1")
-	tgl2 := r.URL.Query().Get("tgl2")
-	if tgl1 == "" || tgl2 == "" {
-		today := time.Now().Format("2006-01-02")
-		tgl1, tgl2 = today, today
-	}
-	rows, err := queryPendingProcedures(a.db, tgl1, tgl2)
+	f := a.pendingFilterFromQuery(r)
+	rows, err := queryPendingProcedures(r.Context(), a.db, f)
 	if err != nil {
 		jsonError(w, err.Error(), 500)
 		return
@@ -118,73 +118,72 @@ func (a *App) handlePendingProcedures(w http.ResponseWriter, r *http.Request) {
 			sent = append(sent, row)
 		}
 	}
-	jsonResponse(w, map[string]interface{}{
-		"tgl1": tgl1, "tgl2": tgl2,
+	writePending(w, r, map[string]interface{}{
+		"tgl1": f.Tgl1, "tgl2": f.Tgl2,
 		"total": len(rows), "pending_count": len(pending), "sent_count": len(sent),
 		"pending": pending,
 	})
 }
 
 func (a *App) handleSendProcedures(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Tgl1 string `json:"tgl1"`
-		Tgl2 string `json:"tgl2"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, "invalid request body", 400)
-		return
-	}
-	if req.Tgl1 == "" || req.Tgl2 == "" {
-		jsonError(w, "tgl1 and tgl2 required", 400)
-		return
-	}
-	rows, err := queryPendingProcedures(a.db, req.Tgl1, req.Tgl2)
-	if err != nil {
-		jsonError(w, err.Error(), 500)
+	f, ok := a.decodeSendRequest(w, r)
+	if !ok {
 		return
 	}
-	var results []map[string]interface{}
-	sentCount, failCount := 0, 0
-	for _, row := range rows {
+	res, done, err := a.batch(r.Context()).sendProcedures(f)
+	writeBatch(w, res, done, err, "details", nil)
+}
+
+// sendProcedures sends every pending procedure in f
+func (a *App) sendProcedures(f PendingFilter) (*batchResult, int, error) {
+	res := a.newBatchResult()
+	done, err := eachChunk(a.ctx, f, a.cfg.ChunkDays, func(cf PendingFilter) ([]ProcedureRow, error) {
+		return queryPendingProcedures(a.ctx, a.db, cf)
+	}, func(row ProcedureRow) {
 		if row.IDProcedure != "" {
-			continue
+			return
 		}
 		if row.NoKTPPasien == "" {
 			a.saveSendLog(row.NoRawat, "Procedure", "", "skipped", "missing NIK pasien")
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "kode": row.KodeICD9, "status": "skipped", "reason": "missing NIK"})
-			failCount++
-			continue
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "kode": row.KodeICD9, "status": "skipped", "reason": "missing NIK"})
+			return
+		}
+		if a.enqueueRow("Procedure", row.jobKey(), row.NoRawat) {
+			return
 		}
-		patientID, err := a.ss.LookupPatient(row.NoKTPPasien)
+		patientID, err := a.lookupPatient(row.NoKTPPasien)
 		if err != nil {
-			a.saveSendLog(row.NoRawat, "Procedure", "", "failed", "patient lookup: "+err.Error())
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "kode": row.KodeICD9, "status": "failed", "error": "patient lookup: " + err.Error()})
-			failCount++
-			continue
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, "Procedure", "", st, "patient lookup: "+err.Error())
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "kode": row.KodeICD9, "status": st, "error": "patient lookup: " + err.Error()})
+			return
 		}
 		proc := buildProcedureJSON(row, patientID)
-		fhirID, err := a.sendViaJob("Procedure", idempKey(row.NoRawat, row.KodeICD9, row.StatusProc), proc, a.ss.SendProcedure)
+		if ts := futureTimestamp(proc); ts != "" {
+			a.saveSendLog(row.NoRawat, "Procedure", "", "skipped", "future timestamp: "+ts)
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "kode": row.KodeICD9, "status": "skipped", "reason": "future timestamp", "timestamp": ts})
+			return
+		}
+		fhirID, err := a.sendViaJob("Procedure", row.jobKey(), proc, a.ss.SendProcedure)
 		if err != nil {
 			a.saveSendLog(row.NoRawat, "Procedure", "", "failed", err.Error())
-			results = append(results, map[string]interface{}{"no_rawat": row.NoRawat, "kode": row.KodeICD9, "status": "failed", "error": err.Error()})
-			failCount++
-			continue
+			res.add(res.withResponse(map[string]interface{}{"no_rawat": row.NoRawat, "kode": row.KodeICD9, "status": "failed", "error": err.Error()}, err))
+			return
 		}
 		if fhirID == "" {
-			continue
+			return
 		}
 		_, dbErr := a.db.Exec(
 			"INSERT INTO satu_sehat_procedure (no_rawat, kode, status, id_procedure) VALUES (?,?,?,?)",
 			row.NoRawat, row.KodeICD9, row.StatusProc, fhirID)
 		if dbErr != nil {
-			log.Printf("⚠️ save procedure %s: %v", fhirID, dbErr)
+			logErrorf("❌ save procedure %s: %v", fhirID, dbErr)
 		}
 		a.saveSendLog(row.NoRawat, "Procedure", fhirID, "success", "")
-		results = append(results, map[string]interface{}{
+		res.add(map[string]interface{}{
 			"no_rawat": row.NoRawat, "kode": row.KodeICD9, "prosedur": row.NamaProsedur,
 			"status": "success", "fhir_id": fhirID,
 		})
-		sentCount++
-	}
-	jsonResponse(w, map[string]interface{}{"sent": sentCount, "failed": failCount, "details": results})
+	})
+	return res, done, err
 }
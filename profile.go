@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ============================================================
+// META PROFILE (SS_META_PROFILE, SS_META_PROFILES)
+// ============================================================
+
+// satuSehatProfileBase prefixes the default SatuSehat StructureDefinition URLs
+const satuSehatProfileBase = "https://fhir.kemkes.go.id/r4/StructureDefinition/"
+
+// metaProfiles maps a resourceType to the meta.profile URL declared on it;
+// nil (SS_META_PROFILE off) declares none
+var metaProfiles map[string]string
+
+// defaultMetaProfiles are the SatuSehat profiles of every resource sent
+func defaultMetaProfiles() map[string]string {
+	profiles := map[string]string{}
+	for _, rt := range []string{"Encounter", "Condition", "Observation", "Procedure", "Specimen",
+		"ServiceRequest", "MedicationRequest", "MedicationDispense", "Medication", "Composition",
+		"Patient", "Device", "QuestionnaireResponse"} {
+		profiles[rt] = satuSehatProfileBase + rt
+	}
+	return profiles
+}
+
+// setMetaProfiles enables meta.profile with the defaults overridden by
+// overrides ("Type=URL,Type2=URL2"; "Type=" declares no profile for Type)
+func setMetaProfiles(enabled bool, overrides string) error {
+	if !enabled {
+		metaProfiles = nil
+		return nil
+	}
+	profiles := defaultMetaProfiles()
+	for _, pair := range strings.Split(overrides, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		rt, url, ok := strings.Cut(pair, "=")
+		rt, url = strings.TrimSpace(rt), strings.TrimSpace(url)
+		if !ok || rt == "" {
+			return fmt.Errorf("SS_META_PROFILES entry %q must be ResourceType=URL", pair)
+		}
+		if url == "" {
+			delete(profiles, rt)
+			continue
+		}
+		profiles[rt] = url
+	}
+	metaProfiles = profiles
+	return nil
+}
+
+// withMetaProfile declares the configured profile of resource's type in its
+// meta, unless it already declares one, and returns resource. Every build*JSON
+// ends with it, so previews, validation and stored job payloads carry the
+// profile that is sent.
+func withMetaProfile(resource map[string]interface{}) map[string]interface{} {
+	rt, _ := resource["resourceType"].(string)
+	url, ok := metaProfiles[rt]
+	if !ok {
+		return resource
+	}
+	meta, _ := resource["meta"].(map[string]interface{})
+	if meta == nil {
+		meta = map[string]interface{}{}
+		resource["meta"] = meta
+	}
+	if _, ok := meta["profile"]; !ok {
+		meta["profile"] = []interface{}{url}
+	}
+	return resource
+}
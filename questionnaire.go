@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ============================================================
+// QUESTIONNAIRE RESPONSE (screening forms, SS_QUESTIONNAIRE_ENABLED)
+// ============================================================
+
+// satu_sehat_mapping_questionnaire maps one answer column of a Khanza form
+// table (keyed by no_rawat, e.g. skrining_ptm) to a Questionnaire item. Rows
+// with the same form make up one QuestionnaireResponse per visit.
+const createQuestionnaireTablesSQL = `CREATE TABLE IF NOT EXISTS satu_sehat_mapping_questionnaire (
+	form          VARCHAR(50)  NOT NULL,
+	link_id       VARCHAR(50)  NOT NULL,
+	questionnaire VARCHAR(200) NOT NULL,
+	source_table  VARCHAR(64)  NOT NULL,
+	db_column     VARCHAR(64)  NOT NULL,
+	question_text VARCHAR(255) DEFAULT '',
+	answer_type   VARCHAR(20)  DEFAULT 'string',
+	answer_system VARCHAR(200) DEFAULT '',
+	sort_order    INT          DEFAULT 0,
+	PRIMARY KEY (form, link_id)
+)`
+
+const createQuestionnaireTrackSQL = `CREATE TABLE IF NOT EXISTS satu_sehat_questionnaire_response (
+	form                      VARCHAR(50)  NOT NULL,
+	no_rawat                  VARCHAR(17)  NOT NULL,
+	id_questionnaire_response VARCHAR(100) NOT NULL,
+	PRIMARY KEY (form, no_rawat)
+)`
+
+type QuestionnaireItem struct {
+	LinkID       string
+	QuestionText string
+	DBColumn     string
+	AnswerType   string // string | boolean | integer | decimal | coding
+	AnswerSystem string // coding only
+}
+
+type QuestionnaireForm struct {
+	Name          string
+	Questionnaire string
+	SourceTable   string
+	Items         []QuestionnaireItem
+}
+
+type QuestionnaireRow struct {
+	NoRawat     string
+	NoRM        string
+	NmPasien    string
+	NoKTPPasien string
+	Authored    string
+	IDEncounter string
+	IDResponse  string
+	Answers     []string // same order as QuestionnaireForm.Items, "" = not answered
+}
+
+// jobKey is the idempotency key of this row's send job
+func (r QuestionnaireRow) jobKey(form string) string {
+	return idempKey(r.NoRawat, form)
+}
+
+func initQuestionnaireTables(db *sql.DB) {
+	for _, ddl := range []string{createQuestionnaireTablesSQL, createQuestionnaireTrackSQL} {
+		if _, err := db.Exec(ddl); err != nil {
+			logErrorf("❌ create questionnaire table: %v", err)
+		}
+	}
+}
+
+// loadQuestionnaireForm reads one form's mapping; nil if the form has no rows
+func loadQuestionnaireForm(db *sql.DB, name string) (*QuestionnaireForm, error) {
+	rows, err := db.Query(`SELECT questionnaire, source_table, link_id, IFNULL(question_text,''),
+			db_column, IFNULL(answer_type,'string'), IFNULL(answer_system,'')
+		FROM satu_sehat_mapping_questionnaire WHERE form = ? ORDER BY sort_order, link_id`, name)
+	if err != nil {
+		return nil, fmt.Errorf("load questionnaire %s: %w", name, err)
+	}
+	defer rows.Close()
+
+	var form *QuestionnaireForm
+	for rows.Next() {
+		var questionnaire, source string
+		var it QuestionnaireItem
+		if err := rows.Scan(&questionnaire, &source, &it.LinkID, &it.QuestionText,
+			&it.DBColumn, &it.AnswerType, &it.AnswerSystem); err != nil {
+			logWarnf("⚠️ scan questionnaire item: %v", err)
+			continue
+		}
+		if form == nil {
+			form = &QuestionnaireForm{Name: name, Questionnaire: questionnaire, SourceTable: source}
+		}
+		if !sqlIdentPattern.MatchString(source) || source != form.SourceTable || !sqlIdentPattern.MatchString(it.DBColumn) {
+			return nil, fmt.Errorf("questionnaire %s item %s: invalid or mixed source_table/db_column", name, it.LinkID)
+		}
+		form.Items = append(form.Items, it)
+	}
+	return form, nil
+}
+
+// questionnaireForms lists the configured form names
+func questionnaireForms(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT DISTINCT form FROM satu_sehat_mapping_questionnaire ORDER BY form`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var n string
+		if rows.Scan(&n) == nil {
+			names = append(names, n)
+		}
+	}
+	return names, nil
+}
+
+func queryPendingQuestionnaire(ctx context.Context, db *sql.DB, form QuestionnaireForm, f PendingFilter) ([]QuestionnaireRow, error) {
+	cols := make([]string, len(form.Items))
+	for i, it := range form.Items {
+		cols[i] = "src." + it.DBColumn
+	}
+	query := fmt.Sprintf(`
+		SELECT reg_periksa.no_rawat, reg_periksa.no_rkm_medis, pasien.nm_pasien, pasien.no_ktp,
+			CONCAT(reg_periksa.tgl_registrasi,'T',reg_periksa.jam_reg,'+07:00') as authored,
+			satu_sehat_encounter.id_encounter,
+			IFNULL(satu_sehat_questionnaire_response.id_questionnaire_response,'') as id_response,
+			%s
+		FROM %s src
+		INNER JOIN reg_periksa ON reg_periksa.no_rawat = src.no_rawat
+		INNER JOIN pasien ON reg_periksa.no_rkm_medis = pasien.no_rkm_medis
+		INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
+		LEFT JOIN satu_sehat_questionnaire_response ON satu_sehat_questionnaire_response.form = ?
+			AND satu_sehat_questionnaire_response.no_rawat = reg_periksa.no_rawat
+		WHERE `+f.rangeSQL(registrationDate)+`
+		ORDER BY reg_periksa.tgl_registrasi %s, reg_periksa.jam_reg %s`,
+		strings.Join(cols, ", "), form.SourceTable, f.orderSQL(), f.orderSQL())
+
+	rows, err := db.QueryContext(ctx, query, append([]interface{}{form.Name}, f.rangeArgs(1)...)...)
+	if err != nil {
+		return nil, fmt.Errorf("query questionnaire %s: %w", form.Name, err)
+	}
+	defer rows.Close()
+
+	var results []QuestionnaireRow
+	seen := map[string]bool{}
+	for rows.Next() {
+		var r QuestionnaireRow
+		answers := make([]sql.NullString, len(form.Items))
+		dest := []interface{}{&r.NoRawat, &r.NoRM, &r.NmPasien, &r.NoKTPPasien, &r.Authored, &r.IDEncounter, &r.IDResponse}
+		for i := range answers {
+			dest = append(dest, &answers[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			logWarnf("⚠️ scan questionnaire %s: %v", form.Name, err)
+			continue
+		}
+		if seen[r.NoRawat] {
+			continue // one response per visit, first form row wins
+		}
+		seen[r.NoRawat] = true
+		for _, a := range answers {
+			r.Answers = append(r.Answers, strings.TrimSpace(a.String))
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// questionnaireAnswer converts one stored answer to a FHIR answer[] value;
+// nil when the answer is empty or doesn't parse as the configured type
+func questionnaireAnswer(it QuestionnaireItem, v string) map[string]interface{} {
+	if v == "" {
+		return nil
+	}
+	switch it.AnswerType {
+	case "boolean":
+		switch strings.ToLower(v) {
+		case "ya", "y", "1", "true":
+			return map[string]interface{}{"valueBoolean": true}
+		case "tidak", "t", "n", "0", "false":
+			return map[string]interface{}{"valueBoolean": false}
+		}
+		return nil
+	case "integer":
+		if n, err := strconv.Atoi(v); err == nil {
+			return map[string]interface{}{"valueInteger": n}
+		}
+		return nil
+	case "decimal":
+		if n, ok := parseLabNumber(v); ok {
+			return map[string]interface{}{"valueDecimal": n}
+		}
+		return nil
+	case "coding":
+		return map[string]interface{}{"valueCoding": map[string]interface{}{"system": it.AnswerSystem, "code": v}}
+	default:
+		return map[string]interface{}{"valueString": v}
+	}
+}
+
+func buildQuestionnaireResponseJSON(row QuestionnaireRow, form QuestionnaireForm, patientID string) map[string]interface{} {
+	var items []interface{}
+	for i, it := range form.Items {
+		ans := questionnaireAnswer(it, row.Answers[i])
+		if ans == nil {
+			continue
+		}
+		item := map[string]interface{}{"linkId": it.LinkID, "answer": []interface{}{ans}}
+		if it.QuestionText != "" {
+			item["text"] = it.QuestionText
+		}
+		items = append(items, item)
+	}
+	return withMetaProfile(map[string]interface{}{
+		"resourceType":  "QuestionnaireResponse",
+		"questionnaire": form.Questionnaire,
+		"status":        "completed",
+		"subject":       map[string]interface{}{"reference": "Patient/" + patientID, "display": row.NmPasien},
+		"encounter":     map[string]interface{}{"reference": "Encounter/" + row.IDEncounter},
+		"authored":      row.Authored,
+		"item":          items,
+	})
+}
+
+// ============================================================
+// QUESTIONNAIRE RESPONSE HANDLERS
+// ============================================================
+
+// questionnaireFormFromPath resolves {form}, writing a 400/500 when it can't
+func (a *App) questionnaireFormFromPath(w http.ResponseWriter, r *http.Request) (*QuestionnaireForm, bool) {
+	name := r.PathValue("form")
+	form, err := loadQuestionnaireForm(a.db, name)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return nil, false
+	}
+	if form == nil {
+		names, _ := questionnaireForms(a.db)
+		jsonError(w, "unknown questionnaire form: "+name+". Valid: "+strings.Join(names, ","), 400)
+		return nil, false
+	}
+	return form, true
+}
+
+func (a *App) handleListQuestionnaires(w http.ResponseWriter, r *http.Request) {
+	names, err := questionnaireForms(a.db)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	writePending(w, r, map[string]interface{}{"forms": names})
+}
+
+func (a *App) handlePendingQuestionnaire(w http.ResponseWriter, r *http.Request) {
+	form, ok := a.questionnaireFormFromPath(w, r)
+	if !ok {
+		return
+	}
+	f := a.pendingFilterFromQuery(r)
+	rows, err := queryPendingQuestionnaire(r.Context(), a.db, *form, f)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	var pending []QuestionnaireRow
+	for _, row := range rows {
+		if row.IDResponse == "" {
+			pending = append(pending, row)
+		}
+	}
+	jsonResponse(w, map[string]interface{}{
+		"form": form.Name, "tgl1": f.Tgl1, "tgl2": f.Tgl2,
+		"total": len(rows), "pending_count": len(pending), "sent_count": len(rows) - len(pending),
+		"pending": pending,
+	})
+}
+
+func (a *App) handleSendQuestionnaire(w http.ResponseWriter, r *http.Request) {
+	form, ok := a.questionnaireFormFromPath(w, r)
+	if !ok {
+		return
+	}
+	f, ok := a.decodeSendRequest(w, r)
+	if !ok {
+		return
+	}
+	res, done, err := a.batch(r.Context()).sendQuestionnaire(form, f)
+	writeBatch(w, res, done, err, "details", map[string]interface{}{"form": form.Name})
+}
+
+// sendQuestionnaire sends every pending response of one form in f
+func (a *App) sendQuestionnaire(form *QuestionnaireForm, f PendingFilter) (*batchResult, int, error) {
+	res := a.newBatchResult()
+	resourceLabel := "QuestionnaireResponse_" + form.Name
+	done, err := eachChunk(a.ctx, f, a.cfg.ChunkDays, func(cf PendingFilter) ([]QuestionnaireRow, error) {
+		return queryPendingQuestionnaire(a.ctx, a.db, *form, cf)
+	}, func(row QuestionnaireRow) {
+		if row.IDResponse != "" {
+			return
+		}
+		if row.NoKTPPasien == "" {
+			a.saveSendLog(row.NoRawat, resourceLabel, "", "skipped", "missing NIK")
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "status": "skipped", "reason": "missing NIK"})
+			return
+		}
+		if a.enqueueRow("QuestionnaireResponse", row.jobKey(form.Name), row.NoRawat) {
+			return
+		}
+		patientID, err := a.lookupPatient(row.NoKTPPasien)
+		if err != nil {
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, resourceLabel, "", st, "patient lookup: "+err.Error())
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "status": st, "error": "patient lookup: " + err.Error()})
+			return
+		}
+		qr := buildQuestionnaireResponseJSON(row, *form, patientID)
+		if items, _ := qr["item"].([]interface{}); len(items) == 0 {
+			a.saveSendLog(row.NoRawat, resourceLabel, "", "skipped", "no answers")
+			res.add(map[string]interface{}{"no_rawat": row.NoRawat, "status": "skipped", "reason": "no answers"})
+			return
+		}
+		fhirID, err := a.sendViaJob("QuestionnaireResponse", row.jobKey(form.Name), qr, a.ss.SendQuestionnaireResponse)
+		if err != nil {
+			a.saveSendLog(row.NoRawat, resourceLabel, "", "failed", err.Error())
+			res.add(res.withResponse(map[string]interface{}{"no_rawat": row.NoRawat, "status": "failed", "error": err.Error()}, err))
+			return
+		}
+		if fhirID == "" {
+			return
+		}
+		_, dbErr := a.db.Exec(`INSERT INTO satu_sehat_questionnaire_response (form, no_rawat, id_questionnaire_response)
+			VALUES (?,?,?)`, form.Name, row.NoRawat, fhirID)
+		if dbErr != nil {
+			logErrorf("❌ save questionnaire response %s: %v", fhirID, dbErr)
+		}
+		a.saveSendLog(row.NoRawat, resourceLabel, fhirID, "success", "")
+		res.add(map[string]interface{}{"no_rawat": row.NoRawat, "status": "success", "fhir_id": fhirID})
+	})
+	return res, done, err
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================
+// SEND QUEUE (SS_ASYNC_SEND)
+// ============================================================
+
+// In queue mode a send request only selects its rows: each row it would send
+// becomes a 'pending' job holding the filter that selects it again instead of
+// a FHIR payload, and the request returns at once. The worker drains the due
+// jobs of mera_integration_jobs and runs the send flow of each one for its
+// visit, which does the lookups, builds the payload into the job and sends
+// it. Queued rows survive a restart, and progress is read from the same table.
+
+// queuePoll is how often the worker looks for due jobs when nothing woke it
+const queuePoll = 30 * time.Second
+
+// queueDrainSize is how many due jobs the worker takes per pass
+const queueDrainSize = 100
+
+// orphanJobAge is how long a job may stay 'pending' without a due time before
+// the worker treats it as orphaned (the process died between creating and
+// sending it, or the worker died while sending it)
+const orphanJobAge = 10 * time.Minute
+
+// batchIDKey carries the batch id a queued row was selected in, so batch()
+// stamps the worker's run with it
+type batchIDKey struct{}
+
+// enqueueKey marks a send request run in queue mode
+type enqueueKey struct{}
+
+// enqueued counts the rows a queue-mode request queued. window is the
+// eachChunk window the rows being handed out were selected from; all marks a
+// send-all request, set before its first row.
+type enqueued struct {
+	n      atomic.Int64
+	mu     sync.Mutex
+	window PendingFilter
+	all    bool
+}
+
+// enqueuedFrom returns the queue state of ctx, nil outside queue mode
+func enqueuedFrom(ctx context.Context) *enqueued {
+	q, _ := ctx.Value(enqueueKey{}).(*enqueued)
+	return q
+}
+
+func (q *enqueued) setWindow(f PendingFilter) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.window = f
+	q.mu.Unlock()
+}
+
+// queuedRow is the payload of a queued job until the worker builds it: the
+// filter selecting the row's visit in the window it was found in. All rows
+// come from send-all, whose later flows only see the visit once this row's
+// resource was sent.
+type queuedRow struct {
+	Filter PendingFilter `json:"filter"`
+	All    bool          `json:"all,omitempty"`
+}
+
+// queuedRowOf returns the queued row stored in a job payload, ok=false for a
+// built FHIR payload
+func queuedRowOf(payload string) (queuedRow, bool) {
+	var p struct {
+		Queued *queuedRow `json:"queued"`
+	}
+	if json.Unmarshal([]byte(payload), &p) != nil || p.Queued == nil {
+		return queuedRow{}, false
+	}
+	return *p.Queued, true
+}
+
+// enqueueRow queues the row resourceType/key of visit noRawat when the request
+// runs in queue mode, and reports whether it did: the caller then stops
+// before any lookup. A row that already has a job is left to that job; a newly
+// queued one counts against the request's rowLimit.
+func (a *App) enqueueRow(resourceType, key, noRawat string) bool {
+	q := enqueuedFrom(a.ctx)
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	f := q.window
+	q.mu.Unlock()
+	f.NoRawat = noRawat
+	payload := map[string]interface{}{"queued": queuedRow{Filter: f, All: q.all}}
+	if id := createJob(a.db, resourceType, key, payload, a.batchID, a.org); id != 0 {
+		queueJob(a.db, id)
+		q.n.Add(1)
+		rowLimitFrom(a.ctx).take()
+	}
+	return true
+}
+
+// dueJobSQL is the condition of a job the worker may take: queued and due, or
+// left pending without a due time for longer than orphanJobAge
+const dueJobSQL = `status='pending' AND (next_retry_at <= NOW()
+	OR (next_retry_at IS NULL AND updated_at < NOW() - INTERVAL ? SECOND))`
+
+// queueJob makes a job due for the worker
+func queueJob(db *sql.DB, jobID int64) {
+	if _, err := db.Exec("UPDATE mera_integration_jobs SET next_retry_at=NOW() WHERE id=?", jobID); err != nil {
+		logErrorf("❌ queue job %d: %v", jobID, err)
+	}
+}
+
+// fillQueuedJob stores the built payload in the queued job resourceType/key
+// and returns its id. It returns 0 when there is no such job, or when another
+// run filled it first.
+func fillQueuedJob(db *sql.DB, resourceType, key string, payload map[string]interface{}) int64 {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		logErrorf("❌ marshal job payload: %v", err)
+		return 0
+	}
+	res, err := db.Exec(
+		`UPDATE mera_integration_jobs SET payload=?, status='pending', next_retry_at=NULL
+		 WHERE resource_type=? AND idempotency_key=? AND status<>'success'
+		   AND JSON_CONTAINS_PATH(payload, 'one', '$.queued')`,
+		payloadJSON, resourceType, key)
+	if err != nil {
+		logErrorf("❌ fill queued job %s %s: %v", resourceType, key, err)
+		return 0
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return 0
+	}
+	var id int64
+	db.QueryRow("SELECT id FROM mera_integration_jobs WHERE resource_type=? AND idempotency_key=?",
+		resourceType, key).Scan(&id)
+	return id
+}
+
+// queuedFlow returns the send flow that builds rows of resourceType
+func (a *App) queuedFlow(resourceType, key string) (func(PendingFilter) (*batchResult, int, error), bool) {
+	switch resourceType {
+	case "Encounter":
+		return a.sendEncounters, true
+	case "EncounterRanap":
+		return a.sendEncountersRanap, true
+	case "Condition":
+		return a.sendConditions, true
+	case "Procedure":
+		return a.sendProcedures, true
+	case "Specimen", "Observation_Lab":
+		// the lab flow sends the Specimens first, then the observations that
+		// were waiting for them
+		return a.sendLabObs, true
+	case "Observation_Rad":
+		return a.sendRadObs, true
+	case "MedicationRequest":
+		return a.sendMedReq, true
+	case "MedicationDispense":
+		return a.sendMedDisp, true
+	case "Composition":
+		return a.sendCompositions, true
+	case "QuestionnaireResponse":
+		_, name, _ := strings.Cut(key, "|") // no_rawat|form
+		form, err := loadQuestionnaireForm(a.db, name)
+		if err != nil {
+			return nil, false
+		}
+		return func(f PendingFilter) (*batchResult, int, error) { return a.sendQuestionnaire(form, f) }, true
+	}
+	for i := range ttvConfigs {
+		if c := &ttvConfigs[i]; resourceType == "Observation_"+c.Name {
+			return func(f PendingFilter) (*batchResult, int, error) { return a.sendTTV(c, f) }, true
+		}
+	}
+	return nil, false
+}
+
+// sendQueuedRow builds and sends a queued job. It runs the send flow of the
+// job's resource type over the job's filter as the job's org and batch; the
+// flow fills the job with its payload and sends it, together with the other
+// pending rows of the visit. A send-all row then runs every send-all flow for
+// the visit, in order. A job the flow did not send is failed with the reason
+// the flow gave.
+func (a *App) sendQueuedRow(jobID int64, resourceType, key, org, batchID string, row queuedRow) map[string]interface{} {
+	ctx := context.WithValue(context.WithValue(a.ctx, orgKey{}, org), batchIDKey{}, batchID)
+	b := a.batch(ctx)
+	send, ok := b.queuedFlow(resourceType, key)
+	if !ok {
+		return map[string]interface{}{"id": jobID, "status": "error", "error": "no send flow for " + resourceType}
+	}
+	res, _, sendErr := send(row.Filter)
+	if row.All {
+		for _, step := range b.sendAllSteps() {
+			if b.cfg.resourceEnabled(step.key) && ctx.Err() == nil {
+				step.send(row.Filter)
+			}
+		}
+	}
+
+	var status, fhirID, errMsg string
+	var stillQueued bool
+	if err := a.db.QueryRow(
+		`SELECT status, fhir_id, IFNULL(error_message,''), JSON_CONTAINS_PATH(payload, 'one', '$.queued')
+		 FROM mera_integration_jobs WHERE id=?`, jobID,
+	).Scan(&status, &fhirID, &errMsg, &stillQueued); err != nil {
+		return map[string]interface{}{"id": jobID, "status": "error", "error": "job not found"}
+	}
+	if !stillQueued {
+		if status == "success" {
+			return map[string]interface{}{"id": jobID, "status": "success", "fhir_id": fhirID}
+		}
+		return map[string]interface{}{"id": jobID, "status": status, "error": errMsg}
+	}
+	if ctx.Err() != nil {
+		queueJob(a.db, jobID) // shutting down: due again on the next start
+		return map[string]interface{}{"id": jobID, "status": "pending", "reason": "cancelled"}
+	}
+	reason := queuedRowReason(res, sendErr, row.Filter.NoRawat)
+	failJob(a.db, jobID, errors.New(reason))
+	return map[string]interface{}{"id": jobID, "status": "failed", "error": reason}
+}
+
+// queuedRowReason explains why the flow left a queued row of visit noRawat
+// unsent: its error, the outcome it reported for the visit, or that the row
+// was no longer pending
+func queuedRowReason(res *batchResult, err error, noRawat string) string {
+	if err != nil {
+		return err.Error()
+	}
+	if res != nil {
+		res.mu.Lock()
+		defer res.mu.Unlock()
+		for _, d := range res.details {
+			if d["no_rawat"] != noRawat || d["status"] == "success" {
+				continue
+			}
+			if msg, ok := d["error"]; ok {
+				return fmt.Sprint(msg)
+			}
+			if msg, ok := d["reason"]; ok {
+				return fmt.Sprint(d["status"], ": ", msg)
+			}
+		}
+	}
+	return "row is no longer pending"
+}
+
+// sendQueue is the background worker sending the due jobs of
+// mera_integration_jobs one at a time
+type sendQueue struct {
+	app  *App
+	wake chan struct{}
+	ctx  context.Context
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+func newSendQueue(app *App) *sendQueue {
+	ctx, stop := context.WithCancel(context.Background())
+	return &sendQueue{app: app, wake: make(chan struct{}, 1), ctx: ctx, stop: stop, done: make(chan struct{})}
+}
+
+// start runs the worker until close. It drains the table on start, so jobs
+// queued before a restart are sent, then whenever notified or every queuePoll.
+func (q *sendQueue) start() {
+	go func() {
+		defer close(q.done)
+		tick := time.NewTicker(queuePoll)
+		defer tick.Stop()
+		for {
+			for q.ctx.Err() == nil && q.drain() {
+			}
+			select {
+			case <-q.ctx.Done():
+				return
+			case <-q.wake:
+			case <-tick.C:
+			}
+		}
+	}()
+}
+
+// notify wakes the worker after rows were queued
+func (q *sendQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close stops the worker after the row it is sending and waits for it, at
+// most until ctx is done. Jobs not sent yet stay due for the next start.
+func (q *sendQueue) close(ctx context.Context) {
+	q.stop()
+	select {
+	case <-q.done:
+	case <-ctx.Done():
+	}
+}
+
+// due lists up to queueDrainSize due jobs, oldest first
+func (q *sendQueue) due() ([]int64, error) {
+	rows, err := q.app.db.QueryContext(q.ctx,
+		`SELECT id FROM mera_integration_jobs WHERE `+dueJobSQL+` ORDER BY id LIMIT ?`,
+		int(orphanJobAge.Seconds()), queueDrainSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// claim takes a due job by clearing its due time, so neither a second pass
+// nor a second instance takes it again. A claimed job that is never finished
+// is picked up as orphaned after orphanJobAge.
+func (q *sendQueue) claim(id int64) bool {
+	res, err := q.app.db.Exec(
+		`UPDATE mera_integration_jobs SET next_retry_at=NULL, updated_at=NOW()
+		 WHERE id=? AND `+dueJobSQL, id, int(orphanJobAge.Seconds()))
+	if err != nil {
+		logWarnf("⚠️ claim job %d: %v", id, err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+// drain sends one pass of due jobs and reports whether there was any. A
+// queued row is built by its send flow, which also sends the rows queued with
+// it for the same visit; those are no longer due when their turn comes.
+func (q *sendQueue) drain() bool {
+	ids, err := q.due()
+	if err != nil {
+		logWarnf("⚠️ list queued jobs: %v", err)
+		return false
+	}
+	if len(ids) == 0 {
+		return false
+	}
+	a := q.app.batch(q.ctx)
+	sent, failed := 0, 0
+	for _, id := range ids {
+		if q.ctx.Err() != nil {
+			break
+		}
+		if !q.claim(id) {
+			continue
+		}
+		res := a.retryOneJob(id, false)
+		switch res["status"] {
+		case "success":
+			sent++
+		case "error", "skipped":
+			// not sendable as stored (org removed, bad payload, out of
+			// retries): fail it instead of picking it up again as an orphan
+			reason := res["error"]
+			if reason == nil {
+				reason = res["reason"]
+			}
+			failJob(q.app.db, id, errors.New(fmt.Sprint(reason)))
+			failed++
+		case "failed":
+			failed++
+		}
+	}
+	logInfof("📬 queue: %d job(s) sent, %d failed", sent, failed)
+	return true
+}
+
+// batchProgress counts the jobs of a batch per status; the batch is "queued"
+// while any of them is pending, else "done"
+func (a *App) batchProgress(ctx context.Context, batchID string) (map[string]interface{}, error) {
+	rows, err := a.db.QueryContext(ctx,
+		"SELECT status, COUNT(*) FROM mera_integration_jobs WHERE batch_id=? GROUP BY status", batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	total := 0
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[status] += n
+		total += n
+	}
+	status := "done"
+	if counts["pending"] > 0 {
+		status = "queued"
+	}
+	return map[string]interface{}{
+		"batch_id": batchID, "status": status,
+		"pending": counts["pending"], "success": counts["success"], "failed": counts["failed"], "total": total,
+	}, rows.Err()
+}
+
+// queued runs a send handler in queue mode when SS_ASYNC_SEND is on: its rows
+// become queued jobs, reported as "queued" with a "progress" link, and the
+// worker is woken to send them. Without the queue the handler sends as before.
+func (a *App) queued(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.queue == nil {
+			next(w, r)
+			return
+		}
+		q := &enqueued{}
+		next(w, r.WithContext(context.WithValue(r.Context(), enqueueKey{}, q)))
+		if q.n.Load() > 0 {
+			a.queue.notify()
+		}
+	}
+}
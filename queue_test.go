@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// TestEnqueueRow: in queue mode a row only becomes a due job holding its
+// filter; a row that already has a job is left alone.
+func TestEnqueueRow(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	q := &enqueued{}
+	q.setWindow(PendingFilter{Tgl1: "2025-01-01", Tgl2: "2025-01-07", Order: "asc"})
+	a := &App{db: db, ctx: context.WithValue(context.Background(), enqueueKey{}, q), batchID: "b-1"}
+
+	mock.ExpectExec("INSERT IGNORE INTO mera_integration_jobs").
+		WithArgs("Condition", "2025/01/02/000001|A09",
+			[]byte(`{"queued":{"filter":{"tgl1":"2025-01-01","tgl2":"2025-01-07","order":"asc","no_rawat":"2025/01/02/000001"}}}`),
+			"b-1", "").
+		WillReturnResult(sqlmock.NewResult(7, 1))
+	mock.ExpectExec("UPDATE mera_integration_jobs SET next_retry_at=NOW\\(\\) WHERE id=\\?").
+		WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT IGNORE INTO mera_integration_jobs").
+		WithArgs("Condition", "2025/01/02/000001|J00", sqlmock.AnyArg(), "b-1", "").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if !a.enqueueRow("Condition", "2025/01/02/000001|A09", "2025/01/02/000001") {
+		t.Fatal("new row not queued")
+	}
+	if !a.enqueueRow("Condition", "2025/01/02/000001|J00", "2025/01/02/000001") {
+		t.Fatal("row with a job not left to it")
+	}
+	if q.n.Load() != 1 {
+		t.Fatalf("queued %d, want 1", q.n.Load())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	if (&App{ctx: context.Background()}).enqueueRow("Condition", "x", "y") {
+		t.Fatal("queued outside queue mode")
+	}
+}
+
+// TestSendViaJobFillsQueuedRow: the worker's send of a queued row fills the
+// existing job with the built payload and sends it.
+func TestSendViaJobFillsQueuedRow(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := &App{db: db, ctx: context.Background()}
+
+	mock.ExpectExec("INSERT IGNORE INTO mera_integration_jobs").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE mera_integration_jobs SET payload=\\?").
+		WithArgs(sqlmock.AnyArg(), "Condition", "2025/01/02/000001|A09").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT id FROM mera_integration_jobs").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectExec("UPDATE mera_integration_jobs SET status='success'").
+		WithArgs("ss-1", 7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO mera_integration_job_attempts").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT resource_type, idempotency_key FROM mera_integration_jobs").
+		WillReturnRows(sqlmock.NewRows([]string{"resource_type", "idempotency_key"}).AddRow("Condition", "2025/01/02/000001|A09"))
+
+	cond := map[string]interface{}{
+		"resourceType": "Condition",
+		"subject":      map[string]interface{}{"reference": "Patient/P1"},
+		"encounter":    map[string]interface{}{"reference": "Encounter/E1"},
+	}
+	sent := 0
+	id, err := a.sendViaJob("Condition", "2025/01/02/000001|A09", cond,
+		func(map[string]interface{}) (string, error) { sent++; return "ss-1", nil })
+	if err != nil || id != "ss-1" || sent != 1 {
+		t.Fatalf("sendViaJob = %q, %v after %d sends; want ss-1, nil after 1", id, err, sent)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueuedRowOf(t *testing.T) {
+	row, ok := queuedRowOf(`{"queued":{"filter":{"no_rawat":"2025/01/02/000001"}}}`)
+	if !ok || row.Filter.NoRawat != "2025/01/02/000001" {
+		t.Fatalf("queued row = %+v, %v", row, ok)
+	}
+	if _, ok := queuedRowOf(`{"resourceType":"Condition"}`); ok {
+		t.Fatal("FHIR payload read as a queued row")
+	}
+}
+
+// TestBatchProgress: a batch stays "queued" while any of its jobs is pending.
+func TestBatchProgress(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := &App{db: db}
+
+	for _, tc := range []struct {
+		rows       *sqlmock.Rows
+		wantStatus string
+		wantTotal  int
+	}{
+		{sqlmock.NewRows([]string{"status", "n"}).AddRow("pending", 2).AddRow("success", 3), "queued", 5},
+		{sqlmock.NewRows([]string{"status", "n"}).AddRow("success", 4).AddRow("failed", 1), "done", 5},
+	} {
+		mock.ExpectQuery("SELECT status, COUNT\\(\\*\\) FROM mera_integration_jobs WHERE batch_id=\\?").
+			WithArgs("b-1").WillReturnRows(tc.rows)
+		p, err := a.batchProgress(context.Background(), "b-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p["status"] != tc.wantStatus || p["total"] != tc.wantTotal {
+			t.Errorf("status/total = %v/%v, want %s/%d", p["status"], p["total"], tc.wantStatus, tc.wantTotal)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// ============================================================
+// LOG REDACTION (LOG_REDACT)
+// ============================================================
+
+// logRedact masks patient identifiers in the 📤/📥 payload dumps. It is set
+// once at startup from LOG_REDACT, on by default against production.
+var logRedact = true
+
+// redactedText replaces a masked name or address
+const redactedText = "[redacted]"
+
+// maskNIK keeps the last 4 digits of a NIK
+func maskNIK(nik string) string {
+	if len(nik) <= 4 {
+		return strings.Repeat("*", len(nik))
+	}
+	return strings.Repeat("*", len(nik)-4) + nik[len(nik)-4:]
+}
+
+// redactPath masks the NIK of an identifier search such as
+// /Patient?identifier=<nikSystem>|<nik>, query-escaped
+func redactPath(path string) string {
+	if !logRedact {
+		return path
+	}
+	prefix := url.QueryEscape(nikSystem + "|")
+	i := strings.Index(path, prefix)
+	if i < 0 {
+		return path
+	}
+	start := i + len(prefix)
+	end := strings.IndexByte(path[start:], '&')
+	if end < 0 {
+		end = len(path) - start
+	}
+	return path[:start] + maskNIK(path[start:start+end]) + path[start+end:]
+}
+
+// redactPayload returns body with NIKs, patient names and addresses masked,
+// for logging only. Bodies that are not JSON are returned unchanged.
+func redactPayload(body []byte) []byte {
+	if !logRedact || len(body) == 0 || !logEnabled(levelDebug) {
+		return body
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return body
+	}
+	out, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// redactValue walks a decoded FHIR payload in place
+func redactValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if sys, _ := t["system"].(string); sys == nikSystem {
+			if nik, ok := t["value"].(string); ok {
+				t["value"] = maskNIK(nik)
+			}
+		}
+		if t["resourceType"] == "Patient" {
+			if _, ok := t["name"]; ok {
+				t["name"] = redactedText
+			}
+		}
+		for k, child := range t {
+			switch k {
+			case "address":
+				t[k] = redactedText
+			case "subject", "patient":
+				if ref, ok := child.(map[string]interface{}); ok {
+					if _, ok := ref["display"]; ok {
+						ref["display"] = redactedText
+					}
+				}
+				redactValue(child)
+			default:
+				redactValue(child)
+			}
+		}
+	case []interface{}:
+		for _, child := range t {
+			redactValue(child)
+		}
+	}
+	return v
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+// TestRedactPath: the NIK of an escaped identifier search is masked up to its
+// last four digits, other query parameters are kept.
+func TestRedactPath(t *testing.T) {
+	defer func(v bool) { logRedact = v }(logRedact)
+	logRedact = true
+
+	path := "/Patient?identifier=" + url.QueryEscape(nikSystem+"|3201234567890123") + "&_count=1"
+	want := "/Patient?identifier=" + url.QueryEscape(nikSystem+"|") + "************0123&_count=1"
+	if got := redactPath(path); got != want {
+		t.Fatalf("redactPath = %q, want %q", got, want)
+	}
+	if got := redactPath("/Encounter/abc"); got != "/Encounter/abc" {
+		t.Fatalf("redactPath changed %q", got)
+	}
+}
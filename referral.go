@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ============================================================
+// REFERRAL (rujuk_masuk → Encounter)
+// ============================================================
+
+// SS_REFERRAL_MODE values
+const (
+	referralOrigin         = "origin"         // Encounter.hospitalization.origin + preAdmissionIdentifier
+	referralServiceRequest = "servicerequest" // ServiceRequest sent first, linked via Encounter.basedOn
+)
+
+// Referral is the incoming referral of a visit from Khanza's rujuk_masuk
+type Referral struct {
+	Perujuk    string // referring facility
+	NoRujuk    string
+	KdPenyakit string
+	Keterangan string
+}
+
+// queryReferral returns the referral of noRawat, or nil when the visit was not referred
+func queryReferral(ctx context.Context, db *sql.DB, noRawat string) (*Referral, error) {
+	var r Referral
+	err := db.QueryRowContext(ctx, `SELECT IFNULL(perujuk,''), IFNULL(no_rujuk,''), IFNULL(kd_penyakit,''), IFNULL(keterangan,'')
+		FROM rujuk_masuk WHERE no_rawat = ? LIMIT 1`, noRawat).
+		Scan(&r.Perujuk, &r.NoRujuk, &r.KdPenyakit, &r.Keterangan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query rujuk_masuk: %w", err)
+	}
+	return &r, nil
+}
+
+func buildReferralServiceRequestJSON(ref Referral, noRawat, patientID, orgID string) map[string]interface{} {
+	sr := map[string]interface{}{
+		"resourceType": "ServiceRequest",
+		"status":       "completed",
+		"intent":       "order",
+		"identifier": []interface{}{
+			map[string]interface{}{"system": sysID("servicerequest", orgID), "value": noRawat},
+		},
+		"category": []interface{}{
+			map[string]interface{}{
+				"coding": []interface{}{
+					map[string]interface{}{"system": "http://snomed.info/sct", "code": "3457005", "display": "Patient referral"},
+				},
+			},
+		},
+		"code": map[string]interface{}{
+			"coding": []interface{}{
+				map[string]interface{}{"system": "http://snomed.info/sct", "code": "3457005", "display": "Patient referral"},
+			},
+			"text": "Rujukan masuk " + ref.NoRujuk,
+		},
+		"subject":   map[string]interface{}{"reference": "Patient/" + patientID},
+		"requester": map[string]interface{}{"display": ref.Perujuk},
+		"performer": []interface{}{map[string]interface{}{"reference": "Organization/" + orgID}},
+	}
+	if ref.KdPenyakit != "" {
+		sr["reasonCode"] = []interface{}{
+			map[string]interface{}{
+				"coding": []interface{}{map[string]interface{}{"system": "http://hl7.org/fhir/sid/icd-10", "code": ref.KdPenyakit}},
+			},
+		}
+	}
+	if ref.Keterangan != "" {
+		sr["note"] = []interface{}{map[string]interface{}{"text": ref.Keterangan}}
+	}
+	return withMetaProfile(sr)
+}
+
+// attachReferral adds the referral context of row's visit to enc according to
+// SS_REFERRAL_MODE. Problems are logged and leave enc unchanged, so a broken
+// referral never blocks the Encounter itself.
+func (a *App) attachReferral(enc map[string]interface{}, row EncounterRow, patientID string) {
+	if a.cfg.ReferralMode != referralOrigin && a.cfg.ReferralMode != referralServiceRequest {
+		return
+	}
+	ref, err := queryReferral(a.ctx, a.db, row.NoRawat)
+	if err != nil {
+		logWarnf("⚠️ referral %s: %v", row.NoRawat, err)
+		return
+	}
+	if ref == nil {
+		return
+	}
+
+	if a.cfg.ReferralMode == referralOrigin {
+		hosp, _ := enc["hospitalization"].(map[string]interface{}) // ranap admit/discharge
+		if hosp == nil {
+			hosp = map[string]interface{}{}
+		}
+		hosp["origin"] = map[string]interface{}{"display": ref.Perujuk}
+		if ref.NoRujuk != "" {
+			hosp["preAdmissionIdentifier"] = map[string]interface{}{"value": ref.NoRujuk}
+		}
+		enc["hospitalization"] = hosp
+		return
+	}
+
+	key := idempKey(row.NoRawat, "rujukan")
+	srID, err := a.sendViaJob("ServiceRequest", key,
+		buildReferralServiceRequestJSON(*ref, row.NoRawat, patientID, a.cfg.SSOrgID), a.ss.SendServiceRequest)
+	if err != nil {
+		logWarnf("⚠️ referral ServiceRequest %s: %v", row.NoRawat, err)
+		return
+	}
+	if srID == "" {
+		srID = jobFHIRID(a.db, "ServiceRequest", key) // sent by an earlier run
+	}
+	if srID == "" {
+		logWarnf("⚠️ referral ServiceRequest %s: job exists without fhir_id, Encounter sent unlinked", row.NoRawat)
+		return
+	}
+	enc["basedOn"] = []interface{}{map[string]interface{}{"reference": "ServiceRequest/" + srID}}
+}
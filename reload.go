@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/joho/godotenv"
+	"golang.org/x/time/rate"
+)
+
+// ============================================================
+// CONFIG RELOAD (SIGHUP)
+// ============================================================
+
+// runtimeSettings are the settings a SIGHUP applies without a restart. The
+// DB connection, credentials, URLs and cached tokens are left alone.
+type runtimeSettings struct {
+	LogLevel         string
+	RateLimit        float64
+	EncounterWorkers int
+	MaxBatch         int
+	RetryBackoff     int
+}
+
+// runtimeEnv names the variable behind each runtimeSettings field
+var runtimeEnv = map[string]string{
+	"LogLevel":         "LOG_LEVEL",
+	"RateLimit":        "SS_RATE_LIMIT",
+	"EncounterWorkers": "SS_ENCOUNTER_WORKERS",
+	"MaxBatch":         "SS_MAX_BATCH",
+	"RetryBackoff":     "SS_RETRY_BACKOFF",
+}
+
+func (c Config) runtimeSettings() runtimeSettings {
+	return runtimeSettings{
+		LogLevel:         c.LogLevel,
+		RateLimit:        c.RateLimit,
+		EncounterWorkers: c.EncounterWorkers,
+		MaxBatch:         c.MaxBatch,
+		RetryBackoff:     c.RetryBackoff,
+	}
+}
+
+func (s runtimeSettings) validate() error {
+	if s.RateLimit < 0 {
+		return fmt.Errorf("SS_RATE_LIMIT must be >= 0, got %g", s.RateLimit)
+	}
+	if s.MaxBatch < 0 {
+		return fmt.Errorf("SS_MAX_BATCH must be >= 0, got %d", s.MaxBatch)
+	}
+	return nil
+}
+
+// liveConfig holds the current runtimeSettings. Code reading one of them goes
+// through live.get(); App.cfg keeps the values read at startup.
+type liveConfig struct {
+	mu sync.RWMutex
+	s  runtimeSettings
+}
+
+var live liveConfig
+
+func (l *liveConfig) get() runtimeSettings {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.s
+}
+
+func (l *liveConfig) set(s runtimeSettings) {
+	l.mu.Lock()
+	l.s = s
+	l.mu.Unlock()
+	setLogLevel(parseLogLevel(s.LogLevel))
+}
+
+// setRateLimit changes the request rate of c, 0 = unlimited
+func (c *SSClient) setRateLimit(perSec float64) {
+	if perSec <= 0 {
+		c.limiter.SetLimit(rate.Inf)
+		return
+	}
+	c.limiter.SetLimit(rate.Limit(perSec))
+	c.limiter.SetBurst(max(1, int(perSec)))
+}
+
+// processEnv is the set of variables given by the real environment at
+// startup; they win over .env on a reload as they did at startup
+var processEnv = func() map[string]bool {
+	keys := map[string]bool{}
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		keys[k] = true
+	}
+	return keys
+}()
+
+// dotEnvKeys are the variables the last .env read set
+var dotEnvKeys = map[string]bool{}
+
+// loadDotEnv sets every .env variable that is not in processEnv, and unsets
+// the ones an earlier read set but the file no longer has
+func loadDotEnv() {
+	vals, err := godotenv.Read()
+	if err != nil {
+		vals = map[string]string{} // no .env: env vars only
+	}
+	for k := range dotEnvKeys {
+		if _, ok := vals[k]; !ok {
+			os.Unsetenv(k)
+		}
+	}
+	dotEnvKeys = map[string]bool{}
+	for k, v := range vals {
+		if !processEnv[k] {
+			os.Setenv(k, v)
+			dotEnvKeys[k] = true
+		}
+	}
+}
+
+// reloadConfig re-reads the environment and .env, applies the runtime
+// settings and logs each one that changed. Other changed settings are only
+// reported, they need a restart.
+func (a *App) reloadConfig() {
+	cfg := loadConfig()
+	if err := cfg.applyEnvPreset(); err != nil {
+		logErrorf("❌ SIGHUP: invalid config, nothing reloaded: %v", err)
+		return
+	}
+	next := cfg.runtimeSettings()
+	if err := next.validate(); err != nil {
+		logErrorf("❌ SIGHUP: invalid config, nothing reloaded: %v", err)
+		return
+	}
+
+	prev := live.get()
+	var changed []string
+	pv, nv := reflect.ValueOf(prev), reflect.ValueOf(next)
+	for i := 0; i < pv.NumField(); i++ {
+		if field := pv.Type().Field(i).Name; pv.Field(i).Interface() != nv.Field(i).Interface() {
+			changed = append(changed, fmt.Sprintf("%s %v → %v", runtimeEnv[field], pv.Field(i).Interface(), nv.Field(i).Interface()))
+		}
+	}
+	live.set(next)
+	if next.RateLimit != prev.RateLimit {
+		for _, org := range a.orgs {
+			org.ss.setRateLimit(next.RateLimit)
+		}
+	}
+	if len(changed) == 0 {
+		logInfof("🔄 SIGHUP: config reloaded, no runtime setting changed")
+	} else {
+		logInfof("🔄 SIGHUP: config reloaded: %s", strings.Join(changed, ", "))
+	}
+
+	var restart []string
+	cv, av := reflect.ValueOf(cfg), reflect.ValueOf(a.cfg)
+	for i := 0; i < cv.NumField(); i++ {
+		field := cv.Type().Field(i).Name
+		if _, ok := runtimeEnv[field]; ok {
+			continue
+		}
+		if !reflect.DeepEqual(cv.Field(i).Interface(), av.Field(i).Interface()) {
+			restart = append(restart, field)
+		}
+	}
+	if len(restart) > 0 {
+		logWarnf("⚠️ SIGHUP: %s changed but only apply after a restart", strings.Join(restart, ", "))
+	}
+}
+
+// watchReload reloads the config on every SIGHUP
+func (a *App) watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			a.reloadConfig()
+		}
+	}()
+}
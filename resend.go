@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// ============================================================
+// RESEND (clear local tracking in a window and send again)
+// ============================================================
+
+type resendRequest struct {
+	ResourceType string `json:"resource_type"`
+	Tgl1         string `json:"tgl1"`
+	Tgl2         string `json:"tgl2"`
+	Confirm      bool   `json:"confirm"`
+}
+
+// clearSent removes the send job of every row in f, and the tracking row of
+// those already sent, so the next send treats them as pending again
+func clearSent[T any](a *App, f PendingFilter, resourceType string,
+	query func(PendingFilter) ([]T, error), isSent func(T) bool, jobKey func(T) string, untrack func(T) error) (int, error) {
+
+	cleared := 0
+	_, err := eachChunk(a.ctx, f, a.cfg.ChunkDays, query, func(row T) {
+		if isSent(row) {
+			if err := untrack(row); err != nil {
+				logWarnf("⚠️ resend: clear %s tracking %s: %v", resourceType, jobKey(row), err)
+				return
+			}
+			cleared++
+		}
+		if _, err := a.db.Exec(`DELETE FROM mera_integration_jobs WHERE resource_type=? AND idempotency_key=?`,
+			resourceType, jobKey(row)); err != nil {
+			logWarnf("⚠️ resend: clear %s job %s: %v", resourceType, jobKey(row), err)
+		}
+	})
+	return cleared, err
+}
+
+// resendTarget returns the clear + send pair for a resource type as it appears
+// in jobs and send logs (Encounter, Condition, Observation_suhu, ...)
+func (a *App) resendTarget(resourceType string) (func(PendingFilter) (int, error), func(PendingFilter) (*batchResult, int, error), bool) {
+	exec := func(query string, args ...interface{}) error {
+		_, err := a.db.Exec(query, args...)
+		return err
+	}
+
+	switch resourceType {
+	case "Encounter", "EncounterRanap":
+		query := func(f PendingFilter) ([]EncounterRow, error) { return queryPendingEncounters(a.ctx, a.db, f) }
+		send := a.sendEncounters
+		if resourceType == "EncounterRanap" {
+			query = func(f PendingFilter) ([]EncounterRow, error) { return queryPendingEncountersRanap(a.ctx, a.db, f) }
+			send = a.sendEncountersRanap
+		}
+		return func(f PendingFilter) (int, error) {
+			return clearSent(a, f, resourceType, query,
+				func(r EncounterRow) bool { return r.IDEncounter != "" }, EncounterRow.jobKey,
+				func(r EncounterRow) error {
+					return exec("DELETE FROM satu_sehat_encounter WHERE no_rawat=?", r.NoRawat)
+				})
+		}, send, true
+
+	case "Condition":
+		return func(f PendingFilter) (int, error) {
+			return clearSent(a, f, resourceType,
+				func(f PendingFilter) ([]ConditionRow, error) { return queryPendingConditions(a.ctx, a.db, f) },
+				func(r ConditionRow) bool { return r.IDCondition != "" }, ConditionRow.jobKey,
+				func(r ConditionRow) error {
+					return exec("DELETE FROM satu_sehat_condition WHERE no_rawat=? AND kd_penyakit=?", r.NoRawat, r.KdPenyakit)
+				})
+		}, a.sendConditions, true
+
+	case "Observation_Lab":
+		return func(f PendingFilter) (int, error) {
+			return clearSent(a, f, resourceType,
+				func(f PendingFilter) ([]LabRow, error) { return queryPendingLabObs(a.ctx, a.db, f) },
+				func(r LabRow) bool { return r.IDObservation != "" }, LabRow.jobKey,
+				func(r LabRow) error {
+					return exec("DELETE FROM satu_sehat_observation_lab WHERE noorder=? AND id_template=? AND kd_jenis_prw=?",
+						r.NoOrder, r.IDTemplate, r.KdJenisPrw)
+				})
+		}, a.sendLabObs, true
+
+	case "Observation_Rad":
+		return func(f PendingFilter) (int, error) {
+			return clearSent(a, f, resourceType,
+				func(f PendingFilter) ([]RadRow, error) { return queryPendingRadObs(a.ctx, a.db, f) },
+				func(r RadRow) bool { return r.IDObservation != "" }, RadRow.jobKey,
+				func(r RadRow) error {
+					return exec("DELETE FROM satu_sehat_observation_radiologi WHERE noorder=? AND kd_jenis_prw=?", r.NoOrder, r.KdJenisPrw)
+				})
+		}, a.sendRadObs, true
+
+	case "Procedure":
+		return func(f PendingFilter) (int, error) {
+			return clearSent(a, f, resourceType,
+				func(f PendingFilter) ([]ProcedureRow, error) { return queryPendingProcedures(a.ctx, a.db, f) },
+				func(r ProcedureRow) bool { return r.IDProcedure != "" }, ProcedureRow.jobKey,
+				func(r ProcedureRow) error {
+					return exec("DELETE FROM satu_sehat_procedure WHERE no_rawat=? AND kode=? AND status=?", r.NoRawat, r.KodeICD9, r.StatusProc)
+				})
+		}, a.sendProcedures, true
+
+	case "MedicationRequest":
+		return func(f PendingFilter) (int, error) {
+			return clearSent(a, f, resourceType,
+				func(f PendingFilter) ([]MedReqRow, error) { return queryPendingMedReq(a.ctx, a.db, f) },
+				func(r MedReqRow) bool { return r.IDMedReq != "" }, MedReqRow.jobKey,
+				func(r MedReqRow) error {
+					if r.NoRacik != "" {
+						return exec("DELETE FROM satu_sehat_medicationrequest_racikan WHERE no_resep=? AND kode_brng=? AND no_racik=?",
+							r.NoResep, r.KodeBrng, r.NoRacik)
+					}
+					return exec("DELETE FROM satu_sehat_medicationrequest WHERE no_resep=? AND kode_brng=?", r.NoResep, r.KodeBrng)
+				})
+		}, a.sendMedReq, true
+
+	case "MedicationDispense":
+		return func(f PendingFilter) (int, error) {
+			return clearSent(a, f, resourceType,
+				func(f PendingFilter) ([]MedDispRow, error) { return queryPendingMedDisp(a.ctx, a.db, f) },
+				func(r MedDispRow) bool { return r.IDMedDisp != "" }, MedDispRow.jobKey,
+				func(r MedDispRow) error {
+					tgl, jam, _ := strings.Cut(r.TglValidasi, " ")
+					return exec(`DELETE FROM satu_sehat_medicationdispense WHERE no_rawat=? AND tgl_perawatan=? AND jam=?
+						AND kode_brng=? AND no_batch=? AND no_faktur=?`,
+						r.NoRawat, tgl, jam, r.KodeBrng, r.NoBatch, r.NoFaktur)
+				})
+		}, a.sendMedDisp, true
+	}
+
+	if name, ok := strings.CutPrefix(resourceType, "Observation_"); ok {
+		if cfg := findTTVConfig(name); cfg != nil {
+			return func(f PendingFilter) (int, error) {
+					return clearSent(a, f, resourceType,
+						func(f PendingFilter) ([]TTVRow, error) { return queryPendingTTV(a.ctx, a.db, *cfg, f) },
+						func(r TTVRow) bool { return r.IDObservation != "" }, TTVRow.jobKey,
+						func(r TTVRow) error {
+							return exec("DELETE FROM "+cfg.TrackTable+" WHERE no_rawat=? AND tgl_perawatan=? AND jam_rawat=? AND status=?",
+								r.NoRawat, r.TglPerawatan, r.JamRawat, r.SttsLanjut)
+						})
+				}, func(f PendingFilter) (*batchResult, int, error) {
+					return a.sendTTV(cfg, f)
+				}, true
+		}
+	}
+	return nil, nil, false
+}
+
+func (a *App) handleResend(w http.ResponseWriter, r *http.Request) {
+	var req resendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request body", 400)
+		return
+	}
+	if req.ResourceType == "" || req.Tgl1 == "" || req.Tgl2 == "" {
+		jsonError(w, "resource_type, tgl1 and tgl2 required", 400)
+		return
+	}
+	if !req.Confirm {
+		jsonError(w, "resend clears local tracking and sends everything again; set confirm:true to proceed", 400)
+		return
+	}
+	clearFn, send, ok := a.batch(r.Context()).resendTarget(req.ResourceType)
+	if !ok {
+		jsonError(w, "unknown resource_type: "+req.ResourceType, 400)
+		return
+	}
+
+	f := PendingFilter{Tgl1: req.Tgl1, Tgl2: req.Tgl2, Order: a.cfg.SendOrder}
+	cleared, err := clearFn(f)
+	if err != nil {
+		jsonError(w, "clear tracking: "+err.Error(), 500)
+		return
+	}
+	logInfof("🔄 resend %s %s..%s: cleared %d tracked row(s)", req.ResourceType, req.Tgl1, req.Tgl2, cleared)
+
+	res, done, err := send(f)
+	writeBatch(w, res, done, err, "details", map[string]interface{}{"resource_type": req.ResourceType, "cleared": cleared})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ============================================================
+// RESOURCE CATALOG (SS_ENABLED_RESOURCES)
+// ============================================================
+
+// resourceInfo is one send flow as the dashboard shows it
+type resourceInfo struct {
+	Key     string `json:"key"`
+	Label   string `json:"label"`
+	Emoji   string `json:"emoji"`
+	Pending string `json:"pending"`
+	Send    string `json:"send"`
+	Enabled bool   `json:"enabled"`
+}
+
+// ttvLabels are the dashboard label and emoji of the built-in TTV types
+var ttvLabels = map[string][2]string{
+	"suhu":      {"TTV Suhu", "🌡️"},
+	"nadi":      {"TTV Nadi", "💓"},
+	"tensi":     {"TTV Tensi", "🩸"},
+	"respirasi": {"TTV Respirasi", "🫁"},
+	"spo2":      {"TTV SpO2", "🫀"},
+	"gcs":       {"TTV GCS", "🧠"},
+	"tb":        {"TTV Tinggi Badan", "📏"},
+	"bb":        {"TTV Berat Badan", "⚖️"},
+	"lp":        {"TTV Lingkar Perut", "📐"},
+}
+
+// resourceCatalog lists every send flow, TTV types as configured
+func resourceCatalog() []resourceInfo {
+	list := []resourceInfo{
+		{Key: "encounter", Label: "Encounter Ralan", Emoji: "🏨", Pending: "/api/encounters/pending", Send: "/api/encounters/send"},
+		{Key: "encounter-ranap", Label: "Encounter Ranap", Emoji: "🛏️", Pending: "/api/encounters-ranap/pending", Send: "/api/encounters-ranap/send"},
+		{Key: "condition", Label: "Condition (ICD-10)", Emoji: "🩺", Pending: "/api/conditions/pending", Send: "/api/conditions/send"},
+	}
+	for _, c := range ttvConfigs {
+		label, ok := ttvLabels[c.Name]
+		if !ok {
+			label = [2]string{"TTV " + c.Name, "📈"}
+		}
+		list = append(list, resourceInfo{Key: "ttv-" + c.Name, Label: label[0], Emoji: label[1],
+			Pending: "/api/observations-ttv/" + c.Name + "/pending", Send: "/api/observations-ttv/" + c.Name + "/send"})
+	}
+	return append(list,
+		resourceInfo{Key: "lab", Label: "Observation Lab", Emoji: "🔬", Pending: "/api/observations-lab/pending", Send: "/api/observations-lab/send"},
+		resourceInfo{Key: "rad", Label: "Observation Radiologi", Emoji: "☢️", Pending: "/api/observations-rad/pending", Send: "/api/observations-rad/send"},
+		resourceInfo{Key: "procedure", Label: "Procedure (ICD-9)", Emoji: "🔧", Pending: "/api/procedures/pending", Send: "/api/procedures/send"},
+		resourceInfo{Key: "medreq", Label: "Medication Request", Emoji: "💊", Pending: "/api/medication-requests/pending", Send: "/api/medication-requests/send"},
+		resourceInfo{Key: "meddisp", Label: "Medication Dispense", Emoji: "💉", Pending: "/api/medication-dispenses/pending", Send: "/api/medication-dispenses/send"},
+		resourceInfo{Key: "composition", Label: "Resume Medis Ranap", Emoji: "📋", Pending: "/api/compositions/pending", Send: "/api/compositions/send"},
+	)
+}
+
+// resourceEnabled reports whether SS_ENABLED_RESOURCES allows the flow key;
+// "ttv" enables every ttv-<type>. An empty list enables everything.
+func (c Config) resourceEnabled(key string) bool {
+	if len(c.EnabledResources) == 0 || c.EnabledResources[key] {
+		return true
+	}
+	return strings.HasPrefix(key, "ttv-") && c.EnabledResources["ttv"]
+}
+
+// checkEnabledResources warns about SS_ENABLED_RESOURCES names that match no flow
+func checkEnabledResources(c Config) {
+	known := map[string]bool{"ttv": true}
+	for _, res := range resourceCatalog() {
+		known[res.Key] = true
+	}
+	for name := range c.EnabledResources {
+		if !known[name] {
+			logWarnf("⚠️ SS_ENABLED_RESOURCES: unknown resource %q", name)
+		}
+	}
+}
+
+// enabledOnly rejects requests to a flow SS_ENABLED_RESOURCES leaves out.
+// "{type}" in key is replaced by the request's type path value.
+func (a *App) enabledOnly(key string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		k := strings.ReplaceAll(key, "{type}", r.PathValue("type"))
+		if !a.cfg.resourceEnabled(k) {
+			jsonError(w, k+" is disabled (SS_ENABLED_RESOURCES)", 403)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// sendRoute wraps the send handler of flow key: rejected when disabled,
+// verbose on request, capped at SS_MAX_BATCH rows, queued with SS_ASYNC_SEND,
+// and announced by webhook when it completes
+func (a *App) sendRoute(key string, next http.HandlerFunc) http.HandlerFunc {
+	return a.enabledOnly(key, withVerbose(a.withRowLimit(a.queued(a.notifyBatch(key, next)))))
+}
+
+func (a *App) handleResources(w http.ResponseWriter, r *http.Request) {
+	list := resourceCatalog()
+	for i := range list {
+		list[i].Enabled = a.cfg.resourceEnabled(list[i].Key)
+	}
+	jsonResponse(w, map[string]interface{}{"resources": list})
+}
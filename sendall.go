@@ -0,0 +1,97 @@
+package main
+
+import "net/http"
+
+// ============================================================
+// SEND ALL (every flow of a date range in dependency order)
+// ============================================================
+
+// sendStep is one flow of send-all
+type sendStep struct {
+	key  string // resourceCatalog key, checked against SS_ENABLED_RESOURCES
+	send func(f PendingFilter) (*batchResult, int, error)
+}
+
+// sendAllSteps lists the flows in dependency order: Encounters first, then
+// what references them, MedicationDispense after its MedicationRequest and the
+// resume after the Conditions and Procedures it lists
+func (a *App) sendAllSteps() []sendStep {
+	steps := []sendStep{
+		{"encounter", a.sendEncounters},
+		{"encounter-ranap", a.sendEncountersRanap},
+		{"condition", a.sendConditions},
+		{"procedure", a.sendProcedures},
+	}
+	for _, c := range ttvConfigs {
+		steps = append(steps, sendStep{"ttv-" + c.Name, func(f PendingFilter) (*batchResult, int, error) {
+			return a.sendTTV(&c, f)
+		}})
+	}
+	return append(steps,
+		sendStep{"lab", a.sendLabObs},
+		sendStep{"rad", a.sendRadObs},
+		sendStep{"medreq", a.sendMedReq},
+		sendStep{"meddisp", a.sendMedDisp},
+		sendStep{"composition", a.sendCompositions},
+	)
+}
+
+// handleSendAll runs every enabled flow over one date range as one batch.
+// A flow that fails is reported and the next one still runs: the later
+// queries only pick rows whose references were sent. In queue mode the worker
+// runs the later flows for each visit it sent a queued row of.
+func (a *App) handleSendAll(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.decodeSendRequest(w, r)
+	if !ok {
+		return
+	}
+	if f.hasUnit() {
+		jsonError(w, "kd_poli, kd_bangsal and kd_kamar only apply to the encounter endpoints", 400)
+		return
+	}
+	a = a.batch(r.Context())
+	queue := enqueuedFrom(a.ctx)
+	if queue != nil {
+		queue.all = true
+	}
+	var sent, failed, skipped int
+	var results []map[string]interface{}
+	for _, step := range a.sendAllSteps() {
+		if !a.cfg.resourceEnabled(step.key) {
+			continue
+		}
+		if a.ctx.Err() != nil {
+			results = append(results, map[string]interface{}{"resource": step.key, "error": "cancelled"})
+			continue
+		}
+		res, done, err := step.send(f)
+		out := res.toJSON("details")
+		out["resource"] = step.key
+		delete(out, "batch_id")
+		delete(out, "remaining")
+		delete(out, "progress")
+		if err != nil {
+			out["error"] = err.Error()
+			if done == 0 {
+				logWarnf("⚠️ send-all %s: %v", step.key, err)
+			}
+		}
+		res.mu.Lock()
+		sent, failed, skipped = sent+res.sent, failed+res.failed, skipped+res.skipped
+		res.mu.Unlock()
+		results = append(results, out)
+	}
+	resp := map[string]interface{}{
+		"tgl1": f.Tgl1, "tgl2": f.Tgl2, "batch_id": a.batchID,
+		"sent": sent, "failed": failed, "skipped": skipped,
+		"resources": results,
+	}
+	if l := rowLimitFrom(a.ctx); l.active() {
+		resp["remaining"] = l.left()
+	}
+	if queue != nil {
+		resp["queued"] = queue.n.Load()
+		resp["progress"] = "/api/jobs?batch_id=" + a.batchID
+	}
+	jsonResponse(w, resp)
+}
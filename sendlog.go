@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================
+// SEND LOG WRITER (buffered, batched satu_sehat_send_log inserts)
+// ============================================================
+
+type sendLogEntry struct {
+	noRawat, resourceType, fhirID, status, errMsg, batchID string
+}
+
+// sendLogWriter batches send-log inserts in a background goroutine so the
+// send loops don't pay one synchronous INSERT per record
+type sendLogWriter struct {
+	db        *sql.DB
+	ch        chan sendLogEntry
+	batchSize int
+	interval  time.Duration
+	done      chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newSendLogWriter(db *sql.DB, batchSize int, interval time.Duration) *sendLogWriter {
+	w := &sendLogWriter{
+		db:        db,
+		ch:        make(chan sendLogEntry, batchSize*4),
+		batchSize: batchSize,
+		interval:  interval,
+		done:      make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// write queues an entry; once closed it falls back to a direct insert so nothing is dropped
+func (w *sendLogWriter) write(e sendLogEntry) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		insertSendLogs(w.db, []sendLogEntry{e})
+		return
+	}
+	w.ch <- e
+}
+
+func (w *sendLogWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	var buf []sendLogEntry
+	flush := func() {
+		if len(buf) > 0 {
+			insertSendLogs(w.db, buf)
+			buf = buf[:0]
+		}
+	}
+	for {
+		select {
+		case e, ok := <-w.ch:
+			if !ok {
+				flush()
+				return
+			}
+			buf = append(buf, e)
+			if len(buf) >= w.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Close flushes everything still queued and stops the writer
+func (w *sendLogWriter) Close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.ch)
+	}
+	w.mu.Unlock()
+	<-w.done
+}
+
+// insertSendLogs writes entries with a single multi-row INSERT
+func insertSendLogs(db *sql.DB, entries []sendLogEntry) {
+	placeholders := make([]string, len(entries))
+	args := make([]interface{}, 0, len(entries)*6)
+	for i, e := range entries {
+		placeholders[i] = "(?, ?, ?, ?, ?, ?)"
+		args = append(args, e.noRawat, e.resourceType, e.fhirID, e.status, e.errMsg, e.batchID)
+	}
+	_, err := db.Exec(`INSERT INTO satu_sehat_send_log
+		(no_rawat, resource_type, fhir_id, status, error_message, batch_id)
+		VALUES `+strings.Join(placeholders, ", "), args...)
+	if err != nil {
+		logErrorf("❌ save send log (%d rows): %v", len(entries), err)
+	}
+}
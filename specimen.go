@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+)
+
+// ============================================================
+// SPECIMEN (Lab)
+// ============================================================
+
+type SpecimenRow struct {
+	NoRawat          string
+	NmPasien         string
+	NoKTPPasien      string
+	NoOrder          string
+	IDTemplate       string
+	KdJenisPrw       string
+	Pemeriksaan      string
+	TypeCode         string // satu_sehat_mapping_lab.sampel_*
+	TypeSystem       string
+	TypeDisplay      string
+	Collected        string
+	IDServiceRequest string
+	IDSpecimen       string
+}
+
+// jobKey is the idempotency key of this row's send job
+func (r SpecimenRow) jobKey() string {
+	return idempKey(r.NoOrder, r.IDTemplate, r.KdJenisPrw)
+}
+
+// initSpecimenMapping adds the specimen type columns to satu_sehat_mapping_lab
+// on databases whose Khanza version predates them
+func initSpecimenMapping(db *sql.DB) {
+	ensureColumn(db, "satu_sehat_mapping_lab", "sampel_code", "VARCHAR(50) DEFAULT ''")
+	ensureColumn(db, "satu_sehat_mapping_lab", "sampel_system", "VARCHAR(200) DEFAULT ''")
+	ensureColumn(db, "satu_sehat_mapping_lab", "sampel_display", "VARCHAR(200) DEFAULT ''")
+}
+
+// queryPendingLabSpecimens lists every mapped lab order item with its specimen
+// (id_specimen empty when not yet sent), filtered like the lab Observations
+func queryPendingLabSpecimens(ctx context.Context, db *sql.DB, f PendingFilter) ([]SpecimenRow, error) {
+	query := `
+		SELECT reg_periksa.no_rawat, pasien.nm_pasien, pasien.no_ktp,
+			permintaan_lab.noorder, permintaan_detail_permintaan_lab.id_template,
+			permintaan_detail_permintaan_lab.kd_jenis_prw, template_laboratorium.Pemeriksaan,
+			IFNULL(satu_sehat_mapping_lab.sampel_code,''), IFNULL(satu_sehat_mapping_lab.sampel_system,''),
+			IFNULL(satu_sehat_mapping_lab.sampel_display,''),
+			CONCAT(permintaan_lab.tgl_sampel,'T',permintaan_lab.jam_sampel,'+07:00') as collected,
+			IFNULL(satu_sehat_servicerequest_lab.id_servicerequest,'') as id_servicerequest,
+			IFNULL(satu_sehat_specimen_lab.id_specimen,'') as id_specimen
+		FROM reg_periksa
+		INNER JOIN pasien ON reg_periksa.no_rkm_medis = pasien.no_rkm_medis
+		INNER JOIN permintaan_lab ON permintaan_lab.no_rawat = reg_periksa.no_rawat
+		INNER JOIN permintaan_detail_permintaan_lab ON permintaan_detail_permintaan_lab.noorder = permintaan_lab.noorder
+		INNER JOIN template_laboratorium ON template_laboratorium.id_template = permintaan_detail_permintaan_lab.id_template
+		INNER JOIN satu_sehat_mapping_lab ON satu_sehat_mapping_lab.id_template = template_laboratorium.id_template
+		INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
+		LEFT JOIN satu_sehat_servicerequest_lab ON satu_sehat_servicerequest_lab.noorder = permintaan_detail_permintaan_lab.noorder
+			AND satu_sehat_servicerequest_lab.id_template = permintaan_detail_permintaan_lab.id_template
+			AND satu_sehat_servicerequest_lab.kd_jenis_prw = permintaan_detail_permintaan_lab.kd_jenis_prw
+		LEFT JOIN satu_sehat_specimen_lab ON satu_sehat_specimen_lab.noorder = permintaan_detail_permintaan_lab.noorder
+			AND satu_sehat_specimen_lab.id_template = permintaan_detail_permintaan_lab.id_template
+			AND satu_sehat_specimen_lab.kd_jenis_prw = permintaan_detail_permintaan_lab.kd_jenis_prw
+		WHERE permintaan_lab.tgl_sampel <> '0000-00-00'
+			AND ` + f.rangeSQL(dateFilterColumn("Observation_Lab")) + `
+		ORDER BY permintaan_lab.tgl_sampel ` + f.orderSQL() + `, permintaan_lab.jam_sampel ` + f.orderSQL()
+
+	rows, err := db.QueryContext(ctx, query, f.rangeArgs(1)...)
+	if err != nil {
+		return nil, fmt.Errorf("query lab specimens: %w", err)
+	}
+	defer rows.Close()
+
+	var results []SpecimenRow
+	for rows.Next() {
+		var r SpecimenRow
+		if err := rows.Scan(&r.NoRawat, &r.NmPasien, &r.NoKTPPasien,
+			&r.NoOrder, &r.IDTemplate, &r.KdJenisPrw, &r.Pemeriksaan,
+			&r.TypeCode, &r.TypeSystem, &r.TypeDisplay,
+			&r.Collected, &r.IDServiceRequest, &r.IDSpecimen); err != nil {
+			logWarnf("⚠️ scan specimen row: %v", err)
+			continue
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+func buildSpecimenJSON(row SpecimenRow, patientID, orgID string) map[string]interface{} {
+	spec := map[string]interface{}{
+		"resourceType": "Specimen",
+		"identifier": []interface{}{
+			map[string]interface{}{
+				"system":   sysID("specimen", orgID),
+				"value":    row.NoOrder + "." + row.IDTemplate,
+				"assigner": map[string]interface{}{"reference": "Organization/" + orgID},
+			},
+		},
+		"status": "available",
+		"type": map[string]interface{}{
+			"coding": []interface{}{
+				map[string]interface{}{"system": row.TypeSystem, "code": row.TypeCode, "display": row.TypeDisplay},
+			},
+		},
+		"collection": map[string]interface{}{"collectedDateTime": row.Collected},
+		"subject":    map[string]interface{}{"reference": "Patient/" + patientID, "display": row.NmPasien},
+	}
+	if row.IDServiceRequest != "" {
+		spec["request"] = []interface{}{map[string]interface{}{"reference": "ServiceRequest/" + row.IDServiceRequest}}
+	}
+	return withMetaProfile(spec)
+}
+
+// saveSpecimenID fills satu_sehat_specimen_lab.id_specimen, inserting the row if Khanza has none yet
+func (a *App) saveSpecimenID(row SpecimenRow, fhirID string) {
+	res, err := a.db.Exec(`UPDATE satu_sehat_specimen_lab SET id_specimen=? WHERE noorder=? AND id_template=? AND kd_jenis_prw=?`,
+		fhirID, row.NoOrder, row.IDTemplate, row.KdJenisPrw)
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			_, err = a.db.Exec(`INSERT INTO satu_sehat_specimen_lab (noorder, id_template, kd_jenis_prw, id_specimen) VALUES (?,?,?,?)`,
+				row.NoOrder, row.IDTemplate, row.KdJenisPrw, fhirID)
+		}
+	}
+	if err != nil {
+		logErrorf("❌ save specimen %s: %v", fhirID, err)
+	}
+}
+
+// ============================================================
+// SPECIMEN HANDLERS
+// ============================================================
+
+func (a *App) handlePendingLabSpecimens(w http.ResponseWriter, r *http.Request) {
+	f := a.pendingFilterFromQuery(r)
+	rows, err := queryPendingLabSpecimens(r.Context(), a.db, f)
+	if err != nil {
+		jsonError(w, err.Error(), 500)
+		return
+	}
+	var pending []SpecimenRow
+	for _, row := range rows {
+		if row.IDSpecimen == "" {
+			pending = append(pending, row)
+		}
+	}
+	writePending(w, r, map[string]interface{}{
+		"tgl1": f.Tgl1, "tgl2": f.Tgl2,
+		"total": len(rows), "pending_count": len(pending), "sent_count": len(rows) - len(pending),
+		"pending": pending,
+	})
+}
+
+func (a *App) handleSendLabSpecimens(w http.ResponseWriter, r *http.Request) {
+	f, ok := a.decodeSendRequest(w, r)
+	if !ok {
+		return
+	}
+	b := a.batch(r.Context())
+	res := b.newBatchResult()
+	done, err := b.sendLabSpecimens(res, f)
+	writeBatch(w, res, done, err, "details", nil)
+}
+
+// sendLabSpecimens creates the Specimen of every lab order item in f that has
+// none yet, recording outcomes in res with "step":"specimen"
+func (a *App) sendLabSpecimens(res *batchResult, f PendingFilter) (int, error) {
+	return eachChunk(a.ctx, f, a.cfg.ChunkDays, func(cf PendingFilter) ([]SpecimenRow, error) {
+		return queryPendingLabSpecimens(a.ctx, a.db, cf)
+	}, func(row SpecimenRow) {
+		if row.IDSpecimen != "" {
+			return
+		}
+		add := func(d map[string]interface{}) {
+			d["step"], d["no_rawat"], d["noorder"] = "specimen", row.NoRawat, row.NoOrder
+			res.add(d)
+		}
+		if row.TypeCode == "" {
+			a.saveSendLog(row.NoRawat, "Specimen", "", "skipped", "no specimen type mapping for "+row.IDTemplate)
+			add(map[string]interface{}{"status": "skipped", "reason": "no sampel_code in satu_sehat_mapping_lab"})
+			return
+		}
+		if row.NoKTPPasien == "" {
+			a.saveSendLog(row.NoRawat, "Specimen", "", "skipped", "missing NIK")
+			add(map[string]interface{}{"status": "skipped", "reason": "missing NIK"})
+			return
+		}
+		if a.enqueueRow("Specimen", row.jobKey(), row.NoRawat) {
+			return
+		}
+		patientID, err := a.lookupPatient(row.NoKTPPasien)
+		if err != nil {
+			st := a.lookupStatus(err)
+			a.saveSendLog(row.NoRawat, "Specimen", "", st, "patient lookup: "+err.Error())
+			add(map[string]interface{}{"status": st, "error": "patient lookup: " + err.Error()})
+			return
+		}
+		fhirID, err := a.sendViaJob("Specimen", row.jobKey(), buildSpecimenJSON(row, patientID, a.cfg.SSOrgID), a.ss.SendSpecimen)
+		if err != nil {
+			a.saveSendLog(row.NoRawat, "Specimen", "", "failed", err.Error())
+			add(res.withResponse(map[string]interface{}{"status": "failed", "error": err.Error()}, err))
+			return
+		}
+		if fhirID == "" {
+			// sent by an earlier run (or a job retry) without reaching the tracking table
+			if fhirID = jobFHIRID(a.db, "Specimen", row.jobKey()); fhirID == "" {
+				return
+			}
+		}
+		a.saveSpecimenID(row, fhirID)
+		a.saveSendLog(row.NoRawat, "Specimen", fhirID, "success", "")
+		add(map[string]interface{}{"status": "success", "fhir_id": fhirID})
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ============================================================
+// SWAPPED URL CHECK (SS_AUTH_URL vs SS_FHIR_URL)
+// ============================================================
+
+// swappedURLHints lists the path signs that SS_AUTH_URL and SS_FHIR_URL were
+// set to each other's host path
+func (c Config) swappedURLHints() []string {
+	var hints []string
+	if strings.Contains(strings.ToLower(c.SSFHIRURL), "oauth2") {
+		hints = append(hints, "SS_FHIR_URL "+c.SSFHIRURL+" looks like the auth endpoint (oauth2)")
+	}
+	if strings.Contains(strings.ToLower(c.SSAuthURL), "fhir") {
+		hints = append(hints, "SS_AUTH_URL "+c.SSAuthURL+" looks like the FHIR endpoint")
+	}
+	return hints
+}
+
+// answersFHIR reports whether a GET of Organization/{orgID} under base comes
+// back as a FHIR resource (any resourceType, an OperationOutcome included)
+func answersFHIR(base, token, orgID string) (bool, int) {
+	req, err := http.NewRequest("GET", base+"/Organization/"+orgID, nil)
+	if err != nil {
+		return false, 0
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := tokenHTTP.Do(req)
+	if err != nil {
+		return false, 0
+	}
+	defer resp.Body.Close()
+	var body struct {
+		ResourceType string `json:"resourceType"`
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	json.Unmarshal(raw, &body)
+	return body.ResourceType != "", resp.StatusCode
+}
+
+// answersToken reports whether base hands out an access token for cfg's client
+func answersToken(base string, cfg Config) bool {
+	data := url.Values{}
+	data.Set("client_id", cfg.SSClientID)
+	data.Set("client_secret", cfg.SSSecret)
+	resp, err := tokenHTTP.PostForm(base+"/accesstoken?grant_type=client_credentials", data)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	json.Unmarshal(raw, &body)
+	return resp.StatusCode == 200 && body.AccessToken != ""
+}
+
+// probeSwappedURLs runs after the initial token fetch: when the token fails
+// it tries the token request on SS_FHIR_URL, otherwise it checks that
+// SS_FHIR_URL answers FHIR and, if not, whether SS_AUTH_URL does. Signs of a
+// swap are only logged, the service keeps running.
+func probeSwappedURLs(cfg Config, token string, tokenErr error) {
+	var signs []string
+	if tokenErr != nil {
+		if answersToken(cfg.SSFHIRURL, cfg) {
+			signs = append(signs, "the token request fails on SS_AUTH_URL "+cfg.SSAuthURL+
+				" but succeeds on SS_FHIR_URL "+cfg.SSFHIRURL)
+		}
+	} else if ok, status := answersFHIR(cfg.SSFHIRURL, token, cfg.SSOrgID); !ok {
+		if authOK, _ := answersFHIR(cfg.SSAuthURL, token, cfg.SSOrgID); authOK {
+			signs = append(signs, fmt.Sprintf("GET Organization on SS_FHIR_URL %s returns HTTP %d without a FHIR resource, SS_AUTH_URL %s answers with one",
+				cfg.SSFHIRURL, status, cfg.SSAuthURL))
+		}
+	}
+	for _, s := range signs {
+		logWarnf("⚠️ SS_FHIR_URL and SS_AUTH_URL may be swapped: %s", s)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ============================================================
+// PRE-SEND VALIDATION
+// ============================================================
+
+// ErrInvalidPayload marks a payload rejected locally before any request
+var ErrInvalidPayload = errors.New("invalid payload")
+
+// requiredRefs lists the reference fields each resource must carry. A lookup
+// that returned "" without an error would otherwise go out as "Patient/".
+var requiredRefs = map[string][]string{
+	"Encounter":             {"subject", "participant.individual", "serviceProvider"},
+	"Condition":             {"subject", "encounter"},
+	"Observation":           {"subject", "encounter"},
+	"Procedure":             {"subject", "encounter"},
+	"Specimen":              {"subject"},
+	"ServiceRequest":        {"subject"},
+	"MedicationRequest":     {"subject", "encounter", "requester"},
+	"MedicationDispense":    {"subject", "context"},
+	"Composition":           {"subject", "encounter", "author", "custodian"},
+	"QuestionnaireResponse": {"subject", "encounter"},
+}
+
+// validatePayload checks that the required references of payload's type are
+// present and that no reference anywhere lacks its id
+func validatePayload(payload map[string]interface{}) error {
+	rt, _ := payload["resourceType"].(string)
+	if rt == "" {
+		return fmt.Errorf("%w: no resourceType", ErrInvalidPayload)
+	}
+	var problems []string
+	for _, field := range requiredRefs[rt] {
+		if refs := collectRefs(payload, strings.Split(field, ".")); len(refs) == 0 {
+			problems = append(problems, field+" is missing")
+		}
+	}
+	walkRefs(payload, "", func(path, ref string) {
+		if i := strings.LastIndexByte(ref, '/'); ref == "" || i == len(ref)-1 || i == 0 {
+			problems = append(problems, fmt.Sprintf("%s %q has no id", path, ref))
+		}
+	})
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%w: %s %s", ErrInvalidPayload, rt, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// collectRefs returns the reference strings found under path, descending
+// into lists
+func collectRefs(v interface{}, path []string) []string {
+	switch node := v.(type) {
+	case []interface{}:
+		var refs []string
+		for _, item := range node {
+			refs = append(refs, collectRefs(item, path)...)
+		}
+		return refs
+	case map[string]interface{}:
+		if len(path) == 0 {
+			if ref, ok := node["reference"].(string); ok {
+				return []string{ref}
+			}
+			return nil
+		}
+		return collectRefs(node[path[0]], path[1:])
+	}
+	return nil
+}
+
+// walkRefs calls fn with the JSON path of every "reference" string in v
+func walkRefs(v interface{}, path string, fn func(path, ref string)) {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for k, child := range node {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			if ref, ok := child.(string); ok && k == "reference" {
+				fn(p, ref)
+				continue
+			}
+			walkRefs(child, p, fn)
+		}
+	case []interface{}:
+		for i, child := range node {
+			walkRefs(child, fmt.Sprintf("%s[%d]", path, i), fn)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func refTo(r string) map[string]interface{} {
+	return map[string]interface{}{"reference": r}
+}
+
+func TestValidatePayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload map[string]interface{}
+		wantErr string // "" = accepted
+	}{
+		{
+			name:    "condition",
+			payload: map[string]interface{}{"resourceType": "Condition", "subject": refTo("Patient/P1"), "encounter": refTo("Encounter/E1")},
+		},
+		{
+			name: "encounter with participant list",
+			payload: map[string]interface{}{
+				"resourceType":    "Encounter",
+				"subject":         refTo("Patient/P1"),
+				"participant":     []interface{}{map[string]interface{}{"individual": refTo("Practitioner/N1")}},
+				"serviceProvider": refTo("Organization/O1"),
+			},
+		},
+		{
+			name:    "type without required references",
+			payload: map[string]interface{}{"resourceType": "Device", "owner": refTo("Organization/O1")},
+		},
+		{
+			name:    "no resourceType",
+			payload: map[string]interface{}{"subject": refTo("Patient/P1")},
+			wantErr: "no resourceType",
+		},
+		{
+			name:    "required reference missing",
+			payload: map[string]interface{}{"resourceType": "Condition", "subject": refTo("Patient/P1")},
+			wantErr: "encounter is missing",
+		},
+		{
+			name:    "reference without id",
+			payload: map[string]interface{}{"resourceType": "Condition", "subject": refTo("Patient/"), "encounter": refTo("Encounter/E1")},
+			wantErr: `subject.reference "Patient/" has no id`,
+		},
+		{
+			name:    "empty reference",
+			payload: map[string]interface{}{"resourceType": "Condition", "subject": refTo(""), "encounter": refTo("Encounter/E1")},
+			wantErr: `subject.reference "" has no id`,
+		},
+		{
+			name: "nested reference without id",
+			payload: map[string]interface{}{
+				"resourceType": "Encounter",
+				"subject":      refTo("Patient/P1"),
+				"participant": []interface{}{
+					map[string]interface{}{"individual": refTo("Practitioner/N1")},
+					map[string]interface{}{"individual": refTo("Practitioner/")},
+				},
+				"serviceProvider": refTo("Organization/O1"),
+			},
+			wantErr: `participant[1].individual.reference "Practitioner/" has no id`,
+		},
+		{
+			name: "participant present but empty",
+			payload: map[string]interface{}{
+				"resourceType":    "Encounter",
+				"subject":         refTo("Patient/P1"),
+				"participant":     []interface{}{},
+				"serviceProvider": refTo("Organization/O1"),
+			},
+			wantErr: "participant.individual is missing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePayload(tt.payload)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validatePayload() = %v, want accepted", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidPayload) {
+				t.Fatalf("validatePayload() = %v, want ErrInvalidPayload", err)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validatePayload() = %q, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ============================================================
+// VERIFICATION GATE (SS_REQUIRE_VERIFICATION)
+// ============================================================
+
+// satu_sehat_verification holds the sign-off of one record, keyed by the same
+// idempotency key its send job uses
+const createVerificationTableSQL = `CREATE TABLE IF NOT EXISTS satu_sehat_verification (
+	resource_type VARCHAR(50)  NOT NULL,
+	record_key    VARCHAR(200) NOT NULL,
+	verified_by   VARCHAR(100) DEFAULT '',
+	verified_at   TIMESTAMP    DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (resource_type, record_key)
+)`
+
+func initVerificationTable(db *sql.DB) {
+	if _, err := db.Exec(createVerificationTableSQL); err != nil {
+		logErrorf("❌ create satu_sehat_verification table: %v", err)
+	}
+}
+
+// requiresVerification reports whether resourceType is listed in SS_REQUIRE_VERIFICATION
+func (a *App) requiresVerification(resourceType string) bool {
+	return a.cfg.RequireVerification[resourceType]
+}
+
+// isVerified reports whether the record was signed off; a lookup error counts as not verified
+func (a *App) isVerified(resourceType, key string) bool {
+	var n int
+	err := a.db.QueryRowContext(a.ctx, `SELECT COUNT(*) FROM satu_sehat_verification WHERE resource_type=? AND record_key=?`,
+		resourceType, key).Scan(&n)
+	return err == nil && n > 0
+}
+
+// verifiedKeys returns which of keys are signed off
+func (a *App) verifiedKeys(resourceType string, keys []string) map[string]bool {
+	verified := map[string]bool{}
+	if len(keys) == 0 {
+		return verified
+	}
+	args := []interface{}{resourceType}
+	for _, k := range keys {
+		args = append(args, k)
+	}
+	rows, err := a.db.QueryContext(a.ctx, `SELECT record_key FROM satu_sehat_verification
+		WHERE resource_type=? AND record_key IN (?`+strings.Repeat(",?", len(keys)-1)+`)`, args...)
+	if err != nil {
+		logWarnf("⚠️ load verification %s: %v", resourceType, err)
+		return verified
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k string
+		if rows.Scan(&k) == nil {
+			verified[k] = true
+		}
+	}
+	return verified
+}
+
+// markVerified records the sign-off of keys, returning how many were new
+func (a *App) markVerified(resourceType string, keys []string, by string) (int, error) {
+	n := 0
+	for _, k := range keys {
+		res, err := a.db.Exec(`INSERT IGNORE INTO satu_sehat_verification (resource_type, record_key, verified_by)
+			VALUES (?,?,?)`, resourceType, k, by)
+		if err != nil {
+			return n, err
+		}
+		if c, _ := res.RowsAffected(); c > 0 {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ============================================================
+// VERIFICATION HANDLERS
+// ============================================================
+
+// verifyItem identifies one record; which fields matter depends on the resource
+type verifyItem struct {
+	NoRawat     string `json:"no_rawat"`
+	KdPenyakit  string `json:"kd_penyakit"`
+	TglValidasi string `json:"tgl_validasi"`
+	KodeBrng    string `json:"kode_brng"`
+	NoBatch     string `json:"no_batch"`
+	NoFaktur    string `json:"no_faktur"`
+}
+
+type verifyRequest struct {
+	VerifiedBy string       `json:"verified_by"`
+	Items      []verifyItem `json:"items"`
+}
+
+// handleVerify marks records of one resource verified. keyOf builds the
+// record key from an item, or "" when the item is incomplete.
+func (a *App) handleVerify(resourceType string, keyOf func(verifyItem) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req verifyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Items) == 0 {
+			jsonError(w, "invalid request body: items required", 400)
+			return
+		}
+		var keys []string
+		for i, it := range req.Items {
+			key := keyOf(it)
+			if key == "" {
+				jsonError(w, fmt.Sprintf("items[%d]: missing key fields", i), 400)
+				return
+			}
+			keys = append(keys, key)
+		}
+		n, err := a.markVerified(resourceType, keys, req.VerifiedBy)
+		if err != nil {
+			jsonError(w, err.Error(), 500)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"resource_type": resourceType, "requested": len(keys), "verified": n, "already_verified": len(keys) - n,
+		})
+	}
+}
+
+func (a *App) handleVerifyConditions(w http.ResponseWriter, r *http.Request) {
+	a.handleVerify("Condition", func(it verifyItem) string {
+		if it.NoRawat == "" || it.KdPenyakit == "" {
+			return ""
+		}
+		return ConditionRow{NoRawat: it.NoRawat, KdPenyakit: it.KdPenyakit}.jobKey()
+	})(w, r)
+}
+
+func (a *App) handleVerifyMedDisp(w http.ResponseWriter, r *http.Request) {
+	a.handleVerify("MedicationDispense", func(it verifyItem) string {
+		if it.NoRawat == "" || it.TglValidasi == "" || it.KodeBrng == "" {
+			return ""
+		}
+		return MedDispRow{NoRawat: it.NoRawat, TglValidasi: it.TglValidasi, KodeBrng: it.KodeBrng,
+			NoBatch: it.NoBatch, NoFaktur: it.NoFaktur}.jobKey()
+	})(w, r)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ============================================================
+// WATERMARKS (per-resource reconciliation status)
+// ============================================================
+
+// watermarkSource is a trimmed-down version of a pending query: it selects one
+// (tgl, sent) row per record with `params` pairs of tgl BETWEEN ? AND ?
+// placeholders, and MySQL aggregates over it
+type watermarkSource struct {
+	Resource string
+	SQL      string
+	Params   int
+}
+
+func watermarkSources() []watermarkSource {
+	sources := []watermarkSource{
+		{"Encounter", `
+			SELECT reg_periksa.tgl_registrasi AS tgl, IFNULL(satu_sehat_encounter.id_encounter,'') != '' AS sent
+			FROM reg_periksa
+			INNER JOIN satu_sehat_mapping_lokasi_ralan ON satu_sehat_mapping_lokasi_ralan.kd_poli = reg_periksa.kd_poli
+			LEFT JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
+			WHERE reg_periksa.status_bayar = 'Sudah Bayar' AND reg_periksa.tgl_registrasi BETWEEN ? AND ?`, 1},
+		{"EncounterRanap", `
+			SELECT DISTINCT reg_periksa.no_rawat, reg_periksa.tgl_registrasi AS tgl, IFNULL(satu_sehat_encounter.id_encounter,'') != '' AS sent
+			FROM reg_periksa
+			INNER JOIN kamar_inap ON kamar_inap.no_rawat = reg_periksa.no_rawat
+			INNER JOIN satu_sehat_mapping_lokasi_ranap ON satu_sehat_mapping_lokasi_ranap.kd_kamar = kamar_inap.kd_kamar
+			LEFT JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
+			WHERE reg_periksa.status_lanjut = 'Ranap' AND reg_periksa.tgl_registrasi BETWEEN ? AND ?`, 1},
+		{"Condition", `
+			SELECT DISTINCT reg_periksa.no_rawat, diagnosa_pasien.kd_penyakit, reg_periksa.tgl_registrasi AS tgl,
+				IFNULL(satu_sehat_condition.id_condition,'') != '' AS sent
+			FROM reg_periksa
+			INNER JOIN diagnosa_pasien ON diagnosa_pasien.no_rawat = reg_periksa.no_rawat
+			INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
+			LEFT JOIN satu_sehat_condition ON satu_sehat_condition.no_rawat = reg_periksa.no_rawat
+				AND satu_sehat_condition.kd_penyakit = diagnosa_pasien.kd_penyakit
+			WHERE satu_sehat_encounter.id_encounter != '' AND reg_periksa.tgl_registrasi BETWEEN ? AND ?`, 1},
+		{"Observation_Lab", `
+			SELECT ` + dateFilterColumn("Observation_Lab") + ` AS tgl, IFNULL(satu_sehat_observation_lab.id_observation,'') != '' AS sent
+			FROM reg_periksa
+			INNER JOIN permintaan_lab ON permintaan_lab.no_rawat = reg_periksa.no_rawat
+			INNER JOIN satu_sehat_specimen_lab ON satu_sehat_specimen_lab.noorder = permintaan_lab.noorder
+			INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
+			LEFT JOIN satu_sehat_observation_lab ON satu_sehat_specimen_lab.noorder = satu_sehat_observation_lab.noorder
+				AND satu_sehat_specimen_lab.id_template = satu_sehat_observation_lab.id_template
+				AND satu_sehat_specimen_lab.kd_jenis_prw = satu_sehat_observation_lab.kd_jenis_prw
+			WHERE ` + dateFilterColumn("Observation_Lab") + ` BETWEEN ? AND ?`, 1},
+		{"Observation_Rad", `
+			SELECT ` + dateFilterColumn("Observation_Rad") + ` AS tgl, IFNULL(satu_sehat_observation_radiologi.id_observation,'') != '' AS sent
+			FROM reg_periksa
+			INNER JOIN permintaan_radiologi ON permintaan_radiologi.no_rawat = reg_periksa.no_rawat
+			INNER JOIN satu_sehat_specimen_radiologi ON satu_sehat_specimen_radiologi.noorder = permintaan_radiologi.noorder
+			INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
+			LEFT JOIN satu_sehat_observation_radiologi ON satu_sehat_specimen_radiologi.noorder = satu_sehat_observation_radiologi.noorder
+				AND satu_sehat_specimen_radiologi.kd_jenis_prw = satu_sehat_observation_radiologi.kd_jenis_prw
+			WHERE ` + dateFilterColumn("Observation_Rad") + ` BETWEEN ? AND ?`, 1},
+		{"Procedure", `
+			SELECT reg_periksa.tgl_registrasi AS tgl, IFNULL(satu_sehat_procedure.id_procedure,'') != '' AS sent
+			FROM reg_periksa
+			INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
+			INNER JOIN prosedur_pasien ON prosedur_pasien.no_rawat = reg_periksa.no_rawat
+			LEFT JOIN satu_sehat_procedure ON satu_sehat_procedure.no_rawat = prosedur_pasien.no_rawat
+				AND satu_sehat_procedure.kode = prosedur_pasien.kode
+				AND satu_sehat_procedure.status = prosedur_pasien.status
+			WHERE reg_periksa.tgl_registrasi BETWEEN ? AND ?`, 1},
+		{"MedicationRequest", `
+			SELECT ` + dateFilterColumn("MedicationRequest") + ` AS tgl, IFNULL(satu_sehat_medicationrequest.id_medicationrequest,'') != '' AS sent
+			FROM reg_periksa
+			INNER JOIN resep_obat ON reg_periksa.no_rawat = resep_obat.no_rawat
+			INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
+			INNER JOIN resep_dokter ON resep_dokter.no_resep = resep_obat.no_resep
+			INNER JOIN satu_sehat_mapping_obat ON satu_sehat_mapping_obat.kode_brng = resep_dokter.kode_brng
+			LEFT JOIN satu_sehat_medicationrequest ON satu_sehat_medicationrequest.no_resep = resep_dokter.no_resep
+				AND satu_sehat_medicationrequest.kode_brng = resep_dokter.kode_brng
+			WHERE ` + dateFilterColumn("MedicationRequest") + ` BETWEEN ? AND ?
+			UNION ALL
+			SELECT ` + dateFilterColumn("MedicationRequest") + ` AS tgl, IFNULL(satu_sehat_medicationrequest_racikan.id_medicationrequest,'') != '' AS sent
+			FROM reg_periksa
+			INNER JOIN resep_obat ON reg_periksa.no_rawat = resep_obat.no_rawat
+			INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
+			INNER JOIN resep_dokter_racikan_detail ON resep_dokter_racikan_detail.no_resep = resep_obat.no_resep
+			INNER JOIN satu_sehat_mapping_obat ON satu_sehat_mapping_obat.kode_brng = resep_dokter_racikan_detail.kode_brng
+			LEFT JOIN satu_sehat_medicationrequest_racikan ON satu_sehat_medicationrequest_racikan.no_resep = resep_dokter_racikan_detail.no_resep
+				AND satu_sehat_medicationrequest_racikan.kode_brng = resep_dokter_racikan_detail.kode_brng
+				AND satu_sehat_medicationrequest_racikan.no_racik = resep_dokter_racikan_detail.no_racik
+			WHERE ` + dateFilterColumn("MedicationRequest") + ` BETWEEN ? AND ?`, 2},
+		{"MedicationDispense", `
+			SELECT ` + dateFilterColumn("MedicationDispense") + ` AS tgl, IFNULL(satu_sehat_medicationdispense.id_medicationdispanse,'') != '' AS sent
+			FROM reg_periksa
+			INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
+			INNER JOIN detail_pemberian_obat ON detail_pemberian_obat.no_rawat = reg_periksa.no_rawat
+			INNER JOIN satu_sehat_medication ON satu_sehat_medication.kode_brng = detail_pemberian_obat.kode_brng
+			LEFT JOIN satu_sehat_medicationdispense ON satu_sehat_medicationdispense.no_rawat = detail_pemberian_obat.no_rawat
+				AND satu_sehat_medicationdispense.tgl_perawatan = detail_pemberian_obat.tgl_perawatan
+				AND satu_sehat_medicationdispense.jam = detail_pemberian_obat.jam
+				AND satu_sehat_medicationdispense.kode_brng = detail_pemberian_obat.kode_brng
+				AND satu_sehat_medicationdispense.no_batch = detail_pemberian_obat.no_batch
+				AND satu_sehat_medicationdispense.no_faktur = detail_pemberian_obat.no_faktur
+			WHERE ` + dateFilterColumn("MedicationDispense") + ` BETWEEN ? AND ?`, 1},
+	}
+	for _, cfg := range ttvConfigs {
+		// identifiers were validated by loadTTVConfigs / are built-in
+		sources = append(sources, watermarkSource{"Observation_" + cfg.Name, fmt.Sprintf(`
+			SELECT reg_periksa.tgl_registrasi AS tgl, %[2]s != '' AS sent
+			FROM reg_periksa
+			INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
+			INNER JOIN pemeriksaan_ralan p ON p.no_rawat = reg_periksa.no_rawat
+			WHERE p.%[1]s <> '' AND reg_periksa.tgl_registrasi BETWEEN ? AND ?
+			UNION ALL
+			SELECT reg_periksa.tgl_registrasi AS tgl, %[3]s != '' AS sent
+			FROM reg_periksa
+			INNER JOIN satu_sehat_encounter ON satu_sehat_encounter.no_rawat = reg_periksa.no_rawat
+			INNER JOIN pemeriksaan_ranap p ON p.no_rawat = reg_periksa.no_rawat
+			WHERE p.%[1]s <> '' AND reg_periksa.tgl_registrasi BETWEEN ? AND ?`, cfg.DBColumn,
+			ttvTrackedSQL(cfg, "p", "Ralan", "id_observation"), ttvTrackedSQL(cfg, "p", "Ranap", "id_observation")), 2})
+	}
+	return sources
+}
+
+// watermark is the reconciliation status of one resource in the window
+type watermark struct {
+	Resource     string `json:"resource_type"`
+	Total        int    `json:"total"`
+	Sent         int    `json:"sent"`
+	Pending      int    `json:"pending"`
+	FirstPending string `json:"first_pending_date,omitempty"`
+	Watermark    string `json:"watermark"` // last date with zero pending on and before it, "" if none
+	Error        string `json:"error,omitempty"`
+}
+
+// queryWatermark aggregates one source over [tgl1, tgl2]
+func queryWatermark(ctx context.Context, db *sql.DB, src watermarkSource, tgl1, tgl2 string) watermark {
+	wm := watermark{Resource: src.Resource}
+	var args []interface{}
+	for i := 0; i < src.Params; i++ {
+		args = append(args, tgl1, tgl2)
+	}
+	var firstPending, lastDate sql.NullTime
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*), IFNULL(SUM(sent),0), MIN(CASE WHEN sent = 0 THEN tgl END), MAX(tgl)
+		FROM (`+src.SQL+`) w`, args...).Scan(&wm.Total, &wm.Sent, &firstPending, &lastDate)
+	if err != nil {
+		wm.Error = err.Error()
+		return wm
+	}
+	wm.Pending = wm.Total - wm.Sent
+	switch {
+	case firstPending.Valid:
+		wm.FirstPending = firstPending.Time.Format("2006-01-02")
+		if prev := firstPending.Time.AddDate(0, 0, -1).Format("2006-01-02"); prev >= tgl1 {
+			wm.Watermark = prev
+		}
+	case lastDate.Valid:
+		wm.Watermark = lastDate.Time.Format("2006-01-02")
+	}
+	return wm
+}
+
+// handleWatermarks reports, per resource, up to which tgl_registrasi every
+// record is sent. Window: tgl1/tgl2, or the last `days` days (default 90).
+func (a *App) handleWatermarks(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	tgl1, tgl2 := q.Get("tgl1"), q.Get("tgl2")
+	if tgl1 == "" || tgl2 == "" {
+		days, err := strconv.Atoi(q.Get("days"))
+		if err != nil || days <= 0 {
+			days = 90
+		}
+		now := time.Now()
+		tgl1, tgl2 = now.AddDate(0, 0, -(days-1)).Format("2006-01-02"), now.Format("2006-01-02")
+	}
+
+	var marks []watermark
+	for _, src := range watermarkSources() {
+		marks = append(marks, queryWatermark(r.Context(), a.db, src, tgl1, tgl2))
+	}
+	jsonResponse(w, map[string]interface{}{"tgl1": tgl1, "tgl2": tgl2, "watermarks": marks})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ============================================================
+// WEBHOOK (SS_WEBHOOK_URL)
+// ============================================================
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// postWebhook POSTs {"event", "time", ...data} to SS_WEBHOOK_URL. With
+// SS_WEBHOOK_SECRET set the body is signed in X-Signature as
+// "sha256=<hex hmac>". Failures are logged only, never returned.
+func postWebhook(cfg Config, event string, data map[string]interface{}) {
+	if cfg.WebhookURL == "" {
+		return
+	}
+	payload := map[string]interface{}{"event": event, "time": time.Now().Format(time.RFC3339)}
+	for k, v := range data {
+		payload[k] = v
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logErrorf("❌ marshal webhook %s: %v", event, err)
+		return
+	}
+	req, err := http.NewRequest("POST", cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		logWarnf("⚠️ webhook %s: %v", event, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(cfg.WebhookSecret))
+		mac.Write(body)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		logWarnf("⚠️ webhook %s: %v", event, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logWarnf("⚠️ webhook %s: HTTP %d", event, resp.StatusCode)
+		return
+	}
+	logInfof("🔔 webhook %s delivered", event)
+}
+
+// batchTee passes a send handler's response through while keeping a copy
+type batchTee struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (t *batchTee) WriteHeader(code int) {
+	if t.code == 0 {
+		t.code = code
+	}
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *batchTee) Write(p []byte) (int, error) {
+	if t.code == 0 {
+		t.code = http.StatusOK
+	}
+	t.body.Write(p)
+	return t.ResponseWriter.Write(p)
+}
+
+// notifyBatch POSTs a "batch.completed" webhook with the summary of every
+// finished send of resource (resource_type, tgl1/tgl2, sent/failed/skipped,
+// batch_id, and in queue mode the rows left queued). "{type}" and "{form}" in
+// resource are replaced by the path values; a resource_type in the response
+// (resend) takes precedence.
+func (a *App) notifyBatch(resource string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.cfg.WebhookURL == "" {
+			next(w, r)
+			return
+		}
+		reqBody, err := io.ReadAll(r.Body)
+		if err != nil {
+			jsonError(w, "read request body: "+err.Error(), 400)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(reqBody))
+		tee := &batchTee{ResponseWriter: w}
+		next(tee, r)
+
+		var summary struct {
+			Sent         *int   `json:"sent"`
+			Failed       int    `json:"failed"`
+			Skipped      int    `json:"skipped"`
+			Queued       int    `json:"queued"`
+			BatchID      string `json:"batch_id"`
+			ResourceType string `json:"resource_type"`
+			Error        string `json:"error"`
+		}
+		if tee.code >= 300 || json.Unmarshal(tee.body.Bytes(), &summary) != nil || summary.Sent == nil {
+			return // rejected request, nothing was sent
+		}
+		// The handler accepted the body (devices/sync takes none); a field of
+		// another type only leaves its value out of the summary
+		var req sendRequest
+		if len(bytes.TrimSpace(reqBody)) > 0 {
+			if err := json.Unmarshal(reqBody, &req); err != nil {
+				logWarnf("⚠️ webhook batch.completed: read request body: %v", err)
+			}
+		}
+		resourceType := summary.ResourceType
+		if resourceType == "" {
+			resourceType = strings.NewReplacer("{type}", r.PathValue("type"), "{form}", r.PathValue("form")).Replace(resource)
+		}
+		data := map[string]interface{}{
+			"resource_type": resourceType,
+			"tgl1":          req.Tgl1, "tgl2": req.Tgl2,
+			"sent": *summary.Sent, "failed": summary.Failed, "skipped": summary.Skipped,
+			"batch_id": summary.BatchID,
+		}
+		if req.NoRawat != "" {
+			data["no_rawat"] = req.NoRawat
+		}
+		if summary.Queued > 0 {
+			data["queued"] = summary.Queued
+		}
+		if summary.Error != "" {
+			data["error"] = summary.Error
+		}
+		go postWebhook(a.cfg, "batch.completed", data)
+	}
+}